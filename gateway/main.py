@@ -1,4 +1,5 @@
 import os
+import sys
 import time
 import requests
 import sqlite3
@@ -6,7 +7,8 @@ import urllib3
 import json
 import uuid
 import socket
-from datetime import datetime
+from collections import OrderedDict
+from datetime import datetime, timezone
 from dotenv import load_dotenv
 
 # Suppress insecure HTTPS warning for local ESP32 self-signed certs
@@ -22,6 +24,12 @@ FARM_ID = os.getenv("FARM_ID", "")
 COOP_ID = os.getenv("COOP_ID", "")
 POLL_INTERVAL = int(os.getenv("POLL_INTERVAL", "5"))
 DEVICE_REPORT_INTERVAL = int(os.getenv("DEVICE_REPORT_INTERVAL", "600"))  # seconds
+CONFIG_PATH = os.getenv("CONFIG_PATH", "gateway_config.json")  # latest config pushed by the cloud
+LOG_FILE = os.getenv("LOG_FILE", "")  # agent log sent by upload_logs
+
+# Results of recently executed commands by idempotency key, so a re-delivered command is not run twice
+EXECUTED_KEYS_MAX = 256
+executed_commands = OrderedDict()
 
 def get_unique_hardware_id():
     """Generates a unique hardware ID from CPU serial or MAC address."""
@@ -96,7 +104,11 @@ def format_telemetry_payload(esp32_data):
     if not sensors:
         return None
 
-    return {"hardware_id": HARDWARE_ID, "sensors": sensors}
+    # Reading time, so snapshots replayed from the offline queue keep their own timestamp
+    return {"hardware_id": HARDWARE_ID, "timestamp": utc_now_iso(), "sensors": sensors}
+
+def utc_now_iso():
+    return datetime.now(timezone.utc).isoformat()
 
 def push_to_cloud(payload):
     """Pushes formatted telemetry data to the cloud."""
@@ -108,8 +120,10 @@ def push_to_cloud(payload):
         "X-Gateway-Token": GATEWAY_TOKEN,
         "Content-Type": "application/json"
     }
+    # sent_at lets the cloud measure this gateway's clock skew on every push
+    body = dict(payload, sent_at=utc_now_iso())
     try:
-        response = requests.post(url, headers=headers, json=payload, timeout=5)
+        response = requests.post(url, headers=headers, json=body, timeout=5)
         return response.status_code in [200, 201]
     except Exception as e:
         print(f"[{datetime.now()}] Cloud push error: {e}")
@@ -196,16 +210,71 @@ def fetch_cloud_commands():
         return []
     return []
 
-def update_command_status(command_id, status, response_text):
+def update_command_status(command_id, status, response_text, idempotency_key=""):
     if not GATEWAY_TOKEN: return
     url = f"{CLOUD_API_URL}/v1/gateway/commands/{command_id}/status"
     headers = {"X-Gateway-Token": GATEWAY_TOKEN, "Content-Type": "application/json"}
-    payload = {"status": status, "response": response_text}
+    payload = {"status": status, "response": response_text, "idempotency_key": idempotency_key}
     try:
         requests.post(url, headers=headers, json=payload, timeout=5)
     except:
         pass
 
+def command_payload(command):
+    try:
+        value = json.loads(command.get("command_value") or "{}")
+        return value if isinstance(value, dict) else {}
+    except ValueError:
+        return {}
+
+def apply_config(command):
+    """Stores the pushed config version; the command status reports it as applied."""
+    value = command_payload(command)
+    try:
+        with open(CONFIG_PATH, "w") as f:
+            json.dump(value, f)
+    except OSError as e:
+        return False, f"Config not saved: {e}"
+    return True, f"Config version {value.get('version')} applied"
+
+def upload_logs(command):
+    value = command_payload(command)
+    if not LOG_FILE:
+        return False, "LOG_FILE is not set"
+    try:
+        with open(LOG_FILE) as f:
+            lines = [line.rstrip("\n") for line in f.readlines()[-int(value.get("lines", 200)):]]
+    except OSError as e:
+        return False, f"Log not readable: {e}"
+    url = f"{CLOUD_API_URL}{value.get('upload_path', '/v1/gateway/logs')}"
+    headers = {"X-Gateway-Token": GATEWAY_TOKEN, "Content-Type": "application/json"}
+    payload = {"command_id": command.get("id"), "hardware_id": HARDWARE_ID, "lines": lines}
+    try:
+        res = requests.post(url, headers=headers, json=payload, timeout=15)
+        if res.status_code in [200, 201]:
+            return True, f"Uploaded {len(lines)} lines"
+        return False, f"Upload failed: HTTP {res.status_code}"
+    except Exception as e:
+        return False, str(e)
+
+def handle_gateway_command(command):
+    """Runs cloud commands addressed to the gateway itself rather than an ESP32 actuator.
+    Returns None for command types that are not gateway commands."""
+    cmd_type = command.get("command_type")
+    if cmd_type == "apply_config":
+        return apply_config(command)
+    if cmd_type == "ota_update":
+        # Accepted only; the install outcome is reported through heartbeat `ota` progress
+        return True, "accepted"
+    if cmd_type == "gateway_rediscover":
+        return (True, "Devices re-reported") if report_devices_to_cloud() else (False, "Device report failed")
+    if cmd_type == "gateway_upload_logs":
+        return upload_logs(command)
+    if cmd_type in ("gateway_reboot", "gateway_restart_agent"):
+        # Acknowledged now; process_commands reboots or exits after reporting the status
+        return True, "accepted"
+    return None
+
 def relay_to_esp32(command):
     cmd_type = command.get("command_type")
     mapping = {
@@ -215,9 +284,9 @@ def relay_to_esp32(command):
         "conveyor_on": ("conveyor_belt", True), "conveyor_off": ("conveyor_belt", False)
     }
 
-    # Newer UI issues generic commands (`turn_on` / `turn_off`) per-device.
-    # When available, use `device_model` to map to the ESP32 actuator endpoint.
-    if cmd_type in ("turn_on", "turn_off"):
+    # The cloud issues canonical `on` / `off` (older builds: `turn_on` / `turn_off`) per device.
+    # Use `device_model` to map to the ESP32 actuator endpoint.
+    if cmd_type in ("on", "off", "turn_on", "turn_off"):
         model = (command.get("device_model") or "").strip().lower()
         model_to_endpoint = {
             "fan": "fan",
@@ -228,7 +297,7 @@ def relay_to_esp32(command):
         endpoint = model_to_endpoint.get(model)
         if not endpoint:
             return False, f"Unknown device model for {cmd_type}: {model or 'missing'}"
-        state = cmd_type == "turn_on"
+        state = cmd_type in ("on", "turn_on")
     else:
         if cmd_type not in mapping:
             return False, "Unknown command"
@@ -246,9 +315,26 @@ def relay_to_esp32(command):
 def process_commands():
     cmds = fetch_cloud_commands() or []
     for cmd in cmds:
+        key = cmd.get("idempotency_key") or ""
+        if key and key in executed_commands:
+            # Re-delivered (our earlier status report was lost): report the stored result again
+            status, msg = executed_commands[key]
+            update_command_status(cmd.get("id"), status, msg, key)
+            continue
         print(f"[{datetime.now()}] Executing: {cmd.get('command_type')}")
-        success, msg = relay_to_esp32(cmd)
-        update_command_status(cmd.get("id"), "executed" if success else "failed", msg)
+        result = handle_gateway_command(cmd)
+        success, msg = result if result is not None else relay_to_esp32(cmd)
+        status = "success" if success else "failed"
+        if key:
+            executed_commands[key] = (status, msg)
+            while len(executed_commands) > EXECUTED_KEYS_MAX:
+                executed_commands.popitem(last=False)
+        update_command_status(cmd.get("id"), status, msg, key)
+        if cmd.get("command_type") == "gateway_reboot":
+            os.system("sudo reboot")
+        elif cmd.get("command_type") == "gateway_restart_agent":
+            # The service manager starts the agent again
+            sys.exit(0)
 
 def queue_locally(conn, payload):
     try:
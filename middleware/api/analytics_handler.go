@@ -4,6 +4,7 @@ import (
 	"log"
 	"middleware/services"
 	"middleware/utils"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -58,16 +59,238 @@ func GetFarmSensorTrendsHandler(c *fiber.Ctx) error {
 	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Sensor trends retrieved (mock)")
 }
 
+// GetDeviceHealthReportHandler scores device health per device, coop and farm
+// @Summary Device Health Report
+// @Description 0-100 health score per device from heartbeat regularity, command success/timeouts, reading gaps, stuck values and out-of-range values, with explanations and per-coop rollups
+// @Tags Analytics
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id query string false "Limit to one coop (UUID)"
+// @Param hours query int false "Window in hours (default 24, max 168)"
+// @Success 200 {object} schemas.DeviceHealthReport
+// @Router /v1/farms/{farm_id}/reports/device-health [get]
 func GetDeviceHealthReportHandler(c *fiber.Ctx) error {
-	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Device health report retrieved (mock)")
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, hours, ok := parseHealthReportQuery(c)
+	if !ok {
+		return utils.BadRequest(c, "invalid_query", "coop_id must be a UUID and hours between 1 and 168")
+	}
+
+	report, err := analyticsService.GetDeviceHealthReport(userID, farmID, coopID, hours)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err != nil {
+		log.Printf("Device health report error: %v", err)
+		return utils.InternalError(c, "Failed to build device health report")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, report, "Device health report retrieved")
 }
 
+// GetDeviceMetricsReportHandler returns the raw measurements behind the device health report
+// @Summary Device Metrics Report
+// @Description Per device: heartbeat hours, command outcomes and per-sensor reading counts, gaps, unchanged duration and out-of-range counts
+// @Tags Analytics
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id query string false "Limit to one coop (UUID)"
+// @Param hours query int false "Window in hours (default 24, max 168)"
+// @Success 200 {object} schemas.DeviceMetricsReport
+// @Router /v1/farms/{farm_id}/reports/device-metrics [get]
 func GetDeviceMetricsReportHandler(c *fiber.Ctx) error {
-	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Device metrics report retrieved (mock)")
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, hours, ok := parseHealthReportQuery(c)
+	if !ok {
+		return utils.BadRequest(c, "invalid_query", "coop_id must be a UUID and hours between 1 and 168")
+	}
+
+	report, err := analyticsService.GetDeviceMetricsReport(userID, farmID, coopID, hours)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err != nil {
+		log.Printf("Device metrics report error: %v", err)
+		return utils.InternalError(c, "Failed to build device metrics report")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, report, "Device metrics report retrieved")
 }
 
+// parseHealthReportQuery reads ?coop_id= and ?hours= (default 24, at most the 7 days of raw readings kept)
+func parseHealthReportQuery(c *fiber.Ctx) (*uuid.UUID, int, bool) {
+	var coopID *uuid.UUID
+	if raw := c.Query("coop_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return nil, 0, false
+		}
+		coopID = &id
+	}
+	hours := c.QueryInt("hours", 24)
+	if hours < 1 || hours > 168 {
+		return nil, 0, false
+	}
+	return coopID, hours, true
+}
+
+// GetDeviceUsageReportHandler returns actuator runtime and duty cycle over a date range
+// @Summary Device Usage Report
+// @Description Per actuator: ON time per day, cycles, longest run and duty cycle, built from command history and state transitions
+// @Tags Analytics
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param from query string false "First day (YYYY-MM-DD, default 6 days ago)"
+// @Param to query string false "Last day (YYYY-MM-DD, default today)"
+// @Param coop_id query string false "Limit to one coop (UUID)"
+// @Param tag query string false "Limit to devices with this tag"
+// @Param group_id query string false "Limit to members of this device group (UUID)"
+// @Success 200 {object} schemas.DeviceUsageReport
+// @Router /v1/farms/{farm_id}/reports/device-usage [get]
 func GetDeviceUsageReportHandler(c *fiber.Ctx) error {
-	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Device usage report retrieved (mock)")
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	from, to, ok := parseReportRange(c)
+	if !ok {
+		return utils.BadRequest(c, "invalid_range", "from/to must be YYYY-MM-DD, from <= to, at most 92 days")
+	}
+
+	var coopID *uuid.UUID
+	if raw := c.Query("coop_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+		}
+		coopID = &id
+	}
+	sel, ok := parseDeviceSelectorQuery(c)
+	if !ok {
+		return utils.BadRequest(c, "invalid_id", "Invalid group ID")
+	}
+
+	report, err := analyticsService.GetDeviceUsageReport(userID, farmID, coopID, sel, from, to)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrDeviceGroupNotFound {
+		return utils.NotFound(c, "Device group not found")
+	}
+	if err == services.ErrInvalidTag {
+		return utils.BadRequest(c, "invalid_tag", "Tags must be 1-50 characters")
+	}
+	if err != nil {
+		log.Printf("Device usage report error: %v", err)
+		return utils.InternalError(c, "Failed to build device usage report")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, report, "Device usage report retrieved")
+}
+
+// GetEnergyReportHandler estimates electricity use and cost from actuator runtime
+// @Summary Energy & Cost Report
+// @Description Energy (kWh) and cost per device, coop and farm with daily and monthly totals. Uses each device's rated_watts configuration and the farm tariff.
+// @Tags Analytics
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param from query string false "First day (YYYY-MM-DD, default 6 days ago)"
+// @Param to query string false "Last day (YYYY-MM-DD, default today)"
+// @Param coop_id query string false "Limit to one coop (UUID)"
+// @Param tag query string false "Limit to devices with this tag"
+// @Param group_id query string false "Limit to members of this device group (UUID)"
+// @Success 200 {object} schemas.EnergyReport
+// @Router /v1/farms/{farm_id}/reports/energy [get]
+func GetEnergyReportHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	from, to, ok := parseReportRange(c)
+	if !ok {
+		return utils.BadRequest(c, "invalid_range", "from/to must be YYYY-MM-DD, from <= to, at most 92 days")
+	}
+
+	var coopID *uuid.UUID
+	if raw := c.Query("coop_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+		}
+		coopID = &id
+	}
+	sel, ok := parseDeviceSelectorQuery(c)
+	if !ok {
+		return utils.BadRequest(c, "invalid_id", "Invalid group ID")
+	}
+
+	report, err := analyticsService.GetEnergyReport(userID, farmID, coopID, sel, from, to)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrDeviceGroupNotFound {
+		return utils.NotFound(c, "Device group not found")
+	}
+	if err == services.ErrInvalidTag {
+		return utils.BadRequest(c, "invalid_tag", "Tags must be 1-50 characters")
+	}
+	if err != nil {
+		log.Printf("Energy report error: %v", err)
+		return utils.InternalError(c, "Failed to build energy report")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, report, "Energy report retrieved")
+}
+
+// maxReportDays bounds date-range reports
+const maxReportDays = 92
+
+// parseReportRange reads from/to (YYYY-MM-DD) query parameters, defaulting to the last 7 days
+func parseReportRange(c *fiber.Ctx) (time.Time, time.Time, bool) {
+	to := time.Now()
+	if raw := c.Query("to"); raw != "" {
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -6)
+	if raw := c.Query("from"); raw != "" {
+		t, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		from = t
+	}
+	if from.After(to) || to.Sub(from) > maxReportDays*24*time.Hour {
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
 }
 
 func GetFarmPerformanceReportHandler(c *fiber.Ctx) error {
@@ -83,12 +83,13 @@ func validateGatewayToken(c *fiber.Ctx, token string) error {
 	tokenHash := utils.HashToken(token)
 
 	var farmID, userID uuid.UUID
+	var deviceID *uuid.UUID
 	err := database.DB.QueryRow(`
 		UPDATE gateway_tokens 
 		SET last_used_at = CURRENT_TIMESTAMP 
 		WHERE token_hash = $1 AND is_active = true
-		RETURNING farm_id, user_id
-	`, tokenHash).Scan(&farmID, &userID)
+		RETURNING farm_id, user_id, device_id
+	`, tokenHash).Scan(&farmID, &userID, &deviceID)
 
 	if err == sql.ErrNoRows {
 		return utils.Unauthorized(c, "Invalid or inactive gateway token")
@@ -102,10 +103,40 @@ func validateGatewayToken(c *fiber.Ctx, token string) error {
 	c.Locals("farm_id", farmID)
 	c.Locals("role", "worker")
 	c.Locals("auth_type", "gateway")
+	c.Locals("gateway_device_id", deviceID)
 
 	return c.Next()
 }
 
+// GatewayAuthMiddleware accepts only gateway tokens (X-Gateway-Token or "Gateway <token>")
+func GatewayAuthMiddleware(c *fiber.Ctx) error {
+	token := gatewayTokenFromRequest(c)
+	if token == "" {
+		return utils.Unauthorized(c, "Missing gateway token")
+	}
+	return validateGatewayToken(c, token)
+}
+
+// OptionalGatewayAuthMiddleware lets unauthenticated requests through (e.g. discovery heartbeats)
+// but rejects an invalid gateway token. Handlers check Locals("auth_type") before trusting the caller.
+func OptionalGatewayAuthMiddleware(c *fiber.Ctx) error {
+	token := gatewayTokenFromRequest(c)
+	if token == "" {
+		return c.Next()
+	}
+	return validateGatewayToken(c, token)
+}
+
+func gatewayTokenFromRequest(c *fiber.Ctx) string {
+	token := c.Get("X-Gateway-Token")
+	if token == "" {
+		if authHeader := c.Get("Authorization"); strings.HasPrefix(authHeader, "Gateway ") {
+			token = authHeader[8:]
+		}
+	}
+	return token
+}
+
 // RequireRole checks if user has the required role
 // Usage: RequireRole("farmer") or RequireRole("farmer", "viewer") for multiple allowed roles
 func RequireRole(allowedRoles ...string) fiber.Handler {
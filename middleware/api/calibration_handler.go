@@ -0,0 +1,246 @@
+package api
+
+import (
+	"middleware/schemas"
+	"middleware/services"
+	"middleware/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ===== SENSOR CALIBRATION HANDLERS =====
+
+// StartCalibrationHandler opens a calibration session for one sensor of a device
+// @Summary Start Calibration Session
+// @Tags Devices, Calibration
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Param request body schemas.StartCalibrationRequest true "Sensor to calibrate"
+// @Success 201 {object} schemas.CalibrationSessionDetail
+// @Router /v1/farms/{farm_id}/devices/{device_id}/calibration/sessions [post]
+func StartCalibrationHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	var req schemas.StartCalibrationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	session, err := calibrationService.StartSession(userID, farmID, deviceID, req)
+	if err != nil {
+		return respondCalibrationError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusCreated, session, "Calibration session started")
+}
+
+// ListCalibrationSessionsHandler returns a device's calibration sessions
+// @Summary List Calibration Sessions
+// @Tags Devices, Calibration
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Success 200 {array} models.CalibrationSession
+// @Router /v1/farms/{farm_id}/devices/{device_id}/calibration/sessions [get]
+func ListCalibrationSessionsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	sessions, err := calibrationService.ListSessions(userID, farmID, deviceID)
+	if err != nil {
+		return respondCalibrationError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, sessions, "Calibration sessions retrieved")
+}
+
+// GetCalibrationSessionHandler returns a calibration session with its points
+// @Summary Get Calibration Session
+// @Tags Devices, Calibration
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Param session_id path string true "Calibration session ID (UUID)"
+// @Success 200 {object} schemas.CalibrationSessionDetail
+// @Router /v1/farms/{farm_id}/devices/{device_id}/calibration/sessions/{session_id} [get]
+func GetCalibrationSessionHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+	sessionID, err := uuid.Parse(c.Params("session_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid session ID")
+	}
+
+	session, err := calibrationService.GetSession(userID, farmID, deviceID, sessionID)
+	if err != nil {
+		return respondCalibrationError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, session, "Calibration session retrieved")
+}
+
+// AddCalibrationPointHandler records a reference value against the sensor's raw reading
+// @Summary Add Calibration Point
+// @Tags Devices, Calibration
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Param session_id path string true "Calibration session ID (UUID)"
+// @Param request body schemas.CalibrationPointRequest true "Reference point"
+// @Success 201 {object} schemas.CalibrationSessionDetail
+// @Router /v1/farms/{farm_id}/devices/{device_id}/calibration/sessions/{session_id}/points [post]
+func AddCalibrationPointHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+	sessionID, err := uuid.Parse(c.Params("session_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid session ID")
+	}
+
+	var req schemas.CalibrationPointRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+	if req.ReferenceValue == nil {
+		return utils.BadRequest(c, "invalid_body", "reference_value is required")
+	}
+
+	session, err := calibrationService.AddPoint(userID, farmID, deviceID, sessionID, req)
+	if err != nil {
+		return respondCalibrationError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusCreated, session, "Calibration point recorded")
+}
+
+// CompleteCalibrationHandler fits the session's points and applies the result
+// @Summary Complete Calibration Session
+// @Description Fits value = gain * raw + offset and stores it in the device configuration
+// @Tags Devices, Calibration
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Param session_id path string true "Calibration session ID (UUID)"
+// @Success 200 {object} schemas.CalibrationSessionDetail
+// @Router /v1/farms/{farm_id}/devices/{device_id}/calibration/sessions/{session_id}/complete [post]
+func CompleteCalibrationHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+	sessionID, err := uuid.Parse(c.Params("session_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid session ID")
+	}
+
+	session, err := calibrationService.CompleteSession(userID, farmID, deviceID, sessionID)
+	if err != nil {
+		return respondCalibrationError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, session, "Calibration applied")
+}
+
+// CancelCalibrationHandler discards an open calibration session
+// @Summary Cancel Calibration Session
+// @Tags Devices, Calibration
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Param session_id path string true "Calibration session ID (UUID)"
+// @Success 200 {object} object
+// @Router /v1/farms/{farm_id}/devices/{device_id}/calibration/sessions/{session_id}/cancel [post]
+func CancelCalibrationHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+	sessionID, err := uuid.Parse(c.Params("session_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid session ID")
+	}
+
+	if err := calibrationService.CancelSession(userID, farmID, deviceID, sessionID); err != nil {
+		return respondCalibrationError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Calibration session cancelled")
+}
+
+func respondCalibrationError(c *fiber.Ctx, err error) error {
+	switch err {
+	case services.ErrFarmAccessDenied:
+		return utils.Forbidden(c, "Access denied")
+	case services.ErrDeviceNotFound:
+		return utils.NotFound(c, "Device not found")
+	case services.ErrCalibrationNotFound:
+		return utils.NotFound(c, "Calibration session not found")
+	case services.ErrCalibrationSensor:
+		return utils.BadRequest(c, "invalid_sensor_type", "sensor_type is required")
+	case services.ErrCalibrationOpen:
+		return utils.Conflict(c, "calibration_open", "A calibration session is already open for this sensor")
+	case services.ErrCalibrationNotOpen:
+		return utils.Conflict(c, "calibration_not_open", "Calibration session is not open")
+	case services.ErrCalibrationNoReading:
+		return utils.BadRequest(c, "no_recent_reading", "No raw reading in the last 2 minutes; wait for telemetry or send raw_value")
+	case services.ErrCalibrationNoPoints:
+		return utils.BadRequest(c, "no_points", "Add at least one reference point")
+	case services.ErrCalibrationDegenerate:
+		return utils.BadRequest(c, "degenerate_points", "Reference points need distinct raw values and a positive slope")
+	}
+	return utils.InternalError(c, "Failed to process calibration")
+}
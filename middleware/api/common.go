@@ -9,16 +9,20 @@ import (
 )
 
 var (
-	farmService      = services.NewFarmService()
-	coopService      = services.NewCoopService()
-	alertService     = services.NewAlertService()
-	deviceService    = services.NewDeviceService()
-	authService      = services.NewAuthService()
-	scheduleService  = services.NewScheduleService()
-	analyticsService = services.NewAnalyticsService()
-	adminService     = services.NewAdminService()
-	telemetryService = services.NewTelemetryService()
-	webPushService   = services.NewWebPushService()
+	farmService        = services.NewFarmService()
+	coopService        = services.NewCoopService()
+	alertService       = services.NewAlertService()
+	deviceService      = services.NewDeviceService()
+	authService        = services.NewAuthService()
+	scheduleService    = services.NewScheduleService()
+	analyticsService   = services.NewAnalyticsService()
+	adminService       = services.NewAdminService()
+	telemetryService   = services.NewTelemetryService()
+	webPushService     = services.NewWebPushService()
+	interlockService   = services.NewInterlockService()
+	firmwareService    = services.NewFirmwareService()
+	calibrationService = services.NewCalibrationService()
+	deviceGroupService = services.NewDeviceGroupService()
 )
 
 // checkFarmAccess is a helper to verify farm membership/role
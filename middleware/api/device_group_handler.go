@@ -0,0 +1,284 @@
+package api
+
+import (
+	"middleware/schemas"
+	"middleware/services"
+	"middleware/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ===== DEVICE TAG & GROUP HANDLERS =====
+
+// ListDeviceTagsHandler returns the tags used in a farm with their device counts
+// @Summary List Device Tags
+// @Description Responds with {"tags": [{"tag", "device_count"}]}
+// @Tags Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Success 200 {object} object
+// @Router /v1/farms/{farm_id}/device-tags [get]
+func ListDeviceTagsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	tags, err := deviceGroupService.ListTags(userID, farmID)
+	if err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"tags": tags}, "Device tags retrieved")
+}
+
+// GetDeviceTagsHandler returns a device's tags
+// @Summary Get Device Tags
+// @Tags Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Success 200 {object} object
+// @Router /v1/farms/{farm_id}/devices/{device_id}/tags [get]
+func GetDeviceTagsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	tags, err := deviceGroupService.GetDeviceTags(userID, farmID, deviceID)
+	if err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"tags": tags}, "Device tags retrieved")
+}
+
+// SetDeviceTagsHandler replaces a device's tags
+// @Summary Set Device Tags
+// @Tags Devices
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Param request body schemas.DeviceTagsRequest true "Tags"
+// @Success 200 {object} object
+// @Router /v1/farms/{farm_id}/devices/{device_id}/tags [put]
+func SetDeviceTagsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	var req schemas.DeviceTagsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	tags, err := deviceGroupService.SetDeviceTags(userID, farmID, deviceID, req.Tags)
+	if err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"tags": tags}, "Device tags updated")
+}
+
+// ListDeviceGroupsHandler returns a farm's device groups
+// @Summary List Device Groups
+// @Description Responds with {"groups": [...]}
+// @Tags Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Success 200 {object} object
+// @Router /v1/farms/{farm_id}/device-groups [get]
+func ListDeviceGroupsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	groups, err := deviceGroupService.ListGroups(userID, farmID)
+	if err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"groups": groups}, "Device groups retrieved")
+}
+
+// CreateDeviceGroupHandler creates a named device group
+// @Summary Create Device Group
+// @Tags Devices
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param request body schemas.DeviceGroupRequest true "Group"
+// @Success 201 {object} models.DeviceGroup
+// @Router /v1/farms/{farm_id}/device-groups [post]
+func CreateDeviceGroupHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	var req schemas.DeviceGroupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	group, err := deviceGroupService.CreateGroup(userID, farmID, req)
+	if err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusCreated, group, "Device group created")
+}
+
+// GetDeviceGroupHandler returns a device group with its members
+// @Summary Get Device Group
+// @Tags Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param group_id path string true "Device group ID (UUID)"
+// @Success 200 {object} models.DeviceGroup
+// @Router /v1/farms/{farm_id}/device-groups/{group_id} [get]
+func GetDeviceGroupHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	groupID, err := uuid.Parse(c.Params("group_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid group ID")
+	}
+
+	group, err := deviceGroupService.GetGroup(userID, farmID, groupID)
+	if err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, group, "Device group retrieved")
+}
+
+// UpdateDeviceGroupHandler renames a device group or replaces its members
+// @Summary Update Device Group
+// @Tags Devices
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param group_id path string true "Device group ID (UUID)"
+// @Param request body schemas.DeviceGroupRequest true "Changes"
+// @Success 200 {object} models.DeviceGroup
+// @Router /v1/farms/{farm_id}/device-groups/{group_id} [put]
+func UpdateDeviceGroupHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	groupID, err := uuid.Parse(c.Params("group_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid group ID")
+	}
+
+	var req schemas.DeviceGroupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	group, err := deviceGroupService.UpdateGroup(userID, farmID, groupID, req)
+	if err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, group, "Device group updated")
+}
+
+// DeleteDeviceGroupHandler deletes a device group
+// @Summary Delete Device Group
+// @Tags Devices
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param group_id path string true "Device group ID (UUID)"
+// @Success 200 {object} object
+// @Router /v1/farms/{farm_id}/device-groups/{group_id} [delete]
+func DeleteDeviceGroupHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	groupID, err := uuid.Parse(c.Params("group_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid group ID")
+	}
+
+	if err := deviceGroupService.DeleteGroup(userID, farmID, groupID); err != nil {
+		return respondDeviceGroupError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Device group deleted")
+}
+
+// parseDeviceSelectorQuery reads the optional ?tag= and ?group_id= report filters
+func parseDeviceSelectorQuery(c *fiber.Ctx) (schemas.DeviceSelector, bool) {
+	var sel schemas.DeviceSelector
+	if tag := c.Query("tag"); tag != "" {
+		sel.Tag = &tag
+	}
+	if raw := c.Query("group_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return sel, false
+		}
+		sel.GroupID = &id
+	}
+	return sel, true
+}
+
+func respondDeviceGroupError(c *fiber.Ctx, err error) error {
+	switch err {
+	case services.ErrFarmAccessDenied:
+		return utils.Forbidden(c, "Access denied")
+	case services.ErrDeviceNotFound:
+		return utils.NotFound(c, "Device not found")
+	case services.ErrDeviceGroupNotFound:
+		return utils.NotFound(c, "Device group not found")
+	case services.ErrDeviceGroupExists:
+		return utils.Conflict(c, "device_group_exists", "A device group with this name already exists")
+	case services.ErrDeviceGroupInvalid:
+		return utils.BadRequest(c, "invalid_group", "Group name is required")
+	case services.ErrInvalidTag:
+		return utils.BadRequest(c, "invalid_tag", "Tags must be 1-50 characters")
+	}
+	return utils.InternalError(c, "Failed to process device tags or groups")
+}
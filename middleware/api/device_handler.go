@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"log"
 	"middleware/schemas"
 	"middleware/services"
@@ -201,6 +202,118 @@ func DeleteDeviceHandler(c *fiber.Ctx) error {
 	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Device deleted")
 }
 
+// ReplaceDeviceHandler moves a logical device onto new hardware, keeping its history
+func ReplaceDeviceHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	var req schemas.ReplaceDeviceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	rep, err := deviceService.ReplaceDevice(userID, farmID, deviceID, req, c.IP())
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrDeviceNotFound {
+		return utils.NotFound(c, "Device not found")
+	}
+	if err == services.ErrReplacementInvalid {
+		return utils.BadRequest(c, "invalid_replacement", "new_hardware_id is required and must differ from the current hardware; devices without a model need new_device_key")
+	}
+	if err == services.ErrReplacementInUse {
+		return utils.Conflict(c, "hardware_in_use", "The new hardware is registered to another farm")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to replace device")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, rep, "Device hardware replaced")
+}
+
+// GetDeviceTimelineHandler lists lifecycle events (replacements, config, calibration, firmware)
+func GetDeviceTimelineHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	timeline, err := deviceService.GetDeviceTimeline(userID, farmID, deviceID, c.QueryInt("limit", 100))
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrDeviceNotFound {
+		return utils.NotFound(c, "Device not found")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch device timeline")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, timeline, "Device timeline retrieved")
+}
+
+// GetGatewayDiagnosticsHandler returns a gateway's heartbeat diagnostics time series
+// @Summary Gateway Diagnostics
+// @Description Uptime, CPU temperature, load, disk, memory, RSSI, queue depth and clock offset reported in heartbeats, plus active disk/temperature alerts
+// @Tags Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param hardware_id path string true "Gateway hardware ID"
+// @Param hours query int false "Window in hours (default 24, max 168)"
+// @Success 200 {object} schemas.GatewayDiagnosticsHistory
+// @Router /v1/farms/{farm_id}/gateways/{hardware_id}/diagnostics [get]
+func GetGatewayDiagnosticsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	hardwareID := strings.TrimSpace(c.Params("hardware_id"))
+	if hardwareID == "" {
+		return utils.BadRequest(c, "invalid_id", "Invalid hardware ID")
+	}
+	hours := c.QueryInt("hours", 24)
+	if hours < 1 || hours > 168 {
+		return utils.BadRequest(c, "invalid_query", "hours must be between 1 and 168")
+	}
+
+	history, err := deviceService.GetGatewayDiagnostics(userID, farmID, hardwareID, hours)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrDeviceNotFound {
+		return utils.NotFound(c, "Gateway not found")
+	}
+	if err != nil {
+		log.Printf("Gateway diagnostics error: %v", err)
+		return utils.InternalError(c, "Failed to fetch gateway diagnostics")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, history, "Gateway diagnostics retrieved")
+}
+
 func GetDeviceHistoryHandler(c *fiber.Ctx) error {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
@@ -218,8 +331,9 @@ func GetDeviceHistoryHandler(c *fiber.Ctx) error {
 	limit := c.QueryInt("limit", 50)
 	offset := c.QueryInt("offset", 0)
 	sensorType := c.Query("sensor_type", "")
+	quality := c.Query("quality", "")
 
-	history, total, err := deviceService.GetDeviceHistory(userID, farmID, deviceID, sensorType, limit, offset)
+	history, total, err := deviceService.GetDeviceHistory(userID, farmID, deviceID, sensorType, quality, limit, offset)
 	if err == services.ErrFarmAccessDenied {
 		return utils.Forbidden(c, "Access denied")
 	}
@@ -292,6 +406,35 @@ func GetDeviceConfigHandler(c *fiber.Ctx) error {
 	return utils.SuccessResponse(c, fiber.StatusOK, cfgs, "Device config retrieved")
 }
 
+// GetDeviceConfigStatusHandler shows whether the gateway applied the latest config version
+func GetDeviceConfigStatusHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	status, err := deviceService.GetDeviceConfigStatus(userID, farmID, deviceID)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrDeviceNotFound {
+		return utils.NotFound(c, "Device not found")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch device config status")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, status, "Device config status retrieved")
+}
+
 func UpdateDeviceConfigHandler(c *fiber.Ctx) error {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
@@ -402,6 +545,7 @@ func SendDeviceCommandHandler(c *fiber.Ctx) error {
 		CommandValue   *string `json:"command_value,omitempty"`
 		Parameters     *string `json:"parameters,omitempty"`
 		ActionDuration *int    `json:"action_duration,omitempty"`
+		Override       bool    `json:"override,omitempty"`
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return utils.BadRequest(c, "invalid_body", "Invalid request body")
@@ -412,14 +556,77 @@ func SendDeviceCommandHandler(c *fiber.Ctx) error {
 		value = req.Parameters
 	}
 
-	cmd, err := deviceService.IssueCommand(userID, farmID, deviceID, req.CommandType, value, req.ActionDuration)
+	if strings.TrimSpace(req.CommandType) == "" {
+		return utils.BadRequest(c, "invalid_body", "command_type is required")
+	}
+
+	opts := services.CommandOptions{Override: req.Override, IPAddress: c.IP()}
+	cmd, err := deviceService.IssueCommandWithOptions(userID, farmID, deviceID, req.CommandType, value, req.ActionDuration, opts)
 	if err != nil {
-		return utils.InternalError(c, "Failed to issue command")
+		return respondCommandError(c, err, "Failed to issue command")
 	}
 
 	return utils.SuccessResponse(c, fiber.StatusOK, cmd, "Command issued")
 }
 
+// respondCommandError maps errors from issuing a command to API responses.
+// Capability violations are returned as structured 400 errors.
+func respondCommandError(c *fiber.Ctx, err error, fallback string) error {
+	var verr *services.CommandValidationError
+	var violation *services.InterlockViolationError
+	switch {
+	case err == services.ErrFarmAccessDenied:
+		return utils.Forbidden(c, "Access denied")
+	case err == services.ErrDeviceNotFound:
+		return utils.NotFound(c, "Device not found")
+	case err == services.ErrEmergencyStopActive:
+		return utils.Conflict(c, "emergency_stop_active", "An emergency stop is latched; resume or send with override")
+	case errors.As(err, &verr):
+		return utils.ErrorResponseWithDetails(c, fiber.StatusBadRequest, verr.Code, verr.Message, verr)
+	case errors.As(err, &violation):
+		return utils.ErrorResponseWithDetails(c, fiber.StatusConflict, "interlock_violation", violation.Reason, violation)
+	}
+	log.Printf("%s: %v", fallback, err)
+	return utils.InternalError(c, fallback)
+}
+
+// GetDeviceCapabilitiesHandler returns the commands a device accepts
+// @Summary Get Device Capabilities
+// @Description Returns allowed commands, value ranges, units and max action duration for a device
+// @Tags Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param device_id path string true "Device ID (UUID)"
+// @Success 200 {object} schemas.DeviceCapabilitiesResponse
+// @Router /v1/farms/{farm_id}/devices/{device_id}/capabilities [get]
+func GetDeviceCapabilitiesHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	deviceID, err := uuid.Parse(c.Params("device_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid device ID")
+	}
+
+	caps, err := deviceService.GetDeviceCapabilities(userID, farmID, deviceID)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrDeviceNotFound {
+		return utils.NotFound(c, "Device not found")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch device capabilities")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, caps, "Device capabilities retrieved")
+}
+
 func GetDeviceCommandStatusHandler(c *fiber.Ctx) error {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
@@ -527,6 +734,16 @@ func GetFarmCommandHistoryHandler(c *fiber.Ctx) error {
 	return utils.SuccessResponse(c, fiber.StatusOK, history, "Farm command history retrieved")
 }
 
+// EmergencyStopHandler latches a farm or coop into a stopped state
+// @Summary Emergency Stop
+// @Description Cancels pending commands, switches devices off and blocks commands and schedules until resumed
+// @Tags Devices, Commands
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param request body schemas.EmergencyStopRequest false "Optional coop scope, tag/group selector and reason"
+// @Success 200 {object} schemas.EmergencyStopStatus
+// @Router /v1/farms/{farm_id}/emergency-stop [post]
 func EmergencyStopHandler(c *fiber.Ctx) error {
 	userID, err := GetUserIDFromContext(c)
 	if err != nil {
@@ -537,15 +754,102 @@ func EmergencyStopHandler(c *fiber.Ctx) error {
 		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
 	}
 
-	count, err := deviceService.EmergencyStop(userID, farmID)
+	var req schemas.EmergencyStopRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return utils.BadRequest(c, "invalid_body", "Invalid request body")
+		}
+	}
+
+	stop, err := deviceService.EmergencyStop(userID, farmID, req, c.IP())
 	if err == services.ErrFarmAccessDenied {
 		return utils.Forbidden(c, "Access denied")
 	}
+	if err == services.ErrCoopNotFound {
+		return utils.NotFound(c, "Coop not found")
+	}
+	if err == services.ErrDeviceGroupNotFound {
+		return utils.NotFound(c, "Device group not found")
+	}
+	if err == services.ErrInvalidTag {
+		return utils.BadRequest(c, "invalid_tag", "Tags must be 1-50 characters")
+	}
 	if err != nil {
+		log.Printf("Emergency stop error: %v", err)
 		return utils.InternalError(c, "Failed to trigger emergency stop")
 	}
 
-	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"commands_issued": count}, "Emergency stop triggered")
+	return utils.SuccessResponse(c, fiber.StatusOK, stop, "Emergency stop triggered")
+}
+
+// ResumeEmergencyStopHandler releases an emergency stop latch
+// @Summary Resume After Emergency Stop
+// @Description Releases the farm (or coop) latch so commands and schedules run again. Devices stay off.
+// @Tags Devices, Commands
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param request body schemas.EmergencyResumeRequest false "Optional coop scope and note"
+// @Success 200 {object} schemas.EmergencyStopStatus
+// @Router /v1/farms/{farm_id}/emergency-stop/resume [post]
+func ResumeEmergencyStopHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	var req schemas.EmergencyResumeRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return utils.BadRequest(c, "invalid_body", "Invalid request body")
+		}
+	}
+
+	stop, err := deviceService.ResumeEmergencyStop(userID, farmID, req, c.IP())
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err == services.ErrEmergencyStopNotActive {
+		return utils.Conflict(c, "emergency_stop_not_active", "No emergency stop is latched for this scope")
+	}
+	if err != nil {
+		log.Printf("Emergency resume error: %v", err)
+		return utils.InternalError(c, "Failed to resume after emergency stop")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, stop, "Emergency stop released")
+}
+
+// GetEmergencyStopStatusHandler lists the emergency stop latches in force for a farm
+// @Summary Emergency Stop Status
+// @Tags Devices, Commands
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Success 200 {array} schemas.EmergencyStopStatus
+// @Router /v1/farms/{farm_id}/emergency-stop [get]
+func GetEmergencyStopStatusHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	stops, err := deviceService.GetActiveEmergencyStops(userID, farmID)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch emergency stop status")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, stops, "Emergency stop status retrieved")
 }
 
 // BatchDeviceCommandHandler issues commands to multiple devices
@@ -572,14 +876,20 @@ func BatchDeviceCommandHandler(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return utils.BadRequest(c, "invalid_body", "Invalid request body")
 	}
-	if len(req.DeviceIDs) == 0 || strings.TrimSpace(req.CommandType) == "" {
-		return utils.BadRequest(c, "invalid_body", "device_ids and command_type are required")
+	if (len(req.DeviceIDs) == 0 && req.DeviceSelector.IsEmpty()) || strings.TrimSpace(req.CommandType) == "" {
+		return utils.BadRequest(c, "invalid_body", "command_type and device_ids, tag or group_id are required")
 	}
 
 	results, err := deviceService.BatchCommands(userID, farmID, req)
 	if err == services.ErrFarmAccessDenied {
 		return utils.Forbidden(c, "Access denied")
 	}
+	if err == services.ErrDeviceGroupNotFound {
+		return utils.NotFound(c, "Device group not found")
+	}
+	if err == services.ErrInvalidTag {
+		return utils.BadRequest(c, "invalid_tag", "Tags must be 1-50 characters")
+	}
 	if err != nil {
 		return utils.InternalError(c, "Failed to process batch command")
 	}
@@ -589,17 +899,34 @@ func BatchDeviceCommandHandler(c *fiber.Ctx) error {
 
 func UpdateDeviceHeartbeatHandler(c *fiber.Ctx) error {
 	hardwareID := c.Params("hardware_id")
+	farmID, authenticated := c.Locals("farm_id").(uuid.UUID)
+	if authenticated {
+		// A gateway may only check in for hardware of its own farm
+		resolved, err := gatewayHardwareID(c, hardwareID)
+		if err != nil {
+			return utils.Forbidden(c, "Hardware ID does not belong to this gateway")
+		}
+		hardwareID = resolved
+	}
 	if strings.TrimSpace(hardwareID) == "" {
 		return utils.BadRequest(c, "invalid_id", "Invalid hardware ID")
 	}
 
 	var req struct {
-		Status   *string `json:"status,omitempty"`
-		Response *string `json:"response,omitempty"`
+		Status      *string                       `json:"status,omitempty"`
+		Response    *string                       `json:"response,omitempty"`
+		States      []schemas.ReportedDeviceState `json:"states,omitempty"`
+		OTA         []schemas.OTAProgressReport   `json:"ota,omitempty"`
+		Configs     []schemas.ConfigApplyReport   `json:"configs,omitempty"`
+		Diagnostics *schemas.GatewayDiagnostics   `json:"diagnostics,omitempty"`
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return utils.BadRequest(c, "invalid_body", "Invalid request body")
 	}
+	// Without a gateway token only a bare check-in is accepted; state reports need the token
+	if !authenticated && (len(req.States) > 0 || len(req.OTA) > 0 || len(req.Configs) > 0 || req.Diagnostics != nil) {
+		return utils.Unauthorized(c, "Gateway token required for device reports")
+	}
 
 	status := ""
 	if req.Status != nil {
@@ -612,15 +939,39 @@ func UpdateDeviceHeartbeatHandler(c *fiber.Ctx) error {
 		println("HEARTBEAT ERROR:", err.Error())
 		return utils.InternalError(c, "Failed to record heartbeat")
 	}
+	if len(req.States) > 0 {
+		if err := deviceService.ApplyReportedStates(farmID, hardwareID, req.States); err != nil {
+			log.Printf("Heartbeat state report error: %v", err)
+		}
+	}
+	if len(req.OTA) > 0 {
+		if err := deviceService.ApplyOTAProgress(farmID, hardwareID, req.OTA); err != nil {
+			log.Printf("Heartbeat OTA report error: %v", err)
+		}
+	}
+	if len(req.Configs) > 0 {
+		if err := deviceService.ApplyConfigReports(farmID, hardwareID, req.Configs); err != nil {
+			log.Printf("Heartbeat config report error: %v", err)
+		}
+	}
+	if req.Diagnostics != nil {
+		if err := deviceService.RecordGatewayDiagnostics(farmID, hardwareID, *req.Diagnostics); err != nil {
+			log.Printf("Heartbeat diagnostics error: %v", err)
+		}
+	}
 
 	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Heartbeat recorded")
 }
-// GetGatewayCommandsHandler returns pending commands for a specific hardware_id
+// GetGatewayCommandsHandler returns the commands due for delivery to a specific hardware_id.
+// Each returned command carries an idempotency_key the gateway must echo when reporting status.
 func GetGatewayCommandsHandler(c *fiber.Ctx) error {
 	hardwareID := c.Params("hardware_id")
 	if strings.TrimSpace(hardwareID) == "" {
 		return utils.BadRequest(c, "invalid_id", "Invalid hardware ID")
 	}
+	if _, err := gatewayHardwareID(c, hardwareID); err != nil {
+		return utils.Forbidden(c, "Hardware ID does not belong to this gateway")
+	}
 
 	commands, err := deviceService.GetPendingCommands(hardwareID)
 	if err != nil {
@@ -631,27 +982,110 @@ func GetGatewayCommandsHandler(c *fiber.Ctx) error {
 	return utils.SuccessResponse(c, fiber.StatusOK, commands, "Gateway commands retrieved")
 }
 
-// UpdateGatewayCommandStatusHandler updates the status of a specific command
+// gatewayHardwareID returns the hardware ID an authenticated gateway acts for. A token bound to a
+// gateway device only ever acts for that device; a farm token may act for any device of its farm.
+func gatewayHardwareID(c *fiber.Ctx, requested string) (string, error) {
+	farmID, ok := c.Locals("farm_id").(uuid.UUID)
+	if !ok {
+		return "", services.ErrDeviceNotFound
+	}
+	tokenDeviceID, _ := c.Locals("gateway_device_id").(*uuid.UUID)
+	hardwareID, err := deviceService.ResolveGatewayHardwareID(farmID, tokenDeviceID, requested)
+	if err != nil {
+		return "", err
+	}
+	if requested != "" && strings.TrimSpace(requested) != hardwareID {
+		return "", services.ErrDeviceNotFound
+	}
+	return hardwareID, nil
+}
+
+// GetGatewayShadowHandler returns the shadow deltas a gateway should reconcile, typically after reconnecting
+func GetGatewayShadowHandler(c *fiber.Ctx) error {
+	hardwareID := c.Params("hardware_id")
+	if strings.TrimSpace(hardwareID) == "" {
+		return utils.BadRequest(c, "invalid_id", "Invalid hardware ID")
+	}
+	hardwareID, err := gatewayHardwareID(c, hardwareID)
+	if err != nil {
+		return utils.Forbidden(c, "Hardware ID does not belong to this gateway")
+	}
+
+	deltas, err := deviceService.GetGatewayShadowDeltas(c.Locals("farm_id").(uuid.UUID), hardwareID)
+	if err != nil {
+		log.Printf("Get gateway shadow error: %v", err)
+		return utils.InternalError(c, "Failed to fetch device shadow")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, deltas, "Device shadow deltas retrieved")
+}
+
+// UpdateGatewayCommandStatusHandler updates the status of a specific command.
+// Duplicate or stale reports are acknowledged with 200 but not applied, so a gateway
+// that retries after a lost response does not get stuck.
 func UpdateGatewayCommandStatusHandler(c *fiber.Ctx) error {
+	farmID, ok := c.Locals("farm_id").(uuid.UUID)
+	if !ok {
+		return utils.Unauthorized(c, "Gateway authentication required")
+	}
 	commandID, err := uuid.Parse(c.Params("command_id"))
 	if err != nil {
 		return utils.BadRequest(c, "invalid_id", "Invalid command ID")
 	}
+	// Tokens bound to a gateway device may only report on that gateway's commands
+	hardwareID := ""
+	if tokenDeviceID, _ := c.Locals("gateway_device_id").(*uuid.UUID); tokenDeviceID != nil {
+		if hardwareID, err = gatewayHardwareID(c, ""); err != nil {
+			return utils.Forbidden(c, "Gateway token is not bound to a known gateway")
+		}
+	}
 
 	var req struct {
-		Status   string `json:"status"`
-		Response string `json:"response"`
+		Status         string `json:"status"`
+		Response       string `json:"response"`
+		IdempotencyKey string `json:"idempotency_key"`
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return utils.BadRequest(c, "invalid_body", "Invalid request body")
 	}
+	req.Status = normalizeCommandStatus(req.Status)
+	if !validCommandStatuses[req.Status] {
+		return utils.BadRequest(c, "invalid_status", "status must be one of: success, failed, timeout")
+	}
 
-	if err := deviceService.UpdateCommandStatus(commandID, req.Status, req.Response); err != nil {
+	if err := deviceService.UpdateCommandStatus(farmID, hardwareID, commandID, req.Status, req.Response, req.IdempotencyKey); err != nil {
 		if err == services.ErrCommandNotFound {
 			return utils.NotFound(c, "Command not found")
 		}
+		if err == services.ErrIdempotencyKey {
+			return utils.Conflict(c, "idempotency_key_mismatch", "idempotency_key is missing or does not match the command")
+		}
+		if err == services.ErrCommandStatusStale {
+			return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"applied": false}, "Duplicate or stale status ignored")
+		}
 		return utils.InternalError(c, "Failed to update command status")
 	}
 
-	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Command status updated")
+	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"applied": true}, "Command status updated")
+}
+
+// validCommandStatuses are the final states a gateway may report for a command
+var validCommandStatuses = map[string]bool{
+	"success": true,
+	"failed":  true,
+	"timeout": true,
+}
+
+// commandStatusAliases maps statuses sent by older gateways to the canonical ones
+var commandStatusAliases = map[string]string{
+	"executed":  "success",
+	"completed": "success",
+}
+
+func normalizeCommandStatus(status string) string {
+	status = strings.ToLower(strings.TrimSpace(status))
+	if canonical, ok := commandStatusAliases[status]; ok {
+		return canonical
+	}
+	return status
 }
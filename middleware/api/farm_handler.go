@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"log"
 	"strconv"
 
@@ -168,3 +169,71 @@ func DeleteFarmHandler(c *fiber.Ctx) error {
 
 	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Farm deleted successfully")
 }
+
+// GetFarmTariffHandler returns the farm's electricity tariff
+// @Summary Get Farm Tariff
+// @Tags Farms
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Success 200 {object} schemas.FarmTariff
+// @Router /v1/farms/{farm_id}/tariff [get]
+func GetFarmTariffHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid token")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	tariff, err := farmService.GetFarmTariff(userID, farmID)
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch tariff")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, tariff, "Tariff retrieved")
+}
+
+// UpdateFarmTariffHandler replaces the farm's electricity tariff
+// @Summary Update Farm Tariff
+// @Description Sets the base price per kWh and optional time-of-use periods (HH:MM, may wrap midnight)
+// @Tags Farms
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param request body schemas.UpdateFarmTariffRequest true "Tariff"
+// @Success 200 {object} schemas.FarmTariff
+// @Router /v1/farms/{farm_id}/tariff [put]
+func UpdateFarmTariffHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid token")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	var req schemas.UpdateFarmTariffRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_request", "Invalid request body")
+	}
+
+	tariff, err := farmService.UpdateFarmTariff(userID, farmID, req)
+	var verr *services.CommandValidationError
+	if errors.As(err, &verr) {
+		return utils.ErrorResponseWithDetails(c, fiber.StatusBadRequest, verr.Code, verr.Message, verr)
+	}
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Access denied")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to update tariff")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, tariff, "Tariff updated")
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"errors"
+	"middleware/schemas"
+	"middleware/services"
+	"middleware/utils"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ===== FIRMWARE & OTA HANDLERS (admin) =====
+
+// UploadFirmwareHandler registers a firmware image (multipart: file, version, target_model, signature, checksum_sha256, notes)
+func UploadFirmwareHandler(c *fiber.Ctx) error {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Authentication failed")
+	}
+
+	version := strings.TrimSpace(c.FormValue("version"))
+	targetModel := strings.TrimSpace(c.FormValue("target_model"))
+	if version == "" || targetModel == "" {
+		return utils.BadRequest(c, "invalid_body", "version and target_model are required")
+	}
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return utils.BadRequest(c, "invalid_body", "Firmware file is required")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return utils.BadRequest(c, "invalid_body", "Unable to read firmware file")
+	}
+	defer file.Close()
+
+	var notes *string
+	if n := strings.TrimSpace(c.FormValue("notes")); n != "" {
+		notes = &n
+	}
+
+	artifact, err := firmwareService.RegisterArtifact(adminID, version, targetModel, fileHeader.Filename, file,
+		strings.TrimSpace(c.FormValue("signature")), strings.TrimSpace(c.FormValue("checksum_sha256")), notes)
+	if err == services.ErrFirmwareExists {
+		return utils.Conflict(c, "firmware_exists", "This version is already registered for the model")
+	}
+	if err == services.ErrFirmwareChecksum {
+		return utils.BadRequest(c, "checksum_mismatch", "Uploaded file does not match checksum_sha256")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to store firmware")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusCreated, artifact, "Firmware registered")
+}
+
+func ListFirmwareHandler(c *fiber.Ctx) error {
+	artifacts, err := firmwareService.ListArtifacts()
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch firmware")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, artifacts, "Firmware retrieved")
+}
+
+// DownloadGatewayFirmwareHandler serves a firmware image to a gateway that was asked to install it
+func DownloadGatewayFirmwareHandler(c *fiber.Ctx) error {
+	farmID, ok := c.Locals("farm_id").(uuid.UUID)
+	if !ok {
+		return utils.Unauthorized(c, "Gateway authentication required")
+	}
+	firmwareID, err := uuid.Parse(c.Params("firmware_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid firmware ID")
+	}
+
+	artifact, err := firmwareService.GetArtifactForGateway(farmID, firmwareID)
+	if err == services.ErrFirmwareNotFound {
+		return utils.NotFound(c, "Firmware not found")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch firmware")
+	}
+
+	c.Set("X-Firmware-Version", artifact.Version)
+	c.Set("X-Firmware-SHA256", artifact.ChecksumSHA256)
+	c.Set("X-Firmware-Signature", artifact.Signature)
+	return c.Download(artifact.FilePath, artifact.FileName)
+}
+
+func CreateOTACampaignHandler(c *fiber.Ctx) error {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Authentication failed")
+	}
+
+	var req schemas.CreateOTACampaignRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	campaign, err := firmwareService.CreateCampaign(adminID, req)
+	if err != nil {
+		return respondCampaignError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusCreated, campaign, "OTA campaign started")
+}
+
+func ListOTACampaignsHandler(c *fiber.Ctx) error {
+	campaigns, err := firmwareService.ListCampaigns()
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch campaigns")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, campaigns, "Campaigns retrieved")
+}
+
+func GetOTACampaignHandler(c *fiber.Ctx) error {
+	campaignID, err := uuid.Parse(c.Params("campaign_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid campaign ID")
+	}
+
+	campaign, err := firmwareService.GetCampaign(campaignID)
+	if err != nil {
+		return respondCampaignError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, campaign, "Campaign retrieved")
+}
+
+// ExpandOTACampaignHandler moves a running campaign to its next stage
+func ExpandOTACampaignHandler(c *fiber.Ctx) error {
+	campaignID, err := uuid.Parse(c.Params("campaign_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid campaign ID")
+	}
+
+	var req schemas.ExpandOTACampaignRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	campaign, err := firmwareService.ExpandCampaign(campaignID, req.TargetPercentage)
+	if err != nil {
+		return respondCampaignError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, campaign, "Campaign expanded")
+}
+
+func HaltOTACampaignHandler(c *fiber.Ctx) error {
+	campaignID, err := uuid.Parse(c.Params("campaign_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid campaign ID")
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	_ = c.BodyParser(&req)
+
+	campaign, err := firmwareService.HaltCampaign(campaignID, strings.TrimSpace(req.Reason))
+	if err != nil {
+		return respondCampaignError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, campaign, "Campaign halted")
+}
+
+func ResumeOTACampaignHandler(c *fiber.Ctx) error {
+	campaignID, err := uuid.Parse(c.Params("campaign_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid campaign ID")
+	}
+
+	campaign, err := firmwareService.ResumeCampaign(campaignID)
+	if err != nil {
+		return respondCampaignError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, campaign, "Campaign resumed")
+}
+
+func respondCampaignError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrCampaignNotFound):
+		return utils.NotFound(c, "Campaign not found")
+	case errors.Is(err, services.ErrCampaignNoFirmware):
+		return utils.BadRequest(c, "firmware_not_found", "Firmware not found")
+	case errors.Is(err, services.ErrCampaignInvalidName):
+		return utils.BadRequest(c, "invalid_body", "Campaign name is required")
+	case errors.Is(err, services.ErrCampaignBadPercent):
+		return utils.BadRequest(c, "invalid_percentage", "target_percentage must be 1-100 and cannot shrink")
+	case errors.Is(err, services.ErrCampaignNotRunning):
+		return utils.Conflict(c, "campaign_not_running", "Campaign is not running")
+	case errors.Is(err, services.ErrCampaignNotHalted):
+		return utils.Conflict(c, "campaign_not_halted", "Campaign is not halted")
+	}
+	return utils.InternalError(c, "Failed to process campaign")
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"log"
+	"middleware/config"
+	"middleware/schemas"
+	"middleware/services"
+	"middleware/utils"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ===== GATEWAY MAINTENANCE HANDLERS =====
+
+// GatewayMaintenanceHandler queues reboot, restart_agent, upload_logs or rediscover for a gateway
+// @Summary Gateway Maintenance Command
+// @Description Farm owner only. Queues a maintenance command through the normal command queue.
+// @Tags Devices, Commands
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param hardware_id path string true "Gateway hardware ID"
+// @Param request body schemas.GatewayMaintenanceRequest true "Action and, for upload_logs, the number of lines"
+// @Success 202 {object} models.DeviceCommand
+// @Router /v1/farms/{farm_id}/gateways/{hardware_id}/maintenance [post]
+func GatewayMaintenanceHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid user session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+
+	var req schemas.GatewayMaintenanceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	cmd, err := deviceService.QueueGatewayMaintenance(userID, farmID, c.Params("hardware_id"), req, c.IP())
+	if err == services.ErrFarmAccessDenied {
+		return utils.Forbidden(c, "Only the farm owner can send gateway maintenance commands")
+	}
+	if err != nil {
+		return respondGatewayMaintenanceError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusAccepted, cmd, "Gateway maintenance command queued")
+}
+
+// AdminGatewayMaintenanceHandler queues a maintenance command for any assigned gateway
+func AdminGatewayMaintenanceHandler(c *fiber.Ctx) error {
+	adminID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Authentication failed")
+	}
+
+	var req schemas.GatewayMaintenanceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	cmd, err := deviceService.AdminQueueGatewayMaintenance(adminID, c.Params("hardware_id"), req, c.IP())
+	if err != nil {
+		return respondGatewayMaintenanceError(c, err)
+	}
+	return utils.SuccessResponse(c, fiber.StatusAccepted, cmd, "Gateway maintenance command queued")
+}
+
+// UploadGatewayLogsHandler receives the log lines requested by an upload_logs command
+func UploadGatewayLogsHandler(c *fiber.Ctx) error {
+	farmID, ok := c.Locals("farm_id").(uuid.UUID)
+	if !ok {
+		return utils.Unauthorized(c, "Gateway authentication required")
+	}
+	tokenDeviceID, _ := c.Locals("gateway_device_id").(*uuid.UUID)
+
+	var req schemas.GatewayLogUploadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	upload, err := deviceService.ReceiveGatewayLogs(farmID, tokenDeviceID, req)
+	if err == services.ErrDeviceNotFound {
+		return utils.NotFound(c, "Gateway not found")
+	}
+	if err == services.ErrCommandNotFound {
+		return utils.NotFound(c, "No upload_logs command with this ID for this gateway")
+	}
+	if err == services.ErrLogUploadInvalid {
+		return utils.BadRequest(c, "invalid_body", "lines must not be empty")
+	}
+	if err != nil {
+		log.Printf("Gateway log upload error: %v", err)
+		return utils.InternalError(c, "Failed to store gateway logs")
+	}
+	return utils.SuccessResponse(c, fiber.StatusCreated, upload, "Gateway logs stored")
+}
+
+// ListGatewayLogsHandler lists stored log uploads, optionally for one ?hardware_id=
+func ListGatewayLogsHandler(c *fiber.Ctx) error {
+	uploads, err := deviceService.ListGatewayLogs(c.Query("hardware_id"), c.QueryInt("limit", 50))
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch gateway logs")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"logs": uploads}, "Gateway logs retrieved")
+}
+
+// GetGatewayLogHandler returns one log upload with its content
+func GetGatewayLogHandler(c *fiber.Ctx) error {
+	logID, err := uuid.Parse(c.Params("log_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid log ID")
+	}
+
+	upload, err := deviceService.GetGatewayLog(logID)
+	if err == services.ErrGatewayLogNotFound {
+		return utils.NotFound(c, "Gateway log not found or expired")
+	}
+	if err != nil {
+		return utils.InternalError(c, "Failed to fetch gateway log")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, upload, "Gateway log retrieved")
+}
+
+func respondGatewayMaintenanceError(c *fiber.Ctx, err error) error {
+	switch err {
+	case services.ErrMaintenanceAction:
+		return utils.BadRequest(c, "invalid_action",
+			"action must be one of reboot, restart_agent, upload_logs, rediscover; lines between 1 and "+strconv.Itoa(config.AppConfig.GatewayLogMaxLines))
+	case services.ErrDeviceNotFound:
+		return utils.NotFound(c, "Gateway not found")
+	}
+	log.Printf("Gateway maintenance error: %v", err)
+	return utils.InternalError(c, "Failed to queue gateway maintenance command")
+}
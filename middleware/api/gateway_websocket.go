@@ -0,0 +1,292 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"middleware/config"
+	"middleware/schemas"
+	"middleware/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+)
+
+// ===== GATEWAY WEBSOCKET =====
+
+// GatewayClient is a gateway's persistent command channel. Commands are pushed as soon as they
+// are issued; acks and status reports come back on the same socket. Polling stays available
+// as a fallback for gateways that are not connected.
+type GatewayClient struct {
+	conn       *websocket.Conn
+	farmID     uuid.UUID
+	hardwareID string
+	send       chan []byte
+	wake       chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// gatewayStatusMessage is the payload of "ack" and "status" messages sent by a gateway
+type gatewayStatusMessage struct {
+	CommandID      string `json:"command_id"`
+	Status         string `json:"status"`
+	Response       string `json:"response"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// GatewayWebSocketHandler serves /v1/gateway/ws for gateways authenticated with X-Gateway-Token
+func GatewayWebSocketHandler(c *websocket.Conn) {
+	farmID, ok := c.Locals("farm_id").(uuid.UUID)
+	if !ok {
+		_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"))
+		_ = c.Close()
+		return
+	}
+	tokenDeviceID, _ := c.Locals("gateway_device_id").(*uuid.UUID)
+
+	hardwareID, err := deviceService.ResolveGatewayHardwareID(farmID, tokenDeviceID, c.Query("hardware_id"))
+	if err != nil {
+		_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unknown gateway"))
+		_ = c.Close()
+		return
+	}
+
+	gw := &GatewayClient{
+		conn:       c,
+		farmID:     farmID,
+		hardwareID: hardwareID,
+		send:       make(chan []byte, 32),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	WSHub.registerGateway(gw)
+	defer func() {
+		WSHub.unregisterGateway(gw)
+		gw.close()
+	}()
+
+	go gw.writePump()
+	go gw.deliveryLoop()
+
+	gw.sendMessage("welcome", fiber.Map{"hardware_id": hardwareID})
+	if deltas, err := deviceService.GetGatewayShadowDeltas(farmID, hardwareID); err == nil && len(deltas) > 0 {
+		gw.sendMessage("shadow_delta", deltas)
+	}
+	gw.wakeUp() // flush anything queued while disconnected
+	gw.readPump()
+}
+
+func (g *GatewayClient) wakeUp() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+		// A delivery is already pending
+	}
+}
+
+func (g *GatewayClient) close() {
+	g.closeOnce.Do(func() {
+		close(g.done)
+		_ = g.conn.Close()
+	})
+}
+
+// deliveryLoop pushes due commands when woken and re-checks periodically so retries follow
+// the same backoff as polling.
+func (g *GatewayClient) deliveryLoop() {
+	interval := time.Duration(config.AppConfig.CommandRetryBaseSeconds) * time.Second
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-g.wake:
+		case <-ticker.C:
+		}
+
+		commands, err := deviceService.DeliverDueCommands(g.hardwareID)
+		if err != nil {
+			log.Printf("Gateway push error (%s): %v", g.hardwareID, err)
+			continue
+		}
+		if len(commands) > 0 {
+			g.sendMessage("commands", commands)
+		}
+	}
+}
+
+func (g *GatewayClient) readPump() {
+	g.conn.SetReadLimit(64 * 1024)
+	_ = g.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	g.conn.SetPongHandler(func(string) error {
+		_ = g.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	for {
+		_, msg, err := g.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = g.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+
+		var incoming WSIncoming
+		if err := json.Unmarshal(msg, &incoming); err != nil {
+			continue
+		}
+
+		switch incoming.Type {
+		case "ping":
+			g.sendMessage("pong", fiber.Map{"ts": time.Now().UTC().Format(time.RFC3339)})
+		case "ack":
+			g.handleAck(incoming.Data)
+		case "status":
+			g.handleStatus(incoming.Data)
+		case "state":
+			var states []schemas.ReportedDeviceState
+			if err := json.Unmarshal(incoming.Data, &states); err != nil {
+				g.sendMessage("error", fiber.Map{"message": "state must be a list of device states"})
+				continue
+			}
+			if err := deviceService.ApplyReportedStates(g.farmID, g.hardwareID, states); err != nil {
+				log.Printf("Gateway state report error (%s): %v", g.hardwareID, err)
+			}
+		case "ota_progress":
+			var reports []schemas.OTAProgressReport
+			if err := json.Unmarshal(incoming.Data, &reports); err != nil {
+				g.sendMessage("error", fiber.Map{"message": "ota_progress must be a list of progress reports"})
+				continue
+			}
+			if err := deviceService.ApplyOTAProgress(g.farmID, g.hardwareID, reports); err != nil {
+				log.Printf("Gateway OTA report error (%s): %v", g.hardwareID, err)
+			}
+		case "config_ack":
+			var reports []schemas.ConfigApplyReport
+			if err := json.Unmarshal(incoming.Data, &reports); err != nil {
+				g.sendMessage("error", fiber.Map{"message": "config_ack must be a list of config reports"})
+				continue
+			}
+			if err := deviceService.ApplyConfigReports(g.farmID, g.hardwareID, reports); err != nil {
+				log.Printf("Gateway config report error (%s): %v", g.hardwareID, err)
+			}
+		case "diagnostics":
+			var diag schemas.GatewayDiagnostics
+			if err := json.Unmarshal(incoming.Data, &diag); err != nil {
+				g.sendMessage("error", fiber.Map{"message": "diagnostics must be an object"})
+				continue
+			}
+			if err := deviceService.RecordGatewayDiagnostics(g.farmID, g.hardwareID, diag); err != nil {
+				log.Printf("Gateway diagnostics error (%s): %v", g.hardwareID, err)
+			}
+		default:
+			// Ignore unknown message types
+		}
+	}
+}
+
+func (g *GatewayClient) handleAck(data json.RawMessage) {
+	var req gatewayStatusMessage
+	if err := json.Unmarshal(data, &req); err != nil {
+		return
+	}
+	commandID, err := uuid.Parse(req.CommandID)
+	if err != nil {
+		g.sendMessage("error", fiber.Map{"message": "invalid command_id"})
+		return
+	}
+	err = deviceService.AcknowledgeCommand(g.farmID, g.hardwareID, commandID, req.IdempotencyKey)
+	switch err {
+	case nil, services.ErrCommandStatusStale:
+	case services.ErrIdempotencyKey:
+		g.sendMessage("error", fiber.Map{"command_id": req.CommandID, "message": "idempotency_key is missing or does not match the command"})
+	default:
+		log.Printf("Gateway ack error (%s): %v", g.hardwareID, err)
+	}
+}
+
+func (g *GatewayClient) handleStatus(data json.RawMessage) {
+	var req gatewayStatusMessage
+	if err := json.Unmarshal(data, &req); err != nil {
+		return
+	}
+	commandID, err := uuid.Parse(req.CommandID)
+	if err != nil {
+		g.sendMessage("error", fiber.Map{"message": "invalid command_id"})
+		return
+	}
+	req.Status = normalizeCommandStatus(req.Status)
+	if !validCommandStatuses[req.Status] {
+		g.sendMessage("error", fiber.Map{"command_id": req.CommandID, "message": "status must be one of: success, failed, timeout"})
+		return
+	}
+
+	applied := true
+	if err := deviceService.UpdateCommandStatus(g.farmID, g.hardwareID, commandID, req.Status, req.Response, req.IdempotencyKey); err != nil {
+		if err == services.ErrIdempotencyKey {
+			g.sendMessage("error", fiber.Map{"command_id": req.CommandID, "message": "idempotency_key is missing or does not match the command"})
+			return
+		}
+		if err != services.ErrCommandStatusStale && err != services.ErrCommandNotFound {
+			log.Printf("Gateway status error (%s): %v", g.hardwareID, err)
+			g.sendMessage("error", fiber.Map{"command_id": req.CommandID, "message": "failed to update command status"})
+			return
+		}
+		applied = false
+	}
+	g.sendMessage("status_ack", fiber.Map{"command_id": req.CommandID, "applied": applied})
+}
+
+func (g *GatewayClient) writePump() {
+	ticker := time.NewTicker(25 * time.Second)
+	defer func() {
+		ticker.Stop()
+		g.close()
+	}()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case msg := <-g.send:
+			_ = g.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := g.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = g.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := g.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (g *GatewayClient) sendMessage(eventType string, data interface{}) {
+	msg := WSMessage{
+		Type:      eventType,
+		FarmID:    g.farmID.String(),
+		Data:      data,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Gateway WS marshal error: %v", err)
+		return
+	}
+	select {
+	case g.send <- payload:
+	case <-g.done:
+	default:
+		// Drop if the gateway is backed up; undelivered commands are retried by the delivery loop
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"middleware/schemas"
+	"middleware/services"
+	"middleware/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ===== COOP INTERLOCK HANDLERS =====
+
+func respondInterlockError(c *fiber.Ctx, err error, fallback string) error {
+	var verr *services.CommandValidationError
+	switch {
+	case err == services.ErrFarmAccessDenied:
+		return utils.Forbidden(c, "Access denied")
+	case err == services.ErrInterlockNotFound:
+		return utils.NotFound(c, "Interlock not found")
+	case err == services.ErrDeviceNotFound:
+		return utils.BadRequest(c, "invalid_device", "Device not found in this coop")
+	case errors.As(err, &verr):
+		return utils.ErrorResponseWithDetails(c, fiber.StatusBadRequest, verr.Code, verr.Message, verr)
+	}
+	log.Printf("%s: %v", fallback, err)
+	return utils.InternalError(c, fallback)
+}
+
+// ListInterlocksHandler returns the safety interlocks of a coop
+// @Summary List Coop Interlocks
+// @Tags Coops, Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id path string true "Coop ID (UUID)"
+// @Success 200 {array} models.CoopInterlock
+// @Router /v1/farms/{farm_id}/coops/{coop_id}/interlocks [get]
+func ListInterlocksHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+
+	interlocks, err := interlockService.ListInterlocks(userID, farmID, coopID)
+	if err != nil {
+		return respondInterlockError(c, err, "Failed to fetch interlocks")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, interlocks, "Interlocks retrieved")
+}
+
+// CreateInterlockHandler adds a safety interlock to a coop
+// @Summary Create Coop Interlock
+// @Description rule_type is mutual_exclusion or requires_running (with other_device_id), or max_runtime or min_off_time (with duration_seconds)
+// @Tags Coops, Devices
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id path string true "Coop ID (UUID)"
+// @Param request body schemas.CreateInterlockRequest true "Interlock rule"
+// @Success 201 {object} models.CoopInterlock
+// @Router /v1/farms/{farm_id}/coops/{coop_id}/interlocks [post]
+func CreateInterlockHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+
+	var req schemas.CreateInterlockRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	interlock, err := interlockService.CreateInterlock(userID, farmID, coopID, req)
+	if err != nil {
+		return respondInterlockError(c, err, "Failed to create interlock")
+	}
+	return utils.SuccessResponse(c, fiber.StatusCreated, interlock, "Interlock created")
+}
+
+// UpdateInterlockHandler changes an interlock
+// @Summary Update Coop Interlock
+// @Tags Coops, Devices
+// @Accept json
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id path string true "Coop ID (UUID)"
+// @Param interlock_id path string true "Interlock ID (UUID)"
+// @Param request body schemas.UpdateInterlockRequest true "Changes"
+// @Success 200 {object} models.CoopInterlock
+// @Router /v1/farms/{farm_id}/coops/{coop_id}/interlocks/{interlock_id} [put]
+func UpdateInterlockHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+	interlockID, err := uuid.Parse(c.Params("interlock_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid interlock ID")
+	}
+
+	var req schemas.UpdateInterlockRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_body", "Invalid request body")
+	}
+
+	interlock, err := interlockService.UpdateInterlock(userID, farmID, coopID, interlockID, req)
+	if err != nil {
+		return respondInterlockError(c, err, "Failed to update interlock")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, interlock, "Interlock updated")
+}
+
+// DeleteInterlockHandler removes an interlock
+// @Summary Delete Coop Interlock
+// @Tags Coops, Devices
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id path string true "Coop ID (UUID)"
+// @Param interlock_id path string true "Interlock ID (UUID)"
+// @Success 200 {object} object
+// @Router /v1/farms/{farm_id}/coops/{coop_id}/interlocks/{interlock_id} [delete]
+func DeleteInterlockHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+	interlockID, err := uuid.Parse(c.Params("interlock_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid interlock ID")
+	}
+
+	if err := interlockService.DeleteInterlock(userID, farmID, coopID, interlockID); err != nil {
+		return respondInterlockError(c, err, "Failed to delete interlock")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Interlock deleted")
+}
+
+// ListInterlockViolationsHandler returns commands recently blocked by interlocks
+// @Summary List Interlock Violations
+// @Tags Coops, Devices
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id path string true "Coop ID (UUID)"
+// @Param limit query int false "Max entries (default 50)"
+// @Success 200 {array} models.InterlockViolation
+// @Router /v1/farms/{farm_id}/coops/{coop_id}/interlocks/violations [get]
+func ListInterlockViolationsHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	violations, err := interlockService.ListViolations(userID, farmID, coopID, limit)
+	if err != nil {
+		return respondInterlockError(c, err, "Failed to fetch interlock violations")
+	}
+	return utils.SuccessResponse(c, fiber.StatusOK, violations, "Interlock violations retrieved")
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"middleware/models"
 	"middleware/schemas"
@@ -95,6 +96,10 @@ func CreateScheduleHandler(c *fiber.Ctx) error {
 		req.IsActive = payload.IsEnabled
 	}
 
+	if req.DeviceID == nil && req.DeviceSelector.IsEmpty() {
+		return utils.BadRequest(c, "validation_error", "device_id, tag or group_id is required")
+	}
+
 	// Infer action if not explicitly provided
 	req.Action = normalizeScheduleAction(&req.Action, req.ActionValue)
 
@@ -102,9 +107,22 @@ func CreateScheduleHandler(c *fiber.Ctx) error {
 	if err == services.ErrFarmAccessDenied {
 		return utils.Forbidden(c, "Access denied")
 	}
-	if err == sql.ErrNoRows {
+	if err == sql.ErrNoRows || err == services.ErrDeviceNotFound {
 		return utils.BadRequest(c, "invalid_device", "Device not found for this farm")
 	}
+	if err == services.ErrDeviceGroupNotFound {
+		return utils.BadRequest(c, "invalid_group", "Device group not found for this farm")
+	}
+	if err == services.ErrInvalidTag {
+		return utils.BadRequest(c, "invalid_tag", "Tags must be 1-50 characters")
+	}
+	if err == services.ErrScheduleTargetConflict {
+		return utils.BadRequest(c, "validation_error", "Use either device_id or tag/group_id, not both")
+	}
+	var verr *services.CommandValidationError
+	if errors.As(err, &verr) {
+		return utils.ErrorResponseWithDetails(c, fiber.StatusBadRequest, verr.Code, verr.Message, verr)
+	}
 	if err != nil {
 		log.Printf("Create schedule error: %v", err)
 		return utils.InternalError(c, "Failed to create schedule")
@@ -182,6 +200,19 @@ func UpdateScheduleHandler(c *fiber.Ctx) error {
 	if err == services.ErrFarmAccessDenied {
 		return utils.Forbidden(c, "Access denied")
 	}
+	if err == sql.ErrNoRows {
+		return utils.NotFound(c, "Schedule not found")
+	}
+	if err == services.ErrDeviceNotFound {
+		return utils.BadRequest(c, "invalid_device", "Schedule device is no longer active")
+	}
+	if err == services.ErrDeviceGroupNotFound {
+		return utils.BadRequest(c, "invalid_group", "Schedule device group no longer exists")
+	}
+	var verr *services.CommandValidationError
+	if errors.As(err, &verr) {
+		return utils.ErrorResponseWithDetails(c, fiber.StatusBadRequest, verr.Code, verr.Message, verr)
+	}
 	if err != nil {
 		log.Printf("Update schedule error: %v", err)
 		return utils.InternalError(c, "Failed to update schedule")
@@ -262,12 +293,18 @@ func ExecuteScheduleNowHandler(c *fiber.Ctx) error {
 		return utils.BadRequest(c, "invalid_id", "Invalid schedule ID")
 	}
 
-	cmd, err := scheduleService.ExecuteScheduleNow(userID, farmID, scheduleID)
-	if err == services.ErrFarmAccessDenied {
-		return utils.Forbidden(c, "Access denied")
+	cmd, results, err := scheduleService.ExecuteScheduleNow(userID, farmID, scheduleID)
+	if err == sql.ErrNoRows {
+		return utils.NotFound(c, "Schedule not found")
+	}
+	if err == services.ErrDeviceGroupNotFound {
+		return utils.NotFound(c, "Schedule device group no longer exists")
 	}
 	if err != nil {
-		return utils.InternalError(c, "Failed to execute schedule")
+		return respondCommandError(c, err, "Failed to execute schedule")
+	}
+	if cmd == nil {
+		return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"results": results}, "Schedule execution queued")
 	}
 
 	return utils.SuccessResponse(c, fiber.StatusOK, cmd, "Schedule execution queued")
@@ -304,6 +341,8 @@ func scheduleToResponse(sc models.Schedule) fiber.Map {
 		"farm_id":         sc.FarmID,
 		"coop_id":         sc.CoopID,
 		"device_id":       sc.DeviceID,
+		"target_tag":      sc.TargetTag,
+		"target_group_id": sc.TargetGroupID,
 		"name":            sc.Name,
 		"schedule_type":   sc.ScheduleType,
 		"cron_expression": sc.CronExpression,
@@ -1,8 +1,15 @@
 package api
 
 import (
+	"errors"
+	"log"
 	"middleware/schemas"
+	"middleware/services"
 	"middleware/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -60,10 +67,184 @@ func PostCoopTelemetryHandler(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return utils.BadRequest(c, "invalid_request", "Invalid request body")
 	}
+	if req.SentAt == nil {
+		req.SentAt = requestDate(c)
+	}
 
-	if err := telemetryService.IngestTelemetry(userID, farmID, coopID, req); err != nil {
+	resp, err := telemetryService.IngestTelemetry(userID, farmID, coopID, req)
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownMetric) {
+			return utils.BadRequest(c, "unknown_metric", err.Error())
+		}
+		if errors.Is(err, services.ErrTelemetryTimestamp) {
+			return utils.BadRequest(c, "invalid_timestamp", err.Error())
+		}
 		return utils.InternalError(c, "Failed to ingest telemetry")
 	}
 
-	return utils.SuccessResponse(c, fiber.StatusOK, nil, "Telemetry ingested")
+	return utils.SuccessResponse(c, fiber.StatusOK, resp, "Telemetry ingested")
+}
+
+// requestDate returns the gateway's clock from the HTTP Date header, used to measure clock skew
+// when the body carries no sent_at
+func requestDate(c *fiber.Ctx) *time.Time {
+	t, err := http.ParseTime(c.Get(fiber.HeaderDate))
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// PostCoopTelemetryBatchHandler ingests an array of timestamped snapshots, e.g. a gateway's
+// backlog after an outage. Each item is accepted or rejected on its own.
+func PostCoopTelemetryBatchHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+
+	var req schemas.TelemetryBatchRequest
+	if err := c.BodyParser(&req); err != nil {
+		return utils.BadRequest(c, "invalid_request", "Invalid request body")
+	}
+	if req.SentAt == nil {
+		req.SentAt = requestDate(c)
+	}
+
+	resp, err := telemetryService.IngestTelemetryBatch(userID, farmID, coopID, req)
+	switch err {
+	case nil:
+	case services.ErrTelemetryBatchSize:
+		return utils.BadRequest(c, "invalid_request", "items must contain 1-"+strconv.Itoa(services.MaxTelemetryBatchItems)+" snapshots")
+	case services.ErrFarmAccessDenied:
+		return utils.Forbidden(c, "Access denied")
+	case services.ErrCoopNotFound:
+		return utils.NotFound(c, "Coop not found")
+	default:
+		log.Printf("Telemetry batch ingest error: %v", err)
+		return utils.InternalError(c, "Failed to ingest telemetry batch")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, resp, "Telemetry batch ingested")
+}
+
+// ListMetricsHandler returns the registered telemetry metrics
+func ListMetricsHandler(c *fiber.Ctx) error {
+	return utils.SuccessResponse(c, fiber.StatusOK, fiber.Map{"metrics": services.ListMetrics()}, "Metrics retrieved")
+}
+
+// MetricTimelineHandler returns today's hourly averages and daily high/low of one metric
+func MetricTimelineHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+
+	resp, err := telemetryService.GetMetricTimeline(userID, farmID, coopID, c.Params("metric"), c.QueryInt("days", 7))
+	switch err {
+	case nil:
+	case services.ErrUnknownMetric:
+		return utils.NotFound(c, "Unknown metric")
+	case services.ErrFarmAccessDenied:
+		return utils.Forbidden(c, "Access denied")
+	case services.ErrCoopNotFound:
+		return utils.NotFound(c, "Coop not found")
+	default:
+		log.Printf("Metric timeline error: %v", err)
+		return utils.InternalError(c, "Failed to fetch metric timeline")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, resp, "Metric timeline retrieved")
+}
+
+// MetricSeriesHandler returns a bucketed series of one metric for a coop, optionally compared
+// with other coops of the farm (?compare=<coop_id>,<coop_id>)
+// @Summary Get Metric Series
+// @Description Returns one metric of a coop in time buckets aligned to the farm's local midnight, read from raw readings, hourly or daily rollups depending on the range
+// @Tags Telemetry
+// @Produce json
+// @Param farm_id path string true "Farm ID (UUID)"
+// @Param coop_id path string true "Coop ID (UUID)"
+// @Param metric path string true "Metric name (e.g. temperature)"
+// @Param from query string false "Start (RFC 3339 or YYYY-MM-DD, default 24h ago)"
+// @Param to query string false "End (RFC 3339 or YYYY-MM-DD, default now)"
+// @Param bucket query string false "Bucket size (1m, 5m, 15m, 30m, 1h, 3h, 6h, 12h, 1d, 7d); picked from the range when omitted"
+// @Param agg query string false "Aggregation (avg, min, max, sum, count, last)" default(avg)
+// @Param compare query string false "Comma-separated coop IDs of the same farm to compare (max 10 coops)"
+// @Param include_suspect query bool false "Include suspect readings from the raw tier"
+// @Success 200 {object} schemas.MetricSeriesResponse
+// @Router /v1/farms/{farm_id}/coops/{coop_id}/metrics/{metric}/series [get]
+func MetricSeriesHandler(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromContext(c)
+	if err != nil {
+		return utils.Unauthorized(c, "Invalid session")
+	}
+	farmID, err := uuid.Parse(c.Params("farm_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid farm ID")
+	}
+	coopID, err := uuid.Parse(c.Params("coop_id"))
+	if err != nil {
+		return utils.BadRequest(c, "invalid_id", "Invalid coop ID")
+	}
+
+	q := schemas.MetricSeriesQuery{
+		From:   c.Query("from"),
+		To:     c.Query("to"),
+		Bucket: c.Query("bucket"),
+		Agg:    c.Query("agg"),
+
+		IncludeSuspect: c.QueryBool("include_suspect"),
+	}
+	if raw := c.Query("compare"); raw != "" {
+		for _, part := range strings.Split(raw, ",") {
+			id, err := uuid.Parse(strings.TrimSpace(part))
+			if err != nil {
+				return utils.BadRequest(c, "invalid_id", "compare must be a comma-separated list of coop IDs")
+			}
+			q.CoopIDs = append(q.CoopIDs, id)
+		}
+	}
+
+	resp, err := telemetryService.GetMetricSeries(userID, farmID, coopID, c.Params("metric"), q)
+	switch err {
+	case nil:
+	case services.ErrUnknownMetric:
+		return utils.NotFound(c, "Unknown metric")
+	case services.ErrSeriesRange:
+		return utils.BadRequest(c, "invalid_range", "from/to must be RFC 3339 times or YYYY-MM-DD, from before to, at most 1000 buckets")
+	case services.ErrSeriesBucket:
+		return utils.BadRequest(c, "invalid_bucket", "bucket must be one of 1m, 5m, 15m, 30m, 1h, 3h, 6h, 12h, 1d, 7d")
+	case services.ErrSeriesBucketTooFine:
+		return utils.BadRequest(c, "bucket_too_fine", "Ranges older than raw retention need a bucket of at least 1h, older than hourly retention at least 1d")
+	case services.ErrSeriesAgg:
+		return utils.BadRequest(c, "invalid_agg", "agg must be one of avg, min, max, sum, count, last")
+	case services.ErrSeriesTooManyCoops:
+		return utils.BadRequest(c, "too_many_coops", "At most 10 coops can be compared")
+	case services.ErrFarmAccessDenied:
+		return utils.Forbidden(c, "Access denied")
+	case services.ErrCoopNotFound:
+		return utils.NotFound(c, "Coop not found")
+	default:
+		log.Printf("Metric series error: %v", err)
+		return utils.InternalError(c, "Failed to fetch metric series")
+	}
+
+	return utils.SuccessResponse(c, fiber.StatusOK, resp, "Metric series retrieved")
 }
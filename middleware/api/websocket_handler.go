@@ -3,8 +3,10 @@ package api
 import (
 	"encoding/json"
 	"log"
+	"strconv"
 	"time"
 
+	"middleware/services"
 	"middleware/utils"
 
 	"github.com/gofiber/fiber/v2"
@@ -22,12 +24,19 @@ type WSClient struct {
 	farmID uuid.UUID
 	role   string
 	send   chan []byte
+	// done is closed once the hub drops the client
+	done chan struct{}
+	// topics maps each subscribed topic to its farm; owned by the hub loop
+	topics map[string]uuid.UUID
 }
 
 type WSIncoming struct {
-	Type   string          `json:"type"`
-	FarmID string          `json:"farm_id,omitempty"`
-	Data   json.RawMessage `json:"data,omitempty"`
+	Type        string          `json:"type"`
+	FarmID      string          `json:"farm_id,omitempty"`
+	Topic       string          `json:"topic,omitempty"`
+	Topics      []string        `json:"topics,omitempty"`
+	LastEventID *int64          `json:"last_event_id,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
 }
 
 // WebSocketUpgradeMiddleware ensures the request is a websocket upgrade.
@@ -55,7 +64,9 @@ func WebSocketHandler(c *websocket.Conn) {
 		userID: userID,
 		farmID: farmID,
 		role:   role,
-		send:   make(chan []byte, 32),
+		send:   make(chan []byte, wsSendBuffer),
+		done:   make(chan struct{}),
+		topics: make(map[string]uuid.UUID),
 	}
 
 	WSHub.register <- client
@@ -80,13 +91,21 @@ func (c *WSClient) readPump() {
 	// Send welcome packet (direct)
 	c.sendMessage("welcome", fiber.Map{
 		"user_id": c.userID,
-		"role":    c.role,
-		"farm_id": c.farmID,
+		"role":          c.role,
+		"farm_id":       c.farmID,
+		"last_event_id": WSHub.LastEventID(),
 	})
 
+	// Reconnecting clients pass the last event they saw to get what they missed
+	if raw := c.conn.Query("last_event_id"); raw != "" {
+		if lastEventID, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			WSHub.Resume(c, lastEventID)
+		}
+	}
+
 	for {
 		_, msg, err := c.conn.ReadMessage()
-		if err != nil {
+		if err != nil || c.closed() {
 			return
 		}
 
@@ -101,22 +120,94 @@ func (c *WSClient) readPump() {
 				"ts": time.Now().UTC().Format(time.RFC3339),
 			})
 		case "subscribe":
-			// Security: only allow subscribing to the farm bound in JWT
-			if incoming.FarmID != "" && incoming.FarmID != c.farmID.String() {
-			c.sendMessage("error", fiber.Map{
-				"message": "farm subscription not allowed",
-			})
+			topics := incoming.topics()
+			if len(topics) == 0 {
+				if incoming.FarmID == "" {
+					// Legacy: confirm the farm bound in the JWT
+					c.sendMessage("subscribed", fiber.Map{
+						"farm_id": c.farmID.String(),
+					})
+					continue
+				}
+				topics = []string{"farm:" + incoming.FarmID}
+			}
+			c.subscribe(topics)
+		case "unsubscribe":
+			c.unsubscribe(incoming.topics())
+		case "resume":
+			if incoming.LastEventID == nil {
+				c.sendMessage("error", fiber.Map{
+					"message": "last_event_id required",
+				})
 				continue
 			}
-			c.sendMessage("subscribed", fiber.Map{
-				"farm_id": c.farmID.String(),
-			})
+			WSHub.Resume(c, *incoming.LastEventID)
 		default:
 			// Ignore unknown message types
 		}
 	}
 }
 
+// topics returns the topics named by a subscribe or unsubscribe message
+func (m WSIncoming) topics() []string {
+	topics := m.Topics
+	if m.Topic != "" {
+		topics = append(topics, m.Topic)
+	}
+	return topics
+}
+
+// subscribe adds topics the user may see: the topic's farm (or the farm of its coop or device)
+// must be one the user is a member of
+func (c *WSClient) subscribe(topics []string) {
+	accepted := make([]string, 0, len(topics))
+	rejected := make([]fiber.Map, 0)
+	for _, raw := range topics {
+		scope, id, topic, ok := parseWSTopic(raw)
+		if !ok {
+			rejected = append(rejected, fiber.Map{"topic": raw, "reason": "invalid_topic"})
+			continue
+		}
+		farmID, err := farmService.TopicFarm(scope, id)
+		if err == nil {
+			err = farmService.CheckAccess(c.userID, farmID, "viewer")
+		}
+		switch {
+		case err == services.ErrFarmNotFound || err == services.ErrCoopNotFound || err == services.ErrDeviceNotFound:
+			rejected = append(rejected, fiber.Map{"topic": raw, "reason": "not_found"})
+		case err == services.ErrFarmAccessDenied:
+			rejected = append(rejected, fiber.Map{"topic": raw, "reason": "access_denied"})
+		case err != nil:
+			log.Printf("WS subscribe error (%s): %v", raw, err)
+			rejected = append(rejected, fiber.Map{"topic": raw, "reason": "internal_error"})
+		case !WSHub.subscribe(c, topic, farmID, true):
+			if c.closed() {
+				// Dropped by the hub (slow consumer); the connection is closing
+				return
+			}
+			rejected = append(rejected, fiber.Map{"topic": raw, "reason": "too_many_topics"})
+		default:
+			accepted = append(accepted, topic)
+		}
+	}
+	c.sendMessage("subscribed", fiber.Map{
+		"topics":   accepted,
+		"rejected": rejected,
+	})
+}
+
+func (c *WSClient) unsubscribe(topics []string) {
+	removed := make([]string, 0, len(topics))
+	for _, raw := range topics {
+		if _, _, topic, ok := parseWSTopic(raw); ok && WSHub.subscribe(c, topic, uuid.Nil, false) {
+			removed = append(removed, topic)
+		}
+	}
+	c.sendMessage("unsubscribed", fiber.Map{
+		"topics": removed,
+	})
+}
+
 func (c *WSClient) writePump() {
 	ticker := time.NewTicker(25 * time.Second)
 	defer func() {
@@ -126,12 +217,12 @@ func (c *WSClient) writePump() {
 
 	for {
 		select {
-		case msg, ok := <-c.send:
+		case <-c.done:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case msg := <-c.send:
 			_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
 				return
 			}
@@ -158,11 +249,22 @@ func (c *WSClient) sendMessage(eventType string, data interface{}) {
 	}
 	select {
 	case c.send <- payload:
+	case <-c.done:
 	default:
 		// Drop if the client is backed up
 	}
 }
 
+// closed reports whether the hub has dropped the client
+func (c *WSClient) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // GetWebSocketStatsHandler returns hub metrics
 // @Summary WebSocket Stats
 // @Description Returns internal hub status and client count
@@ -3,6 +3,10 @@ package api
 import (
 	"encoding/json"
 	"log"
+	"middleware/config"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,34 +17,113 @@ import (
 
 type wsBroadcast struct {
 	farmID uuid.UUID
+	topics []string
+	msg    WSMessage
+}
+
+// wsSubscription adds or removes a client's topic; ok reports whether it was applied
+type wsSubscription struct {
+	client *WSClient
+	topic  string
+	farmID uuid.UUID
+	add    bool
+	ok     chan bool
+}
+
+// wsReplay asks the hub to resend the events a client missed after lastEventID
+type wsReplay struct {
+	client      *WSClient
+	lastEventID int64
+}
+
+// wsEvent is a published event kept for replay
+type wsEvent struct {
+	id     int64
+	topics []string
 	data   []byte
 }
 
+// farmHistory is the bounded replay buffer of one farm, oldest first
+type farmHistory struct {
+	events []wsEvent
+	// evictedUpTo is the newest event ID dropped from the buffer
+	evictedUpTo int64
+	// telemetry holds only the latest telemetry event per coop. Each one supersedes the last, so
+	// they are kept apart and never push alerts or command events out of the buffer.
+	telemetry map[string]wsEvent
+}
+
+const (
+	// maxWSTopics bounds the topics one client can subscribe to
+	maxWSTopics = 50
+	// wsSendBuffer is the queue of outgoing messages per client; a replay never fills more
+	// than wsSendBuffer-wsSendHeadroom of it
+	wsSendBuffer   = 256
+	wsSendHeadroom = 16
+)
+
+// wsEventKinds maps event types to the topic suffix clients subscribe to, e.g.
+// coop:<id>:telemetry or farm:<id>:alerts. Every event also matches its bare scope topics.
+var wsEventKinds = map[string]string{
+	"telemetry":      "telemetry",
+	"alert":          "alerts",
+	"device_state":   "state",
+	"command_status": "commands",
+	"device_config":  "config",
+}
+
 type WSMessage struct {
+	// ID increases with every hub event; direct replies to a client carry none
+	ID        int64       `json:"id,omitempty"`
 	Type      string      `json:"type"`
 	FarmID    string      `json:"farm_id,omitempty"`
+	CoopID    string      `json:"coop_id,omitempty"`
+	DeviceID  string      `json:"device_id,omitempty"`
 	Data      interface{} `json:"data,omitempty"`
 	Timestamp string      `json:"timestamp"`
 }
 
 type Hub struct {
-	register   chan *WSClient
-	unregister chan *WSClient
-	broadcast  chan wsBroadcast
+	register      chan *WSClient
+	unregister    chan *WSClient
+	broadcast     chan wsBroadcast
+	subscriptions chan wsSubscription
+	replays       chan wsReplay
 
-	clients     map[*WSClient]struct{}
-	farmClients map[uuid.UUID]map[*WSClient]struct{}
+	clients      map[*WSClient]struct{}
+	topicClients map[string]map[*WSClient]struct{}
+	// Counters for Stats, which runs on request goroutines and must not read the maps above
 	clientCount atomic.Int64
+	topicCount  atomic.Int64
+	farmCount   atomic.Int64
+
+	// Event IDs start at the hub's start time in microseconds, so they keep increasing across
+	// restarts; IDs before firstEventID can no longer be replayed
+	firstEventID int64
+	lastEventID  atomic.Int64
+	history      map[uuid.UUID]*farmHistory
+
+	// Gateway section: one live connection per gateway hardware ID.
+	// Looked up from request goroutines, so it is guarded by a mutex rather than the hub loop.
+	gatewayMu sync.RWMutex
+	gateways  map[string]*GatewayClient
 }
 
 func NewHub() *Hub {
-	return &Hub{
-		register:    make(chan *WSClient),
-		unregister:  make(chan *WSClient),
-		broadcast:   make(chan wsBroadcast, 256),
-		clients:     make(map[*WSClient]struct{}),
-		farmClients: make(map[uuid.UUID]map[*WSClient]struct{}),
+	h := &Hub{
+		register:      make(chan *WSClient),
+		unregister:    make(chan *WSClient),
+		broadcast:     make(chan wsBroadcast, 256),
+		subscriptions: make(chan wsSubscription),
+		replays:       make(chan wsReplay),
+		clients:       make(map[*WSClient]struct{}),
+		topicClients:  make(map[string]map[*WSClient]struct{}),
+		firstEventID:  time.Now().UnixMicro(),
+		history:       make(map[uuid.UUID]*farmHistory),
+		gateways:      make(map[string]*GatewayClient),
 	}
+	h.lastEventID.Store(h.firstEventID - 1)
+	return h
 }
 
 func (h *Hub) RunHub() {
@@ -48,54 +131,316 @@ func (h *Hub) RunHub() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = struct{}{}
+			// Clients start out subscribed to every event of the farm bound in their JWT
 			if client.farmID != uuid.Nil {
-				if h.farmClients[client.farmID] == nil {
-					h.farmClients[client.farmID] = make(map[*WSClient]struct{})
-				}
-				h.farmClients[client.farmID][client] = struct{}{}
+				h.addTopic(client, farmTopic(client.farmID), client.farmID)
 			}
 			h.clientCount.Add(1)
 
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				if client.farmID != uuid.Nil {
-					if farmSet, ok := h.farmClients[client.farmID]; ok {
-						delete(farmSet, client)
-						if len(farmSet) == 0 {
-							delete(h.farmClients, client.farmID)
-						}
-					}
-				}
-				h.clientCount.Add(-1)
-				close(client.send)
+				h.dropClient(client)
+			}
+
+		case sub := <-h.subscriptions:
+			_, connected := h.clients[sub.client]
+			switch {
+			case !connected:
+				sub.ok <- false
+			case !sub.add:
+				h.removeTopic(sub.client, sub.topic)
+				sub.ok <- true
+			case len(sub.client.topics) >= maxWSTopics:
+				sub.ok <- false
+			default:
+				h.addTopic(sub.client, sub.topic, sub.farmID)
+				sub.ok <- true
+			}
+
+		case r := <-h.replays:
+			if _, ok := h.clients[r.client]; ok {
+				h.replay(r.client, r.lastEventID)
 			}
 
 		case msg := <-h.broadcast:
-			targets := h.farmClients[msg.farmID]
-			for client := range targets {
-				select {
-				case client.send <- msg.data:
-				default:
-					// Slow consumer; drop connection to protect hub
-					close(client.send)
-					delete(targets, client)
-					delete(h.clients, client)
-					h.clientCount.Add(-1)
+			ev, ok := h.record(msg)
+			if !ok {
+				continue
+			}
+			// A client matching several topics of the event gets it once
+			sent := make(map[*WSClient]struct{})
+			for _, topic := range ev.topics {
+				for client := range h.topicClients[topic] {
+					if _, done := sent[client]; done {
+						continue
+					}
+					sent[client] = struct{}{}
+					h.deliver(client, ev.data)
 				}
 			}
 		}
 	}
 }
 
+// record gives an event the next ID and keeps it in its farm's replay buffer
+func (h *Hub) record(b wsBroadcast) (wsEvent, bool) {
+	id := h.lastEventID.Load() + 1
+	b.msg.ID = id
+	payload, err := json.Marshal(b.msg)
+	if err != nil {
+		log.Printf("WS publish marshal error: %v", err)
+		return wsEvent{}, false
+	}
+	h.lastEventID.Store(id)
+
+	ev := wsEvent{id: id, topics: b.topics, data: payload}
+	hist := h.history[b.farmID]
+	if hist == nil {
+		hist = &farmHistory{telemetry: make(map[string]wsEvent)}
+		h.history[b.farmID] = hist
+	}
+	if b.msg.Type == "telemetry" {
+		hist.telemetry[b.msg.CoopID] = ev
+		return ev, true
+	}
+	hist.events = append(hist.events, ev)
+	if size := config.AppConfig.WSReplayBufferSize; len(hist.events) > size {
+		drop := len(hist.events) - size
+		hist.evictedUpTo = hist.events[drop-1].id
+		hist.events = append([]wsEvent(nil), hist.events[drop:]...)
+	}
+	return ev, true
+}
+
+// replay resends the buffered events after lastEventID that match the client's topics, in ID
+// order, followed by replay_complete. When some of them are no longer buffered (or too many
+// to send at once) the client gets resync_required instead and should reload its state.
+// The latest telemetry of each coop is added when newer than lastEventID and there is room.
+func (h *Hub) replay(client *WSClient, lastEventID int64) {
+	latest := h.lastEventID.Load()
+	resync := lastEventID < h.firstEventID-1 || lastEventID > latest
+
+	missed := make([]wsEvent, 0)
+	telemetry := make([]wsEvent, 0)
+	farms := make(map[uuid.UUID]struct{})
+	for _, farmID := range client.topics {
+		farms[farmID] = struct{}{}
+	}
+	for farmID := range farms {
+		hist := h.history[farmID]
+		if resync || hist == nil {
+			continue
+		}
+		if hist.evictedUpTo > lastEventID {
+			resync = true
+			break
+		}
+		for _, ev := range hist.events {
+			if ev.id > lastEventID && client.matches(ev.topics) {
+				missed = append(missed, ev)
+			}
+		}
+		for _, ev := range hist.telemetry {
+			if ev.id > lastEventID && client.matches(ev.topics) {
+				telemetry = append(telemetry, ev)
+			}
+		}
+	}
+	limit := config.AppConfig.WSReplayMaxEvents
+	if limit > wsSendBuffer-wsSendHeadroom {
+		limit = wsSendBuffer - wsSendHeadroom
+	}
+	if len(missed) > limit {
+		resync = true
+	}
+
+	if resync {
+		h.deliver(client, controlMessage("resync_required", map[string]interface{}{
+			"last_event_id":   lastEventID,
+			"latest_event_id": latest,
+		}))
+		return
+	}
+	if room := limit - len(missed); len(telemetry) > room {
+		sort.Slice(telemetry, func(i, j int) bool { return telemetry[i].id > telemetry[j].id })
+		telemetry = telemetry[:room]
+	}
+	missed = append(missed, telemetry...)
+	sort.Slice(missed, func(i, j int) bool { return missed[i].id < missed[j].id })
+	for _, ev := range missed {
+		if !h.deliver(client, ev.data) {
+			return
+		}
+	}
+	h.deliver(client, controlMessage("replay_complete", map[string]interface{}{
+		"last_event_id":   lastEventID,
+		"replayed":        len(missed),
+		"latest_event_id": latest,
+	}))
+}
+
+// deliver queues a message for a client; false when the client was dropped as a slow consumer
+func (h *Hub) deliver(client *WSClient, data []byte) bool {
+	if data == nil {
+		return true
+	}
+	select {
+	case client.send <- data:
+		return true
+	default:
+		// Slow consumer; drop connection to protect hub
+		h.dropClient(client)
+		return false
+	}
+}
+
+// controlMessage builds a hub message that is not an event and carries no ID
+func controlMessage(msgType string, data interface{}) []byte {
+	payload, err := json.Marshal(WSMessage{
+		Type:      msgType,
+		Data:      data,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("WS control marshal error: %v", err)
+		return nil
+	}
+	return payload
+}
+
+// matches reports whether the client holds one of an event's topics; hub loop only
+func (c *WSClient) matches(topics []string) bool {
+	for _, topic := range topics {
+		if _, ok := c.topics[topic]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) addTopic(client *WSClient, topic string, farmID uuid.UUID) {
+	if h.topicClients[topic] == nil {
+		h.topicClients[topic] = make(map[*WSClient]struct{})
+		h.countTopic(topic, 1)
+	}
+	h.topicClients[topic][client] = struct{}{}
+	client.topics[topic] = farmID
+}
+
+func (h *Hub) removeTopic(client *WSClient, topic string) {
+	delete(client.topics, topic)
+	if set, ok := h.topicClients[topic]; ok {
+		delete(set, client)
+		if len(set) == 0 {
+			delete(h.topicClients, topic)
+			h.countTopic(topic, -1)
+		}
+	}
+}
+
+// countTopic keeps the active topic and farm counters in step with topicClients; a bare
+// farm:<id> topic counts as an active farm
+func (h *Hub) countTopic(topic string, delta int64) {
+	h.topicCount.Add(delta)
+	if strings.HasPrefix(topic, "farm:") && strings.Count(topic, ":") == 1 {
+		h.farmCount.Add(delta)
+	}
+}
+
+// dropClient forgets a client and closes its done channel, which ends its writePump and with it
+// the connection. send is never closed, so late direct replies cannot panic. Hub loop only.
+func (h *Hub) dropClient(client *WSClient) {
+	for topic := range client.topics {
+		h.removeTopic(client, topic)
+	}
+	delete(h.clients, client)
+	h.clientCount.Add(-1)
+	close(client.done)
+}
+
+// subscribe adds (or removes) a topic of farmID for a client; false when the client is gone
+// (see WSClient.closed) or already holds maxWSTopics topics
+func (h *Hub) subscribe(client *WSClient, topic string, farmID uuid.UUID, add bool) bool {
+	ok := make(chan bool, 1)
+	h.subscriptions <- wsSubscription{client: client, topic: topic, farmID: farmID, add: add, ok: ok}
+	return <-ok
+}
+
+// Resume replays the events a client missed since lastEventID
+func (h *Hub) Resume(client *WSClient, lastEventID int64) {
+	h.replays <- wsReplay{client: client, lastEventID: lastEventID}
+}
+
+// LastEventID returns the ID of the newest hub event
+func (h *Hub) LastEventID() int64 {
+	return h.lastEventID.Load()
+}
+
 func (h *Hub) Stats() map[string]interface{} {
+	h.gatewayMu.RLock()
+	gateways := len(h.gateways)
+	h.gatewayMu.RUnlock()
 	return map[string]interface{}{
-		"total_clients": h.clientCount.Load(),
-		"farms_active":  len(h.farmClients),
+		"total_clients":      h.clientCount.Load(),
+		"farms_active":       h.farmCount.Load(),
+		"topics_active":      h.topicCount.Load(),
+		"gateways_connected": gateways,
+	}
+}
+
+// registerGateway makes gw the live connection for its hardware ID, replacing an older one
+func (h *Hub) registerGateway(gw *GatewayClient) {
+	h.gatewayMu.Lock()
+	previous := h.gateways[gw.hardwareID]
+	h.gateways[gw.hardwareID] = gw
+	h.gatewayMu.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+}
+
+func (h *Hub) unregisterGateway(gw *GatewayClient) {
+	h.gatewayMu.Lock()
+	if h.gateways[gw.hardwareID] == gw {
+		delete(h.gateways, gw.hardwareID)
+	}
+	h.gatewayMu.Unlock()
+}
+
+// IsGatewayConnected reports whether a gateway holds a live WebSocket
+func (h *Hub) IsGatewayConnected(hardwareID string) bool {
+	h.gatewayMu.RLock()
+	defer h.gatewayMu.RUnlock()
+	_, ok := h.gateways[hardwareID]
+	return ok
+}
+
+// NotifyGateway wakes the gateway connection so it pushes due commands immediately.
+// Gateways without a socket keep receiving commands through polling.
+func (h *Hub) NotifyGateway(hardwareID string) {
+	h.gatewayMu.RLock()
+	gw := h.gateways[hardwareID]
+	h.gatewayMu.RUnlock()
+	if gw != nil {
+		gw.wakeUp()
 	}
 }
 
 func (h *Hub) PublishFarmEvent(farmID uuid.UUID, eventType string, data interface{}) {
+	h.publish(farmID, uuid.Nil, uuid.Nil, eventType, data)
+}
+
+// PublishCoopEvent broadcasts an event scoped to one coop of the farm
+func (h *Hub) PublishCoopEvent(farmID, coopID uuid.UUID, eventType string, data interface{}) {
+	h.publish(farmID, coopID, uuid.Nil, eventType, data)
+}
+
+// PublishDeviceEvent broadcasts an event scoped to one device of the farm
+func (h *Hub) PublishDeviceEvent(farmID, deviceID uuid.UUID, eventType string, data interface{}) {
+	h.publish(farmID, uuid.Nil, deviceID, eventType, data)
+}
+
+func (h *Hub) publish(farmID, coopID, deviceID uuid.UUID, eventType string, data interface{}) {
 	if farmID == uuid.Nil {
 		return
 	}
@@ -105,11 +450,59 @@ func (h *Hub) PublishFarmEvent(farmID uuid.UUID, eventType string, data interfac
 		Data:      data,
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
 	}
-	payload, err := json.Marshal(msg)
+	kind := wsEventKinds[eventType]
+	topics := scopeTopics("farm", farmID, kind)
+	if coopID != uuid.Nil {
+		msg.CoopID = coopID.String()
+		topics = append(topics, scopeTopics("coop", coopID, kind)...)
+	}
+	if deviceID != uuid.Nil {
+		msg.DeviceID = deviceID.String()
+		topics = append(topics, scopeTopics("device", deviceID, kind)...)
+	}
+	h.broadcast <- wsBroadcast{farmID: farmID, topics: topics, msg: msg}
+}
+
+// scopeTopics returns the topics an event of the given kind matches within one scope
+func scopeTopics(scope string, id uuid.UUID, kind string) []string {
+	topic := scope + ":" + id.String()
+	if kind == "" {
+		return []string{topic}
+	}
+	return []string{topic, topic + ":" + kind}
+}
+
+func farmTopic(farmID uuid.UUID) string {
+	return "farm:" + farmID.String()
+}
+
+// parseWSTopic validates a topic of the form <farm|coop|device>:<id>[:<kind>] and returns its
+// scope, ID and canonical spelling
+func parseWSTopic(topic string) (string, uuid.UUID, string, bool) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(topic)), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", uuid.Nil, "", false
+	}
+	switch parts[0] {
+	case "farm", "coop", "device":
+	default:
+		return "", uuid.Nil, "", false
+	}
+	id, err := uuid.Parse(parts[1])
 	if err != nil {
-		log.Printf("WS publish marshal error: %v", err)
-		return
+		return "", uuid.Nil, "", false
+	}
+	canonical := parts[0] + ":" + id.String()
+	if len(parts) == 3 {
+		known := false
+		for _, kind := range wsEventKinds {
+			known = known || kind == parts[2]
+		}
+		if !known {
+			return "", uuid.Nil, "", false
+		}
+		canonical += ":" + parts[2]
 	}
-	h.broadcast <- wsBroadcast{farmID: farmID, data: payload}
+	return parts[0], id, canonical, true
 }
 
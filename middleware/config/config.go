@@ -38,8 +38,39 @@ type Config struct {
 	// Environment
 	Environment string
 
-	// Telemetry retention
-	TelemetryRetentionDays int
+	// Telemetry retention (raw readings, hourly rollups; daily rollups are kept forever)
+	TelemetryRetentionDays       int
+	TelemetryHourlyRetentionDays int
+
+	// Telemetry timestamp sanity and gateway clock skew
+	TelemetryMaxFutureSeconds  int
+	TelemetryTimestampPolicy   string
+	GatewayClockSkewMaxSeconds int
+
+	// Realtime telemetry events
+	TelemetryEventIntervalMs int
+
+	// WebSocket event replay
+	WSReplayBufferSize int
+	WSReplayMaxEvents  int
+
+	// Gateway command delivery
+	CommandMaxAttempts      int
+	CommandRetryBaseSeconds int
+	CommandRetryMaxSeconds  int
+
+	// Gateway diagnostics alert thresholds
+	GatewayDiskFreeMinPct int
+	GatewayCPUTempMaxC    int
+
+	// Gateway maintenance log uploads
+	GatewayLogRetentionDays int
+	GatewayLogMaxLines      int
+
+	// Firmware artifacts (OTA)
+	FirmwareStorageDir string
+	// OTA campaigns halt when the failure rate reaches this percentage (unless set per campaign)
+	OTAFailureThresholdPct int
 
 	// Web Push (VAPID)
 	VapidPublicKey  string
@@ -89,7 +120,38 @@ func LoadConfig() *Config {
 		Environment: getEnv("ENVIRONMENT", "development"),
 
 		// Telemetry retention (days)
-		TelemetryRetentionDays: getEnvInt("TELEMETRY_RETENTION_DAYS", 7),
+		TelemetryRetentionDays:       getEnvInt("TELEMETRY_RETENTION_DAYS", 7),
+		TelemetryHourlyRetentionDays: getEnvInt("TELEMETRY_HOURLY_RETENTION_DAYS", 90),
+
+		// Readings dated further ahead than this (after skew correction) or older than raw
+		// retention are corrected ("correct") or rejected ("reject"); skew above the max alerts
+		TelemetryMaxFutureSeconds:  getEnvInt("TELEMETRY_MAX_FUTURE_SECONDS", 300),
+		TelemetryTimestampPolicy:   getEnv("TELEMETRY_TIMESTAMP_POLICY", "correct"),
+		GatewayClockSkewMaxSeconds: getEnvInt("GATEWAY_CLOCK_SKEW_MAX_SECONDS", 120),
+
+		// At most one WebSocket telemetry event per coop per interval; readings in between are merged
+		TelemetryEventIntervalMs: getEnvInt("TELEMETRY_EVENT_INTERVAL_MS", 2000),
+
+		// Hub events kept per farm for reconnecting clients, and the most replayed at once
+		WSReplayBufferSize: getEnvInt("WS_REPLAY_BUFFER_SIZE", 500),
+		WSReplayMaxEvents:  getEnvInt("WS_REPLAY_MAX_EVENTS", 200),
+
+		// Gateway command delivery (re-delivery with exponential backoff)
+		CommandMaxAttempts:      getEnvInt("COMMAND_MAX_ATTEMPTS", 5),
+		CommandRetryBaseSeconds: getEnvInt("COMMAND_RETRY_BASE_SECONDS", 15),
+		CommandRetryMaxSeconds:  getEnvInt("COMMAND_RETRY_MAX_SECONDS", 300),
+
+		// Gateway heartbeat diagnostics: alert below this free disk % / above this CPU temperature
+		GatewayDiskFreeMinPct: getEnvInt("GATEWAY_DISK_FREE_MIN_PCT", 10),
+		GatewayCPUTempMaxC:    getEnvInt("GATEWAY_CPU_TEMP_MAX_C", 80),
+
+		// Gateway log uploads (maintenance command upload_logs)
+		GatewayLogRetentionDays: getEnvInt("GATEWAY_LOG_RETENTION_DAYS", 14),
+		GatewayLogMaxLines:      getEnvInt("GATEWAY_LOG_MAX_LINES", 5000),
+
+		// Firmware registry on local disk + OTA rollout safety
+		FirmwareStorageDir:     getEnv("FIRMWARE_STORAGE_DIR", "./data/firmware"),
+		OTAFailureThresholdPct: getEnvInt("OTA_FAILURE_THRESHOLD_PCT", 20),
 
 		// Web Push Configuration
 		VapidPublicKey:  getEnv("VAPID_PUBLIC_KEY", ""),
@@ -68,6 +68,30 @@ func CreateSchema() error {
 		`UPDATE farm_users SET role = 'farmer' WHERE role IN ('owner', 'manager')`,
 		// Add missing created_at to unassigned_gateways
 		`ALTER TABLE unassigned_gateways ADD COLUMN IF NOT EXISTS created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP`,
+		// Command delivery tracking (retry with backoff + idempotency keys)
+		`ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(64)`,
+		`ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS attempt_count INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMP`,
+		`ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS last_polled_at TIMESTAMP`,
+		`ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP`,
+		`ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP`,
+		`ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_command_at TIMESTAMP`,
+		`CREATE INDEX IF NOT EXISTS idx_device_commands_delivery ON device_commands(status, next_attempt_at)`,
+		// Emergency stop cancels pending commands
+		`ALTER TABLE device_commands DROP CONSTRAINT IF EXISTS device_commands_status_check`,
+		`ALTER TABLE device_commands ADD CONSTRAINT device_commands_status_check CHECK (status IN ('pending', 'success', 'failed', 'timeout', 'cancelled'))`,
+		`ALTER TABLE device_readings ADD COLUMN IF NOT EXISTS raw_value DECIMAL(10,4)`,
+		// Insert time drives the hourly/daily rollups (backfilled readings are rolled up too)
+		`ALTER TABLE device_readings ADD COLUMN IF NOT EXISTS created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP`,
+		`CREATE INDEX IF NOT EXISTS idx_device_readings_created_at ON device_readings(created_at)`,
+		// Plausibility/rate/spike checks flag readings suspect or bad
+		`ALTER TABLE device_readings ADD COLUMN IF NOT EXISTS quality_reason VARCHAR(30)`,
+		// Tag/group selectors for schedules and emergency stops
+		`ALTER TABLE schedules ALTER COLUMN device_id DROP NOT NULL`,
+		`ALTER TABLE schedules ADD COLUMN IF NOT EXISTS target_tag VARCHAR(50)`,
+		`ALTER TABLE schedules ADD COLUMN IF NOT EXISTS target_group_id UUID REFERENCES device_groups(id) ON DELETE SET NULL`,
+		`ALTER TABLE emergency_stops ADD COLUMN IF NOT EXISTS selector TEXT`,
+		`ALTER TABLE emergency_stops ADD COLUMN IF NOT EXISTS device_ids UUID[]`,
 	}
 	for _, m := range migrations {
 		if _, merr := DB.Exec(m); merr != nil {
@@ -86,8 +110,25 @@ func DropAllTables() error {
 	}
 
 	dropSQL := `
+		DROP TABLE IF EXISTS ota_campaign_devices    CASCADE;
+		DROP TABLE IF EXISTS ota_campaigns           CASCADE;
+		DROP TABLE IF EXISTS firmware_artifacts      CASCADE;
+		DROP TABLE IF EXISTS reading_rollups_daily   CASCADE;
+		DROP TABLE IF EXISTS reading_rollups_hourly  CASCADE;
 		DROP TABLE IF EXISTS device_readings         CASCADE;
+		DROP TABLE IF EXISTS device_heartbeat_hours  CASCADE;
+		DROP TABLE IF EXISTS gateway_diagnostics     CASCADE;
+		DROP TABLE IF EXISTS gateway_log_uploads     CASCADE;
+		DROP TABLE IF EXISTS gateway_clock_skew      CASCADE;
+		DROP TABLE IF EXISTS device_config_versions  CASCADE;
+		DROP TABLE IF EXISTS device_replacements     CASCADE;
+		DROP TABLE IF EXISTS calibration_points      CASCADE;
+		DROP TABLE IF EXISTS calibration_sessions    CASCADE;
 		DROP TABLE IF EXISTS device_configurations   CASCADE;
+		DROP TABLE IF EXISTS farm_tariffs            CASCADE;
+		DROP TABLE IF EXISTS device_capabilities     CASCADE;
+		DROP TABLE IF EXISTS device_shadows          CASCADE;
+		DROP TABLE IF EXISTS device_state_transitions CASCADE;
 		DROP TABLE IF EXISTS alert_subscriptions     CASCADE;
 		DROP TABLE IF EXISTS alerts                  CASCADE;
 		DROP TABLE IF EXISTS user_sessions           CASCADE;
@@ -95,6 +136,12 @@ func DropAllTables() error {
 		DROP TABLE IF EXISTS event_logs              CASCADE;
 		DROP TABLE IF EXISTS schedule_executions     CASCADE;
 		DROP TABLE IF EXISTS schedules               CASCADE;
+		DROP TABLE IF EXISTS device_group_members    CASCADE;
+		DROP TABLE IF EXISTS device_groups           CASCADE;
+		DROP TABLE IF EXISTS device_tags             CASCADE;
+		DROP TABLE IF EXISTS emergency_stops         CASCADE;
+		DROP TABLE IF EXISTS interlock_violations    CASCADE;
+		DROP TABLE IF EXISTS coop_interlocks         CASCADE;
 		DROP TABLE IF EXISTS device_commands         CASCADE;
 		DROP TABLE IF EXISTS devices                 CASCADE;
 		DROP TABLE IF EXISTS farm_users              CASCADE;
@@ -105,6 +105,7 @@ CREATE TABLE IF NOT EXISTS devices (
     is_online BOOLEAN DEFAULT false,
     last_heartbeat TIMESTAMP,
     last_command_status VARCHAR(50),
+    last_command_at TIMESTAMP,
     response TEXT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -120,19 +121,152 @@ CREATE TABLE IF NOT EXISTS device_commands (
     command_type VARCHAR(50) NOT NULL,
     command_value TEXT,
     action_duration INTEGER,
-    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'success', 'failed', 'timeout')),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'success', 'failed', 'timeout', 'cancelled')),
     response TEXT,
+    idempotency_key VARCHAR(64),
+    attempt_count INTEGER NOT NULL DEFAULT 0,
+    delivered_at TIMESTAMP,
+    last_polled_at TIMESTAMP,
+    next_attempt_at TIMESTAMP,
     issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     executed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Emergency stop latches (farm-wide when coop_id is NULL); active until resumed_at is set
+CREATE TABLE IF NOT EXISTS emergency_stops (
+    id UUID PRIMARY KEY,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    coop_id UUID REFERENCES coops(id) ON DELETE CASCADE,
+    selector TEXT,
+    device_ids UUID[],
+    reason TEXT,
+    commands_cancelled INTEGER NOT NULL DEFAULT 0,
+    commands_issued INTEGER NOT NULL DEFAULT 0,
+    triggered_by UUID NOT NULL REFERENCES users(id),
+    triggered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resumed_by UUID REFERENCES users(id),
+    resumed_at TIMESTAMP,
+    resume_note TEXT
+);
+
+-- Actuator safety interlocks per coop
+CREATE TABLE IF NOT EXISTS coop_interlocks (
+    id UUID PRIMARY KEY,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    coop_id UUID NOT NULL REFERENCES coops(id) ON DELETE CASCADE,
+    rule_type VARCHAR(30) NOT NULL CHECK (rule_type IN ('mutual_exclusion', 'requires_running', 'max_runtime', 'min_off_time')),
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    other_device_id UUID REFERENCES devices(id) ON DELETE CASCADE,
+    duration_seconds INTEGER,
+    description TEXT,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_by UUID NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Commands blocked by interlocks
+CREATE TABLE IF NOT EXISTS interlock_violations (
+    id UUID PRIMARY KEY,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    coop_id UUID NOT NULL REFERENCES coops(id) ON DELETE CASCADE,
+    interlock_id UUID REFERENCES coop_interlocks(id) ON DELETE SET NULL,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    command_type VARCHAR(50) NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    reason TEXT NOT NULL,
+    attempted_by UUID NOT NULL REFERENCES users(id),
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- Schedules
+-- Structured gateway diagnostics from heartbeats (time series, pruned with raw readings)
+CREATE TABLE IF NOT EXISTS gateway_diagnostics (
+    id UUID PRIMARY KEY,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    hardware_id TEXT NOT NULL,
+    uptime_seconds BIGINT,
+    cpu_temp_c DECIMAL(6,2),
+    load_1m DECIMAL(8,3),
+    disk_free_mb DECIMAL(12,2),
+    disk_free_pct DECIMAL(5,2),
+    mem_free_mb DECIMAL(12,2),
+    mem_free_pct DECIMAL(5,2),
+    wifi_rssi INTEGER,
+    cellular_rssi INTEGER,
+    queue_depth INTEGER,
+    clock_offset_ms BIGINT,
+    recorded_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Latest measured clock skew of each gateway (gateway clock minus server time)
+CREATE TABLE IF NOT EXISTS gateway_clock_skew (
+    hardware_id TEXT PRIMARY KEY,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    skew_ms BIGINT NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    measured_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Log uploads requested by upload_logs gateway maintenance commands
+CREATE TABLE IF NOT EXISTS gateway_log_uploads (
+    id UUID PRIMARY KEY,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    hardware_id TEXT NOT NULL,
+    command_id UUID REFERENCES device_commands(id) ON DELETE SET NULL,
+    requested_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    line_count INTEGER NOT NULL,
+    size_bytes INTEGER NOT NULL,
+    truncated BOOLEAN NOT NULL DEFAULT false,
+    content TEXT NOT NULL,
+    uploaded_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Heartbeats per device per hour (heartbeat regularity in the device health report)
+CREATE TABLE IF NOT EXISTS device_heartbeat_hours (
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    hour TIMESTAMP NOT NULL,
+    heartbeats INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (device_id, hour)
+);
+
+-- Free-form device tags (e.g. "fans", "zone-a") used as command/report selectors
+CREATE TABLE IF NOT EXISTS device_tags (
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    tag VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (device_id, tag)
+);
+
+-- Named device groups per farm
+CREATE TABLE IF NOT EXISTS device_groups (
+    id UUID PRIMARY KEY,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    description TEXT,
+    created_by UUID NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(farm_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS device_group_members (
+    group_id UUID NOT NULL REFERENCES device_groups(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, device_id)
+);
+
+-- Schedules (one device, or every device matching target_tag / target_group_id at run time)
 CREATE TABLE IF NOT EXISTS schedules (
     id UUID PRIMARY KEY,
     farm_id UUID NOT NULL REFERENCES farms(id),
     coop_id UUID REFERENCES coops(id),
-    device_id UUID NOT NULL REFERENCES devices(id),
+    device_id UUID REFERENCES devices(id),
+    target_tag VARCHAR(50),
+    target_group_id UUID REFERENCES device_groups(id) ON DELETE SET NULL,
     name TEXT NOT NULL,
     schedule_type VARCHAR(20) NOT NULL CHECK (schedule_type IN ('time_based', 'duration_based', 'condition_based')),
     cron_expression TEXT,
@@ -258,7 +392,17 @@ CREATE TABLE IF NOT EXISTS web_push_subscriptions (
     last_used TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- Device configurations
+-- Farm electricity tariff; periods is a JSON list of time-of-use bands
+CREATE TABLE IF NOT EXISTS farm_tariffs (
+    farm_id UUID PRIMARY KEY REFERENCES farms(id) ON DELETE CASCADE,
+    currency VARCHAR(3) NOT NULL DEFAULT 'KHR',
+    base_rate_per_kwh DECIMAL(12,4) NOT NULL DEFAULT 0,
+    periods JSONB NOT NULL DEFAULT '[]',
+    updated_by UUID REFERENCES users(id),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Device configurations (rated_watts holds an actuator's power draw for energy estimates)
 CREATE TABLE IF NOT EXISTS device_configurations (
     id UUID PRIMARY KEY,
     device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
@@ -274,15 +418,88 @@ CREATE TABLE IF NOT EXISTS device_configurations (
     UNIQUE(device_id, parameter_name)
 );
 
+-- Device capabilities (commands a device accepts, as reported by the gateway)
+CREATE TABLE IF NOT EXISTS device_capabilities (
+    id UUID PRIMARY KEY,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    command_type VARCHAR(50) NOT NULL,
+    value_min DECIMAL(10,4),
+    value_max DECIMAL(10,4),
+    allowed_values JSONB,
+    unit VARCHAR(20),
+    max_action_duration INTEGER,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(device_id, command_type)
+);
+
+-- Device shadow (desired state from commands/schedules, reported state from the gateway)
+CREATE TABLE IF NOT EXISTS device_shadows (
+    device_id UUID PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    desired_state VARCHAR(20),
+    desired_value TEXT,
+    desired_command_id UUID,
+    desired_at TIMESTAMP,
+    reported_state VARCHAR(20),
+    reported_value TEXT,
+    reported_at TIMESTAMP,
+    version INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Reported device state changes (actuator runtime history)
+CREATE TABLE IF NOT EXISTS device_state_transitions (
+    id UUID PRIMARY KEY,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    from_state VARCHAR(20),
+    to_state VARCHAR(20) NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Device readings
 CREATE TABLE IF NOT EXISTS device_readings (
     id UUID PRIMARY KEY,
     device_id UUID NOT NULL REFERENCES devices(id),
     sensor_type VARCHAR(50) NOT NULL,
     value DECIMAL(10,4) NOT NULL,
+    raw_value DECIMAL(10,4),
     unit VARCHAR(20) NOT NULL DEFAULT '',
     quality VARCHAR(20) NOT NULL DEFAULT 'good',
-    timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    quality_reason VARCHAR(30),
+    timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Hourly and daily aggregates of device_readings per device and metric. Raw readings are pruned
+-- after TELEMETRY_RETENTION_DAYS, hourly rollups after TELEMETRY_HOURLY_RETENTION_DAYS.
+CREATE TABLE IF NOT EXISTS reading_rollups_hourly (
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    sensor_type VARCHAR(50) NOT NULL,
+    bucket TIMESTAMP NOT NULL,
+    min_value DECIMAL(10,4) NOT NULL,
+    max_value DECIMAL(10,4) NOT NULL,
+    avg_value DECIMAL(14,6) NOT NULL,
+    sample_count INTEGER NOT NULL,
+    last_value DECIMAL(10,4) NOT NULL,
+    last_at TIMESTAMP NOT NULL,
+    rolled_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (device_id, sensor_type, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS reading_rollups_daily (
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    sensor_type VARCHAR(50) NOT NULL,
+    bucket TIMESTAMP NOT NULL,
+    min_value DECIMAL(10,4) NOT NULL,
+    max_value DECIMAL(10,4) NOT NULL,
+    avg_value DECIMAL(14,6) NOT NULL,
+    sample_count INTEGER NOT NULL,
+    last_value DECIMAL(10,4) NOT NULL,
+    last_at TIMESTAMP NOT NULL,
+    rolled_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (device_id, sensor_type, bucket)
 );
 
 -- Gateway persistent tokens (API Keys)
@@ -318,6 +535,112 @@ CREATE TABLE IF NOT EXISTS unassigned_gateways (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Hardware swaps of a logical device (history, schedules and configs stay on the device)
+CREATE TABLE IF NOT EXISTS device_replacements (
+    id UUID PRIMARY KEY,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    old_hardware_id TEXT NOT NULL,
+    new_hardware_id TEXT NOT NULL,
+    old_device_key VARCHAR(50) NOT NULL,
+    new_device_key VARCHAR(50) NOT NULL,
+    merged_device_id UUID,
+    calibration_cleared BOOLEAN NOT NULL DEFAULT false,
+    reason TEXT,
+    replaced_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    replaced_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Sensor calibration sessions; completed sessions write offset/gain into device_configurations
+CREATE TABLE IF NOT EXISTS calibration_sessions (
+    id UUID PRIMARY KEY,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    sensor_type VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'completed', 'cancelled')),
+    offset_value DOUBLE PRECISION,
+    gain_value DOUBLE PRECISION,
+    started_by UUID NOT NULL REFERENCES users(id),
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+-- Reference values paired with the sensor's concurrent raw reading
+CREATE TABLE IF NOT EXISTS calibration_points (
+    id UUID PRIMARY KEY,
+    session_id UUID NOT NULL REFERENCES calibration_sessions(id) ON DELETE CASCADE,
+    reference_value DOUBLE PRECISION NOT NULL,
+    raw_value DOUBLE PRECISION NOT NULL,
+    sample_count INTEGER NOT NULL DEFAULT 0,
+    captured_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Versioned config documents pushed to the gateway with apply_config
+CREATE TABLE IF NOT EXISTS device_config_versions (
+    id UUID PRIMARY KEY,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    document JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'applied', 'failed', 'superseded')),
+    command_id UUID REFERENCES device_commands(id) ON DELETE SET NULL,
+    error TEXT,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    applied_at TIMESTAMP,
+    UNIQUE(device_id, version)
+);
+
+-- Firmware images on local disk (admin uploaded)
+CREATE TABLE IF NOT EXISTS firmware_artifacts (
+    id UUID PRIMARY KEY,
+    version VARCHAR(20) NOT NULL,
+    target_model TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    file_path TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    checksum_sha256 VARCHAR(64) NOT NULL,
+    signature TEXT NOT NULL DEFAULT '',
+    notes TEXT,
+    uploaded_by UUID REFERENCES admins(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(target_model, version)
+);
+
+-- Staged OTA rollouts; halted automatically when the failure rate reaches the threshold
+CREATE TABLE IF NOT EXISTS ota_campaigns (
+    id UUID PRIMARY KEY,
+    firmware_id UUID NOT NULL REFERENCES firmware_artifacts(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'halted', 'completed', 'cancelled')),
+    target_percentage INTEGER CHECK (target_percentage BETWEEN 1 AND 100),
+    target_farm_ids UUID[],
+    failure_threshold_pct INTEGER NOT NULL DEFAULT 20,
+    min_sample_size INTEGER NOT NULL DEFAULT 3,
+    halt_reason TEXT,
+    created_by UUID REFERENCES admins(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    halted_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Per-device OTA progress, fed by ota_update command status and gateway heartbeats
+CREATE TABLE IF NOT EXISTS ota_campaign_devices (
+    id UUID PRIMARY KEY,
+    campaign_id UUID NOT NULL REFERENCES ota_campaigns(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    farm_id UUID NOT NULL REFERENCES farms(id) ON DELETE CASCADE,
+    command_id UUID REFERENCES device_commands(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'in_progress', 'succeeded', 'failed', 'cancelled')),
+    from_version VARCHAR(20) NOT NULL,
+    progress_pct INTEGER,
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(campaign_id, device_id)
+);
+
 -- ===== PERFORMANCE INDEXES =====
 
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
@@ -344,6 +667,7 @@ CREATE INDEX IF NOT EXISTS idx_device_commands_farm_id ON device_commands(farm_i
 CREATE INDEX IF NOT EXISTS idx_device_commands_coop_id ON device_commands(coop_id);
 CREATE INDEX IF NOT EXISTS idx_device_commands_status ON device_commands(status);
 CREATE INDEX IF NOT EXISTS idx_device_commands_created ON device_commands(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_device_commands_delivery ON device_commands(status, next_attempt_at);
 CREATE INDEX IF NOT EXISTS idx_schedules_farm_device ON schedules(farm_id, device_id);
 CREATE INDEX IF NOT EXISTS idx_schedules_coop_id ON schedules(coop_id);
 CREATE INDEX IF NOT EXISTS idx_schedules_is_active ON schedules(is_active);
@@ -351,6 +675,10 @@ CREATE INDEX IF NOT EXISTS idx_schedules_next_execution ON schedules(next_execut
 CREATE INDEX IF NOT EXISTS idx_schedule_executions_schedule_id ON schedule_executions(schedule_id);
 CREATE INDEX IF NOT EXISTS idx_schedule_executions_time ON schedule_executions(scheduled_time DESC);
 CREATE INDEX IF NOT EXISTS idx_schedule_executions_status ON schedule_executions(status);
+CREATE INDEX IF NOT EXISTS idx_coop_interlocks_coop ON coop_interlocks(coop_id) WHERE is_active = true;
+CREATE INDEX IF NOT EXISTS idx_interlock_violations_coop ON interlock_violations(coop_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_device_state_transitions_device ON device_state_transitions(device_id, changed_at);
+CREATE INDEX IF NOT EXISTS idx_emergency_stops_active ON emergency_stops(farm_id) WHERE resumed_at IS NULL;
 CREATE INDEX IF NOT EXISTS idx_event_logs_farm_user ON event_logs(farm_id, user_id);
 CREATE INDEX IF NOT EXISTS idx_event_logs_created ON event_logs(created_at DESC);
 CREATE INDEX IF NOT EXISTS idx_registration_keys_code ON registration_keys(key_code);
@@ -368,11 +696,28 @@ CREATE INDEX IF NOT EXISTS idx_alerts_triggered_at ON alerts(triggered_at DESC);
 CREATE INDEX IF NOT EXISTS idx_alert_subscriptions_user_id ON alert_subscriptions(user_id);
 CREATE INDEX IF NOT EXISTS idx_web_push_user_id ON web_push_subscriptions(user_id);
 CREATE INDEX IF NOT EXISTS idx_device_configs_device_id ON device_configurations(device_id);
+CREATE INDEX IF NOT EXISTS idx_device_capabilities_device_id ON device_capabilities(device_id);
 CREATE INDEX IF NOT EXISTS idx_device_readings_device_id ON device_readings(device_id);
 CREATE INDEX IF NOT EXISTS idx_device_readings_timestamp ON device_readings(timestamp DESC);
 CREATE INDEX IF NOT EXISTS idx_device_readings_sensor_type ON device_readings(device_id, sensor_type);
+CREATE INDEX IF NOT EXISTS idx_device_readings_created_at ON device_readings(created_at);
+CREATE INDEX IF NOT EXISTS idx_reading_rollups_hourly_bucket ON reading_rollups_hourly(bucket);
+CREATE INDEX IF NOT EXISTS idx_reading_rollups_hourly_rolled_at ON reading_rollups_hourly(rolled_at);
 CREATE INDEX IF NOT EXISTS idx_gateway_tokens_farm_id ON gateway_tokens(farm_id);
 CREATE INDEX IF NOT EXISTS idx_gateway_tokens_token_hash ON gateway_tokens(token_hash);
 CREATE INDEX IF NOT EXISTS idx_gateway_provisions_setup_code ON gateway_provisions(setup_code);
 CREATE INDEX IF NOT EXISTS idx_gateway_provisions_expires_at ON gateway_provisions(expires_at);
+CREATE INDEX IF NOT EXISTS idx_device_replacements_device ON device_replacements(device_id, replaced_at DESC);
+CREATE INDEX IF NOT EXISTS idx_calibration_sessions_device ON calibration_sessions(device_id, sensor_type, status);
+CREATE INDEX IF NOT EXISTS idx_device_config_versions_command ON device_config_versions(command_id);
+CREATE INDEX IF NOT EXISTS idx_ota_campaign_devices_command ON ota_campaign_devices(command_id);
+CREATE INDEX IF NOT EXISTS idx_ota_campaign_devices_farm ON ota_campaign_devices(farm_id, status);
+CREATE INDEX IF NOT EXISTS idx_gateway_diagnostics_gateway ON gateway_diagnostics(farm_id, hardware_id, recorded_at DESC);
+CREATE INDEX IF NOT EXISTS idx_gateway_diagnostics_recorded_at ON gateway_diagnostics(recorded_at);
+CREATE INDEX IF NOT EXISTS idx_gateway_clock_skew_farm ON gateway_clock_skew(farm_id);
+CREATE INDEX IF NOT EXISTS idx_gateway_log_uploads_gateway ON gateway_log_uploads(hardware_id, uploaded_at DESC);
+CREATE INDEX IF NOT EXISTS idx_gateway_log_uploads_expires_at ON gateway_log_uploads(expires_at);
+CREATE INDEX IF NOT EXISTS idx_device_heartbeat_hours_hour ON device_heartbeat_hours(hour);
+CREATE INDEX IF NOT EXISTS idx_device_tags_farm_tag ON device_tags(farm_id, tag);
+CREATE INDEX IF NOT EXISTS idx_device_group_members_device ON device_group_members(device_id);
 `
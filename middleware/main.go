@@ -85,12 +85,17 @@ func main() {
 
 	// Start WebSocket hub (for real-time updates)
 	go api.WSHub.RunHub()
+	services.SetEventPublisher(api.WSHub)
 	log.Println("✅ WebSocket hub started")
 
 	// Start telemetry retention cleanup
 	go startTelemetryRetentionCleanup(cfg.TelemetryRetentionDays)
 	log.Printf("✅ Telemetry retention cleanup started (days=%d)", cfg.TelemetryRetentionDays)
 
+	// Start telemetry rollups
+	go startTelemetryRollups()
+	log.Printf("✅ Telemetry rollups started (hourly retention days=%d)", cfg.TelemetryHourlyRetentionDays)
+
 	// Setup routes
 	setupRoutes(app, frontendPath)
 
@@ -103,6 +108,7 @@ func main() {
 
 func startTelemetryRetentionCleanup(retentionDays int) {
 	service := services.NewTelemetryService()
+	deviceService := services.NewDeviceService()
 	ticker := time.NewTicker(24 * time.Hour)
 	defer ticker.Stop()
 
@@ -113,6 +119,24 @@ func startTelemetryRetentionCleanup(retentionDays int) {
 		} else if deleted > 0 {
 			log.Printf("🧹 Telemetry cleanup removed %d readings", deleted)
 		}
+		if deleted, err := deviceService.CleanupGatewayLogs(); err != nil {
+			log.Printf("⚠️  Gateway log cleanup failed: %v", err)
+		} else if deleted > 0 {
+			log.Printf("🧹 Gateway log cleanup removed %d uploads", deleted)
+		}
+		<-ticker.C
+	}
+}
+
+func startTelemetryRollups() {
+	service := services.NewTelemetryService()
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if _, err := service.RollupReadings(); err != nil {
+			log.Printf("⚠️  Telemetry rollup failed: %v", err)
+		}
 		<-ticker.C
 	}
 }
@@ -195,10 +219,17 @@ func setupRoutes(app *fiber.App, frontendPath string) {
 	v1.Get("/gateway/provision/status/:code", api.CheckProvisioningStatusHandler)
 
 	// Device heartbeat (IoT devices - no AuthMiddleware, uses device/gateway key)
-	v1.Post("/devices/:hardware_id/heartbeat", api.UpdateDeviceHeartbeatHandler)
-	v1.Post("/gateway/heartbeat", api.UpdateDeviceHeartbeatHandler) // Support for X-Gateway-Token aware heartbeat
-	v1.Get("/gateway/commands/:hardware_id", api.GetGatewayCommandsHandler)
-	v1.Post("/gateway/commands/:command_id/status", api.UpdateGatewayCommandStatusHandler)
+	v1.Post("/devices/:hardware_id/heartbeat", api.OptionalGatewayAuthMiddleware, api.UpdateDeviceHeartbeatHandler)
+	v1.Post("/gateway/heartbeat", api.GatewayAuthMiddleware, api.UpdateDeviceHeartbeatHandler) // Heartbeat for the token's own gateway
+	v1.Get("/gateway/commands/:hardware_id", api.GatewayAuthMiddleware, api.GetGatewayCommandsHandler)
+	v1.Post("/gateway/commands/:command_id/status", api.GatewayAuthMiddleware, api.UpdateGatewayCommandStatusHandler)
+	v1.Get("/gateway/shadow/:hardware_id", api.GatewayAuthMiddleware, api.GetGatewayShadowHandler)
+
+	// Gateway command push (X-Gateway-Token); polling above remains the fallback
+	v1.Use("/gateway/ws", api.GatewayAuthMiddleware, api.WebSocketUpgradeMiddleware)
+	v1.Get("/gateway/ws", websocket.New(api.GatewayWebSocketHandler))
+	v1.Get("/gateway/firmware/:firmware_id", api.GatewayAuthMiddleware, api.DownloadGatewayFirmwareHandler)
+	v1.Post("/gateway/logs", api.GatewayAuthMiddleware, api.UploadGatewayLogsHandler)
 
 	// Protected routes (require authentication)
 	protected := v1.Group("")
@@ -230,6 +261,8 @@ func setupRoutes(app *fiber.App, frontendPath string) {
 	protected.Get("/farms/:farm_id", api.GetFarmHandler)
 	protected.Put("/farms/:farm_id", api.UpdateFarmHandler)
 	protected.Delete("/farms/:farm_id", api.DeleteFarmHandler)
+	protected.Get("/farms/:farm_id/tariff", api.GetFarmTariffHandler)
+	protected.Put("/farms/:farm_id/tariff", api.UpdateFarmTariffHandler)
 
 	// Farm member endpoints
 	protected.Get("/farms/:farm_id/members", api.GetFarmMembersHandler)
@@ -244,9 +277,20 @@ func setupRoutes(app *fiber.App, frontendPath string) {
 	protected.Put("/farms/:farm_id/coops/:coop_id", api.UpdateCoopHandler)
 	protected.Delete("/farms/:farm_id/coops/:coop_id", api.DeleteCoopHandler)
 	protected.Get("/farms/:farm_id/coops/:coop_id/temperature-timeline", api.TemperatureTimelineHandler)
+	protected.Get("/farms/:farm_id/coops/:coop_id/metrics/:metric/timeline", api.MetricTimelineHandler)
+	protected.Get("/farms/:farm_id/coops/:coop_id/metrics/:metric/series", api.MetricSeriesHandler)
+	protected.Get("/metrics", api.ListMetricsHandler)
 	protected.Post("/farms/:farm_id/coops/:coop_id/telemetry", api.PostCoopTelemetryHandler)
+	protected.Post("/farms/:farm_id/coops/:coop_id/telemetry/batch", api.PostCoopTelemetryBatchHandler)
 	protected.Post("/farms/:farm_id/coops/:coop_id/devices/report", api.ReportCoopDevicesHandler)
+	protected.Get("/farms/:farm_id/coops/:coop_id/interlocks", api.ListInterlocksHandler)
+	protected.Post("/farms/:farm_id/coops/:coop_id/interlocks", api.CreateInterlockHandler)
+	protected.Get("/farms/:farm_id/coops/:coop_id/interlocks/violations", api.ListInterlockViolationsHandler)
+	protected.Put("/farms/:farm_id/coops/:coop_id/interlocks/:interlock_id", api.UpdateInterlockHandler)
+	protected.Delete("/farms/:farm_id/coops/:coop_id/interlocks/:interlock_id", api.DeleteInterlockHandler)
 	protected.Post("/farms/:farm_id/claim-gateway", api.ClaimGatewayHandler)
+	protected.Get("/farms/:farm_id/gateways/:hardware_id/diagnostics", api.GetGatewayDiagnosticsHandler)
+	protected.Post("/farms/:farm_id/gateways/:hardware_id/maintenance", api.GatewayMaintenanceHandler)
 
 
 	// Device management endpoints
@@ -258,10 +302,28 @@ func setupRoutes(app *fiber.App, frontendPath string) {
 
 	// Device advanced endpoints
 	protected.Get("/farms/:farm_id/devices/:device_id/history", api.GetDeviceHistoryHandler)
+	protected.Get("/farms/:farm_id/devices/:device_id/timeline", api.GetDeviceTimelineHandler)
+	protected.Post("/farms/:farm_id/devices/:device_id/replace", api.ReplaceDeviceHandler)
+	protected.Get("/farms/:farm_id/devices/:device_id/tags", api.GetDeviceTagsHandler)
+	protected.Put("/farms/:farm_id/devices/:device_id/tags", api.SetDeviceTagsHandler)
+	protected.Get("/farms/:farm_id/device-tags", api.ListDeviceTagsHandler)
+	protected.Get("/farms/:farm_id/device-groups", api.ListDeviceGroupsHandler)
+	protected.Post("/farms/:farm_id/device-groups", api.CreateDeviceGroupHandler)
+	protected.Get("/farms/:farm_id/device-groups/:group_id", api.GetDeviceGroupHandler)
+	protected.Put("/farms/:farm_id/device-groups/:group_id", api.UpdateDeviceGroupHandler)
+	protected.Delete("/farms/:farm_id/device-groups/:group_id", api.DeleteDeviceGroupHandler)
 	protected.Get("/farms/:farm_id/devices/:device_id/status", api.GetDeviceStatusHandler)
 	protected.Get("/farms/:farm_id/devices/:device_id/config", api.GetDeviceConfigHandler)
 	protected.Put("/farms/:farm_id/devices/:device_id/config", api.UpdateDeviceConfigHandler)
+	protected.Get("/farms/:farm_id/devices/:device_id/config/status", api.GetDeviceConfigStatusHandler)
 	protected.Post("/farms/:farm_id/devices/:device_id/calibrate", api.CalibrateDeviceHandler)
+	protected.Get("/farms/:farm_id/devices/:device_id/calibration/sessions", api.ListCalibrationSessionsHandler)
+	protected.Post("/farms/:farm_id/devices/:device_id/calibration/sessions", api.StartCalibrationHandler)
+	protected.Get("/farms/:farm_id/devices/:device_id/calibration/sessions/:session_id", api.GetCalibrationSessionHandler)
+	protected.Post("/farms/:farm_id/devices/:device_id/calibration/sessions/:session_id/points", api.AddCalibrationPointHandler)
+	protected.Post("/farms/:farm_id/devices/:device_id/calibration/sessions/:session_id/complete", api.CompleteCalibrationHandler)
+	protected.Post("/farms/:farm_id/devices/:device_id/calibration/sessions/:session_id/cancel", api.CancelCalibrationHandler)
+	protected.Get("/farms/:farm_id/devices/:device_id/capabilities", api.GetDeviceCapabilitiesHandler)
 
 	// Device command endpoints
 	protected.Post("/farms/:farm_id/devices/:device_id/commands", api.SendDeviceCommandHandler)
@@ -272,6 +334,8 @@ func setupRoutes(app *fiber.App, frontendPath string) {
 	// Farm-level device control
 	protected.Get("/farms/:farm_id/commands", api.GetFarmCommandHistoryHandler)
 	protected.Post("/farms/:farm_id/emergency-stop", api.EmergencyStopHandler)
+	protected.Get("/farms/:farm_id/emergency-stop", api.GetEmergencyStopStatusHandler)
+	protected.Post("/farms/:farm_id/emergency-stop/resume", api.ResumeEmergencyStopHandler)
 	protected.Post("/farms/:farm_id/devices/batch-command", api.BatchDeviceCommandHandler)
 
 	// Schedule management endpoints
@@ -291,8 +355,10 @@ func setupRoutes(app *fiber.App, frontendPath string) {
 
 	// Analytics & reporting endpoints
 	protected.Get("/farms/:farm_id/dashboard", api.GetFarmDashboardHandler)
+	protected.Get("/farms/:farm_id/reports/device-health", api.GetDeviceHealthReportHandler)
 	protected.Get("/farms/:farm_id/reports/device-metrics", api.GetDeviceMetricsReportHandler)
 	protected.Get("/farms/:farm_id/reports/device-usage", api.GetDeviceUsageReportHandler)
+	protected.Get("/farms/:farm_id/reports/energy", api.GetEnergyReportHandler)
 	protected.Get("/farms/:farm_id/reports/farm-performance", api.GetFarmPerformanceReportHandler)
 	protected.Get("/farms/:farm_id/reports/export", api.ExportReportHandler)
 	protected.Get("/farms/:farm_id/events", api.GetFarmEventLogHandler)
@@ -319,6 +385,17 @@ func setupRoutes(app *fiber.App, frontendPath string) {
 	admin.Delete("/gateways/:id", api.RevokeGatewayHandler)
 	admin.Get("/unassigned-gateways", api.GetUnassignedGatewaysHandler)
 	admin.Post("/assign-gateway", api.AssignGatewayHandler)
+	admin.Post("/gateways/:hardware_id/maintenance", api.AdminGatewayMaintenanceHandler)
+	admin.Get("/gateway-logs", api.ListGatewayLogsHandler)
+	admin.Get("/gateway-logs/:log_id", api.GetGatewayLogHandler)
+	admin.Get("/firmware", api.ListFirmwareHandler)
+	admin.Post("/firmware", api.UploadFirmwareHandler)
+	admin.Get("/ota/campaigns", api.ListOTACampaignsHandler)
+	admin.Post("/ota/campaigns", api.CreateOTACampaignHandler)
+	admin.Get("/ota/campaigns/:campaign_id", api.GetOTACampaignHandler)
+	admin.Post("/ota/campaigns/:campaign_id/expand", api.ExpandOTACampaignHandler)
+	admin.Post("/ota/campaigns/:campaign_id/halt", api.HaltOTACampaignHandler)
+	admin.Post("/ota/campaigns/:campaign_id/resume", api.ResumeOTACampaignHandler)
 
 	// 404 Handler
 	app.Use(func(c *fiber.Ctx) error {
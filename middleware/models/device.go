@@ -28,22 +28,55 @@ type Device struct {
 	UpdatedAt         time.Time  `json:"updated_at"`
 }
 
+// DeviceGroup is a named set of devices on a farm
+type DeviceGroup struct {
+	ID          uuid.UUID   `json:"id"`
+	FarmID      uuid.UUID   `json:"farm_id"`
+	Name        string      `json:"name"`
+	Description *string     `json:"description,omitempty"`
+	DeviceIDs   []uuid.UUID `json:"device_ids"`
+	CreatedBy   uuid.UUID   `json:"created_by"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// DeviceReplacement records a logical device being re-pointed to new hardware
+type DeviceReplacement struct {
+	ID                 uuid.UUID  `json:"id"`
+	DeviceID           uuid.UUID  `json:"device_id"`
+	FarmID             uuid.UUID  `json:"farm_id"`
+	OldHardwareID      string     `json:"old_hardware_id"`
+	NewHardwareID      string     `json:"new_hardware_id"`
+	OldDeviceKey       string     `json:"old_device_key"`
+	NewDeviceKey       string     `json:"new_device_key"`
+	MergedDeviceID     *uuid.UUID `json:"merged_device_id,omitempty"` // auto-created row for the new hardware, folded in
+	CalibrationCleared bool       `json:"calibration_cleared"`
+	Reason             *string    `json:"reason,omitempty"`
+	ReplacedBy         uuid.UUID  `json:"replaced_by"`
+	ReplacedAt         time.Time  `json:"replaced_at"`
+}
+
 // DeviceCommand represents a command sent to a device
 type DeviceCommand struct {
-	ID           uuid.UUID  `json:"id"`
-	DeviceID     uuid.UUID  `json:"device_id"`
-	FarmID       uuid.UUID  `json:"farm_id"`
-	CoopID       *uuid.UUID `json:"coop_id,omitempty"`
-	IssuedBy     uuid.UUID  `json:"issued_by"`
-	CommandType  string     `json:"command_type"`
-	CommandValue *string    `json:"command_value,omitempty"`
-	ActionDuration *int    `json:"action_duration,omitempty"`
-	Status       string     `json:"status"`
-	Response     *string    `json:"response,omitempty"`
-	IssuedAt     time.Time  `json:"issued_at"`
-	ExecutedAt   *time.Time `json:"executed_at,omitempty"`
-	CreatedAt    time.Time  `json:"created_at"`
-	DeviceModel  *string    `json:"device_model,omitempty"`
+	ID             uuid.UUID  `json:"id"`
+	DeviceID       uuid.UUID  `json:"device_id"`
+	FarmID         uuid.UUID  `json:"farm_id"`
+	CoopID         *uuid.UUID `json:"coop_id,omitempty"`
+	IssuedBy       uuid.UUID  `json:"issued_by"`
+	CommandType    string     `json:"command_type"`
+	CommandValue   *string    `json:"command_value,omitempty"`
+	ActionDuration *int       `json:"action_duration,omitempty"`
+	Status         string     `json:"status"`
+	Response       *string    `json:"response,omitempty"`
+	IdempotencyKey string     `json:"idempotency_key"`
+	AttemptCount   int        `json:"attempt_count"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	LastPolledAt   *time.Time `json:"last_polled_at,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	IssuedAt       time.Time  `json:"issued_at"`
+	ExecutedAt     *time.Time `json:"executed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeviceModel    *string    `json:"device_model,omitempty"`
 }
 
 // DeviceConfiguration represents a device parameter setting
@@ -61,13 +94,86 @@ type DeviceConfiguration struct {
 	UpdatedAt      time.Time  `json:"updated_at"`
 }
 
+// DeviceConfigVersion is a versioned configuration document pushed to the gateway
+type DeviceConfigVersion struct {
+	ID        uuid.UUID              `json:"id"`
+	DeviceID  uuid.UUID              `json:"device_id"`
+	Version   int                    `json:"version"`
+	Document  map[string]interface{} `json:"document"`
+	Status    string                 `json:"status"` // pending, applied, failed, superseded
+	CommandID *uuid.UUID             `json:"command_id,omitempty"`
+	Error     *string                `json:"error,omitempty"`
+	CreatedBy *uuid.UUID             `json:"created_by,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	AppliedAt *time.Time             `json:"applied_at,omitempty"`
+}
+
 // DeviceReading represents a time-series sensor reading
 type DeviceReading struct {
-	ID         uuid.UUID `json:"id"`
-	DeviceID   uuid.UUID `json:"device_id"`
-	SensorType string    `json:"sensor_type"`
-	Value      float64   `json:"value"`
-	Unit       string    `json:"unit"`
-	Quality    string    `json:"quality"`
-	Timestamp  time.Time `json:"timestamp"`
+	ID            uuid.UUID `json:"id"`
+	DeviceID      uuid.UUID `json:"device_id"`
+	SensorType    string    `json:"sensor_type"`
+	Value         float64   `json:"value"`
+	RawValue      *float64  `json:"raw_value,omitempty"` // set when a calibration was applied
+	Unit          string    `json:"unit"`
+	Quality       string    `json:"quality"`                  // good, suspect or bad
+	QualityReason *string   `json:"quality_reason,omitempty"` // out_of_range, rate_of_change or spike
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// CalibrationSession fits offset and gain for one sensor of a device from reference points.
+// Calibrated value = gain * raw + offset.
+type CalibrationSession struct {
+	ID          uuid.UUID  `json:"id"`
+	DeviceID    uuid.UUID  `json:"device_id"`
+	FarmID      uuid.UUID  `json:"farm_id"`
+	SensorType  string     `json:"sensor_type"`
+	Status      string     `json:"status"` // open, completed, cancelled
+	Offset      *float64   `json:"offset,omitempty"`
+	Gain        *float64   `json:"gain,omitempty"`
+	StartedBy   uuid.UUID  `json:"started_by"`
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// CalibrationPoint pairs a reference value with the sensor's concurrent raw reading
+type CalibrationPoint struct {
+	ID             uuid.UUID `json:"id"`
+	SessionID      uuid.UUID `json:"session_id"`
+	ReferenceValue float64   `json:"reference_value"`
+	RawValue       float64   `json:"raw_value"`
+	SampleCount    int       `json:"sample_count"` // raw readings averaged; 0 when entered by hand
+	CapturedAt     time.Time `json:"captured_at"`
+}
+
+// CoopInterlock is a safety rule between actuators in a coop.
+// mutual_exclusion and requires_running relate DeviceID to OtherDeviceID;
+// max_runtime and min_off_time limit DeviceID using DurationSeconds.
+type CoopInterlock struct {
+	ID              uuid.UUID  `json:"id"`
+	FarmID          uuid.UUID  `json:"farm_id"`
+	CoopID          uuid.UUID  `json:"coop_id"`
+	RuleType        string     `json:"rule_type"`
+	DeviceID        uuid.UUID  `json:"device_id"`
+	OtherDeviceID   *uuid.UUID `json:"other_device_id,omitempty"`
+	DurationSeconds *int       `json:"duration_seconds,omitempty"`
+	Description     *string    `json:"description,omitempty"`
+	IsActive        bool       `json:"is_active"`
+	CreatedBy       uuid.UUID  `json:"created_by"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// InterlockViolation records a command that an interlock blocked
+type InterlockViolation struct {
+	ID          uuid.UUID  `json:"id"`
+	FarmID      uuid.UUID  `json:"farm_id"`
+	CoopID      uuid.UUID  `json:"coop_id"`
+	InterlockID *uuid.UUID `json:"interlock_id,omitempty"`
+	DeviceID    uuid.UUID  `json:"device_id"`
+	CommandType string     `json:"command_type"`
+	Source      string     `json:"source"`
+	Reason      string     `json:"reason"`
+	AttemptedBy uuid.UUID  `json:"attempted_by"`
+	CreatedAt   time.Time  `json:"created_at"`
 }
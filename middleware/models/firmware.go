@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FirmwareArtifact is a firmware image stored on local disk
+type FirmwareArtifact struct {
+	ID             uuid.UUID  `json:"id"`
+	Version        string     `json:"version"`
+	TargetModel    string     `json:"target_model"`
+	FileName       string     `json:"file_name"`
+	FilePath       string     `json:"-"`
+	SizeBytes      int64      `json:"size_bytes"`
+	ChecksumSHA256 string     `json:"checksum_sha256"`
+	Signature      string     `json:"signature"`
+	Notes          *string    `json:"notes,omitempty"`
+	UploadedBy     *uuid.UUID `json:"uploaded_by,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// OTACampaign rolls a firmware artifact out to a subset of devices
+type OTACampaign struct {
+	ID                  uuid.UUID   `json:"id"`
+	FirmwareID          uuid.UUID   `json:"firmware_id"`
+	Name                string      `json:"name"`
+	Status              string      `json:"status"` // running, halted, completed, cancelled
+	TargetPercentage    *int        `json:"target_percentage,omitempty"`
+	TargetFarmIDs       []uuid.UUID `json:"target_farm_ids,omitempty"`
+	FailureThresholdPct int         `json:"failure_threshold_pct"`
+	MinSampleSize       int         `json:"min_sample_size"`
+	HaltReason          *string     `json:"halt_reason,omitempty"`
+	CreatedBy           *uuid.UUID  `json:"created_by,omitempty"`
+	CreatedAt           time.Time   `json:"created_at"`
+	HaltedAt            *time.Time  `json:"halted_at,omitempty"`
+	CompletedAt         *time.Time  `json:"completed_at,omitempty"`
+	UpdatedAt           time.Time   `json:"updated_at"`
+}
+
+// OTACampaignDevice tracks one device's progress in a campaign
+type OTACampaignDevice struct {
+	ID          uuid.UUID  `json:"id"`
+	CampaignID  uuid.UUID  `json:"campaign_id"`
+	DeviceID    uuid.UUID  `json:"device_id"`
+	FarmID      uuid.UUID  `json:"farm_id"`
+	HardwareID  string     `json:"hardware_id"`
+	CommandID   *uuid.UUID `json:"command_id,omitempty"`
+	Status      string     `json:"status"` // pending, in_progress, succeeded, failed, cancelled
+	FromVersion string     `json:"from_version"`
+	ProgressPct *int       `json:"progress_pct,omitempty"`
+	Error       *string    `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
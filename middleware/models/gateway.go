@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GatewayDiagnosticsSample is one structured diagnostics report from a gateway heartbeat
+type GatewayDiagnosticsSample struct {
+	ID            uuid.UUID `json:"id"`
+	FarmID        uuid.UUID `json:"farm_id"`
+	HardwareID    string    `json:"hardware_id"`
+	UptimeSeconds *int64    `json:"uptime_seconds,omitempty"`
+	CPUTempC      *float64  `json:"cpu_temp_c,omitempty"`
+	Load1m        *float64  `json:"load_1m,omitempty"`
+	DiskFreeMB    *float64  `json:"disk_free_mb,omitempty"`
+	DiskFreePct   *float64  `json:"disk_free_pct,omitempty"`
+	MemFreeMB     *float64  `json:"mem_free_mb,omitempty"`
+	MemFreePct    *float64  `json:"mem_free_pct,omitempty"`
+	WifiRSSI      *int      `json:"wifi_rssi,omitempty"`
+	CellularRSSI  *int      `json:"cellular_rssi,omitempty"`
+	QueueDepth    *int      `json:"queue_depth,omitempty"`
+	ClockOffsetMs *int64    `json:"clock_offset_ms,omitempty"`
+	RecordedAt    time.Time `json:"recorded_at"`
+}
+
+// GatewayLogUpload is a block of gateway log lines uploaded in response to an upload_logs command
+type GatewayLogUpload struct {
+	ID          uuid.UUID  `json:"id"`
+	FarmID      uuid.UUID  `json:"farm_id"`
+	HardwareID  string     `json:"hardware_id"`
+	CommandID   *uuid.UUID `json:"command_id,omitempty"`
+	RequestedBy *uuid.UUID `json:"requested_by,omitempty"`
+	LineCount   int        `json:"line_count"`
+	SizeBytes   int        `json:"size_bytes"`
+	Truncated   bool       `json:"truncated"`
+	Content     string     `json:"content,omitempty"`
+	UploadedAt  time.Time  `json:"uploaded_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+}
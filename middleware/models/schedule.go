@@ -11,7 +11,9 @@ type Schedule struct {
 	ID             uuid.UUID      `json:"id"`
 	FarmID         uuid.UUID      `json:"farm_id"`
 	CoopID         *uuid.UUID     `json:"coop_id,omitempty"`
-	DeviceID       uuid.UUID      `json:"device_id"`
+	DeviceID       *uuid.UUID     `json:"device_id,omitempty"`
+	TargetTag      *string        `json:"target_tag,omitempty"`
+	TargetGroupID  *uuid.UUID     `json:"target_group_id,omitempty"`
 	Name           string         `json:"name"`
 	ScheduleType   string         `json:"schedule_type"`
 	CronExpression *string        `json:"cron_expression,omitempty"`
@@ -1,6 +1,10 @@
 package schemas
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 // EventEntry represents a single entry in the event audit log
 type EventEntry struct {
@@ -42,5 +46,174 @@ type DashboardResponse struct {
 		Last24hCommands int64 `json:"last_24h_commands"`
 		Last24hAlerts   int64 `json:"last_24h_alerts"`
 	} `json:"quick_stats"`
-	RecentEvents []EventEntry `json:"recent_events"`
+	RecentEvents []EventEntry  `json:"recent_events"`
+	Energy       *EnergySummary `json:"energy,omitempty"`
+}
+
+// DeviceUsageReport summarizes actuator runtime over a date range
+type DeviceUsageReport struct {
+	FarmID   uuid.UUID     `json:"farm_id"`
+	From     string        `json:"from" example:"2026-01-01"`
+	To       string        `json:"to" example:"2026-01-07"`
+	Timezone string        `json:"timezone" example:"Asia/Phnom_Penh"`
+	Devices  []DeviceUsage `json:"devices"`
+}
+
+// DeviceUsage is the runtime summary of one actuator
+type DeviceUsage struct {
+	DeviceID          uuid.UUID    `json:"device_id"`
+	Name              string       `json:"name"`
+	Type              string       `json:"type"`
+	Model             *string      `json:"model,omitempty"`
+	CoopID            *uuid.UUID   `json:"coop_id,omitempty"`
+	TotalOnSeconds    int64        `json:"total_on_seconds"`
+	Cycles            int          `json:"cycles"`
+	LongestRunSeconds int64        `json:"longest_run_seconds"`
+	AvgRunSeconds     int64        `json:"avg_run_seconds"`
+	DutyCyclePct      float64      `json:"duty_cycle_pct"`
+	Daily             []DailyUsage `json:"daily"`
+}
+
+// DailyUsage is one day of actuator runtime in the farm's time zone
+type DailyUsage struct {
+	Date         string  `json:"date" example:"2026-01-01"`
+	OnSeconds    int64   `json:"on_seconds"`
+	Cycles       int     `json:"cycles"`
+	DutyCyclePct float64 `json:"duty_cycle_pct"`
+}
+
+// EnergyTotal is energy and cost for one day ("2026-01-01") or month ("2026-01")
+type EnergyTotal struct {
+	Period string  `json:"period"`
+	KWh    float64 `json:"kwh"`
+	Cost   float64 `json:"cost"`
+}
+
+// DeviceEnergy is the estimated consumption of one actuator
+type DeviceEnergy struct {
+	DeviceID   uuid.UUID  `json:"device_id"`
+	Name       string     `json:"name"`
+	CoopID     *uuid.UUID `json:"coop_id,omitempty"`
+	RatedWatts *float64   `json:"rated_watts"`
+	OnSeconds  int64      `json:"on_seconds"`
+	KWh        float64    `json:"kwh"`
+	Cost       float64    `json:"cost"`
+}
+
+// CoopEnergy is the estimated consumption of all actuators in a coop
+type CoopEnergy struct {
+	CoopID *uuid.UUID `json:"coop_id"`
+	Name   string     `json:"name"`
+	KWh    float64    `json:"kwh"`
+	Cost   float64    `json:"cost"`
+}
+
+// EnergyReport estimates electricity use and cost from actuator runtime and rated wattage
+type EnergyReport struct {
+	FarmID    uuid.UUID `json:"farm_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Timezone  string    `json:"timezone"`
+	Currency  string    `json:"currency"`
+	TotalKWh  float64   `json:"total_kwh"`
+	TotalCost float64   `json:"total_cost"`
+	// DevicesWithoutWattage counts actuators that ran but have no rated_watts configured
+	DevicesWithoutWattage int            `json:"devices_without_wattage"`
+	Daily                 []EnergyTotal  `json:"daily"`
+	Monthly               []EnergyTotal  `json:"monthly"`
+	Coops                 []CoopEnergy   `json:"coops"`
+	Devices               []DeviceEnergy `json:"devices"`
+}
+
+// EnergySummary is the dashboard's energy tile
+type EnergySummary struct {
+	Currency  string  `json:"currency"`
+	TodayKWh  float64 `json:"today_kwh"`
+	TodayCost float64 `json:"today_cost"`
+	MonthKWh  float64 `json:"month_kwh"`
+	MonthCost float64 `json:"month_cost"`
+}
+
+// DeviceHealthReport scores every active device on a farm, rolled up per coop
+type DeviceHealthReport struct {
+	FarmID      uuid.UUID      `json:"farm_id"`
+	WindowHours int            `json:"window_hours" example:"24"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Score       *float64       `json:"score" example:"86.5"`
+	Status      string         `json:"status" example:"healthy"`
+	Coops       []CoopHealth   `json:"coops"`
+	Devices     []DeviceHealth `json:"devices"`
+}
+
+// CoopHealth is the average device health of one coop (coop_id is null for unassigned devices)
+type CoopHealth struct {
+	CoopID   *uuid.UUID `json:"coop_id"`
+	Name     string     `json:"name"`
+	Score    *float64   `json:"score"`
+	Status   string     `json:"status"`
+	Devices  int        `json:"devices"`
+	Healthy  int        `json:"healthy"`
+	Degraded int        `json:"degraded"`
+	Failing  int        `json:"failing"`
+	// Issues lists the explanations of the coop's degraded and failing devices, worst first
+	Issues []string `json:"issues"`
+}
+
+// DeviceHealth is the 0-100 health score of one device with the reasons behind it
+type DeviceHealth struct {
+	DeviceID      uuid.UUID           `json:"device_id"`
+	Name          string              `json:"name"`
+	Type          string              `json:"type"`
+	Model         *string             `json:"model,omitempty"`
+	CoopID        *uuid.UUID          `json:"coop_id,omitempty"`
+	LastHeartbeat *time.Time          `json:"last_heartbeat,omitempty"`
+	Score         float64             `json:"score" example:"72.5"`
+	Status        string              `json:"status" example:"degraded"`
+	Components    []HealthComponent   `json:"components"`
+	Explanations  []string            `json:"explanations"`
+	Metrics       DeviceHealthMetrics `json:"metrics"`
+}
+
+// HealthComponent is one scored factor; components without data are left out
+type HealthComponent struct {
+	Name   string  `json:"name" example:"heartbeat"`
+	Score  float64 `json:"score" example:"91.7"`
+	Weight float64 `json:"weight" example:"0.3"`
+}
+
+// DeviceHealthMetrics are the raw measurements a health score is computed from
+type DeviceHealthMetrics struct {
+	DeviceID          uuid.UUID             `json:"device_id"`
+	Name              string                `json:"name"`
+	CoopID            *uuid.UUID            `json:"coop_id,omitempty"`
+	ExpectedHours     int                   `json:"expected_hours"`
+	HeartbeatHours    int                   `json:"heartbeat_hours"`
+	CommandsFinished  int                   `json:"commands_finished"`
+	CommandsSucceeded int                   `json:"commands_succeeded"`
+	CommandsFailed    int                   `json:"commands_failed"`
+	CommandsTimedOut  int                   `json:"commands_timed_out"`
+	Sensors           []SensorHealthMetrics `json:"sensors"`
+}
+
+// SensorHealthMetrics summarizes one sensor stream of a device over the report window
+type SensorHealthMetrics struct {
+	SensorType        string     `json:"sensor_type" example:"temperature"`
+	Readings          int        `json:"readings"`
+	HoursWithReadings int        `json:"hours_with_readings"`
+	LongestGapSeconds int64      `json:"longest_gap_seconds"`
+	LastReadingAt     *time.Time `json:"last_reading_at,omitempty"`
+	LastValue         *float64   `json:"last_value,omitempty"`
+	// UnchangedSeconds is how long the sensor has reported the same value up to its last reading
+	UnchangedSeconds int64    `json:"unchanged_seconds"`
+	OutOfRange       int      `json:"out_of_range"`
+	ValidMin         *float64 `json:"valid_min,omitempty"`
+	ValidMax         *float64 `json:"valid_max,omitempty"`
+}
+
+// DeviceMetricsReport lists the raw health measurements of every active device on a farm
+type DeviceMetricsReport struct {
+	FarmID      uuid.UUID             `json:"farm_id"`
+	WindowHours int                   `json:"window_hours"`
+	GeneratedAt time.Time             `json:"generated_at"`
+	Devices     []DeviceHealthMetrics `json:"devices"`
 }
@@ -12,4 +12,5 @@ type CoopWithDevices struct {
 	Temperature *float64  `json:"temperature,omitempty"`
 	Humidity    *float64  `json:"humidity,omitempty"`
 	LastUpdated *time.Time `json:"last_updated,omitempty"`
+	Metrics     map[string]float64 `json:"metrics,omitempty"`
 }
@@ -1,6 +1,7 @@
 package schemas
 
 import (
+	"middleware/models"
 	"time"
 
 	"github.com/google/uuid"
@@ -41,6 +42,54 @@ type DeviceStatusResponse struct {
 	LastCommandAt     *time.Time `json:"last_command_at"`
 	CurrentValue       *float64   `json:"current_value"`
 	Unit               *string    `json:"unit"`
+	Shadow            *DeviceShadow `json:"shadow,omitempty"`
+	Config            *DeviceConfigStatus `json:"config,omitempty"`
+}
+
+// DeviceConfigStatus compares the latest config version with the one the gateway applied
+type DeviceConfigStatus struct {
+	DeviceID       uuid.UUID                    `json:"device_id"`
+	Status         string                       `json:"status"` // none, pending, applied, failed
+	DesiredVersion int                          `json:"desired_version"`
+	AppliedVersion *int                         `json:"applied_version,omitempty"`
+	Error          *string                      `json:"error,omitempty"`
+	Versions       []models.DeviceConfigVersion `json:"versions,omitempty"`
+}
+
+// ConfigApplyReport is a gateway's acknowledgement of a config version
+type ConfigApplyReport struct {
+	DeviceID string  `json:"device_id"` // "<hardware_id>:<model>" or "<model>"
+	Version  int     `json:"version"`
+	Status   string  `json:"status"` // applied, failed
+	Error    *string `json:"error,omitempty"`
+}
+
+// ShadowState is one side (desired or reported) of a device shadow
+type ShadowState struct {
+	State     *string    `json:"state"`
+	Value     *string    `json:"value,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// DeviceShadow compares what was asked of a device with what the gateway reports.
+// Delta holds the desired fields the device has not reached yet; nil when in sync.
+type DeviceShadow struct {
+	DeviceID   uuid.UUID    `json:"device_id"`
+	HardwareID string       `json:"hardware_id"`
+	Model      *string      `json:"model,omitempty"`
+	Desired    ShadowState  `json:"desired"`
+	Reported   ShadowState  `json:"reported"`
+	Delta      *ShadowState `json:"delta"`
+	InSync     bool         `json:"in_sync"`
+	Version    int          `json:"version"`
+}
+
+// ReportedDeviceState is a gateway's report of a device's actual state.
+// DeviceID is the gateway-side id ("<hardware_id>:<model>") or just the model.
+type ReportedDeviceState struct {
+	DeviceID string  `json:"device_id"`
+	State    *string `json:"state"`
+	Value    *string `json:"value,omitempty"`
 }
 
 // CommandEntry represents a single command record in history
@@ -61,12 +110,149 @@ type BatchResult struct {
 	CommandID uuid.UUID `json:"command_id"`
 	DeviceID  uuid.UUID `json:"device_id"`
 	Status    string    `json:"status"`
+	ErrorCode *string   `json:"error_code,omitempty"`
+	Error     *string   `json:"error,omitempty"`
+}
+
+// DeviceSelector targets the devices carrying a tag or belonging to a group
+type DeviceSelector struct {
+	Tag     *string    `json:"tag,omitempty" example:"fans"`
+	GroupID *uuid.UUID `json:"group_id,omitempty"`
+}
+
+// IsEmpty reports whether neither a tag nor a group was given
+func (s DeviceSelector) IsEmpty() bool {
+	return (s.Tag == nil || *s.Tag == "") && s.GroupID == nil
 }
 
-// BatchCommandRequest represents a request to issue commands to multiple devices
+// BatchCommandRequest represents a request to issue commands to multiple devices.
+// Devices matched by the selector are added to DeviceIDs.
 type BatchCommandRequest struct {
+	DeviceSelector
 	DeviceIDs      []uuid.UUID `json:"device_ids"`
 	CommandType    string      `json:"command_type"`
 	Parameters     *string     `json:"parameters,omitempty"`
 	ActionDuration *int        `json:"action_duration,omitempty" example:"300"`
 }
+
+// CommandCapability describes one command a device accepts and its limits
+type CommandCapability struct {
+	CommandType       string   `json:"command_type" example:"set_value"`
+	ValueMin          *float64 `json:"value_min,omitempty" example:"0"`
+	ValueMax          *float64 `json:"value_max,omitempty" example:"100"`
+	AllowedValues     []string `json:"allowed_values,omitempty"`
+	Unit              *string  `json:"unit,omitempty" example:"%"`
+	MaxActionDuration *int     `json:"max_action_duration,omitempty" example:"1800"`
+}
+
+// DeviceCapabilitiesResponse lists the commands a device accepts
+type DeviceCapabilitiesResponse struct {
+	DeviceID uuid.UUID           `json:"device_id"`
+	Type     string              `json:"type"`
+	Model    *string             `json:"model,omitempty"`
+	Source   string              `json:"source" example:"model"` // "reported", "model" (merged with type defaults), "type"
+	Commands []CommandCapability `json:"commands"`
+}
+
+// EmergencyStopRequest triggers an emergency stop for a whole farm, a single coop, or the
+// devices matched by a tag or group (optionally within the coop)
+type EmergencyStopRequest struct {
+	DeviceSelector
+	CoopID *uuid.UUID `json:"coop_id,omitempty"`
+	Reason *string    `json:"reason,omitempty" example:"Smoke in coop 2"`
+}
+
+// EmergencyResumeRequest releases an emergency stop latch
+type EmergencyResumeRequest struct {
+	DeviceSelector
+	CoopID *uuid.UUID `json:"coop_id,omitempty"`
+	Note   *string    `json:"note,omitempty" example:"Checked wiring, safe to resume"`
+}
+
+// EmergencyStopStatus describes an emergency stop latch
+type EmergencyStopStatus struct {
+	ID                uuid.UUID   `json:"id"`
+	FarmID            uuid.UUID   `json:"farm_id"`
+	CoopID            *uuid.UUID  `json:"coop_id,omitempty"`
+	Selector          *string     `json:"selector,omitempty"`   // "tag:<tag>" or "group:<id>"
+	DeviceIDs         []uuid.UUID `json:"device_ids,omitempty"` // devices latched by a selector stop
+	Reason            *string     `json:"reason,omitempty"`
+	Active            bool        `json:"active"`
+	CommandsCancelled int         `json:"commands_cancelled"`
+	CommandsIssued    int         `json:"commands_issued"`
+	CommandIDs        []uuid.UUID `json:"command_ids,omitempty"`
+	TriggeredBy       uuid.UUID   `json:"triggered_by"`
+	TriggeredAt       time.Time   `json:"triggered_at"`
+	ResumedBy         *uuid.UUID  `json:"resumed_by,omitempty"`
+	ResumedAt         *time.Time  `json:"resumed_at,omitempty"`
+	ResumeNote        *string     `json:"resume_note,omitempty"`
+}
+
+// CreateInterlockRequest defines a safety rule for actuators in a coop
+type CreateInterlockRequest struct {
+	RuleType        string     `json:"rule_type" example:"mutual_exclusion"`
+	DeviceID        uuid.UUID  `json:"device_id"`
+	OtherDeviceID   *uuid.UUID `json:"other_device_id,omitempty"`
+	DurationSeconds *int       `json:"duration_seconds,omitempty" example:"1200"`
+	Description     *string    `json:"description,omitempty" example:"Heater and fan never run together"`
+}
+
+// UpdateInterlockRequest changes an interlock's limit, description or enables/disables it
+type UpdateInterlockRequest struct {
+	DurationSeconds *int    `json:"duration_seconds,omitempty"`
+	Description     *string `json:"description,omitempty"`
+	IsActive        *bool   `json:"is_active,omitempty"`
+}
+
+// StartCalibrationRequest opens a calibration session for one sensor of a device
+type StartCalibrationRequest struct {
+	SensorType string `json:"sensor_type" example:"temperature"`
+}
+
+// CalibrationPointRequest adds a reference value; the raw value is taken from recent readings unless given
+type CalibrationPointRequest struct {
+	ReferenceValue *float64 `json:"reference_value" example:"30.5"`
+	RawValue       *float64 `json:"raw_value,omitempty" example:"29.8"`
+}
+
+// CalibrationSessionDetail is a session with its captured points
+type CalibrationSessionDetail struct {
+	models.CalibrationSession
+	Points []models.CalibrationPoint `json:"points"`
+}
+
+// ReplaceDeviceRequest re-points a logical device to new hardware. NewDeviceKey defaults to
+// "<new_hardware_id>:<model>", the key gateways report devices under.
+type ReplaceDeviceRequest struct {
+	NewHardwareID    string  `json:"new_hardware_id" example:"esp32-a1b2c3"`
+	NewDeviceKey     *string `json:"new_device_key,omitempty"`
+	FirmwareVersion  *string `json:"firmware_version,omitempty"`
+	Reason           *string `json:"reason,omitempty" example:"sensor failed"`
+	ResetCalibration bool    `json:"reset_calibration,omitempty"`
+}
+
+// DeviceTimelineEntry is one event in a device's life
+type DeviceTimelineEntry struct {
+	At      time.Time              `json:"at"`
+	Type    string                 `json:"type"` // created, replaced, config, calibration, firmware
+	Summary string                 `json:"summary"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// DeviceTagsRequest replaces the tags on a device
+type DeviceTagsRequest struct {
+	Tags []string `json:"tags" example:"fans,north side"`
+}
+
+// DeviceTagCount is a tag in use on a farm
+type DeviceTagCount struct {
+	Tag         string `json:"tag"`
+	DeviceCount int    `json:"device_count"`
+}
+
+// DeviceGroupRequest creates or updates a named device group. DeviceIDs, when given, replaces the members.
+type DeviceGroupRequest struct {
+	Name        *string     `json:"name,omitempty" example:"North side"`
+	Description *string     `json:"description,omitempty"`
+	DeviceIDs   []uuid.UUID `json:"device_ids,omitempty"`
+}
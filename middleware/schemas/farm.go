@@ -43,3 +43,28 @@ type MemberInfo struct {
 	InvitedBy uuid.UUID `json:"invited_by"`
 	JoinedAt  string    `json:"joined_at"`
 }
+
+// TariffPeriod is a time-of-use band in the farm's local time. A period may wrap past
+// midnight (e.g. 22:00-06:00). Hours outside every period use the base rate.
+type TariffPeriod struct {
+	Label      *string `json:"label,omitempty" example:"night"`
+	StartTime  string  `json:"start_time" example:"22:00"`
+	EndTime    string  `json:"end_time" example:"06:00"`
+	RatePerKWh float64 `json:"rate_per_kwh" example:"480"`
+}
+
+// FarmTariff is the electricity price used for energy cost estimates
+type FarmTariff struct {
+	FarmID         uuid.UUID      `json:"farm_id"`
+	Currency       string         `json:"currency" example:"KHR"`
+	BaseRatePerKWh float64        `json:"base_rate_per_kwh" example:"730"`
+	Periods        []TariffPeriod `json:"periods"`
+	UpdatedAt      *time.Time     `json:"updated_at,omitempty"`
+}
+
+// UpdateFarmTariffRequest replaces a farm's tariff including its time-of-use periods
+type UpdateFarmTariffRequest struct {
+	Currency       string         `json:"currency" example:"KHR"`
+	BaseRatePerKWh float64        `json:"base_rate_per_kwh" example:"730"`
+	Periods        []TariffPeriod `json:"periods"`
+}
@@ -0,0 +1,41 @@
+package schemas
+
+import (
+	"middleware/models"
+
+	"github.com/google/uuid"
+)
+
+// CreateOTACampaignRequest starts a rollout. Targets devices whose model matches the firmware,
+// restricted to FarmIDs when given and to TargetPercentage of gateways (default 100).
+type CreateOTACampaignRequest struct {
+	FirmwareID          uuid.UUID   `json:"firmware_id"`
+	Name                string      `json:"name" example:"ESP32 1.4.0 pilot"`
+	TargetPercentage    *int        `json:"target_percentage,omitempty" example:"10"`
+	FarmIDs             []uuid.UUID `json:"farm_ids,omitempty"`
+	FailureThresholdPct *int        `json:"failure_threshold_pct,omitempty" example:"20"`
+	MinSampleSize       *int        `json:"min_sample_size,omitempty" example:"3"`
+}
+
+// ExpandOTACampaignRequest widens a campaign to a larger share of gateways
+type ExpandOTACampaignRequest struct {
+	TargetPercentage int `json:"target_percentage" example:"50"`
+}
+
+// OTACampaignDetail is a campaign with per-device progress
+type OTACampaignDetail struct {
+	models.OTACampaign
+	Firmware *models.FirmwareArtifact   `json:"firmware,omitempty"`
+	Counts   map[string]int             `json:"counts"`
+	Devices  []models.OTACampaignDevice `json:"devices"`
+}
+
+// OTAProgressReport is sent by gateways in heartbeats (or over the WebSocket) while updating.
+// DeviceID is the gateway-side id or model; empty means every device behind the gateway.
+type OTAProgressReport struct {
+	DeviceID        string  `json:"device_id,omitempty"`
+	FirmwareVersion *string `json:"firmware_version,omitempty"`
+	Status          string  `json:"status" example:"installing"` // downloading, installing, succeeded, failed
+	ProgressPct     *int    `json:"progress_pct,omitempty"`
+	Error           *string `json:"error,omitempty"`
+}
@@ -0,0 +1,66 @@
+package schemas
+
+import (
+	"middleware/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GatewayDiagnostics is the optional "diagnostics" block of a gateway heartbeat. Every field is
+// optional; gateways send what their hardware can measure.
+type GatewayDiagnostics struct {
+	UptimeSeconds *int64   `json:"uptime_seconds,omitempty" example:"86400"`
+	CPUTempC      *float64 `json:"cpu_temp_c,omitempty" example:"54.2"`
+	Load1m        *float64 `json:"load_1m,omitempty" example:"0.42"`
+	DiskFreeMB    *float64 `json:"disk_free_mb,omitempty" example:"2048"`
+	DiskFreePct   *float64 `json:"disk_free_pct,omitempty" example:"37.5"`
+	MemFreeMB     *float64 `json:"mem_free_mb,omitempty" example:"180"`
+	MemFreePct    *float64 `json:"mem_free_pct,omitempty" example:"35"`
+	WifiRSSI      *int     `json:"wifi_rssi,omitempty" example:"-61"`
+	CellularRSSI  *int     `json:"cellular_rssi,omitempty" example:"-85"`
+	// QueueDepth is the number of messages the gateway is holding locally until it can send them
+	QueueDepth *int `json:"queue_depth,omitempty" example:"0"`
+	// ClockOffsetMs is the gateway clock minus NTP/server time
+	ClockOffsetMs *int64 `json:"clock_offset_ms,omitempty" example:"-120"`
+}
+
+// IsEmpty reports whether no measurement was sent
+func (d GatewayDiagnostics) IsEmpty() bool {
+	return d.UptimeSeconds == nil && d.CPUTempC == nil && d.Load1m == nil && d.DiskFreeMB == nil &&
+		d.DiskFreePct == nil && d.MemFreeMB == nil && d.MemFreePct == nil && d.WifiRSSI == nil &&
+		d.CellularRSSI == nil && d.QueueDepth == nil && d.ClockOffsetMs == nil
+}
+
+// GatewayDiagnosticsHistory is the diagnostics time series of one gateway
+type GatewayDiagnosticsHistory struct {
+	HardwareID   string                            `json:"hardware_id"`
+	WindowHours  int                               `json:"window_hours"`
+	Latest       *models.GatewayDiagnosticsSample  `json:"latest"`
+	Samples      []models.GatewayDiagnosticsSample `json:"samples"`
+	ClockSkew    *GatewayClockSkew                 `json:"clock_skew"`
+	ActiveAlerts []models.Alert                    `json:"active_alerts"`
+}
+
+// GatewayClockSkew is the latest measured skew of a gateway's clock against server time
+type GatewayClockSkew struct {
+	SkewMs int64 `json:"skew_ms" example:"-1500"`
+	// Source is telemetry, telemetry_batch or diagnostics
+	Source     string    `json:"source" example:"telemetry"`
+	MeasuredAt time.Time `json:"measured_at"`
+}
+
+// GatewayMaintenanceRequest queues a maintenance command for a gateway
+type GatewayMaintenanceRequest struct {
+	// Action is one of reboot, restart_agent, upload_logs, rediscover
+	Action string `json:"action" example:"upload_logs"`
+	// Lines is how many of the latest log lines upload_logs should send (default 200)
+	Lines *int `json:"lines,omitempty" example:"500"`
+}
+
+// GatewayLogUploadRequest carries the log lines a gateway uploads for an upload_logs command
+type GatewayLogUploadRequest struct {
+	CommandID  uuid.UUID `json:"command_id"`
+	HardwareID string    `json:"hardware_id,omitempty"`
+	Lines      []string  `json:"lines"`
+}
@@ -7,9 +7,11 @@ import (
 	"github.com/google/uuid"
 )
 
-// CreateScheduleRequest represents the request to create an automated schedule
+// CreateScheduleRequest represents the request to create an automated schedule.
+// It targets either one device or the devices matched by a tag or group at execution time.
 type CreateScheduleRequest struct {
-	DeviceID       uuid.UUID       `json:"device_id" example:"550e8400-e29b-41d4-a716-446655440000"`
+	DeviceSelector
+	DeviceID       *uuid.UUID      `json:"device_id,omitempty" example:"550e8400-e29b-41d4-a716-446655440000"`
 	CoopID         *uuid.UUID      `json:"coop_id,omitempty"`
 	Name           string          `json:"name" example:"Daily Watering"`
 	ScheduleType   string          `json:"schedule_type" example:"time_based"` // "time_based", "duration_based", "condition_based"
@@ -53,8 +53,9 @@ type PaginatedResponse struct {
 
 // ErrorResponse for error responses
 type ErrorResponse struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
 }
 
 // JSONResponse for simple success/message responses
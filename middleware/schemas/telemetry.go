@@ -1,13 +1,18 @@
 package schemas
 
-import "time"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type DeviceReportItem struct {
-	Type            string  `json:"type"`
-	Model           string  `json:"model"`
-	Name            string  `json:"name"`
-	Active          *bool   `json:"active,omitempty"`
-	FirmwareVersion *string `json:"firmware_version,omitempty"`
+	Type            string              `json:"type"`
+	Model           string              `json:"model"`
+	Name            string              `json:"name"`
+	Active          *bool               `json:"active,omitempty"`
+	FirmwareVersion *string             `json:"firmware_version,omitempty"`
+	Capabilities    []CommandCapability `json:"capabilities,omitempty"`
 }
 
 type DeviceReportRequest struct {
@@ -15,16 +20,108 @@ type DeviceReportRequest struct {
 	Devices    []DeviceReportItem `json:"devices"`
 }
 
+// TelemetrySensors holds the original fixed sensor fields; new metrics go in the metrics map
 type TelemetrySensors struct {
 	TemperatureC *float64 `json:"temperature_c,omitempty"`
 	HumidityPct  *float64 `json:"humidity_pct,omitempty"`
 	WaterLevel   *float64 `json:"water_level_raw,omitempty"`
 }
 
+// TelemetryRequest is one sensor snapshot. SentAt is the gateway's clock when it sent the
+// request and is used to measure the gateway's clock skew.
 type TelemetryRequest struct {
-	HardwareID string           `json:"hardware_id,omitempty"`
-	Timestamp  *time.Time       `json:"timestamp,omitempty"`
-	Sensors    TelemetrySensors `json:"sensors"`
+	HardwareID string             `json:"hardware_id,omitempty"`
+	Timestamp  *time.Time         `json:"timestamp,omitempty"`
+	SentAt     *time.Time         `json:"sent_at,omitempty"`
+	Sensors    TelemetrySensors   `json:"sensors"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+}
+
+// TelemetryIngestResponse reports the timestamp a snapshot was stored under
+type TelemetryIngestResponse struct {
+	Timestamp time.Time `json:"timestamp"`
+	// TimestampStatus is ok, skew_corrected or server_time
+	TimestampStatus string `json:"timestamp_status" example:"ok"`
+	// ClockSkewMs is the gateway clock minus server time, when known
+	ClockSkewMs *int64 `json:"clock_skew_ms,omitempty" example:"-1500"`
+}
+
+// TelemetryBatchItem is one timestamped snapshot in a batch/backfill upload
+type TelemetryBatchItem struct {
+	Timestamp *time.Time         `json:"timestamp"`
+	Sensors   TelemetrySensors   `json:"sensors"`
+	Metrics   map[string]float64 `json:"metrics,omitempty"`
+}
+
+type TelemetryBatchRequest struct {
+	HardwareID string               `json:"hardware_id,omitempty"`
+	SentAt     *time.Time           `json:"sent_at,omitempty"`
+	Items      []TelemetryBatchItem `json:"items"`
+}
+
+// TelemetryBatchItemResult reports whether one batch item was stored
+type TelemetryBatchItemResult struct {
+	Index     int        `json:"index"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// TimestampCorrected is set when the timestamp was shifted by the gateway's clock skew
+	TimestampCorrected bool   `json:"timestamp_corrected,omitempty"`
+	Accepted           bool   `json:"accepted"`
+	Readings           int    `json:"readings"`
+	Flagged            int    `json:"flagged,omitempty"`
+	Reason             string `json:"reason,omitempty"`
+}
+
+type TelemetryBatchResponse struct {
+	Accepted        int                        `json:"accepted"`
+	Rejected        int                        `json:"rejected"`
+	Readings        int                        `json:"readings"`
+	Flagged         int                        `json:"flagged"`
+	AlertsEvaluated bool                       `json:"alerts_evaluated"`
+	ClockSkewMs     *int64                     `json:"clock_skew_ms,omitempty"`
+	Results         []TelemetryBatchItemResult `json:"results"`
+}
+
+// MetricDefinition is a registered telemetry metric and the sensor device model that reports it
+type MetricDefinition struct {
+	Name        string   `json:"name" example:"ammonia"`
+	Label       string   `json:"label" example:"Ammonia"`
+	Unit        string   `json:"unit" example:"ppm"`
+	ValidMin    *float64 `json:"valid_min,omitempty"`
+	ValidMax    *float64 `json:"valid_max,omitempty"`
+	DeviceModel string   `json:"device_model" example:"ammonia_sensor"`
+	DeviceName  string   `json:"device_name" example:"Ammonia Sensor"`
+	AlertBelow  *float64 `json:"alert_below,omitempty"`
+	AlertAbove  *float64 `json:"alert_above,omitempty"`
+	// Readings changing faster than this per minute, or further than SpikeDelta from the median
+	// of recent readings, are flagged suspect
+	MaxRatePerMin *float64 `json:"max_rate_per_min,omitempty"`
+	SpikeDelta    *float64 `json:"spike_delta,omitempty"`
+}
+
+type MetricPoint struct {
+	Value float64 `json:"value"`
+	Time  string  `json:"time"`
+}
+
+type MetricHourlyPoint struct {
+	Hour  string  `json:"hour"`
+	Value float64 `json:"value"`
+}
+
+type MetricDaySummary struct {
+	Label  string              `json:"label,omitempty"`
+	High   *MetricPoint        `json:"high,omitempty"`
+	Low    *MetricPoint        `json:"low,omitempty"`
+	Hourly []MetricHourlyPoint `json:"hourly,omitempty"`
+}
+
+type MetricTimelineResponse struct {
+	Metric      MetricDefinition   `json:"metric"`
+	SensorFound bool               `json:"sensor_found"`
+	CoopName    string             `json:"coop_name"`
+	Current     *float64           `json:"current,omitempty"`
+	Today       *MetricDaySummary  `json:"today,omitempty"`
+	History     []MetricDaySummary `json:"history"`
 }
 
 type TempPoint struct {
@@ -53,3 +150,61 @@ type TemperatureTimelineResponse struct {
 	Today           *DaySummary `json:"today,omitempty"`
 	History         []DaySummary `json:"history"`
 }
+
+// MetricSeriesQuery selects a bucketed series of one metric. From/To are RFC 3339 times or
+// YYYY-MM-DD days in the farm's time zone.
+type MetricSeriesQuery struct {
+	From    string
+	To      string
+	Bucket  string
+	Agg     string
+	CoopIDs []uuid.UUID
+	// IncludeSuspect adds suspect and bad raw readings; rollups only ever hold good readings
+	IncludeSuspect bool
+}
+
+type MetricSeriesPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Count int64     `json:"count"`
+}
+
+// MetricSeriesGap is a run of buckets without any reading
+type MetricSeriesGap struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type CoopMetricSeries struct {
+	CoopID   uuid.UUID           `json:"coop_id"`
+	CoopName string              `json:"coop_name"`
+	Points   []MetricSeriesPoint `json:"points"`
+	Gaps     []MetricSeriesGap   `json:"gaps"`
+}
+
+type MetricSeriesResponse struct {
+	Metric        MetricDefinition   `json:"metric"`
+	From          time.Time          `json:"from"`
+	To            time.Time          `json:"to"`
+	Timezone      string             `json:"timezone"`
+	Bucket        string             `json:"bucket"`
+	BucketSeconds int64              `json:"bucket_seconds"`
+	Agg           string             `json:"agg"`
+	Tiers         []string           `json:"tiers"`
+	Series        []CoopMetricSeries `json:"series"`
+}
+
+// TelemetryEvent is the data of a "telemetry" WebSocket event: the latest value of every metric
+// that changed in the coop since the previous event
+type TelemetryEvent struct {
+	CoopID  uuid.UUID                      `json:"coop_id"`
+	Metrics map[string]TelemetryEventValue `json:"metrics"`
+	// Readings is how many stored readings were merged into the event
+	Readings int `json:"readings" example:"3"`
+}
+
+type TelemetryEventValue struct {
+	Value     float64   `json:"value" example:"24.5"`
+	Unit      string    `json:"unit" example:"C"`
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -62,6 +62,9 @@ func (s *AnalyticsService) GetFarmDashboard(userID, farmID uuid.UUID) (*schemas.
 	resp.Alerts.Critical = criticalAlerts
 	resp.Alerts.Warning = warningAlerts
 	resp.RecentEvents = recentEvents
+	if energy, err := energySummary(farmID); err == nil {
+		resp.Energy = energy
+	}
 
 	return resp, nil
 }
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrCalibrationNotFound   = errors.New("calibration_not_found")
+	ErrCalibrationNotOpen    = errors.New("calibration_not_open")
+	ErrCalibrationOpen       = errors.New("calibration_already_open")
+	ErrCalibrationNoReading  = errors.New("calibration_no_recent_reading")
+	ErrCalibrationNoPoints   = errors.New("calibration_no_points")
+	ErrCalibrationDegenerate = errors.New("calibration_degenerate_points")
+	ErrCalibrationSensor     = errors.New("calibration_invalid_sensor")
+)
+
+// calibrationCaptureWindow is how far back raw readings count as concurrent with a reference value
+const calibrationCaptureWindow = 2 * time.Minute
+
+// calibrationParams returns the device_configurations parameter names holding a sensor's coefficients
+func calibrationParams(sensorType string) (offset, gain string) {
+	return "calibration_" + sensorType + "_offset", "calibration_" + sensorType + "_gain"
+}
+
+type CalibrationService struct {
+	farmService *FarmService
+}
+
+func NewCalibrationService() *CalibrationService {
+	return &CalibrationService{farmService: NewFarmService()}
+}
+
+// StartSession opens a calibration session. Only one session per device and sensor may be open.
+func (s *CalibrationService) StartSession(userID, farmID, deviceID uuid.UUID, req schemas.StartCalibrationRequest) (*schemas.CalibrationSessionDetail, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
+		return nil, err
+	}
+	sensorType := strings.ToLower(strings.TrimSpace(req.SensorType))
+	if sensorType == "" || len(sensorType) > 50 {
+		return nil, ErrCalibrationSensor
+	}
+
+	var deviceType string
+	err := database.DB.QueryRow(`SELECT type FROM devices WHERE id = $1 AND farm_id = $2`, deviceID, farmID).Scan(&deviceType)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var open bool
+	if err := database.DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM calibration_sessions WHERE device_id = $1 AND sensor_type = $2 AND status = 'open')
+	`, deviceID, sensorType).Scan(&open); err != nil {
+		return nil, err
+	}
+	if open {
+		return nil, ErrCalibrationOpen
+	}
+
+	session := models.CalibrationSession{
+		ID:         uuid.New(),
+		DeviceID:   deviceID,
+		FarmID:     farmID,
+		SensorType: sensorType,
+		Status:     "open",
+		StartedBy:  userID,
+		StartedAt:  time.Now(),
+	}
+	if _, err := database.DB.Exec(`
+		INSERT INTO calibration_sessions (id, device_id, farm_id, sensor_type, status, started_by, started_at)
+		VALUES ($1, $2, $3, $4, 'open', $5, $6)
+	`, session.ID, deviceID, farmID, sensorType, userID, session.StartedAt); err != nil {
+		return nil, err
+	}
+	return &schemas.CalibrationSessionDetail{CalibrationSession: session, Points: []models.CalibrationPoint{}}, nil
+}
+
+// ListSessions returns the device's calibration sessions, newest first
+func (s *CalibrationService) ListSessions(userID, farmID, deviceID uuid.UUID) ([]models.CalibrationSession, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	rows, err := database.DB.Query(`
+		SELECT id, device_id, farm_id, sensor_type, status, offset_value, gain_value, started_by, started_at, completed_at
+		FROM calibration_sessions WHERE device_id = $1 AND farm_id = $2
+		ORDER BY started_at DESC
+	`, deviceID, farmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]models.CalibrationSession, 0)
+	for rows.Next() {
+		var cs models.CalibrationSession
+		if err := rows.Scan(&cs.ID, &cs.DeviceID, &cs.FarmID, &cs.SensorType, &cs.Status, &cs.Offset, &cs.Gain,
+			&cs.StartedBy, &cs.StartedAt, &cs.CompletedAt); err != nil {
+			continue
+		}
+		sessions = append(sessions, cs)
+	}
+	return sessions, nil
+}
+
+// GetSession returns a session with its points
+func (s *CalibrationService) GetSession(userID, farmID, deviceID, sessionID uuid.UUID) (*schemas.CalibrationSessionDetail, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	return loadCalibrationSession(farmID, deviceID, sessionID)
+}
+
+// AddPoint records a reference value with the sensor's raw reading. Without an explicit raw value,
+// the raw readings stored in the capture window are averaged.
+func (s *CalibrationService) AddPoint(userID, farmID, deviceID, sessionID uuid.UUID, req schemas.CalibrationPointRequest) (*schemas.CalibrationSessionDetail, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
+		return nil, err
+	}
+	session, err := loadCalibrationSession(farmID, deviceID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != "open" {
+		return nil, ErrCalibrationNotOpen
+	}
+
+	now := time.Now()
+	point := models.CalibrationPoint{
+		ID:             uuid.New(),
+		SessionID:      sessionID,
+		ReferenceValue: *req.ReferenceValue,
+		CapturedAt:     now,
+	}
+	if req.RawValue != nil {
+		point.RawValue = *req.RawValue
+	} else {
+		var avg sql.NullFloat64
+		if err := database.DB.QueryRow(`
+			SELECT AVG(COALESCE(raw_value, value)), COUNT(*) FROM device_readings
+			WHERE device_id = $1 AND sensor_type = $2 AND timestamp >= $3
+		`, deviceID, session.SensorType, now.Add(-calibrationCaptureWindow)).Scan(&avg, &point.SampleCount); err != nil {
+			return nil, err
+		}
+		if !avg.Valid {
+			return nil, ErrCalibrationNoReading
+		}
+		point.RawValue = avg.Float64
+	}
+
+	if _, err := database.DB.Exec(`
+		INSERT INTO calibration_points (id, session_id, reference_value, raw_value, sample_count, captured_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, point.ID, sessionID, point.ReferenceValue, point.RawValue, point.SampleCount, now); err != nil {
+		return nil, err
+	}
+	session.Points = append(session.Points, point)
+	return session, nil
+}
+
+// CompleteSession fits the coefficients, stores them in device_configurations and pushes them
+// to the gateway config. One point gives an offset only; two or more give a least-squares line.
+func (s *CalibrationService) CompleteSession(userID, farmID, deviceID, sessionID uuid.UUID) (*schemas.CalibrationSessionDetail, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
+		return nil, err
+	}
+	session, err := loadCalibrationSession(farmID, deviceID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != "open" {
+		return nil, ErrCalibrationNotOpen
+	}
+
+	offset, gain, err := fitCalibration(session.Points)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE calibration_sessions SET status = 'completed', offset_value = $2, gain_value = $3, completed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'open'
+	`, sessionID, offset, gain)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrCalibrationNotOpen
+	}
+
+	offsetName, gainName := calibrationParams(session.SensorType)
+	for name, value := range map[string]float64{offsetName: offset, gainName: gain} {
+		if _, err := tx.Exec(`
+			INSERT INTO device_configurations (id, device_id, parameter_name, parameter_value, is_calibrated, calibrated_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, true, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			ON CONFLICT (device_id, parameter_name)
+			DO UPDATE SET parameter_value = $4, is_calibrated = true, calibrated_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		`, uuid.New(), deviceID, name, strconv.FormatFloat(value, 'f', -1, 64)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	NewDeviceService().pushDeviceConfig(userID, farmID, deviceID)
+	return loadCalibrationSession(farmID, deviceID, sessionID)
+}
+
+// CancelSession discards an open session; stored coefficients stay unchanged
+func (s *CalibrationService) CancelSession(userID, farmID, deviceID, sessionID uuid.UUID) error {
+	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
+		return err
+	}
+	res, err := database.DB.Exec(`
+		UPDATE calibration_sessions SET status = 'cancelled', completed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND device_id = $2 AND farm_id = $3 AND status = 'open'
+	`, sessionID, deviceID, farmID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := loadCalibrationSession(farmID, deviceID, sessionID); err != nil {
+			return err
+		}
+		return ErrCalibrationNotOpen
+	}
+	return nil
+}
+
+func loadCalibrationSession(farmID, deviceID, sessionID uuid.UUID) (*schemas.CalibrationSessionDetail, error) {
+	var d schemas.CalibrationSessionDetail
+	err := database.DB.QueryRow(`
+		SELECT id, device_id, farm_id, sensor_type, status, offset_value, gain_value, started_by, started_at, completed_at
+		FROM calibration_sessions WHERE id = $1 AND device_id = $2 AND farm_id = $3
+	`, sessionID, deviceID, farmID).Scan(&d.ID, &d.DeviceID, &d.FarmID, &d.SensorType, &d.Status, &d.Offset, &d.Gain,
+		&d.StartedBy, &d.StartedAt, &d.CompletedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCalibrationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, session_id, reference_value, raw_value, sample_count, captured_at
+		FROM calibration_points WHERE session_id = $1
+		ORDER BY captured_at ASC
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	d.Points = make([]models.CalibrationPoint, 0)
+	for rows.Next() {
+		var p models.CalibrationPoint
+		if err := rows.Scan(&p.ID, &p.SessionID, &p.ReferenceValue, &p.RawValue, &p.SampleCount, &p.CapturedAt); err != nil {
+			continue
+		}
+		d.Points = append(d.Points, p)
+	}
+	return &d, nil
+}
+
+// fitCalibration solves reference = gain * raw + offset
+func fitCalibration(points []models.CalibrationPoint) (offset, gain float64, err error) {
+	switch len(points) {
+	case 0:
+		return 0, 0, ErrCalibrationNoPoints
+	case 1:
+		return points[0].ReferenceValue - points[0].RawValue, 1, nil
+	}
+
+	n := float64(len(points))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		sumX += p.RawValue
+		sumY += p.ReferenceValue
+		sumXY += p.RawValue * p.ReferenceValue
+		sumXX += p.RawValue * p.RawValue
+	}
+	denom := n*sumXX - sumX*sumX
+	if math.Abs(denom) < 1e-9 {
+		return 0, 0, ErrCalibrationDegenerate
+	}
+	gain = (n*sumXY - sumX*sumY) / denom
+	if gain <= 0 {
+		return 0, 0, ErrCalibrationDegenerate
+	}
+	offset = (sumY - gain*sumX) / n
+	return offset, gain, nil
+}
+
+// applyCalibration corrects a raw reading with the device's stored coefficients.
+// The raw value is returned only when a calibration changed the reading.
+func applyCalibration(deviceID uuid.UUID, sensorType string, raw float64) (float64, *float64) {
+	offset, gain := calibrationCoefficients(deviceID, sensorType)
+	return calibrate(offset, gain, raw)
+}
+
+// calibrate applies loaded coefficients; see applyCalibration.
+func calibrate(offset, gain, raw float64) (float64, *float64) {
+	if offset == 0 && gain == 1 {
+		return raw, nil
+	}
+	return gain*raw + offset, &raw
+}
+
+// calibrationCoefficients loads the device's offset and gain for a sensor type (0 and 1 when uncalibrated).
+func calibrationCoefficients(deviceID uuid.UUID, sensorType string) (offset, gain float64) {
+	offsetName, gainName := calibrationParams(sensorType)
+	offset, gain = 0.0, 1.0
+	rows, err := database.DB.Query(`
+		SELECT parameter_name, parameter_value FROM device_configurations
+		WHERE device_id = $1 AND parameter_name IN ($2, $3)
+	`, deviceID, offsetName, gainName)
+	if err != nil {
+		log.Printf("Calibration lookup error (%s): %v", deviceID, err)
+		return offset, gain
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, value string
+		if rows.Scan(&name, &value) != nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			continue
+		}
+		if name == offsetName {
+			offset = v
+		} else {
+			gain = v
+		}
+	}
+	return offset, gain
+}
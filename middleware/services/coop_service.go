@@ -31,50 +31,18 @@ func (s *CoopService) attachLatestTelemetry(coopID uuid.UUID, c *schemas.CoopWit
 		return
 	}
 
-	var (
-		tempVal sql.NullFloat64
-		tempTs  sql.NullTime
-		humVal  sql.NullFloat64
-		humTs   sql.NullTime
-	)
-
-	_ = database.DB.QueryRow(`
-		SELECT dr.value, dr.timestamp
-		FROM device_readings dr
-		JOIN devices d ON dr.device_id = d.id
-		WHERE d.coop_id = $1 AND dr.sensor_type = 'temperature'
-		ORDER BY dr.timestamp DESC
-		LIMIT 1
-	`, coopID).Scan(&tempVal, &tempTs)
-
-	_ = database.DB.QueryRow(`
-		SELECT dr.value, dr.timestamp
-		FROM device_readings dr
-		JOIN devices d ON dr.device_id = d.id
-		WHERE d.coop_id = $1 AND dr.sensor_type = 'humidity'
-		ORDER BY dr.timestamp DESC
-		LIMIT 1
-	`, coopID).Scan(&humVal, &humTs)
-
-	if tempVal.Valid {
-		v := tempVal.Float64
+	metrics, latest, err := latestCoopMetrics(coopID)
+	if err != nil || len(metrics) == 0 {
+		return
+	}
+	c.Metrics = metrics
+	if v, ok := metrics["temperature"]; ok {
 		c.Temperature = &v
 	}
-	if humVal.Valid {
-		v := humVal.Float64
+	if v, ok := metrics["humidity"]; ok {
 		c.Humidity = &v
 	}
-
-	var latest time.Time
-	if tempTs.Valid && tempTs.Time.After(latest) {
-		latest = tempTs.Time
-	}
-	if humTs.Valid && humTs.Time.After(latest) {
-		latest = humTs.Time
-	}
-	if !latest.IsZero() {
-		c.LastUpdated = &latest
-	}
+	c.LastUpdated = latest
 }
 
 // ListCoops returns all coops for a farm
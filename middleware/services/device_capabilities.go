@@ -0,0 +1,320 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"middleware/database"
+	"middleware/schemas"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// CommandValidationError describes why a command was rejected for a device.
+// Handlers return it to the client as a structured 400 error.
+type CommandValidationError struct {
+	Code    string                      `json:"code"`
+	Message string                      `json:"message"`
+	Field   string                      `json:"field,omitempty"`
+	Allowed []schemas.CommandCapability `json:"allowed,omitempty"`
+}
+
+func (e *CommandValidationError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func floatPtr(v float64) *float64 { return &v }
+func intPtr(v int) *int           { return &v }
+func strPtr(v string) *string     { return &v }
+
+var onOffCapabilities = []schemas.CommandCapability{
+	{CommandType: "on"},
+	{CommandType: "off"},
+}
+
+// defaultTypeCapabilities apply when neither the gateway nor the model declares capabilities
+var defaultTypeCapabilities = map[string][]schemas.CommandCapability{
+	"relay": onOffCapabilities,
+	"gpio":  onOffCapabilities,
+	"pwm": {
+		{CommandType: "on"},
+		{CommandType: "off"},
+		{CommandType: "set_value", ValueMin: floatPtr(0), ValueMax: floatPtr(100), Unit: strPtr("%")},
+	},
+	"servo": {
+		{CommandType: "open"},
+		{CommandType: "close"},
+		{CommandType: "set_value", ValueMin: floatPtr(0), ValueMax: floatPtr(180), Unit: strPtr("deg")},
+	},
+	"adc":    {},
+	"sensor": {},
+}
+
+// defaultModelCapabilities are seeded per known hardware model. They are merged over the type
+// defaults, so a model's limits win while commands only the type offers (e.g. pwm set_value) stay.
+var defaultModelCapabilities = map[string][]schemas.CommandCapability{
+	"feeder_motor": {
+		{CommandType: "on", MaxActionDuration: intPtr(1800)},
+		{CommandType: "off"},
+	},
+	"conveyor_belt": {
+		{CommandType: "on", MaxActionDuration: intPtr(3600)},
+		{CommandType: "off"},
+	},
+	"fan":           onOffCapabilities,
+	"heater":        onOffCapabilities,
+	"temp_humidity": {},
+	"water_level":   {},
+}
+
+// GetDeviceCapabilities returns the commands a device accepts
+func (s *DeviceService) GetDeviceCapabilities(userID, farmID, deviceID uuid.UUID) (*schemas.DeviceCapabilitiesResponse, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	target, err := loadCommandTarget(farmID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	caps, source, err := resolveCapabilities(target)
+	if err != nil {
+		return nil, err
+	}
+	return &schemas.DeviceCapabilitiesResponse{
+		DeviceID: deviceID,
+		Type:     target.Type,
+		Model:    target.Model,
+		Source:   source,
+		Commands: caps,
+	}, nil
+}
+
+// resolveCapabilities picks gateway-reported capabilities first, then the model defaults merged
+// over the type defaults
+func resolveCapabilities(target *commandTarget) ([]schemas.CommandCapability, string, error) {
+	rows, err := database.DB.Query(`
+		SELECT command_type, value_min, value_max, allowed_values, unit, max_action_duration
+		FROM device_capabilities
+		WHERE device_id = $1
+		ORDER BY command_type ASC
+	`, target.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	reported := make([]schemas.CommandCapability, 0)
+	for rows.Next() {
+		var c schemas.CommandCapability
+		var allowed []byte
+		if err := rows.Scan(&c.CommandType, &c.ValueMin, &c.ValueMax, &allowed, &c.Unit, &c.MaxActionDuration); err != nil {
+			continue
+		}
+		if len(allowed) > 0 {
+			_ = json.Unmarshal(allowed, &c.AllowedValues)
+		}
+		reported = append(reported, c)
+	}
+	if len(reported) > 0 {
+		return reported, "reported", nil
+	}
+
+	if target.Model != nil {
+		if caps, ok := defaultModelCapabilities[strings.ToLower(*target.Model)]; ok {
+			return mergeCapabilities(defaultTypeCapabilities[target.Type], caps), "model", nil
+		}
+	}
+	return defaultTypeCapabilities[target.Type], "type", nil
+}
+
+// mergeCapabilities returns the base capabilities with each command type the override declares
+// replaced by the override's entry, plus the override's other command types
+func mergeCapabilities(base, override []schemas.CommandCapability) []schemas.CommandCapability {
+	merged := make([]schemas.CommandCapability, 0, len(base)+len(override))
+	declared := make(map[string]bool, len(override))
+	for _, c := range override {
+		declared[c.CommandType] = true
+	}
+	for _, c := range base {
+		if !declared[c.CommandType] {
+			merged = append(merged, c)
+		}
+	}
+	return append(merged, override...)
+}
+
+// saveReportedCapabilities replaces the capabilities a gateway declared for a device
+func saveReportedCapabilities(deviceID uuid.UUID, caps []schemas.CommandCapability) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM device_capabilities WHERE device_id = $1`, deviceID); err != nil {
+		return err
+	}
+	for _, c := range caps {
+		commandType := strings.ToLower(strings.TrimSpace(c.CommandType))
+		if commandType == "" {
+			continue
+		}
+		var allowed interface{}
+		if len(c.AllowedValues) > 0 {
+			raw, _ := json.Marshal(c.AllowedValues)
+			allowed = raw
+		}
+		_, err := tx.Exec(`
+			INSERT INTO device_capabilities (id, device_id, command_type, value_min, value_max, allowed_values, unit, max_action_duration)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (device_id, command_type) DO UPDATE SET
+				value_min = EXCLUDED.value_min, value_max = EXCLUDED.value_max, allowed_values = EXCLUDED.allowed_values,
+				unit = EXCLUDED.unit, max_action_duration = EXCLUDED.max_action_duration, updated_at = CURRENT_TIMESTAMP
+		`, uuid.New(), deviceID, commandType, c.ValueMin, c.ValueMax, allowed, c.Unit, c.MaxActionDuration)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// validateCommand checks a command against the capabilities of its target device
+func validateCommand(target *commandTarget, commandType string, commandValue *string, actionDuration *int) error {
+	caps, _, err := resolveCapabilities(target)
+	if err != nil {
+		return err
+	}
+
+	var capability *schemas.CommandCapability
+	for i := range caps {
+		if caps[i].CommandType == commandType {
+			capability = &caps[i]
+			break
+		}
+	}
+	if capability == nil {
+		msg := fmt.Sprintf("command %q is not supported by this %s device", commandType, target.Type)
+		if len(caps) == 0 {
+			msg = fmt.Sprintf("%s devices do not accept commands", target.Type)
+		}
+		return &CommandValidationError{Code: "unsupported_command", Message: msg, Field: "command_type", Allowed: caps}
+	}
+
+	if actionDuration != nil {
+		if *actionDuration <= 0 {
+			return &CommandValidationError{Code: "invalid_duration", Message: "action_duration must be a positive number of seconds", Field: "action_duration"}
+		}
+		if capability.MaxActionDuration != nil && *actionDuration > *capability.MaxActionDuration {
+			return &CommandValidationError{
+				Code:    "duration_exceeds_limit",
+				Message: fmt.Sprintf("action_duration %ds exceeds the %ds limit for %q", *actionDuration, *capability.MaxActionDuration, commandType),
+				Field:   "action_duration",
+			}
+		}
+	}
+
+	needsValue := capability.ValueMin != nil || capability.ValueMax != nil || len(capability.AllowedValues) > 0
+	if !needsValue {
+		return nil
+	}
+	if commandValue == nil || strings.TrimSpace(*commandValue) == "" {
+		return &CommandValidationError{Code: "value_required", Message: fmt.Sprintf("command %q requires a value", commandType), Field: "command_value"}
+	}
+	value := strings.TrimSpace(*commandValue)
+
+	if len(capability.AllowedValues) > 0 {
+		for _, v := range capability.AllowedValues {
+			if strings.EqualFold(v, value) {
+				return nil
+			}
+		}
+		return &CommandValidationError{
+			Code:    "invalid_value",
+			Message: fmt.Sprintf("value %q is not one of: %s", value, strings.Join(capability.AllowedValues, ", ")),
+			Field:   "command_value",
+		}
+	}
+
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return &CommandValidationError{Code: "invalid_value", Message: fmt.Sprintf("value %q is not a number", value), Field: "command_value"}
+	}
+	if (capability.ValueMin != nil && num < *capability.ValueMin) || (capability.ValueMax != nil && num > *capability.ValueMax) {
+		unit := ""
+		if capability.Unit != nil {
+			unit = *capability.Unit
+		}
+		return &CommandValidationError{
+			Code:    "value_out_of_range",
+			Message: fmt.Sprintf("value %v is outside %s", num, formatRange(capability.ValueMin, capability.ValueMax, unit)),
+			Field:   "command_value",
+		}
+	}
+	return nil
+}
+
+// ValidateDeviceCommand validates a command for a device without issuing it (used by schedules)
+func ValidateDeviceCommand(farmID, deviceID uuid.UUID, commandType string, commandValue *string, actionDuration *int) error {
+	target, err := loadCommandTarget(farmID, deviceID)
+	if err != nil {
+		return err
+	}
+	return validateCommand(target, normalizeCommandType(commandType), commandValue, actionDuration)
+}
+
+func formatRange(min, max *float64, unit string) string {
+	switch {
+	case min != nil && max != nil:
+		return fmt.Sprintf("%v-%v%s", *min, *max, unit)
+	case min != nil:
+		return fmt.Sprintf(">= %v%s", *min, unit)
+	default:
+		return fmt.Sprintf("<= %v%s", *max, unit)
+	}
+}
+
+// legacyCommandTypes maps the model-specific names older dashboards and gateways use to the
+// canonical command types
+var legacyCommandTypes = map[string]string{
+	"turn_on": "on", "turn_off": "off",
+	"fan_on": "on", "fan_off": "off",
+	"heater_on": "on", "heater_off": "off",
+	"feeder_on": "on", "feeder_off": "off",
+	"conveyor_on": "on", "conveyor_off": "off",
+}
+
+func normalizeCommandType(commandType string) string {
+	commandType = strings.ToLower(strings.TrimSpace(commandType))
+	if canonical, ok := legacyCommandTypes[commandType]; ok {
+		return canonical
+	}
+	return commandType
+}
+
+// commandTarget is the device a command is addressed to
+type commandTarget struct {
+	ID         uuid.UUID
+	FarmID     uuid.UUID
+	CoopID     *uuid.UUID
+	Type       string
+	Model      *string
+	HardwareID string
+}
+
+func loadCommandTarget(farmID, deviceID uuid.UUID) (*commandTarget, error) {
+	var t commandTarget
+	err := database.DB.QueryRow(`
+		SELECT id, farm_id, coop_id, type, model, hardware_id
+		FROM devices
+		WHERE id = $1 AND farm_id = $2 AND is_active = true
+	`, deviceID, farmID).Scan(&t.ID, &t.FarmID, &t.CoopID, &t.Type, &t.Model, &t.HardwareID)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
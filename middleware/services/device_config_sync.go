@@ -0,0 +1,270 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// applyConfigCommandType carries a full config document to the gateway
+const applyConfigCommandType = "apply_config"
+
+// publishDeviceConfig snapshots the device's configuration as a new version and queues
+// apply_config for the gateway. Older versions still pending are superseded.
+func publishDeviceConfig(userID uuid.UUID, target *commandTarget) (*models.DeviceConfigVersion, error) {
+	rows, err := database.DB.Query(`
+		SELECT parameter_name, parameter_value, unit, min_value, max_value, is_calibrated
+		FROM device_configurations WHERE device_id = $1
+		ORDER BY parameter_name ASC
+	`, target.ID)
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string]interface{})
+	for rows.Next() {
+		var name, value string
+		var unit *string
+		var minValue, maxValue *float64
+		var calibrated bool
+		if err := rows.Scan(&name, &value, &unit, &minValue, &maxValue, &calibrated); err != nil {
+			continue
+		}
+		params[name] = map[string]interface{}{
+			"value":         value,
+			"unit":          unit,
+			"min_value":     minValue,
+			"max_value":     maxValue,
+			"is_calibrated": calibrated,
+		}
+	}
+	rows.Close()
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize version numbers per device
+	if _, err := tx.Exec(`SELECT id FROM devices WHERE id = $1 FOR UPDATE`, target.ID); err != nil {
+		return nil, err
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM device_config_versions WHERE device_id = $1`, target.ID).Scan(&version); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE device_commands SET status = 'cancelled', response = 'superseded by config version ' || $2::TEXT,
+			executed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE status = 'pending' AND id IN (
+			SELECT command_id FROM device_config_versions WHERE device_id = $1 AND status = 'pending'
+		)
+	`, target.ID, version); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE device_config_versions SET status = 'superseded' WHERE device_id = $1 AND status = 'pending'`, target.ID); err != nil {
+		return nil, err
+	}
+
+	document := map[string]interface{}{"version": version, "parameters": params}
+	payload, _ := json.Marshal(document)
+	value := string(payload)
+	cmd := newPendingCommand(userID, target, applyConfigCommandType, &value, nil)
+	if err := insertCommand(tx, cmd); err != nil {
+		return nil, err
+	}
+
+	cv := models.DeviceConfigVersion{
+		ID:        uuid.New(),
+		DeviceID:  target.ID,
+		Version:   version,
+		Document:  document,
+		Status:    "pending",
+		CommandID: &cmd.ID,
+		CreatedBy: &userID,
+		CreatedAt: time.Now(),
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO device_config_versions (id, device_id, farm_id, version, document, status, command_id, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, 'pending', $6, $7, $8)
+	`, cv.ID, cv.DeviceID, target.FarmID, version, value, cmd.ID, userID, cv.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	commandQueued(cmd, target.HardwareID)
+	events.PublishDeviceEvent(target.FarmID, target.ID, "device_config", map[string]interface{}{
+		"device_id": target.ID,
+		"version":   version,
+		"status":    "pending",
+	})
+	return &cv, nil
+}
+
+// pushDeviceConfig sends the updated configuration to the gateway as a new version.
+// The parameter is already saved, so a failure here only delays the push to the next change.
+func (s *DeviceService) pushDeviceConfig(userID, farmID, deviceID uuid.UUID) {
+	target, err := loadCommandTarget(farmID, deviceID)
+	if err != nil {
+		log.Printf("Config push error (%s): %v", deviceID, err)
+		return
+	}
+	if _, err := publishDeviceConfig(userID, target); err != nil {
+		log.Printf("Config push error (%s): %v", deviceID, err)
+	}
+}
+
+// GetDeviceConfigStatus reports whether the gateway applied the latest config version
+func (s *DeviceService) GetDeviceConfigStatus(userID, farmID, deviceID uuid.UUID) (*schemas.DeviceConfigStatus, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	var exists bool
+	if err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM devices WHERE id = $1 AND farm_id = $2)", deviceID, farmID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrDeviceNotFound
+	}
+
+	status, err := loadConfigStatus(deviceID, 20)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// loadConfigStatus summarizes config versions, including up to limit recent versions (0 for none)
+func loadConfigStatus(deviceID uuid.UUID, limit int) (*schemas.DeviceConfigStatus, error) {
+	status := &schemas.DeviceConfigStatus{DeviceID: deviceID, Status: "none"}
+
+	var latestStatus string
+	var latestError *string
+	err := database.DB.QueryRow(`
+		SELECT version, status, error FROM device_config_versions
+		WHERE device_id = $1 AND status <> 'superseded'
+		ORDER BY version DESC LIMIT 1
+	`, deviceID).Scan(&status.DesiredVersion, &latestStatus, &latestError)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Status = latestStatus
+	status.Error = latestError
+
+	var applied sql.NullInt64
+	_ = database.DB.QueryRow(`SELECT MAX(version) FROM device_config_versions WHERE device_id = $1 AND status = 'applied'`, deviceID).Scan(&applied)
+	if applied.Valid {
+		v := int(applied.Int64)
+		status.AppliedVersion = &v
+	}
+
+	if limit <= 0 {
+		return status, nil
+	}
+	rows, err := database.DB.Query(`
+		SELECT id, device_id, version, document, status, command_id, error, created_by, created_at, applied_at
+		FROM device_config_versions WHERE device_id = $1
+		ORDER BY version DESC LIMIT $2
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v models.DeviceConfigVersion
+		var document []byte
+		if err := rows.Scan(&v.ID, &v.DeviceID, &v.Version, &document, &v.Status, &v.CommandID, &v.Error, &v.CreatedBy, &v.CreatedAt, &v.AppliedAt); err != nil {
+			continue
+		}
+		_ = json.Unmarshal(document, &v.Document)
+		status.Versions = append(status.Versions, v)
+	}
+	return status, nil
+}
+
+// ApplyConfigReports records config versions an authenticated gateway acknowledged via heartbeat
+// or WebSocket. Only devices of the gateway's farm are updated.
+func (s *DeviceService) ApplyConfigReports(farmID uuid.UUID, hardwareID string, reports []schemas.ConfigApplyReport) error {
+	for _, r := range reports {
+		key := strings.TrimSpace(r.DeviceID)
+		if key == "" || r.Version <= 0 {
+			continue
+		}
+		status := strings.ToLower(strings.TrimSpace(r.Status))
+		if status != "applied" && status != "failed" {
+			continue
+		}
+		var deviceID uuid.UUID
+		err := database.DB.QueryRow(`
+			SELECT id FROM devices
+			WHERE hardware_id = $1 AND farm_id = $3 AND (device_id = $2 OR LOWER(model) = LOWER($2))
+			ORDER BY is_active DESC
+			LIMIT 1
+		`, hardwareID, key, farmID).Scan(&deviceID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		setConfigVersionStatus(deviceID, r.Version, status, r.Error)
+	}
+	return nil
+}
+
+// configCommandFinished maps the apply_config command result onto its config version
+func configCommandFinished(commandID uuid.UUID, status, response string) {
+	var deviceID uuid.UUID
+	var version int
+	err := database.DB.QueryRow(`SELECT device_id, version FROM device_config_versions WHERE command_id = $1`, commandID).Scan(&deviceID, &version)
+	if err != nil {
+		return
+	}
+	if status == "success" {
+		setConfigVersionStatus(deviceID, version, "applied", nil)
+		return
+	}
+	msg := "command " + status
+	if response != "" {
+		msg = response
+	}
+	setConfigVersionStatus(deviceID, version, "failed", &msg)
+}
+
+func setConfigVersionStatus(deviceID uuid.UUID, version int, status string, errMsg *string) {
+	var farmID uuid.UUID
+	err := database.DB.QueryRow(`
+		UPDATE device_config_versions
+		SET status = CASE WHEN status = 'superseded' AND $3 = 'failed' THEN status ELSE $3 END,
+			error = $4,
+			applied_at = CASE WHEN $3 = 'applied' THEN CURRENT_TIMESTAMP ELSE applied_at END
+		WHERE device_id = $1 AND version = $2 AND status <> 'applied'
+		RETURNING farm_id
+	`, deviceID, version, status, errMsg).Scan(&farmID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Config version status error (%s v%d): %v", deviceID, version, err)
+		return
+	}
+	events.PublishDeviceEvent(farmID, deviceID, "device_config", map[string]interface{}{
+		"device_id": deviceID,
+		"version":   version,
+		"status":    status,
+		"error":     errMsg,
+	})
+}
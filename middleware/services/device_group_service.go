@@ -0,0 +1,417 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDeviceGroupNotFound = errors.New("device_group_not_found")
+	ErrDeviceGroupExists   = errors.New("device_group_exists")
+	ErrDeviceGroupInvalid  = errors.New("device_group_invalid")
+	ErrInvalidTag          = errors.New("invalid_tag")
+)
+
+// maxTagLength matches the device_tags.tag column
+const maxTagLength = 50
+
+// DeviceGroupService manages device tags and named groups used as command/report selectors
+type DeviceGroupService struct {
+	farmService *FarmService
+}
+
+func NewDeviceGroupService() *DeviceGroupService {
+	return &DeviceGroupService{farmService: NewFarmService()}
+}
+
+// normalizeTag lowercases and trims a tag; empty or over-long tags are rejected
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len(tag) > maxTagLength {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// ===== TAGS =====
+
+// ListTags returns the tags used on a farm with their device counts
+func (s *DeviceGroupService) ListTags(userID, farmID uuid.UUID) ([]schemas.DeviceTagCount, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	rows, err := database.DB.Query(`
+		SELECT tag, COUNT(*) FROM device_tags WHERE farm_id = $1
+		GROUP BY tag ORDER BY tag ASC
+	`, farmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]schemas.DeviceTagCount, 0)
+	for rows.Next() {
+		var t schemas.DeviceTagCount
+		if err := rows.Scan(&t.Tag, &t.DeviceCount); err != nil {
+			continue
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// GetDeviceTags returns a device's tags
+func (s *DeviceGroupService) GetDeviceTags(userID, farmID, deviceID uuid.UUID) ([]string, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	if ok, err := scheduleDeviceBelongsToFarm(deviceID, farmID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	return loadDeviceTags(deviceID)
+}
+
+// SetDeviceTags replaces a device's tags
+func (s *DeviceGroupService) SetDeviceTags(userID, farmID, deviceID uuid.UUID, tags []string) ([]string, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+	if ok, err := scheduleDeviceBelongsToFarm(deviceID, farmID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrDeviceNotFound
+	}
+
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		tag, err := normalizeTag(t)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM device_tags WHERE device_id = $1`, deviceID); err != nil {
+		return nil, err
+	}
+	for _, tag := range normalized {
+		if _, err := tx.Exec(`
+			INSERT INTO device_tags (device_id, farm_id, tag, created_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		`, deviceID, farmID, tag); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return loadDeviceTags(deviceID)
+}
+
+func loadDeviceTags(deviceID uuid.UUID) ([]string, error) {
+	rows, err := database.DB.Query(`SELECT tag FROM device_tags WHERE device_id = $1 ORDER BY tag ASC`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if rows.Scan(&tag) == nil {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// ===== GROUPS =====
+
+// ListGroups returns a farm's device groups with their members
+func (s *DeviceGroupService) ListGroups(userID, farmID uuid.UUID) ([]models.DeviceGroup, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	rows, err := database.DB.Query(`
+		SELECT g.id, g.farm_id, g.name, g.description, g.created_by, g.created_at, g.updated_at,
+			COALESCE(array_agg(m.device_id) FILTER (WHERE m.device_id IS NOT NULL), '{}')
+		FROM device_groups g
+		LEFT JOIN device_group_members m ON m.group_id = g.id
+		WHERE g.farm_id = $1
+		GROUP BY g.id
+		ORDER BY g.name ASC
+	`, farmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]models.DeviceGroup, 0)
+	for rows.Next() {
+		g, err := scanDeviceGroup(rows)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, *g)
+	}
+	return groups, nil
+}
+
+// GetGroup returns one device group
+func (s *DeviceGroupService) GetGroup(userID, farmID, groupID uuid.UUID) (*models.DeviceGroup, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	return loadDeviceGroup(farmID, groupID)
+}
+
+// CreateGroup creates a named group, optionally with members
+func (s *DeviceGroupService) CreateGroup(userID, farmID uuid.UUID, req schemas.DeviceGroupRequest) (*models.DeviceGroup, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+		return nil, ErrDeviceGroupInvalid
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	groupID := uuid.New()
+	now := time.Now()
+	if _, err := tx.Exec(`
+		INSERT INTO device_groups (id, farm_id, name, description, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+	`, groupID, farmID, strings.TrimSpace(*req.Name), req.Description, userID, now); err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrDeviceGroupExists
+		}
+		return nil, err
+	}
+	if err := setGroupMembers(tx, farmID, groupID, req.DeviceIDs); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return loadDeviceGroup(farmID, groupID)
+}
+
+// UpdateGroup renames a group and, when DeviceIDs is given, replaces its members
+func (s *DeviceGroupService) UpdateGroup(userID, farmID, groupID uuid.UUID, req schemas.DeviceGroupRequest) (*models.DeviceGroup, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		return nil, ErrDeviceGroupInvalid
+	}
+	var name *string
+	if req.Name != nil {
+		trimmed := strings.TrimSpace(*req.Name)
+		name = &trimmed
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE device_groups SET name = COALESCE($3, name), description = COALESCE($4, description), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND farm_id = $2
+	`, groupID, farmID, name, req.Description)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrDeviceGroupExists
+		}
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrDeviceGroupNotFound
+	}
+	if req.DeviceIDs != nil {
+		if err := setGroupMembers(tx, farmID, groupID, req.DeviceIDs); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return loadDeviceGroup(farmID, groupID)
+}
+
+// DeleteGroup removes a group. Schedules targeting it no longer match any device.
+func (s *DeviceGroupService) DeleteGroup(userID, farmID, groupID uuid.UUID) error {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return err
+	}
+	res, err := database.DB.Exec(`DELETE FROM device_groups WHERE id = $1 AND farm_id = $2`, groupID, farmID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeviceGroupNotFound
+	}
+	return nil
+}
+
+func setGroupMembers(tx *sql.Tx, farmID, groupID uuid.UUID, deviceIDs []uuid.UUID) error {
+	if _, err := tx.Exec(`DELETE FROM device_group_members WHERE group_id = $1`, groupID); err != nil {
+		return err
+	}
+	for _, deviceID := range deviceIDs {
+		res, err := tx.Exec(`
+			INSERT INTO device_group_members (group_id, device_id)
+			SELECT $1, id FROM devices WHERE id = $2 AND farm_id = $3
+			ON CONFLICT DO NOTHING
+		`, groupID, deviceID, farmID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var member bool
+			_ = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM device_group_members WHERE group_id = $1 AND device_id = $2)`, groupID, deviceID).Scan(&member)
+			if !member {
+				return ErrDeviceNotFound
+			}
+		}
+	}
+	return nil
+}
+
+func loadDeviceGroup(farmID, groupID uuid.UUID) (*models.DeviceGroup, error) {
+	g, err := scanDeviceGroup(database.DB.QueryRow(`
+		SELECT g.id, g.farm_id, g.name, g.description, g.created_by, g.created_at, g.updated_at,
+			COALESCE(array_agg(m.device_id) FILTER (WHERE m.device_id IS NOT NULL), '{}')
+		FROM device_groups g
+		LEFT JOIN device_group_members m ON m.group_id = g.id
+		WHERE g.id = $1 AND g.farm_id = $2
+		GROUP BY g.id
+	`, groupID, farmID))
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceGroupNotFound
+	}
+	return g, err
+}
+
+func scanDeviceGroup(scanner interface{ Scan(...interface{}) error }) (*models.DeviceGroup, error) {
+	var g models.DeviceGroup
+	var members []string
+	if err := scanner.Scan(&g.ID, &g.FarmID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedAt, &g.UpdatedAt, pq.Array(&members)); err != nil {
+		return nil, err
+	}
+	g.DeviceIDs = make([]uuid.UUID, 0, len(members))
+	for _, m := range members {
+		if id, err := uuid.Parse(m); err == nil {
+			g.DeviceIDs = append(g.DeviceIDs, id)
+		}
+	}
+	return &g, nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// ===== SELECTORS =====
+
+// resolveDeviceSelector returns the active farm devices matched by a tag or group, optionally
+// limited to a coop. An unknown group is an error; an unused tag matches nothing.
+func resolveDeviceSelector(farmID uuid.UUID, coopID *uuid.UUID, sel schemas.DeviceSelector) ([]uuid.UUID, error) {
+	var tag interface{}
+	if sel.Tag != nil && *sel.Tag != "" {
+		normalized, err := normalizeTag(*sel.Tag)
+		if err != nil {
+			return nil, err
+		}
+		tag = normalized
+	}
+	if sel.GroupID != nil {
+		var exists bool
+		if err := database.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM device_groups WHERE id = $1 AND farm_id = $2)`, *sel.GroupID, farmID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrDeviceGroupNotFound
+		}
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT d.id FROM devices d
+		WHERE d.farm_id = $1 AND d.is_active = true
+			AND ($2::UUID IS NULL OR d.coop_id = $2)
+			AND ($3::TEXT IS NULL OR EXISTS (SELECT 1 FROM device_tags t WHERE t.device_id = d.id AND t.tag = $3))
+			AND ($4::UUID IS NULL OR EXISTS (SELECT 1 FROM device_group_members m WHERE m.device_id = d.id AND m.group_id = $4))
+		ORDER BY d.name ASC
+	`, farmID, coopID, tag, sel.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id uuid.UUID
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// selectorDeviceFilter binds a selector as a device id array for "($n::UUID[] IS NULL OR id = ANY($n))"
+// filters. No selector binds NULL; a selector matching nothing binds an empty array.
+func selectorDeviceFilter(farmID uuid.UUID, coopID *uuid.UUID, sel schemas.DeviceSelector) (interface{}, error) {
+	if sel.IsEmpty() {
+		return nil, nil
+	}
+	ids, err := resolveDeviceSelector(farmID, coopID, sel)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, id.String())
+	}
+	return pq.Array(values), nil
+}
+
+// selectorLabel identifies a selector scope, e.g. "tag:fans" or "group:<id>"
+func selectorLabel(sel schemas.DeviceSelector) *string {
+	if sel.IsEmpty() {
+		return nil
+	}
+	parts := make([]string, 0, 2)
+	if sel.Tag != nil && *sel.Tag != "" {
+		tag, _ := normalizeTag(*sel.Tag)
+		parts = append(parts, "tag:"+tag)
+	}
+	if sel.GroupID != nil {
+		parts = append(parts, "group:"+sel.GroupID.String())
+	}
+	label := strings.Join(parts, ",")
+	return &label
+}
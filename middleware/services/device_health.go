@@ -0,0 +1,445 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"middleware/database"
+	"middleware/schemas"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Health score weights; components without data are left out and the rest re-weighted
+const (
+	healthWeightHeartbeat = 0.30
+	healthWeightCommands  = 0.25
+	healthWeightGaps      = 0.20
+	healthWeightStuck     = 0.15
+	healthWeightRange     = 0.10
+)
+
+// stuckReadingThreshold is how long a sensor may repeat the exact same value before it counts as stuck
+const stuckReadingThreshold = 3 * time.Hour
+
+// offlineExplanationAfter is how old a last heartbeat must be before the report calls the device offline
+const offlineExplanationAfter = time.Hour
+
+// GetDeviceHealthReport scores every active device on the farm (or one coop) over the last
+// windowHours from heartbeat regularity, command outcomes, reading gaps, stuck values and
+// out-of-range values, and rolls the scores up per coop and for the farm.
+func (s *AnalyticsService) GetDeviceHealthReport(userID, farmID uuid.UUID, coopID *uuid.UUID, windowHours int) (*schemas.DeviceHealthReport, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	devices, err := loadHealthDevices(farmID, coopID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &schemas.DeviceHealthReport{
+		FarmID:      farmID,
+		WindowHours: windowHours,
+		GeneratedAt: now,
+		Coops:       make([]schemas.CoopHealth, 0),
+		Devices:     make([]schemas.DeviceHealth, 0, len(devices)),
+	}
+	coops := make(map[string]*schemas.CoopHealth)
+	coopOrder := make([]string, 0)
+	coopSums := make(map[string]float64)
+	var farmSum float64
+
+	metrics, err := collectHealthMetrics(devices, now, windowHours)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range devices {
+		health := scoreDeviceHealth(d, metrics[i], now)
+		report.Devices = append(report.Devices, health)
+		farmSum += health.Score
+
+		key := ""
+		if d.coopID != nil {
+			key = d.coopID.String()
+		}
+		coop, ok := coops[key]
+		if !ok {
+			coop = &schemas.CoopHealth{CoopID: d.coopID, Name: d.coopName, Issues: make([]string, 0)}
+			coops[key] = coop
+			coopOrder = append(coopOrder, key)
+		}
+		coop.Devices++
+		coopSums[key] += health.Score
+		switch health.Status {
+		case "healthy":
+			coop.Healthy++
+		case "degraded":
+			coop.Degraded++
+		default:
+			coop.Failing++
+		}
+	}
+
+	// Worst devices first, so explanations point installers at what to replace
+	sort.SliceStable(report.Devices, func(i, j int) bool { return report.Devices[i].Score < report.Devices[j].Score })
+	for _, dh := range report.Devices {
+		if dh.Status == "healthy" {
+			continue
+		}
+		key := ""
+		if dh.CoopID != nil {
+			key = dh.CoopID.String()
+		}
+		for _, e := range dh.Explanations {
+			coops[key].Issues = append(coops[key].Issues, dh.Name+": "+e)
+		}
+	}
+
+	for _, key := range coopOrder {
+		coop := coops[key]
+		score := roundScore(coopSums[key] / float64(coop.Devices))
+		coop.Score = &score
+		coop.Status = healthStatus(score)
+		report.Coops = append(report.Coops, *coop)
+	}
+	if len(report.Devices) > 0 {
+		score := roundScore(farmSum / float64(len(report.Devices)))
+		report.Score = &score
+		report.Status = healthStatus(score)
+	} else {
+		report.Status = "no_devices"
+	}
+	return report, nil
+}
+
+// GetDeviceMetricsReport returns the raw measurements behind the health report
+func (s *AnalyticsService) GetDeviceMetricsReport(userID, farmID uuid.UUID, coopID *uuid.UUID, windowHours int) (*schemas.DeviceMetricsReport, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	devices, err := loadHealthDevices(farmID, coopID)
+	if err != nil {
+		return nil, err
+	}
+	report := &schemas.DeviceMetricsReport{
+		FarmID:      farmID,
+		WindowHours: windowHours,
+		GeneratedAt: now,
+		Devices:     make([]schemas.DeviceHealthMetrics, 0, len(devices)),
+	}
+	metrics, err := collectHealthMetrics(devices, now, windowHours)
+	if err != nil {
+		return nil, err
+	}
+	report.Devices = append(report.Devices, metrics...)
+	return report, nil
+}
+
+// healthDevice is an active device with what the health report needs to know about it
+type healthDevice struct {
+	id            uuid.UUID
+	name          string
+	deviceType    string
+	model         *string
+	coopID        *uuid.UUID
+	coopName      string
+	lastHeartbeat *time.Time
+	createdAt     time.Time
+	firstSeenHour *time.Time
+}
+
+func loadHealthDevices(farmID uuid.UUID, coopID *uuid.UUID) ([]healthDevice, error) {
+	rows, err := database.DB.Query(`
+		SELECT d.id, d.name, d.type, d.model, d.coop_id, COALESCE(c.name, ''), d.last_heartbeat, d.created_at,
+			(SELECT MIN(h.hour) FROM device_heartbeat_hours h WHERE h.device_id = d.id)
+		FROM devices d
+		LEFT JOIN coops c ON c.id = d.coop_id
+		WHERE d.farm_id = $1 AND d.is_active = true AND ($2::UUID IS NULL OR d.coop_id = $2)
+		ORDER BY c.name ASC NULLS LAST, d.name ASC
+	`, farmID, coopID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]healthDevice, 0)
+	for rows.Next() {
+		var d healthDevice
+		if err := rows.Scan(&d.id, &d.name, &d.deviceType, &d.model, &d.coopID, &d.coopName, &d.lastHeartbeat, &d.createdAt, &d.firstSeenHour); err != nil {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// collectHealthMetrics measures the devices over the window with one grouped query per measurement.
+// A device's window starts no earlier than its registration or its first recorded heartbeat hour,
+// so new devices are not penalized for hours they did not exist.
+func collectHealthMetrics(devices []healthDevice, now time.Time, windowHours int) ([]schemas.DeviceHealthMetrics, error) {
+	metrics := make([]schemas.DeviceHealthMetrics, len(devices))
+	if len(devices) == 0 {
+		return metrics, nil
+	}
+	windowStart := now.Add(-time.Duration(windowHours) * time.Hour)
+	ids := make([]uuid.UUID, len(devices))
+	starts := make([]time.Time, len(devices))
+	startHours := make([]time.Time, len(devices))
+	index := make(map[uuid.UUID]int, len(devices))
+	for i, d := range devices {
+		start := windowStart
+		if d.createdAt.After(start) {
+			start = d.createdAt
+		}
+		if d.firstSeenHour != nil && d.firstSeenHour.After(start) {
+			start = *d.firstSeenHour
+		}
+		ids[i], starts[i], startHours[i] = d.id, start, start.Truncate(time.Hour)
+		index[d.id] = i
+		metrics[i] = schemas.DeviceHealthMetrics{
+			DeviceID:      d.id,
+			Name:          d.name,
+			CoopID:        d.coopID,
+			ExpectedHours: int(now.Sub(startHours[i])/time.Hour) + 1,
+			Sensors:       make([]schemas.SensorHealthMetrics, 0),
+		}
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT w.device_id, COUNT(*)
+		FROM unnest($1::UUID[], $2::TIMESTAMP[]) AS w(device_id, start)
+		JOIN device_heartbeat_hours h ON h.device_id = w.device_id AND h.hour >= w.start
+		GROUP BY w.device_id
+	`, uuidArray(ids), pq.Array(startHours))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id uuid.UUID
+		var hours int
+		if err := rows.Scan(&id, &hours); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		metrics[index[id]].HeartbeatHours = hours
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT w.device_id, COUNT(*),
+			COUNT(*) FILTER (WHERE c.status = 'success'),
+			COUNT(*) FILTER (WHERE c.status = 'failed'),
+			COUNT(*) FILTER (WHERE c.status = 'timeout')
+		FROM unnest($1::UUID[], $2::TIMESTAMP[]) AS w(device_id, start)
+		JOIN device_commands c ON c.device_id = w.device_id AND c.issued_at >= w.start
+		WHERE c.status IN ('success', 'failed', 'timeout')
+		GROUP BY w.device_id
+	`, uuidArray(ids), pq.Array(starts))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id uuid.UUID
+		var finished, succeeded, failed, timedOut int
+		if err := rows.Scan(&id, &finished, &succeeded, &failed, &timedOut); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m := &metrics[index[id]]
+		m.CommandsFinished, m.CommandsSucceeded, m.CommandsFailed, m.CommandsTimedOut = finished, succeeded, failed, timedOut
+	}
+	rows.Close()
+
+	// Only metrics with a registered valid range are range-checked
+	rangeNames := make([]string, 0)
+	rangeMins := make([]*float64, 0)
+	rangeMaxs := make([]*float64, 0)
+	for _, def := range metricDefinitions {
+		if def.ValidMin != nil || def.ValidMax != nil {
+			rangeNames = append(rangeNames, def.Name)
+			rangeMins = append(rangeMins, def.ValidMin)
+			rangeMaxs = append(rangeMaxs, def.ValidMax)
+		}
+	}
+
+	// Per sensor stream: coverage, the longest gap, the last value, where the current run of that
+	// value started (the first reading after the last different value) and out-of-range readings
+	rows, err = database.DB.Query(`
+		SELECT device_id, sensor_type, COUNT(*), COUNT(DISTINCT date_trunc('hour', timestamp)),
+			MIN(timestamp), MAX(timestamp), COALESCE(MAX(EXTRACT(EPOCH FROM timestamp - prev)), 0),
+			MAX(last_value), MIN(timestamp) FILTER (WHERE last_changed IS NULL OR timestamp > last_changed),
+			COUNT(*) FILTER (WHERE value < COALESCE(valid_min, value) OR value > COALESCE(valid_max, value))
+		FROM (
+			SELECT *, MAX(CASE WHEN value <> last_value THEN timestamp END) OVER (PARTITION BY device_id, sensor_type) AS last_changed
+			FROM (
+				SELECT r.device_id, r.sensor_type, r.timestamp, r.value, m.valid_min, m.valid_max,
+					LAG(r.timestamp) OVER (PARTITION BY r.device_id, r.sensor_type ORDER BY r.timestamp) AS prev,
+					FIRST_VALUE(r.value) OVER (PARTITION BY r.device_id, r.sensor_type ORDER BY r.timestamp DESC) AS last_value
+				FROM unnest($1::UUID[], $2::TIMESTAMP[]) AS w(device_id, start)
+				JOIN device_readings r ON r.device_id = w.device_id AND r.timestamp >= w.start
+				LEFT JOIN unnest($3::TEXT[], $4::FLOAT8[], $5::FLOAT8[]) AS m(sensor_type, valid_min, valid_max) ON m.sensor_type = r.sensor_type
+			) r
+		) r
+		GROUP BY device_id, sensor_type
+		ORDER BY device_id, sensor_type ASC
+	`, uuidArray(ids), pq.Array(starts), pq.Array(rangeNames), pq.Array(rangeMins), pq.Array(rangeMaxs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uuid.UUID
+		var sm schemas.SensorHealthMetrics
+		var first, last time.Time
+		var gap, lastValue float64
+		var runStart sql.NullTime
+		if err := rows.Scan(&id, &sm.SensorType, &sm.Readings, &sm.HoursWithReadings, &first, &last, &gap,
+			&lastValue, &runStart, &sm.OutOfRange); err != nil {
+			return nil, err
+		}
+		i := index[id]
+		// Silence before the first and after the last reading counts as a gap too
+		longest := math.Max(gap, math.Max(first.Sub(starts[i]).Seconds(), now.Sub(last).Seconds()))
+		sm.LongestGapSeconds = int64(longest)
+		sm.LastReadingAt = &last
+		sm.LastValue = &lastValue
+		if runStart.Valid {
+			sm.UnchangedSeconds = int64(last.Sub(runStart.Time).Seconds())
+		}
+		if def, ok := LookupMetric(sm.SensorType); ok && (def.ValidMin != nil || def.ValidMax != nil) {
+			sm.ValidMin, sm.ValidMax = def.ValidMin, def.ValidMax
+		}
+		metrics[i].Sensors = append(metrics[i].Sensors, sm)
+	}
+	return metrics, rows.Err()
+}
+
+// scoreDeviceHealth turns the measurements into a weighted 0-100 score with plain-language explanations
+func scoreDeviceHealth(d healthDevice, m schemas.DeviceHealthMetrics, now time.Time) schemas.DeviceHealth {
+	h := schemas.DeviceHealth{
+		DeviceID:      d.id,
+		Name:          d.name,
+		Type:          d.deviceType,
+		Model:         d.model,
+		CoopID:        d.coopID,
+		LastHeartbeat: d.lastHeartbeat,
+		Components:    make([]schemas.HealthComponent, 0, 5),
+		Explanations:  make([]string, 0),
+		Metrics:       m,
+	}
+	explain := func(format string, args ...interface{}) {
+		h.Explanations = append(h.Explanations, fmt.Sprintf(format, args...))
+	}
+
+	if d.lastHeartbeat == nil {
+		explain("Never sent a heartbeat")
+	} else if age := now.Sub(*d.lastHeartbeat); age > offlineExplanationAfter {
+		explain("Offline: last heartbeat %s ago", formatHealthDuration(age))
+	}
+	if m.ExpectedHours > 0 {
+		hb := math.Min(float64(m.HeartbeatHours)/float64(m.ExpectedHours), 1) * 100
+		h.Components = append(h.Components, schemas.HealthComponent{Name: "heartbeat", Score: roundScore(hb), Weight: healthWeightHeartbeat})
+		if missing := m.ExpectedHours - m.HeartbeatHours; missing > 0 {
+			explain("No heartbeat in %d of the last %d hours", missing, m.ExpectedHours)
+		}
+	}
+
+	if m.CommandsFinished > 0 {
+		score := float64(m.CommandsSucceeded) / float64(m.CommandsFinished) * 100
+		h.Components = append(h.Components, schemas.HealthComponent{Name: "commands", Score: roundScore(score), Weight: healthWeightCommands})
+		if m.CommandsTimedOut > 0 {
+			explain("%d of %d commands timed out", m.CommandsTimedOut, m.CommandsFinished)
+		}
+		if m.CommandsFailed > 0 {
+			explain("%d of %d commands failed", m.CommandsFailed, m.CommandsFinished)
+		}
+	}
+
+	if len(m.Sensors) > 0 {
+		gapScore, stuckScore, rangeScore := 100.0, 100.0, 100.0
+		ranged := false
+		for _, sm := range m.Sensors {
+			coverage := math.Min(float64(sm.HoursWithReadings)/float64(m.ExpectedHours), 1) * 100
+			gapScore = math.Min(gapScore, coverage)
+			if gap := time.Duration(sm.LongestGapSeconds) * time.Second; gap > time.Hour {
+				explain("%s: longest gap between readings was %s", sm.SensorType, formatHealthDuration(gap))
+			}
+
+			if unchanged := time.Duration(sm.UnchangedSeconds) * time.Second; unchanged >= stuckReadingThreshold {
+				stuckScore = 0
+				explain("%s: reported the same value (%g) for %s; the sensor may be stuck", sm.SensorType, *sm.LastValue, formatHealthDuration(unchanged))
+			}
+
+			if sm.ValidMin != nil && sm.Readings > 0 {
+				ranged = true
+				rangeScore = math.Min(rangeScore, (1-float64(sm.OutOfRange)/float64(sm.Readings))*100)
+				if sm.OutOfRange > 0 {
+					explain("%s: %d of %d readings outside the valid range %g to %g", sm.SensorType, sm.OutOfRange, sm.Readings, *sm.ValidMin, *sm.ValidMax)
+				}
+			}
+		}
+		h.Components = append(h.Components,
+			schemas.HealthComponent{Name: "reading_gaps", Score: roundScore(gapScore), Weight: healthWeightGaps},
+			schemas.HealthComponent{Name: "stuck_values", Score: stuckScore, Weight: healthWeightStuck},
+		)
+		if ranged {
+			h.Components = append(h.Components, schemas.HealthComponent{Name: "out_of_range", Score: roundScore(rangeScore), Weight: healthWeightRange})
+		}
+	} else if d.deviceType == "sensor" || d.deviceType == "adc" {
+		h.Components = append(h.Components, schemas.HealthComponent{Name: "reading_gaps", Score: 0, Weight: healthWeightGaps})
+		explain("No readings in the last %d hours", m.ExpectedHours)
+	}
+
+	var total, weights float64
+	for _, c := range h.Components {
+		total += c.Score * c.Weight
+		weights += c.Weight
+	}
+	if weights > 0 {
+		h.Score = roundScore(total / weights)
+	}
+	h.Status = healthStatus(h.Score)
+	return h
+}
+
+// healthStatus buckets a score: healthy >= 80, degraded >= 50, failing below
+func healthStatus(score float64) string {
+	switch {
+	case score >= 80:
+		return "healthy"
+	case score >= 50:
+		return "degraded"
+	}
+	return "failing"
+}
+
+func roundScore(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// formatHealthDuration renders a duration as "2h15m" or "3d4h" for explanations
+func formatHealthDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	}
+	if d >= time.Hour {
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
+
+// recordHeartbeatHour counts a heartbeat in the device's current hour bucket for the health report
+func recordHeartbeatHour(deviceID uuid.UUID, at time.Time) {
+	_, _ = database.DB.Exec(`
+		INSERT INTO device_heartbeat_hours (device_id, hour, heartbeats) VALUES ($1, date_trunc('hour', $2::TIMESTAMP), 1)
+		ON CONFLICT (device_id, hour) DO UPDATE SET heartbeats = device_heartbeat_hours.heartbeats + 1
+	`, deviceID, at)
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrReplacementInvalid = errors.New("replacement_invalid")
+	ErrReplacementInUse   = errors.New("replacement_hardware_in_use")
+)
+
+// tablesReferencingDevice hold history that must follow a folded-in device row to the logical device
+var tablesReferencingDevice = []string{
+	"device_readings",
+	"device_state_transitions",
+	"device_commands",
+	"schedules",
+	"schedule_executions",
+	"alerts",
+	"gateway_tokens",
+}
+
+// ReplaceDevice re-points a logical device to new hardware, keeping its id and therefore its
+// schedules, configuration and reading history. When the gateway already reported the new
+// hardware as a separate device, that row is folded into the logical device.
+func (s *DeviceService) ReplaceDevice(userID, farmID, deviceID uuid.UUID, req schemas.ReplaceDeviceRequest, ipAddress string) (*models.DeviceReplacement, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+	newHardwareID := strings.TrimSpace(req.NewHardwareID)
+	if newHardwareID == "" {
+		return nil, ErrReplacementInvalid
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var oldKey, oldHardwareID string
+	var model *string
+	err = tx.QueryRow(`
+		SELECT device_id, hardware_id, model FROM devices WHERE id = $1 AND farm_id = $2 FOR UPDATE
+	`, deviceID, farmID).Scan(&oldKey, &oldHardwareID, &model)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	newKey := ""
+	if req.NewDeviceKey != nil {
+		newKey = strings.TrimSpace(*req.NewDeviceKey)
+	} else if model != nil && *model != "" {
+		newKey = fmt.Sprintf("%s:%s", newHardwareID, strings.ToLower(*model))
+	}
+	if newKey == "" || len(newKey) > 50 || newKey == oldKey && newHardwareID == oldHardwareID {
+		return nil, ErrReplacementInvalid
+	}
+
+	rep := models.DeviceReplacement{
+		ID:                 uuid.New(),
+		DeviceID:           deviceID,
+		FarmID:             farmID,
+		OldHardwareID:      oldHardwareID,
+		NewHardwareID:      newHardwareID,
+		OldDeviceKey:       oldKey,
+		NewDeviceKey:       newKey,
+		CalibrationCleared: req.ResetCalibration,
+		Reason:             req.Reason,
+		ReplacedBy:         userID,
+		ReplacedAt:         time.Now(),
+	}
+
+	// A row already holding the new key is the gateway's auto-created placeholder; only fold it
+	// in when it belongs to the same farm
+	if newKey != oldKey {
+		var existingID, existingFarm uuid.UUID
+		err = tx.QueryRow(`SELECT id, farm_id FROM devices WHERE device_id = $1 FOR UPDATE`, newKey).Scan(&existingID, &existingFarm)
+		if err == nil {
+			if existingFarm != farmID {
+				return nil, ErrReplacementInUse
+			}
+			for _, table := range tablesReferencingDevice {
+				if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET device_id = $1 WHERE device_id = $2`, table), deviceID, existingID); err != nil {
+					return nil, err
+				}
+			}
+			// Re-roll the moved readings under the logical device; the folded row's rollups go with it
+			if _, err := tx.Exec(`UPDATE device_readings SET created_at = LOCALTIMESTAMP WHERE device_id = $1`, deviceID); err != nil {
+				return nil, err
+			}
+			if _, err := tx.Exec(`UPDATE coops SET main_device_id = $1 WHERE main_device_id = $2`, deviceID, existingID); err != nil {
+				return nil, err
+			}
+			if _, err := tx.Exec(`DELETE FROM devices WHERE id = $1`, existingID); err != nil {
+				return nil, err
+			}
+			rep.MergedDeviceID = &existingID
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE devices SET device_id = $2, hardware_id = $3, firmware_version = COALESCE($4, firmware_version),
+			is_active = true, is_online = false, last_heartbeat = NULL, updated_at = $5
+		WHERE id = $1
+	`, deviceID, newKey, newHardwareID, req.FirmwareVersion, rep.ReplacedAt); err != nil {
+		return nil, err
+	}
+
+	// Capabilities and reported state belong to the old hardware; the new one reports its own
+	if _, err := tx.Exec(`DELETE FROM device_capabilities WHERE device_id = $1`, deviceID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE device_shadows SET reported_state = NULL, reported_value = NULL, reported_at = NULL, version = version + 1, updated_at = $2
+		WHERE device_id = $1
+	`, deviceID, rep.ReplacedAt); err != nil {
+		return nil, err
+	}
+	// Commands queued for the old hardware would never be picked up
+	if _, err := tx.Exec(`
+		UPDATE device_commands SET status = 'cancelled', response = 'device hardware replaced', executed_at = $2, updated_at = $2
+		WHERE device_id = $1 AND status = 'pending' AND command_type NOT IN ($3, $4)
+	`, deviceID, rep.ReplacedAt, applyConfigCommandType, otaCommandType); err != nil {
+		return nil, err
+	}
+	if req.ResetCalibration {
+		if _, err := tx.Exec(`
+			DELETE FROM device_configurations WHERE device_id = $1 AND parameter_name LIKE 'calibration\_%'
+		`, deviceID); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO device_replacements (id, device_id, farm_id, old_hardware_id, new_hardware_id, old_device_key, new_device_key,
+			merged_device_id, calibration_cleared, reason, replaced_by, replaced_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, rep.ID, deviceID, farmID, oldHardwareID, newHardwareID, oldKey, newKey, rep.MergedDeviceID, rep.CalibrationCleared,
+		rep.Reason, userID, rep.ReplacedAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	logEvent(farmID, userID, "device_replaced", &deviceID,
+		map[string]string{"hardware_id": oldHardwareID, "device_id": oldKey},
+		map[string]string{"hardware_id": newHardwareID, "device_id": newKey}, ipAddress)
+	events.PublishFarmEvent(farmID, "device_replaced", rep)
+
+	// The new hardware starts from the logical device's configuration
+	s.pushDeviceConfig(userID, farmID, deviceID)
+	return &rep, nil
+}
+
+// GetDeviceTimeline lists the device's lifecycle events, newest first
+func (s *DeviceService) GetDeviceTimeline(userID, farmID, deviceID uuid.UUID, limit int) ([]schemas.DeviceTimelineEntry, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	var createdAt time.Time
+	err := database.DB.QueryRow(`SELECT created_at FROM devices WHERE id = $1 AND farm_id = $2`, deviceID, farmID).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []schemas.DeviceTimelineEntry{{At: createdAt, Type: "created", Summary: "Device registered"}}
+
+	rows, err := database.DB.Query(`
+		SELECT replaced_at, old_hardware_id, new_hardware_id, old_device_key, new_device_key, calibration_cleared, reason
+		FROM device_replacements WHERE device_id = $1
+		ORDER BY replaced_at DESC LIMIT $2
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var at time.Time
+		var oldHW, newHW, oldKey, newKey string
+		var cleared bool
+		var reason *string
+		if rows.Scan(&at, &oldHW, &newHW, &oldKey, &newKey, &cleared, &reason) != nil {
+			continue
+		}
+		entries = append(entries, schemas.DeviceTimelineEntry{
+			At:      at,
+			Type:    "replaced",
+			Summary: fmt.Sprintf("Hardware replaced: %s → %s", oldHW, newHW),
+			Details: map[string]interface{}{"old_device_id": oldKey, "new_device_id": newKey, "calibration_cleared": cleared, "reason": reason},
+		})
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT created_at, version, status, error FROM device_config_versions WHERE device_id = $1
+		ORDER BY version DESC LIMIT $2
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var at time.Time
+		var version int
+		var status string
+		var errMsg *string
+		if rows.Scan(&at, &version, &status, &errMsg) != nil {
+			continue
+		}
+		entries = append(entries, schemas.DeviceTimelineEntry{
+			At:      at,
+			Type:    "config",
+			Summary: fmt.Sprintf("Config version %d (%s)", version, status),
+			Details: map[string]interface{}{"version": version, "status": status, "error": errMsg},
+		})
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT completed_at, sensor_type, offset_value, gain_value FROM calibration_sessions
+		WHERE device_id = $1 AND status = 'completed'
+		ORDER BY completed_at DESC LIMIT $2
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var at time.Time
+		var sensor string
+		var offset, gain *float64
+		if rows.Scan(&at, &sensor, &offset, &gain) != nil {
+			continue
+		}
+		entries = append(entries, schemas.DeviceTimelineEntry{
+			At:      at,
+			Type:    "calibration",
+			Summary: fmt.Sprintf("Calibrated %s", sensor),
+			Details: map[string]interface{}{"sensor_type": sensor, "offset": offset, "gain": gain},
+		})
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT cd.updated_at, cd.status, cd.from_version, f.version, cd.error
+		FROM ota_campaign_devices cd
+		JOIN ota_campaigns c ON c.id = cd.campaign_id
+		JOIN firmware_artifacts f ON f.id = c.firmware_id
+		WHERE cd.device_id = $1 AND cd.status IN ('succeeded', 'failed')
+		ORDER BY cd.updated_at DESC LIMIT $2
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var at time.Time
+		var status, from, to string
+		var errMsg *string
+		if rows.Scan(&at, &status, &from, &to, &errMsg) != nil {
+			continue
+		}
+		entries = append(entries, schemas.DeviceTimelineEntry{
+			At:      at,
+			Type:    "firmware",
+			Summary: fmt.Sprintf("Firmware %s → %s %s", from, to, status),
+			Details: map[string]interface{}{"from_version": from, "to_version": to, "status": status, "error": errMsg},
+		})
+	}
+	rows.Close()
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.After(entries[j].At) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
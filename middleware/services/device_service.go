@@ -3,10 +3,12 @@ package services
 import (
 	"database/sql"
 	"errors"
+	"middleware/config"
 	"middleware/database"
 	"middleware/models"
 	"middleware/schemas"
 	"middleware/utils"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,8 +17,10 @@ import (
 )
 
 var (
-	ErrDeviceNotFound  = errors.New("device_not_found")
-	ErrCommandNotFound = errors.New("command_not_found")
+	ErrDeviceNotFound     = errors.New("device_not_found")
+	ErrCommandNotFound    = errors.New("command_not_found")
+	ErrCommandStatusStale = errors.New("command_status_stale")
+	ErrIdempotencyKey     = errors.New("idempotency_key_mismatch")
 )
 
 // DeviceService handles all business logic related to device management
@@ -206,12 +210,12 @@ func (s *DeviceService) GetDeviceStatus(userID, farmID, deviceID uuid.UUID) (*sc
 		return nil, err
 	}
 
-	// Latest reading (optional)
+	// Latest good reading (optional); suspect and bad readings are never the current value
 	var value sql.NullFloat64
 	var unit sql.NullString
 	_ = database.DB.QueryRow(`
 		SELECT value, unit FROM device_readings
-		WHERE device_id = $1
+		WHERE device_id = $1 AND quality = 'good'
 		ORDER BY timestamp DESC
 		LIMIT 1
 	`, deviceID).Scan(&value, &unit)
@@ -222,11 +226,18 @@ func (s *DeviceService) GetDeviceStatus(userID, farmID, deviceID uuid.UUID) (*sc
 		status.Unit = &unit.String
 	}
 
+	if shadow, err := loadShadow(deviceID); err == nil {
+		status.Shadow = shadow
+	}
+	if cfgStatus, err := loadConfigStatus(deviceID, 0); err == nil && cfgStatus.Status != "none" {
+		status.Config = cfgStatus
+	}
+
 	return &status, nil
 }
 
-// GetDeviceHistory returns sensor readings
-func (s *DeviceService) GetDeviceHistory(userID, farmID, deviceID uuid.UUID, sensorType string, limit, offset int) ([]models.DeviceReading, int64, error) {
+// GetDeviceHistory returns sensor readings of every quality, optionally filtered by sensor type and quality
+func (s *DeviceService) GetDeviceHistory(userID, farmID, deviceID uuid.UUID, sensorType, quality string, limit, offset int) ([]models.DeviceReading, int64, error) {
 	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
 		return nil, 0, err
 	}
@@ -239,16 +250,11 @@ func (s *DeviceService) GetDeviceHistory(userID, farmID, deviceID uuid.UUID, sen
 		return nil, 0, ErrDeviceNotFound
 	}
 
-	query := `SELECT id, device_id, sensor_type, value, unit, quality, timestamp FROM device_readings WHERE device_id = $1`
-	args := []interface{}{deviceID}
-	if sensorType != "" {
-		query += " AND sensor_type = $2"
-		args = append(args, sensorType)
-	}
-	query += " ORDER BY timestamp DESC LIMIT $3 OFFSET $4"
-	args = append(args, limit, offset)
-
-	rows, err := database.DB.Query(query, args...)
+	rows, err := database.DB.Query(`
+		SELECT id, device_id, sensor_type, value, raw_value, unit, quality, quality_reason, timestamp FROM device_readings
+		WHERE device_id = $1 AND ($2 = '' OR sensor_type = $2) AND ($3 = '' OR quality = $3)
+		ORDER BY timestamp DESC LIMIT $4 OFFSET $5
+	`, deviceID, sensorType, quality, limit, offset)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -257,18 +263,17 @@ func (s *DeviceService) GetDeviceHistory(userID, farmID, deviceID uuid.UUID, sen
 	var readings []models.DeviceReading
 	for rows.Next() {
 		var r models.DeviceReading
-		if err := rows.Scan(&r.ID, &r.DeviceID, &r.SensorType, &r.Value, &r.Unit, &r.Quality, &r.Timestamp); err != nil {
+		if err := rows.Scan(&r.ID, &r.DeviceID, &r.SensorType, &r.Value, &r.RawValue, &r.Unit, &r.Quality, &r.QualityReason, &r.Timestamp); err != nil {
 			continue
 		}
 		readings = append(readings, r)
 	}
 
 	var total int64
-	if sensorType == "" {
-		database.DB.QueryRow("SELECT COUNT(*) FROM device_readings WHERE device_id = $1", deviceID).Scan(&total)
-	} else {
-		database.DB.QueryRow("SELECT COUNT(*) FROM device_readings WHERE device_id = $1 AND sensor_type = $2", deviceID, sensorType).Scan(&total)
-	}
+	database.DB.QueryRow(`
+		SELECT COUNT(*) FROM device_readings
+		WHERE device_id = $1 AND ($2 = '' OR sensor_type = $2) AND ($3 = '' OR quality = $3)
+	`, deviceID, sensorType, quality).Scan(&total)
 
 	return readings, total, nil
 }
@@ -338,6 +343,7 @@ func (s *DeviceService) UpdateDeviceConfig(userID, farmID, deviceID uuid.UUID, n
 	if err != nil {
 		return nil, err
 	}
+	s.pushDeviceConfig(userID, farmID, deviceID)
 	return &cfg, nil
 }
 
@@ -360,44 +366,143 @@ func (s *DeviceService) CalibrateDevice(userID, farmID, deviceID uuid.UUID, name
 	if err != nil {
 		return nil, err
 	}
+	s.pushDeviceConfig(userID, farmID, deviceID)
 	return &cfg, nil
 }
 
-// IssueCommand sends a command to a device
+// IssueCommand validates a command against the device capabilities and queues it for the gateway
 func (s *DeviceService) IssueCommand(userID, farmID, deviceID uuid.UUID, commandType string, commandValue *string, actionDuration *int) (*models.DeviceCommand, error) {
+	return s.IssueCommandWithOptions(userID, farmID, deviceID, commandType, commandValue, actionDuration, CommandOptions{})
+}
+
+// CommandOptions adjusts how a command is issued
+type CommandOptions struct {
+	// Override lets a farmer operate a device while an emergency stop is latched
+	Override bool
+	// IPAddress is recorded in the audit log for override commands
+	IPAddress string
+	// Source identifies the caller in interlock violation logs: manual (default), batch or schedule
+	Source string
+}
+
+// IssueCommandWithOptions issues a command, honouring emergency stop latches unless overridden
+func (s *DeviceService) IssueCommandWithOptions(userID, farmID, deviceID uuid.UUID, commandType string, commandValue *string, actionDuration *int, opts CommandOptions) (*models.DeviceCommand, error) {
 	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
 		return nil, err
 	}
+	if opts.Override {
+		if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+			return nil, err
+		}
+	}
+
+	target, err := loadCommandTarget(farmID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	commandType = normalizeCommandType(commandType)
+	if err := validateCommand(target, commandType, commandValue, actionDuration); err != nil {
+		return nil, err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize commands per coop so two concurrent commands cannot both pass an interlock
+	if target.CoopID != nil {
+		if _, err := tx.Exec(`SELECT id FROM coops WHERE id = $1 FOR UPDATE`, *target.CoopID); err != nil {
+			return nil, err
+		}
+	}
 
-	cmdID := uuid.New()
+	actionDuration, err = checkInterlocks(target, commandType, commandValue, actionDuration)
+	if err != nil {
+		var violation *InterlockViolationError
+		if errors.As(err, &violation) {
+			source := opts.Source
+			if source == "" {
+				source = "manual"
+			}
+			recordInterlockViolation(target, violation, userID, commandType, source)
+		}
+		return nil, err
+	}
+
+	stopID, err := activeEmergencyStop(farmID, target.CoopID, target.ID)
+	if err != nil {
+		return nil, err
+	}
+	if stopID != nil && !opts.Override {
+		return nil, ErrEmergencyStopActive
+	}
+
+	cmd := newPendingCommand(userID, target, commandType, commandValue, actionDuration)
+	if err := insertCommand(tx, cmd); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	commandQueued(cmd, target.HardwareID)
+	if stopID != nil {
+		logEvent(farmID, userID, "emergency_stop_override", &cmd.ID, nil, map[string]interface{}{
+			"emergency_stop_id": stopID,
+			"device_id":         deviceID,
+			"command_type":      commandType,
+		}, opts.IPAddress)
+	}
+	return cmd, nil
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func newPendingCommand(userID uuid.UUID, target *commandTarget, commandType string, commandValue *string, actionDuration *int) *models.DeviceCommand {
 	now := time.Now()
-	cmd := &models.DeviceCommand{
-		ID:             cmdID,
-		FarmID:       farmID,
-		DeviceID:     deviceID,
-		IssuedBy:     userID,
-		CommandType:  commandType,
-		CommandValue: commandValue,
+	return &models.DeviceCommand{
+		ID:             uuid.New(),
+		FarmID:         target.FarmID,
+		CoopID:         target.CoopID,
+		DeviceID:       target.ID,
+		IssuedBy:       userID,
+		CommandType:    commandType,
+		CommandValue:   commandValue,
 		ActionDuration: actionDuration,
-		Status:       "pending",
-		IssuedAt:     now,
-		CreatedAt:    now,
+		Status:         "pending",
+		IdempotencyKey: newIdempotencyKey(),
+		IssuedAt:       now,
+		CreatedAt:      now,
 	}
+}
 
-	_, err := database.DB.Exec(`
-		INSERT INTO device_commands (id, farm_id, device_id, issued_by, command_type, command_value, action_duration, status, issued_at, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-	`, cmd.ID, cmd.FarmID, cmd.DeviceID, cmd.IssuedBy, cmd.CommandType, cmd.CommandValue, cmd.ActionDuration, cmd.Status, cmd.IssuedAt, cmd.CreatedAt)
+// insertCommand stores a pending command; db may be a transaction
+func insertCommand(db sqlExecer, cmd *models.DeviceCommand) error {
+	_, err := db.Exec(`
+		INSERT INTO device_commands (id, farm_id, coop_id, device_id, issued_by, command_type, command_value, action_duration, status, idempotency_key, issued_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12)
+	`, cmd.ID, cmd.FarmID, cmd.CoopID, cmd.DeviceID, cmd.IssuedBy, cmd.CommandType, cmd.CommandValue, cmd.ActionDuration, cmd.Status, cmd.IdempotencyKey, cmd.IssuedAt, cmd.CreatedAt)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	_, _ = database.DB.Exec(`
+	_, err = db.Exec(`
 		UPDATE devices SET last_command_status = $1, last_command_at = $2, updated_at = CURRENT_TIMESTAMP
 		WHERE id = $3
 	`, cmd.Status, cmd.IssuedAt, cmd.DeviceID)
+	return err
+}
 
-	return cmd, err
+// commandQueued runs the side effects of a stored command (after commit when in a transaction).
+// The desired state is only set once the command succeeds, so a cancelled, failed or timed out
+// command is never replayed to a reconnecting gateway.
+func commandQueued(cmd *models.DeviceCommand, hardwareID string) {
+	// Push right away when the gateway holds a WebSocket; otherwise it picks the command up on its next poll
+	events.NotifyGateway(hardwareID)
 }
 
 // GetCommandStatus returns a single command
@@ -408,10 +513,12 @@ func (s *DeviceService) GetCommandStatus(userID, farmID, commandID uuid.UUID) (*
 
 	var c models.DeviceCommand
 	err := database.DB.QueryRow(`
-		SELECT id, device_id, farm_id, coop_id, issued_by, command_type, command_value, action_duration, status, response, issued_at, executed_at, created_at
+		SELECT id, device_id, farm_id, coop_id, issued_by, command_type, command_value, action_duration, status, response,
+		       COALESCE(idempotency_key, ''), attempt_count, delivered_at, last_polled_at, next_attempt_at, issued_at, executed_at, created_at
 		FROM device_commands
 		WHERE id = $1 AND farm_id = $2
-	`, commandID, farmID).Scan(&c.ID, &c.DeviceID, &c.FarmID, &c.CoopID, &c.IssuedBy, &c.CommandType, &c.CommandValue, &c.ActionDuration, &c.Status, &c.Response, &c.IssuedAt, &c.ExecutedAt, &c.CreatedAt)
+	`, commandID, farmID).Scan(&c.ID, &c.DeviceID, &c.FarmID, &c.CoopID, &c.IssuedBy, &c.CommandType, &c.CommandValue, &c.ActionDuration, &c.Status, &c.Response,
+		&c.IdempotencyKey, &c.AttemptCount, &c.DeliveredAt, &c.LastPolledAt, &c.NextAttemptAt, &c.IssuedAt, &c.ExecutedAt, &c.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, ErrCommandNotFound
 	}
@@ -421,14 +528,14 @@ func (s *DeviceService) GetCommandStatus(userID, farmID, commandID uuid.UUID) (*
 	return &c, nil
 }
 
-// CancelCommand marks a pending command as failed
+// CancelCommand marks a pending command as cancelled
 func (s *DeviceService) CancelCommand(userID, farmID, commandID uuid.UUID) error {
 	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
 		return err
 	}
 	res, err := database.DB.Exec(`
 		UPDATE device_commands
-		SET status = 'failed', response = 'cancelled', executed_at = CURRENT_TIMESTAMP
+		SET status = 'cancelled', response = 'cancelled by user', executed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
 		WHERE id = $1 AND farm_id = $2 AND status = 'pending'
 	`, commandID, farmID)
 	if err != nil {
@@ -477,11 +584,29 @@ func (s *DeviceService) BatchCommands(userID, farmID uuid.UUID, req schemas.Batc
 		return nil, err
 	}
 
-	var results []schemas.BatchResult
-	for _, dID := range req.DeviceIDs {
-		cmd, err := s.IssueCommand(userID, farmID, dID, req.CommandType, req.Parameters, req.ActionDuration)
+	deviceIDs := req.DeviceIDs
+	if !req.DeviceSelector.IsEmpty() {
+		selected, err := resolveDeviceSelector(farmID, nil, req.DeviceSelector)
 		if err != nil {
-			results = append(results, schemas.BatchResult{CommandID: uuid.Nil, DeviceID: dID, Status: "failed"})
+			return nil, err
+		}
+		seen := make(map[uuid.UUID]bool, len(deviceIDs))
+		for _, id := range deviceIDs {
+			seen[id] = true
+		}
+		for _, id := range selected {
+			if !seen[id] {
+				seen[id] = true
+				deviceIDs = append(deviceIDs, id)
+			}
+		}
+	}
+
+	results := make([]schemas.BatchResult, 0, len(deviceIDs))
+	for _, dID := range deviceIDs {
+		cmd, err := s.IssueCommandWithOptions(userID, farmID, dID, req.CommandType, req.Parameters, req.ActionDuration, CommandOptions{Source: "batch"})
+		if err != nil {
+			results = append(results, batchFailure(dID, err))
 			continue
 		}
 		results = append(results, schemas.BatchResult{CommandID: cmd.ID, DeviceID: dID, Status: cmd.Status})
@@ -489,35 +614,27 @@ func (s *DeviceService) BatchCommands(userID, farmID uuid.UUID, req schemas.Batc
 	return results, nil
 }
 
-// EmergencyStop issues an "off" command to all active devices in a farm
-func (s *DeviceService) EmergencyStop(userID, farmID uuid.UUID) (int, error) {
-	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
-		return 0, err
-	}
-
-	rows, err := database.DB.Query(`
-		SELECT id FROM devices WHERE farm_id = $1 AND is_active = true
-	`, farmID)
-	if err != nil {
-		return 0, err
-	}
-	defer rows.Close()
-
-	count := 0
-	for rows.Next() {
-		var dID uuid.UUID
-		if err := rows.Scan(&dID); err != nil {
-			continue
-		}
-		_, _ = s.IssueCommand(userID, farmID, dID, "off", nil, nil)
-		count++
-	}
-	return count, nil
+// batchFailure converts a per-device error into a batch result entry
+func batchFailure(deviceID uuid.UUID, err error) schemas.BatchResult {
+	code, msg := "internal_error", "failed to issue command"
+	var verr *CommandValidationError
+	var violation *InterlockViolationError
+	switch {
+	case errors.As(err, &verr):
+		code, msg = verr.Code, verr.Message
+	case errors.As(err, &violation):
+		code, msg = "interlock_violation", violation.Reason
+	case err == ErrDeviceNotFound:
+		code, msg = "device_not_found", "device not found in this farm"
+	case err == ErrEmergencyStopActive:
+		code, msg = "emergency_stop_active", "an emergency stop is latched for this device"
+	}
+	return schemas.BatchResult{CommandID: uuid.Nil, DeviceID: deviceID, Status: "failed", ErrorCode: &code, Error: &msg}
 }
 
 // UpdateHeartbeat updates a device heartbeat by hardware_id
 func (s *DeviceService) UpdateHeartbeat(hardwareID string, status string, response *string, ipAddress string) error {
-	res, err := database.DB.Exec(`
+	rows, err := database.DB.Query(`
 		UPDATE devices
 		SET is_online = true,
 			last_heartbeat = CURRENT_TIMESTAMP,
@@ -525,12 +642,27 @@ func (s *DeviceService) UpdateHeartbeat(hardwareID string, status string, respon
 			last_command_at = CASE WHEN $1::TEXT IS NOT NULL THEN CURRENT_TIMESTAMP ELSE last_command_at END,
 			response = $2::TEXT
 		WHERE hardware_id = $3::TEXT
+		RETURNING id, last_heartbeat
 	`, status, response, hardwareID)
 	if err != nil {
 		return err
 	}
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
+	type beat struct {
+		deviceID uuid.UUID
+		at       time.Time
+	}
+	beats := make([]beat, 0, 1)
+	for rows.Next() {
+		var b beat
+		if rows.Scan(&b.deviceID, &b.at) == nil {
+			beats = append(beats, b)
+		}
+	}
+	rows.Close()
+	for _, b := range beats {
+		recordHeartbeatHour(b.deviceID, b.at)
+	}
+	if len(beats) == 0 {
 		// Device not assigned to any farm yet. Register as unassigned for discovery.
 		_, err = database.DB.Exec(`
 			INSERT INTO unassigned_gateways (hardware_id, ip_address, last_seen)
@@ -662,7 +794,8 @@ func (s *DeviceService) GetDeviceCommands(userID, farmID, deviceID uuid.UUID, li
 	}
 
 	rows, err := database.DB.Query(`
-		SELECT id, farm_id, device_id, issued_by, command_type, command_value, action_duration, status, response, issued_at, executed_at, created_at
+		SELECT id, farm_id, device_id, issued_by, command_type, command_value, action_duration, status, response,
+		       COALESCE(idempotency_key, ''), attempt_count, delivered_at, last_polled_at, next_attempt_at, issued_at, executed_at, created_at
 		FROM device_commands
 		WHERE device_id = $1 AND farm_id = $2
 		ORDER BY created_at DESC
@@ -676,63 +809,215 @@ func (s *DeviceService) GetDeviceCommands(userID, farmID, deviceID uuid.UUID, li
 	var commands []models.DeviceCommand
 	for rows.Next() {
 		var c models.DeviceCommand
-		if err := rows.Scan(&c.ID, &c.FarmID, &c.DeviceID, &c.IssuedBy, &c.CommandType, &c.CommandValue, &c.ActionDuration, &c.Status, &c.Response, &c.IssuedAt, &c.ExecutedAt, &c.CreatedAt); err != nil {
+		if err := rows.Scan(&c.ID, &c.FarmID, &c.DeviceID, &c.IssuedBy, &c.CommandType, &c.CommandValue, &c.ActionDuration, &c.Status, &c.Response,
+			&c.IdempotencyKey, &c.AttemptCount, &c.DeliveredAt, &c.LastPolledAt, &c.NextAttemptAt, &c.IssuedAt, &c.ExecutedAt, &c.CreatedAt); err != nil {
 			continue
 		}
 		commands = append(commands, c)
 	}
 	return commands, nil
 }
-// GetPendingCommands returns all pending commands for a specific gateway/hardware
+// GetPendingCommands returns the commands due for (re-)delivery to a gateway.
+// Every poll is recorded on the pending commands of the gateway. A command is handed out again
+// only after its backoff has elapsed, and is marked as timed out once all attempts are used up.
 func (s *DeviceService) GetPendingCommands(hardwareID string) ([]models.DeviceCommand, error) {
+	// Record the poll on everything still waiting for this gateway
+	_, _ = database.DB.Exec(`
+		UPDATE device_commands dc SET last_polled_at = $2
+		FROM devices d
+		WHERE dc.device_id = d.id AND d.hardware_id = $1 AND dc.status = 'pending'
+	`, hardwareID, time.Now())
+
+	return s.DeliverDueCommands(hardwareID)
+}
+
+// DeliverDueCommands claims the commands that are due for a gateway, counting one delivery
+// attempt each. Used by both the polling endpoint and the gateway WebSocket push.
+func (s *DeviceService) DeliverDueCommands(hardwareID string) ([]models.DeviceCommand, error) {
+	cfg := config.AppConfig
+	now := time.Now()
+
+	// Give up on commands that were delivered max times and never reported back
+	timedOut, err := database.DB.Query(`
+		UPDATE device_commands dc
+		SET status = 'timeout', response = 'no status after ' || dc.attempt_count || ' delivery attempts',
+			executed_at = $2, updated_at = $2
+		FROM devices d
+		WHERE dc.device_id = d.id AND d.hardware_id = $1 AND dc.status = 'pending'
+			AND dc.attempt_count >= $3 AND dc.next_attempt_at <= $2
+		RETURNING dc.id, dc.command_type, dc.response
+	`, hardwareID, now, cfg.CommandMaxAttempts)
+	if err == nil {
+		type expired struct {
+			id          uuid.UUID
+			commandType string
+			response    string
+		}
+		expiredTracked := make([]expired, 0)
+		for timedOut.Next() {
+			var e expired
+			if timedOut.Scan(&e.id, &e.commandType, &e.response) == nil &&
+				(e.commandType == otaCommandType || e.commandType == applyConfigCommandType) {
+				expiredTracked = append(expiredTracked, e)
+			}
+		}
+		timedOut.Close()
+		for _, e := range expiredTracked {
+			if e.commandType == otaCommandType {
+				otaCommandFinished(e.id, "timeout", e.response)
+			} else {
+				configCommandFinished(e.id, "timeout", e.response)
+			}
+		}
+	}
+
 	rows, err := database.DB.Query(`
-		SELECT dc.id, dc.device_id, dc.farm_id, dc.coop_id, dc.issued_by, dc.command_type, dc.command_value, dc.action_duration, dc.status, dc.response, dc.issued_at, dc.executed_at, dc.created_at, d.model
-		FROM device_commands dc
-		JOIN devices d ON dc.device_id = d.id
-		WHERE d.hardware_id = $1 AND dc.status = 'pending'
-		ORDER BY dc.created_at ASC
-	`, hardwareID)
+		UPDATE device_commands dc
+		SET attempt_count = dc.attempt_count + 1,
+			delivered_at = $2,
+			next_attempt_at = $2 + make_interval(secs => LEAST($3 * POWER(2, dc.attempt_count), $4)),
+			updated_at = $2
+		FROM devices d
+		WHERE dc.device_id = d.id AND d.hardware_id = $1 AND dc.status = 'pending'
+			AND dc.attempt_count < $5
+			AND (dc.next_attempt_at IS NULL OR dc.next_attempt_at <= $2)
+		RETURNING dc.id, dc.device_id, dc.farm_id, dc.coop_id, dc.issued_by, dc.command_type, dc.command_value, dc.action_duration,
+			dc.status, dc.response, COALESCE(dc.idempotency_key, ''), dc.attempt_count, dc.delivered_at, dc.last_polled_at, dc.next_attempt_at,
+			dc.issued_at, dc.executed_at, dc.created_at, d.model
+	`, hardwareID, now, cfg.CommandRetryBaseSeconds, cfg.CommandRetryMaxSeconds, cfg.CommandMaxAttempts)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var commands []models.DeviceCommand
+	commands := make([]models.DeviceCommand, 0)
 	for rows.Next() {
 		var c models.DeviceCommand
-		if err := rows.Scan(&c.ID, &c.DeviceID, &c.FarmID, &c.CoopID, &c.IssuedBy, &c.CommandType, &c.CommandValue, &c.ActionDuration, &c.Status, &c.Response, &c.IssuedAt, &c.ExecutedAt, &c.CreatedAt, &c.DeviceModel); err != nil {
+		if err := rows.Scan(&c.ID, &c.DeviceID, &c.FarmID, &c.CoopID, &c.IssuedBy, &c.CommandType, &c.CommandValue, &c.ActionDuration,
+			&c.Status, &c.Response, &c.IdempotencyKey, &c.AttemptCount, &c.DeliveredAt, &c.LastPolledAt, &c.NextAttemptAt,
+			&c.IssuedAt, &c.ExecutedAt, &c.CreatedAt, &c.DeviceModel); err != nil {
 			continue
 		}
 		commands = append(commands, c)
 	}
+	// RETURNING does not keep order; gateways must execute in issue order
+	sort.Slice(commands, func(i, j int) bool { return commands[i].CreatedAt.Before(commands[j].CreatedAt) })
 	return commands, nil
 }
 
-// UpdateCommandStatus updates the status and response of a command
-func (s *DeviceService) UpdateCommandStatus(commandID uuid.UUID, status, response string) error {
+// UpdateCommandStatus records the final status reported by the gateway.
+// Only pending commands are updated, so duplicate or late reports (e.g. after a timeout or a
+// re-delivery) are ignored with ErrCommandStatusStale. The gateway must echo the idempotency key
+// the command was issued with; a missing or different key returns ErrIdempotencyKey.
+// Gateways may only report on commands of their farm and, when known, their own hardware ID;
+// other commands are reported as not found.
+func (s *DeviceService) UpdateCommandStatus(gatewayFarmID uuid.UUID, hardwareID string, commandID uuid.UUID, status, response, idempotencyKey string) error {
 	now := time.Now()
-	res, err := database.DB.Exec(`
+	var deviceID, farmID uuid.UUID
+	var commandType string
+	var commandValue *string
+	err := database.DB.QueryRow(`
 		UPDATE device_commands
 		SET status = $1, response = $2, executed_at = $3, updated_at = $3
-		WHERE id = $4
-	`, status, response, now, commandID)
+		WHERE id = $4 AND status = 'pending' AND (idempotency_key IS NULL OR idempotency_key = $5)
+			AND farm_id = $6 AND ($7 = '' OR device_id IN (SELECT id FROM devices WHERE hardware_id = $7))
+		RETURNING device_id, farm_id, command_type, command_value
+	`, status, response, now, commandID, idempotencyKey, gatewayFarmID, hardwareID).Scan(&deviceID, &farmID, &commandType, &commandValue)
+	if err == sql.ErrNoRows {
+		return commandNotUpdated(gatewayFarmID, hardwareID, commandID, idempotencyKey)
+	}
 	if err != nil {
 		return err
 	}
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		return ErrCommandNotFound
-	}
 
 	// Also update the device's last command status for quick status checks
-	var deviceID uuid.UUID
-	_ = database.DB.QueryRow("SELECT device_id FROM device_commands WHERE id = $1", commandID).Scan(&deviceID)
-	if deviceID != uuid.Nil {
-		_, _ = database.DB.Exec(`
-			UPDATE devices SET last_command_status = $1, last_command_at = $2, updated_at = $2
-			WHERE id = $3
-		`, status, now, deviceID)
+	_, _ = database.DB.Exec(`
+		UPDATE devices SET last_command_status = $1, last_command_at = $2, updated_at = $2
+		WHERE id = $3
+	`, status, now, deviceID)
+
+	// A successful command means the device reached the commanded state
+	if status == "success" {
+		setDesiredState(farmID, deviceID, commandID, commandType, commandValue)
+		state, value := shadowStateForCommand(commandType, commandValue)
+		_ = setReportedState(farmID, deviceID, state, value, "command")
 	}
 
+	switch commandType {
+	case otaCommandType:
+		otaCommandFinished(commandID, status, response)
+	case applyConfigCommandType:
+		configCommandFinished(commandID, status, response)
+	}
+
+	events.PublishDeviceEvent(farmID, deviceID, "command_status", map[string]interface{}{
+		"command_id": commandID,
+		"device_id":  deviceID,
+		"status":     status,
+	})
+
+	return nil
+}
+
+// AcknowledgeCommand records that a gateway received a pushed command. Re-delivery is held off
+// for the maximum backoff so a command that is still executing is not sent twice. Only the
+// gateway's own commands can be acknowledged.
+func (s *DeviceService) AcknowledgeCommand(gatewayFarmID uuid.UUID, hardwareID string, commandID uuid.UUID, idempotencyKey string) error {
+	now := time.Now()
+	res, err := database.DB.Exec(`
+		UPDATE device_commands
+		SET delivered_at = $1, next_attempt_at = $1 + make_interval(secs => $2), updated_at = $1
+		WHERE id = $3 AND status = 'pending' AND (idempotency_key IS NULL OR idempotency_key = $4)
+			AND farm_id = $5 AND ($6 = '' OR device_id IN (SELECT id FROM devices WHERE hardware_id = $6))
+	`, now, config.AppConfig.CommandRetryMaxSeconds, commandID, idempotencyKey, gatewayFarmID, hardwareID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return commandNotUpdated(gatewayFarmID, hardwareID, commandID, idempotencyKey)
+	}
 	return nil
 }
+
+// commandNotUpdated explains why a gateway report changed nothing: unknown (or another
+// gateway's) command, missing or wrong idempotency key, or a command that is no longer pending
+func commandNotUpdated(gatewayFarmID uuid.UUID, hardwareID string, commandID uuid.UUID, idempotencyKey string) error {
+	var key sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT idempotency_key FROM device_commands
+		WHERE id = $1 AND farm_id = $2 AND ($3 = '' OR device_id IN (SELECT id FROM devices WHERE hardware_id = $3))
+	`, commandID, gatewayFarmID, hardwareID).Scan(&key)
+	if err == sql.ErrNoRows {
+		return ErrCommandNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if key.Valid && key.String != idempotencyKey {
+		return ErrIdempotencyKey
+	}
+	return ErrCommandStatusStale
+}
+
+// ResolveGatewayHardwareID returns the hardware ID a gateway connection serves. Tokens bound to a
+// gateway device use that device; otherwise the requested ID must belong to the token's farm.
+func (s *DeviceService) ResolveGatewayHardwareID(farmID uuid.UUID, tokenDeviceID *uuid.UUID, requested string) (string, error) {
+	var hardwareID string
+	var err error
+	if tokenDeviceID != nil {
+		err = database.DB.QueryRow(`SELECT hardware_id FROM devices WHERE id = $1 AND farm_id = $2`, *tokenDeviceID, farmID).Scan(&hardwareID)
+	} else {
+		err = database.DB.QueryRow(`
+			SELECT hardware_id FROM devices WHERE hardware_id = $1 AND farm_id = $2 LIMIT 1
+		`, strings.TrimSpace(requested), farmID).Scan(&hardwareID)
+	}
+	if err == sql.ErrNoRows {
+		return "", ErrDeviceNotFound
+	}
+	return hardwareID, err
+}
+
+// newIdempotencyKey returns the key a gateway echoes back when reporting a command status
+func newIdempotencyKey() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
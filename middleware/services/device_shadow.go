@@ -0,0 +1,229 @@
+package services
+
+import (
+	"database/sql"
+	"middleware/database"
+	"middleware/schemas"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// shadowStateForCommand maps a command to the state it asks the device to reach.
+// set_value only changes the value; the on/off state is left as it was.
+func shadowStateForCommand(commandType string, commandValue *string) (*string, *string) {
+	switch commandType {
+	case "on", "off", "open", "close":
+		state := commandType
+		return &state, nil
+	case "set_value":
+		return nil, commandValue
+	}
+	return nil, nil
+}
+
+// timedEndState is the state a timed run leaves the device in once its duration has passed
+func timedEndState(commandType string) *string {
+	var state string
+	switch commandType {
+	case "on":
+		state = "off"
+	case "open":
+		state = "close"
+	default:
+		return nil
+	}
+	return &state
+}
+
+// setDesiredState records what a successful command asked the device to do
+func setDesiredState(farmID, deviceID, commandID uuid.UUID, commandType string, commandValue *string) {
+	state, value := shadowStateForCommand(commandType, commandValue)
+	if state == nil && value == nil {
+		return
+	}
+	now := time.Now()
+	_, err := database.DB.Exec(`
+		INSERT INTO device_shadows (device_id, desired_state, desired_value, desired_command_id, desired_at, version, updated_at)
+		VALUES ($1, $2, $3, $4, $5, 1, $5)
+		ON CONFLICT (device_id) DO UPDATE SET
+			desired_state = COALESCE(EXCLUDED.desired_state, device_shadows.desired_state),
+			desired_value = COALESCE(EXCLUDED.desired_value, device_shadows.desired_value),
+			desired_command_id = EXCLUDED.desired_command_id,
+			desired_at = EXCLUDED.desired_at,
+			version = device_shadows.version + 1,
+			updated_at = EXCLUDED.updated_at
+	`, deviceID, state, value, commandID, now)
+	if err != nil {
+		return
+	}
+	publishShadow(farmID, deviceID)
+}
+
+// setReportedState records the state the gateway says the device is in. State changes are kept
+// in device_state_transitions (source: command or report) and pushed to subscribers.
+func setReportedState(farmID, deviceID uuid.UUID, state, value *string, source string) error {
+	if state == nil && value == nil {
+		return nil
+	}
+	if state != nil {
+		normalized := normalizeCommandType(*state)
+		state = &normalized
+	}
+
+	var prevState, prevValue sql.NullString
+	_ = database.DB.QueryRow(`SELECT reported_state, reported_value FROM device_shadows WHERE device_id = $1`, deviceID).Scan(&prevState, &prevValue)
+	changed := (state != nil && (!prevState.Valid || prevState.String != *state)) ||
+		(value != nil && (!prevValue.Valid || prevValue.String != *value))
+
+	now := time.Now()
+	_, err := database.DB.Exec(`
+		INSERT INTO device_shadows (device_id, reported_state, reported_value, reported_at, version, updated_at)
+		VALUES ($1, $2, $3, $4, 1, $4)
+		ON CONFLICT (device_id) DO UPDATE SET
+			reported_state = COALESCE(EXCLUDED.reported_state, device_shadows.reported_state),
+			reported_value = COALESCE(EXCLUDED.reported_value, device_shadows.reported_value),
+			reported_at = EXCLUDED.reported_at,
+			version = device_shadows.version + CASE WHEN $5 THEN 1 ELSE 0 END,
+			updated_at = EXCLUDED.updated_at
+	`, deviceID, state, value, now, changed)
+	if err != nil {
+		return err
+	}
+	if state != nil && (!prevState.Valid || prevState.String != *state) {
+		var from interface{}
+		if prevState.Valid {
+			from = prevState.String
+		}
+		_, _ = database.DB.Exec(`
+			INSERT INTO device_state_transitions (id, device_id, farm_id, from_state, to_state, source, changed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, uuid.New(), deviceID, farmID, from, *state, source, now)
+	}
+	if changed {
+		publishShadow(farmID, deviceID)
+	}
+	return nil
+}
+
+func publishShadow(farmID, deviceID uuid.UUID) {
+	shadow, err := loadShadow(deviceID)
+	if err != nil || shadow == nil {
+		return
+	}
+	events.PublishDeviceEvent(farmID, deviceID, "device_state", shadow)
+}
+
+// shadowSelect loads a device shadow with the command that set the desired state and, for a
+// timed run, when that run ends
+const shadowSelect = `
+	SELECT d.id, d.hardware_id, d.model,
+		s.desired_state, s.desired_value, s.desired_at,
+		s.reported_state, s.reported_value, s.reported_at, COALESCE(s.version, 0),
+		dc.command_type, COALESCE(dc.executed_at, dc.issued_at) + make_interval(secs => dc.action_duration)
+	FROM devices d
+	LEFT JOIN device_shadows s ON s.device_id = d.id
+	LEFT JOIN device_commands dc ON dc.id = s.desired_command_id`
+
+func scanShadow(scanner interface{ Scan(...interface{}) error }) (*schemas.DeviceShadow, error) {
+	var sh schemas.DeviceShadow
+	var commandType sql.NullString
+	var runEnd sql.NullTime
+	if err := scanner.Scan(&sh.DeviceID, &sh.HardwareID, &sh.Model,
+		&sh.Desired.State, &sh.Desired.Value, &sh.Desired.UpdatedAt,
+		&sh.Reported.State, &sh.Reported.Value, &sh.Reported.UpdatedAt, &sh.Version,
+		&commandType, &runEnd); err != nil {
+		return nil, err
+	}
+	// Once a timed run is over the device should be in the run's end state, not the commanded one
+	if runEnd.Valid && !runEnd.Time.After(time.Now()) {
+		if end := timedEndState(commandType.String); end != nil {
+			sh.Desired.State = end
+			sh.Desired.UpdatedAt = &runEnd.Time
+		}
+	}
+	sh.Delta = shadowDelta(sh.Desired, sh.Reported)
+	sh.InSync = sh.Delta == nil
+	return &sh, nil
+}
+
+// shadowDelta returns the desired fields that differ from the reported ones
+func shadowDelta(desired, reported schemas.ShadowState) *schemas.ShadowState {
+	var delta schemas.ShadowState
+	differs := false
+	if desired.State != nil && (reported.State == nil || *reported.State != *desired.State) {
+		delta.State = desired.State
+		differs = true
+	}
+	if desired.Value != nil && (reported.Value == nil || *reported.Value != *desired.Value) {
+		delta.Value = desired.Value
+		differs = true
+	}
+	if !differs {
+		return nil
+	}
+	delta.UpdatedAt = desired.UpdatedAt
+	return &delta
+}
+
+func loadShadow(deviceID uuid.UUID) (*schemas.DeviceShadow, error) {
+	sh, err := scanShadow(database.DB.QueryRow(shadowSelect+` WHERE d.id = $1`, deviceID))
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceNotFound
+	}
+	return sh, err
+}
+
+// GetGatewayShadowDeltas returns the devices behind a gateway whose reported state lags the
+// desired state, so a reconnecting gateway can reconcile them.
+func (s *DeviceService) GetGatewayShadowDeltas(farmID uuid.UUID, hardwareID string) ([]schemas.DeviceShadow, error) {
+	rows, err := database.DB.Query(shadowSelect+`
+		WHERE d.hardware_id = $1 AND d.farm_id = $2 AND d.is_active = true AND s.device_id IS NOT NULL
+		ORDER BY d.device_id ASC
+	`, hardwareID, farmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deltas := make([]schemas.DeviceShadow, 0)
+	for rows.Next() {
+		sh, err := scanShadow(rows)
+		if err != nil {
+			continue
+		}
+		if !sh.InSync {
+			deltas = append(deltas, *sh)
+		}
+	}
+	return deltas, nil
+}
+
+// ApplyReportedStates stores device states reported by an authenticated gateway (heartbeat or
+// WebSocket). Only devices of the gateway's farm are updated.
+func (s *DeviceService) ApplyReportedStates(farmID uuid.UUID, hardwareID string, states []schemas.ReportedDeviceState) error {
+	for _, st := range states {
+		key := strings.TrimSpace(st.DeviceID)
+		if key == "" {
+			continue
+		}
+		var deviceID uuid.UUID
+		err := database.DB.QueryRow(`
+			SELECT id FROM devices
+			WHERE hardware_id = $1 AND farm_id = $3 AND (device_id = $2 OR LOWER(model) = LOWER($2))
+			ORDER BY is_active DESC
+			LIMIT 1
+		`, hardwareID, key, farmID).Scan(&deviceID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := setReportedState(farmID, deviceID, st.State, st.Value, "report"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
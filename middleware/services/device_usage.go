@@ -0,0 +1,258 @@
+package services
+
+import (
+	"math"
+	"middleware/database"
+	"middleware/schemas"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// usageLookback is how far before the range start we look for the state a device was in
+const usageLookback = 7 * 24 * time.Hour
+
+// stateEvent is a point where an actuator was switched on or off. A timed "on" carries autoOff.
+type stateEvent struct {
+	at      time.Time
+	on      bool
+	autoOff *time.Time
+	// command is set for issued commands; transitions only confirm the state and keep the auto-off
+	command bool
+}
+
+// runInterval is one continuous ON period
+type runInterval struct {
+	start, end time.Time
+}
+
+// GetDeviceUsageReport builds runtime, cycles and duty cycle per actuator from successful
+// commands and reported state transitions. from/to are whole days in the farm's time zone.
+func (s *AnalyticsService) GetDeviceUsageReport(userID, farmID uuid.UUID, coopID *uuid.UUID, sel schemas.DeviceSelector, from, to time.Time) (*schemas.DeviceUsageReport, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+
+	deviceFilter, err := selectorDeviceFilter(farmID, coopID, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := farmLocation(farmID)
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+	// Nothing has run in the future; measure duty cycle up to now
+	measuredEnd := end
+	if now := time.Now(); now.Before(measuredEnd) {
+		measuredEnd = now
+	}
+
+	report := &schemas.DeviceUsageReport{
+		FarmID:   farmID,
+		From:     start.Format("2006-01-02"),
+		To:       end.AddDate(0, 0, -1).Format("2006-01-02"),
+		Timezone: loc.String(),
+		Devices:  make([]schemas.DeviceUsage, 0),
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, name, type, model, coop_id FROM devices
+		WHERE farm_id = $1 AND type NOT IN ('adc', 'sensor') AND ($2::UUID IS NULL OR coop_id = $2)
+			AND ($3::UUID[] IS NULL OR id = ANY($3::UUID[]))
+		ORDER BY name ASC
+	`, farmID, coopID, deviceFilter)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]schemas.DeviceUsage, 0)
+	for rows.Next() {
+		var d schemas.DeviceUsage
+		if err := rows.Scan(&d.DeviceID, &d.Name, &d.Type, &d.Model, &d.CoopID); err != nil {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+
+	for _, d := range devices {
+		events, err := loadStateEvents(d.DeviceID, start.Add(-usageLookback), measuredEnd)
+		if err != nil {
+			return nil, err
+		}
+		runs := buildRuns(events, measuredEnd)
+		summarizeUsage(&d, runs, start, end, measuredEnd, loc)
+		report.Devices = append(report.Devices, d)
+	}
+	return report, nil
+}
+
+// loadStateEvents merges successful commands and reported transitions for a device
+func loadStateEvents(deviceID uuid.UUID, from, to time.Time) ([]stateEvent, error) {
+	events := make([]stateEvent, 0)
+
+	rows, err := database.DB.Query(`
+		SELECT command_type, COALESCE(executed_at, issued_at), action_duration
+		FROM device_commands
+		WHERE device_id = $1 AND status = 'success' AND command_type IN ('on', 'off', 'open', 'close')
+			AND COALESCE(executed_at, issued_at) BETWEEN $2 AND $3
+	`, deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var commandType string
+		var at time.Time
+		var duration *int
+		if err := rows.Scan(&commandType, &at, &duration); err != nil {
+			continue
+		}
+		ev := stateEvent{at: at, on: commandType == "on" || commandType == "open", command: true}
+		if ev.on && duration != nil && *duration > 0 {
+			off := at.Add(time.Duration(*duration) * time.Second)
+			ev.autoOff = &off
+		}
+		events = append(events, ev)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`
+		SELECT to_state, changed_at FROM device_state_transitions
+		WHERE device_id = $1 AND changed_at BETWEEN $2 AND $3
+	`, deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state string
+		var at time.Time
+		if err := rows.Scan(&state, &at); err != nil {
+			continue
+		}
+		events = append(events, stateEvent{at: at, on: state == "on" || state == "open"})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+	return events, nil
+}
+
+// buildRuns turns on/off events into ON intervals. Repeated "on" while running does not start a
+// new cycle; a timed "on" ends at its auto-off unless something else happens first.
+func buildRuns(events []stateEvent, until time.Time) []runInterval {
+	runs := make([]runInterval, 0)
+	running := false
+	var runStart time.Time
+	var autoOff *time.Time
+
+	closeRun := func(at time.Time) {
+		if at.After(runStart) {
+			runs = append(runs, runInterval{start: runStart, end: at})
+		}
+		running = false
+		autoOff = nil
+	}
+
+	for _, ev := range events {
+		if running && autoOff != nil && !autoOff.After(ev.at) {
+			closeRun(*autoOff)
+		}
+		switch {
+		case ev.on && !running:
+			running = true
+			runStart = ev.at
+			autoOff = ev.autoOff
+		case ev.on && running && ev.command:
+			// A timed "on" while running extends (or sets) the auto-off; an untimed one clears it.
+			// A repeated "on" transition (e.g. the one recorded for the command itself) keeps it.
+			autoOff = ev.autoOff
+		case !ev.on && running:
+			closeRun(ev.at)
+		}
+	}
+	if running {
+		end := until
+		if autoOff != nil && autoOff.Before(until) {
+			end = *autoOff
+		}
+		closeRun(end)
+	}
+	return runs
+}
+
+func summarizeUsage(d *schemas.DeviceUsage, runs []runInterval, start, end, measuredEnd time.Time, loc *time.Location) {
+	type dayTotals struct {
+		on     time.Duration
+		cycles int
+	}
+	days := make(map[string]*dayTotals)
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		days[day.Format("2006-01-02")] = &dayTotals{}
+	}
+
+	var total time.Duration
+	for _, r := range runs {
+		if !r.end.After(start) || !r.start.Before(end) {
+			continue
+		}
+		rs, re := r.start, r.end
+		if rs.Before(start) {
+			rs = start
+		}
+		if re.After(end) {
+			re = end
+		}
+		total += re.Sub(rs)
+		if run := int64(r.end.Sub(r.start).Seconds()); run > d.LongestRunSeconds {
+			d.LongestRunSeconds = run
+		}
+		if !r.start.Before(start) {
+			d.Cycles++
+			if t := days[r.start.In(loc).Format("2006-01-02")]; t != nil {
+				t.cycles++
+			}
+		}
+
+		// Split across day boundaries in the farm's time zone
+		for cur := rs; cur.Before(re); {
+			local := cur.In(loc)
+			nextDay := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+			segEnd := re
+			if nextDay.Before(segEnd) {
+				segEnd = nextDay
+			}
+			if t := days[local.Format("2006-01-02")]; t != nil {
+				t.on += segEnd.Sub(cur)
+			}
+			cur = segEnd
+		}
+	}
+
+	d.TotalOnSeconds = int64(total.Seconds())
+	if d.Cycles > 0 {
+		d.AvgRunSeconds = d.TotalOnSeconds / int64(d.Cycles)
+	}
+	if span := measuredEnd.Sub(start); span > 0 {
+		d.DutyCyclePct = roundPct(total.Seconds() / span.Seconds())
+	}
+
+	d.Daily = make([]schemas.DailyUsage, 0, len(days))
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		t := days[key]
+		entry := schemas.DailyUsage{Date: key, OnSeconds: int64(t.on.Seconds()), Cycles: t.cycles}
+		dayEnd := day.AddDate(0, 0, 1)
+		if dayEnd.After(measuredEnd) {
+			dayEnd = measuredEnd
+		}
+		if span := dayEnd.Sub(day); span > 0 {
+			entry.DutyCyclePct = roundPct(t.on.Seconds() / span.Seconds())
+		}
+		d.Daily = append(d.Daily, entry)
+	}
+}
+
+// roundPct converts a ratio to a percentage with two decimals
+func roundPct(ratio float64) float64 {
+	return math.Round(ratio*10000) / 100
+}
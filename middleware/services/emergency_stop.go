@@ -0,0 +1,273 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrEmergencyStopActive    = errors.New("emergency_stop_active")
+	ErrEmergencyStopNotActive = errors.New("emergency_stop_not_active")
+)
+
+// EmergencyStop cancels pending commands, queues "off" for every switchable device and latches
+// the farm (or one coop) in a stopped state, all in one transaction. While latched, schedules
+// and regular commands are refused until ResumeEmergencyStop is called. With a tag or group
+// selector only the matched devices are stopped and latched; membership is fixed at trigger time.
+func (s *DeviceService) EmergencyStop(userID, farmID uuid.UUID, req schemas.EmergencyStopRequest, ipAddress string) (*schemas.EmergencyStopStatus, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize stops/resumes per farm
+	if _, err := tx.Exec(`SELECT id FROM farms WHERE id = $1 FOR UPDATE`, farmID); err != nil {
+		return nil, err
+	}
+	if req.CoopID != nil {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM coops WHERE id = $1 AND farm_id = $2)`, *req.CoopID, farmID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrCoopNotFound
+		}
+	}
+	deviceFilter, err := selectorDeviceFilter(farmID, req.CoopID, req.DeviceSelector)
+	if err != nil {
+		return nil, err
+	}
+	selector := selectorLabel(req.DeviceSelector)
+
+	// Config and firmware pushes do not move actuators, so they stay queued
+	now := time.Now()
+	res, err := tx.Exec(`
+		UPDATE device_commands
+		SET status = 'cancelled', response = 'cancelled by emergency stop', executed_at = $3, updated_at = $3
+		WHERE farm_id = $1 AND status = 'pending' AND ($2::UUID IS NULL OR coop_id = $2)
+			AND command_type NOT IN ($4, $5) AND ($6::UUID[] IS NULL OR device_id = ANY($6::UUID[]))
+	`, farmID, req.CoopID, now, applyConfigCommandType, otaCommandType, deviceFilter)
+	if err != nil {
+		return nil, err
+	}
+	cancelled, _ := res.RowsAffected()
+
+	targets, err := emergencyStopTargets(tx, farmID, req.CoopID, deviceFilter)
+	if err != nil {
+		return nil, err
+	}
+	queued := make([]*models.DeviceCommand, 0, len(targets))
+	hardwareIDs := make(map[uuid.UUID]string, len(targets))
+	for _, t := range targets {
+		// Devices without an "off" capability (sensors, servos) have nothing to switch off
+		if validateCommand(t, "off", nil, nil) != nil {
+			continue
+		}
+		cmd := newPendingCommand(userID, t, "off", nil, nil)
+		if err := insertCommand(tx, cmd); err != nil {
+			return nil, err
+		}
+		queued = append(queued, cmd)
+		hardwareIDs[cmd.ID] = t.HardwareID
+	}
+
+	stop := schemas.EmergencyStopStatus{
+		FarmID:            farmID,
+		CoopID:            req.CoopID,
+		Selector:          selector,
+		Reason:            req.Reason,
+		Active:            true,
+		CommandsCancelled: int(cancelled),
+		CommandsIssued:    len(queued),
+		TriggeredBy:       userID,
+		TriggeredAt:       now,
+	}
+	for _, cmd := range queued {
+		stop.CommandIDs = append(stop.CommandIDs, cmd.ID)
+	}
+	var latchedDevices interface{}
+	if selector != nil {
+		for _, t := range targets {
+			stop.DeviceIDs = append(stop.DeviceIDs, t.ID)
+		}
+		latchedDevices = uuidArray(stop.DeviceIDs)
+		if latchedDevices == nil {
+			latchedDevices = "{}"
+		}
+	}
+
+	// Re-triggering an already latched scope refreshes the existing latch
+	err = tx.QueryRow(`
+		UPDATE emergency_stops
+		SET reason = COALESCE($3, reason), commands_cancelled = commands_cancelled + $4, commands_issued = commands_issued + $5,
+			device_ids = $7
+		WHERE farm_id = $1 AND coop_id IS NOT DISTINCT FROM $2 AND selector IS NOT DISTINCT FROM $6 AND resumed_at IS NULL
+		RETURNING id, triggered_by, triggered_at
+	`, farmID, req.CoopID, req.Reason, stop.CommandsCancelled, stop.CommandsIssued, selector, latchedDevices).Scan(&stop.ID, &stop.TriggeredBy, &stop.TriggeredAt)
+	if err == sql.ErrNoRows {
+		stop.ID = uuid.New()
+		_, err = tx.Exec(`
+			INSERT INTO emergency_stops (id, farm_id, coop_id, selector, device_ids, reason, commands_cancelled, commands_issued, triggered_by, triggered_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		`, stop.ID, farmID, req.CoopID, selector, latchedDevices, req.Reason, stop.CommandsCancelled, stop.CommandsIssued, userID, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range queued {
+		commandQueued(cmd, hardwareIDs[cmd.ID])
+	}
+	logEvent(farmID, userID, "emergency_stop", &stop.ID, nil, map[string]interface{}{
+		"coop_id":            req.CoopID,
+		"selector":           selector,
+		"reason":             req.Reason,
+		"commands_cancelled": stop.CommandsCancelled,
+		"commands_issued":    stop.CommandsIssued,
+	}, ipAddress)
+	events.PublishFarmEvent(farmID, "emergency_stop", stop)
+
+	return &stop, nil
+}
+
+// ResumeEmergencyStop releases the latch for the farm (or one coop, or one selector). Devices
+// stay off; farmers switch them back on explicitly.
+func (s *DeviceService) ResumeEmergencyStop(userID, farmID uuid.UUID, req schemas.EmergencyResumeRequest, ipAddress string) (*schemas.EmergencyStopStatus, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	selector := selectorLabel(req.DeviceSelector)
+	var stop schemas.EmergencyStopStatus
+	var deviceIDs []string
+	err := database.DB.QueryRow(`
+		UPDATE emergency_stops
+		SET resumed_by = $3, resumed_at = $4, resume_note = $5
+		WHERE farm_id = $1 AND coop_id IS NOT DISTINCT FROM $2 AND selector IS NOT DISTINCT FROM $6 AND resumed_at IS NULL
+		RETURNING id, farm_id, coop_id, selector, device_ids, reason, commands_cancelled, commands_issued, triggered_by, triggered_at, resumed_by, resumed_at, resume_note
+	`, farmID, req.CoopID, userID, now, req.Note, selector).Scan(&stop.ID, &stop.FarmID, &stop.CoopID, &stop.Selector, pq.Array(&deviceIDs), &stop.Reason,
+		&stop.CommandsCancelled, &stop.CommandsIssued, &stop.TriggeredBy, &stop.TriggeredAt, &stop.ResumedBy, &stop.ResumedAt, &stop.ResumeNote)
+	if err == sql.ErrNoRows {
+		return nil, ErrEmergencyStopNotActive
+	}
+	if err != nil {
+		return nil, err
+	}
+	stop.DeviceIDs = parseUUIDs(deviceIDs)
+
+	logEvent(farmID, userID, "emergency_resume", &stop.ID, map[string]interface{}{"active": true}, map[string]interface{}{
+		"active":   false,
+		"coop_id":  req.CoopID,
+		"selector": selector,
+		"note":     req.Note,
+	}, ipAddress)
+	events.PublishFarmEvent(farmID, "emergency_resume", stop)
+
+	return &stop, nil
+}
+
+// GetActiveEmergencyStops lists the latches currently in force for a farm
+func (s *DeviceService) GetActiveEmergencyStops(userID, farmID uuid.UUID) ([]schemas.EmergencyStopStatus, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, farm_id, coop_id, selector, device_ids, reason, commands_cancelled, commands_issued, triggered_by, triggered_at
+		FROM emergency_stops
+		WHERE farm_id = $1 AND resumed_at IS NULL
+		ORDER BY triggered_at DESC
+	`, farmID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stops := make([]schemas.EmergencyStopStatus, 0)
+	for rows.Next() {
+		var st schemas.EmergencyStopStatus
+		var deviceIDs []string
+		if err := rows.Scan(&st.ID, &st.FarmID, &st.CoopID, &st.Selector, pq.Array(&deviceIDs), &st.Reason, &st.CommandsCancelled, &st.CommandsIssued,
+			&st.TriggeredBy, &st.TriggeredAt); err != nil {
+			continue
+		}
+		st.DeviceIDs = parseUUIDs(deviceIDs)
+		st.Active = true
+		stops = append(stops, st)
+	}
+	return stops, nil
+}
+
+// activeEmergencyStop returns the latch blocking a device: a farm-wide stop, one on its coop,
+// or a selector stop that latched the device
+func activeEmergencyStop(farmID uuid.UUID, coopID *uuid.UUID, deviceID uuid.UUID) (*uuid.UUID, error) {
+	var id uuid.UUID
+	err := database.DB.QueryRow(`
+		SELECT id FROM emergency_stops
+		WHERE farm_id = $1 AND resumed_at IS NULL AND (coop_id IS NULL OR coop_id = $2)
+			AND (device_ids IS NULL OR $3 = ANY(device_ids))
+		ORDER BY triggered_at DESC
+		LIMIT 1
+	`, farmID, coopID, deviceID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func emergencyStopTargets(tx *sql.Tx, farmID uuid.UUID, coopID *uuid.UUID, deviceFilter interface{}) ([]*commandTarget, error) {
+	rows, err := tx.Query(`
+		SELECT id, farm_id, coop_id, type, model, hardware_id
+		FROM devices
+		WHERE farm_id = $1 AND is_active = true AND ($2::UUID IS NULL OR coop_id = $2)
+			AND ($3::UUID[] IS NULL OR id = ANY($3::UUID[]))
+		FOR UPDATE
+	`, farmID, coopID, deviceFilter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := make([]*commandTarget, 0)
+	for rows.Next() {
+		var t commandTarget
+		if err := rows.Scan(&t.ID, &t.FarmID, &t.CoopID, &t.Type, &t.Model, &t.HardwareID); err != nil {
+			return nil, err
+		}
+		targets = append(targets, &t)
+	}
+	return targets, rows.Err()
+}
+
+func parseUUIDs(values []string) []uuid.UUID {
+	if len(values) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, 0, len(values))
+	for _, v := range values {
+		if id, err := uuid.Parse(v); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"database/sql"
+	"math"
+	"middleware/database"
+	"middleware/schemas"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ratedWattsParameter is the device_configurations parameter holding an actuator's power draw
+const ratedWattsParameter = "rated_watts"
+
+// GetEnergyReport estimates energy and electricity cost per device, coop and farm from actuator
+// runtime, each device's rated wattage and the farm tariff. Devices draw full rated power while on.
+func (s *AnalyticsService) GetEnergyReport(userID, farmID uuid.UUID, coopID *uuid.UUID, sel schemas.DeviceSelector, from, to time.Time) (*schemas.EnergyReport, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+
+	loc := farmLocation(farmID)
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+	return buildEnergyReport(farmID, coopID, sel, start, end, loc)
+}
+
+// energyDevice is an actuator with its rated power
+type energyDevice struct {
+	schemas.DeviceEnergy
+	coopName string
+}
+
+func buildEnergyReport(farmID uuid.UUID, coopID *uuid.UUID, sel schemas.DeviceSelector, start, end time.Time, loc *time.Location) (*schemas.EnergyReport, error) {
+	tariff, err := loadFarmTariff(farmID)
+	if err != nil {
+		return nil, err
+	}
+	deviceFilter, err := selectorDeviceFilter(farmID, coopID, sel)
+	if err != nil {
+		return nil, err
+	}
+	measuredEnd := end
+	if now := time.Now(); now.Before(measuredEnd) {
+		measuredEnd = now
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT d.id, d.name, d.coop_id, COALESCE(c.name, ''), cfg.parameter_value
+		FROM devices d
+		LEFT JOIN coops c ON c.id = d.coop_id
+		LEFT JOIN device_configurations cfg ON cfg.device_id = d.id AND cfg.parameter_name = $3
+		WHERE d.farm_id = $1 AND d.type NOT IN ('adc', 'sensor') AND ($2::UUID IS NULL OR d.coop_id = $2)
+			AND ($4::UUID[] IS NULL OR d.id = ANY($4::UUID[]))
+		ORDER BY d.name ASC
+	`, farmID, coopID, ratedWattsParameter, deviceFilter)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*energyDevice, 0)
+	for rows.Next() {
+		var d energyDevice
+		var watts sql.NullString
+		if err := rows.Scan(&d.DeviceID, &d.Name, &d.CoopID, &d.coopName, &watts); err != nil {
+			continue
+		}
+		if watts.Valid {
+			if w, err := strconv.ParseFloat(watts.String, 64); err == nil && w >= 0 {
+				d.RatedWatts = &w
+			}
+		}
+		devices = append(devices, &d)
+	}
+	rows.Close()
+
+	report := &schemas.EnergyReport{
+		FarmID:   farmID,
+		From:     start.Format("2006-01-02"),
+		To:       end.AddDate(0, 0, -1).Format("2006-01-02"),
+		Timezone: loc.String(),
+		Currency: tariff.Currency,
+		Daily:    make([]schemas.EnergyTotal, 0),
+		Monthly:  make([]schemas.EnergyTotal, 0),
+		Coops:    make([]schemas.CoopEnergy, 0),
+		Devices:  make([]schemas.DeviceEnergy, 0, len(devices)),
+	}
+	daily := make(map[string]*schemas.EnergyTotal)
+	monthly := make(map[string]*schemas.EnergyTotal)
+	coops := make(map[string]*schemas.CoopEnergy)
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		daily[day.Format("2006-01-02")] = &schemas.EnergyTotal{Period: day.Format("2006-01-02")}
+		monthly[day.Format("2006-01")] = &schemas.EnergyTotal{Period: day.Format("2006-01")}
+	}
+
+	for _, d := range devices {
+		events, err := loadStateEvents(d.DeviceID, start.Add(-usageLookback), measuredEnd)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range buildRuns(events, measuredEnd) {
+			rs, re := r.start, r.end
+			if rs.Before(start) {
+				rs = start
+			}
+			if re.After(end) {
+				re = end
+			}
+			// Split at midnights and tariff edges so each segment has one day and one rate
+			for cur := rs; cur.Before(re); {
+				local := cur.In(loc)
+				segEnd := nextTariffBoundary(tariff, local)
+				if segEnd.After(re) {
+					segEnd = re
+				}
+				seconds := segEnd.Sub(cur).Seconds()
+				d.OnSeconds += int64(seconds)
+				if d.RatedWatts != nil {
+					kwh := *d.RatedWatts * seconds / 3600 / 1000
+					cost := kwh * tariffRate(tariff, local)
+					d.KWh += kwh
+					d.Cost += cost
+					if t := daily[local.Format("2006-01-02")]; t != nil {
+						t.KWh += kwh
+						t.Cost += cost
+					}
+					if t := monthly[local.Format("2006-01")]; t != nil {
+						t.KWh += kwh
+						t.Cost += cost
+					}
+				}
+				cur = segEnd
+			}
+		}
+
+		if d.RatedWatts == nil && d.OnSeconds > 0 {
+			report.DevicesWithoutWattage++
+		}
+		d.KWh, d.Cost = roundEnergy(d.KWh), roundEnergy(d.Cost)
+		report.TotalKWh += d.KWh
+		report.TotalCost += d.Cost
+
+		key := ""
+		if d.CoopID != nil {
+			key = d.CoopID.String()
+		}
+		ce := coops[key]
+		if ce == nil {
+			ce = &schemas.CoopEnergy{CoopID: d.CoopID, Name: d.coopName}
+			coops[key] = ce
+		}
+		ce.KWh += d.KWh
+		ce.Cost += d.Cost
+		report.Devices = append(report.Devices, d.DeviceEnergy)
+	}
+
+	report.TotalKWh, report.TotalCost = roundEnergy(report.TotalKWh), roundEnergy(report.TotalCost)
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		t := daily[day.Format("2006-01-02")]
+		report.Daily = append(report.Daily, schemas.EnergyTotal{Period: t.Period, KWh: roundEnergy(t.KWh), Cost: roundEnergy(t.Cost)})
+	}
+	for _, t := range monthly {
+		report.Monthly = append(report.Monthly, schemas.EnergyTotal{Period: t.Period, KWh: roundEnergy(t.KWh), Cost: roundEnergy(t.Cost)})
+	}
+	sort.Slice(report.Monthly, func(i, j int) bool { return report.Monthly[i].Period < report.Monthly[j].Period })
+	for _, ce := range coops {
+		ce.KWh, ce.Cost = roundEnergy(ce.KWh), roundEnergy(ce.Cost)
+		report.Coops = append(report.Coops, *ce)
+	}
+	sort.Slice(report.Coops, func(i, j int) bool { return report.Coops[i].Name < report.Coops[j].Name })
+	return report, nil
+}
+
+// energySummary returns today's and month-to-date totals for the dashboard
+func energySummary(farmID uuid.UUID) (*schemas.EnergySummary, error) {
+	loc := farmLocation(farmID)
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+
+	report, err := buildEnergyReport(farmID, nil, schemas.DeviceSelector{}, monthStart, today.AddDate(0, 0, 1), loc)
+	if err != nil {
+		return nil, err
+	}
+	summary := &schemas.EnergySummary{Currency: report.Currency, MonthKWh: report.TotalKWh, MonthCost: report.TotalCost}
+	for _, d := range report.Daily {
+		if d.Period == today.Format("2006-01-02") {
+			summary.TodayKWh, summary.TodayCost = d.KWh, d.Cost
+		}
+	}
+	return summary, nil
+}
+
+func roundEnergy(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"middleware/database"
+
+	"github.com/google/uuid"
+)
+
+// logEvent appends an entry to the farm audit log (event_logs). Failures are logged, not returned,
+// so auditing never blocks the action being audited.
+func logEvent(farmID, userID uuid.UUID, eventType string, resourceID *uuid.UUID, oldValue, newValue interface{}, ipAddress string) {
+	var oldJSON, newJSON, ip interface{}
+	if oldValue != nil {
+		raw, _ := json.Marshal(oldValue)
+		oldJSON = raw
+	}
+	if newValue != nil {
+		raw, _ := json.Marshal(newValue)
+		newJSON = raw
+	}
+	if ipAddress != "" {
+		ip = ipAddress
+	}
+	_, err := database.DB.Exec(`
+		INSERT INTO event_logs (id, farm_id, user_id, event_type, resource_id, old_value, new_value, ip_address)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, uuid.New(), farmID, userID, eventType, resourceID, oldJSON, newJSON, ip)
+	if err != nil {
+		log.Printf("Audit log error (%s): %v", eventType, err)
+	}
+}
@@ -0,0 +1,32 @@
+package services
+
+import "github.com/google/uuid"
+
+// EventPublisher delivers realtime events to connected WebSocket clients.
+// The API layer's hub implements it; services only describe what happened.
+type EventPublisher interface {
+	// PublishFarmEvent broadcasts an event to every client bound to the farm
+	PublishFarmEvent(farmID uuid.UUID, eventType string, data interface{})
+	// PublishCoopEvent broadcasts an event about one coop to the farm's clients
+	PublishCoopEvent(farmID, coopID uuid.UUID, eventType string, data interface{})
+	// PublishDeviceEvent broadcasts an event about one device to the farm's clients
+	PublishDeviceEvent(farmID, deviceID uuid.UUID, eventType string, data interface{})
+	// NotifyGateway wakes the gateway connection for hardwareID so it picks up due commands
+	NotifyGateway(hardwareID string)
+}
+
+type noopPublisher struct{}
+
+func (noopPublisher) PublishFarmEvent(uuid.UUID, string, interface{})              {}
+func (noopPublisher) PublishCoopEvent(uuid.UUID, uuid.UUID, string, interface{})   {}
+func (noopPublisher) PublishDeviceEvent(uuid.UUID, uuid.UUID, string, interface{}) {}
+func (noopPublisher) NotifyGateway(string)                                         {}
+
+var events EventPublisher = noopPublisher{}
+
+// SetEventPublisher wires the realtime transport used by services
+func SetEventPublisher(p EventPublisher) {
+	if p != nil {
+		events = p
+	}
+}
@@ -14,6 +14,7 @@ import (
 var (
 	ErrFarmNotFound     = errors.New("farm not found")
 	ErrFarmAccessDenied = errors.New("access denied to farm")
+	ErrInvalidTopic     = errors.New("invalid_topic")
 )
 
 // FarmService handles all business logic related to farm management
@@ -201,3 +202,42 @@ func (s *FarmService) GetFarmMembers(userID, farmID uuid.UUID) ([]schemas.Member
 
 	return members, total, nil
 }
+
+// farmLocation returns the farm's configured time zone, falling back to UTC
+func farmLocation(farmID uuid.UUID) *time.Location {
+	var tz sql.NullString
+	_ = database.DB.QueryRow(`SELECT timezone FROM farms WHERE id = $1`, farmID).Scan(&tz)
+	if tz.Valid && tz.String != "" {
+		if loc, err := time.LoadLocation(tz.String); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// TopicFarm returns the farm a realtime topic scope belongs to: the farm itself, or the farm
+// of a coop or device
+func (s *FarmService) TopicFarm(scope string, id uuid.UUID) (uuid.UUID, error) {
+	var farmID uuid.UUID
+	var err error
+	switch scope {
+	case "farm":
+		err = database.DB.QueryRow(`SELECT id FROM farms WHERE id = $1`, id).Scan(&farmID)
+		if err == sql.ErrNoRows {
+			return uuid.Nil, ErrFarmNotFound
+		}
+	case "coop":
+		err = database.DB.QueryRow(`SELECT farm_id FROM coops WHERE id = $1`, id).Scan(&farmID)
+		if err == sql.ErrNoRows {
+			return uuid.Nil, ErrCoopNotFound
+		}
+	case "device":
+		err = database.DB.QueryRow(`SELECT farm_id FROM devices WHERE id = $1`, id).Scan(&farmID)
+		if err == sql.ErrNoRows {
+			return uuid.Nil, ErrDeviceNotFound
+		}
+	default:
+		return uuid.Nil, ErrInvalidTopic
+	}
+	return farmID, err
+}
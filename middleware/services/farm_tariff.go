@@ -0,0 +1,131 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"middleware/database"
+	"middleware/schemas"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultTariffCurrency is used until a farm configures its tariff
+const defaultTariffCurrency = "KHR"
+
+// GetFarmTariff returns the farm's electricity tariff (zero rates when never configured)
+func (s *FarmService) GetFarmTariff(userID, farmID uuid.UUID) (*schemas.FarmTariff, error) {
+	if err := s.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	return loadFarmTariff(farmID)
+}
+
+// UpdateFarmTariff replaces the farm's tariff and time-of-use periods
+func (s *FarmService) UpdateFarmTariff(userID, farmID uuid.UUID, req schemas.UpdateFarmTariffRequest) (*schemas.FarmTariff, error) {
+	if err := s.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+
+	currency := strings.ToUpper(strings.TrimSpace(req.Currency))
+	if currency == "" {
+		currency = defaultTariffCurrency
+	}
+	if len(currency) != 3 {
+		return nil, &CommandValidationError{Code: "invalid_tariff", Message: "currency must be a 3-letter code", Field: "currency"}
+	}
+	if req.BaseRatePerKWh < 0 {
+		return nil, &CommandValidationError{Code: "invalid_tariff", Message: "base_rate_per_kwh must not be negative", Field: "base_rate_per_kwh"}
+	}
+	if req.Periods == nil {
+		req.Periods = []schemas.TariffPeriod{}
+	}
+	for i, p := range req.Periods {
+		start, okStart := parseClockMinutes(p.StartTime)
+		end, okEnd := parseClockMinutes(p.EndTime)
+		if !okStart || !okEnd || start == end {
+			return nil, &CommandValidationError{Code: "invalid_tariff", Message: fmt.Sprintf("period %d: start_time and end_time must be distinct HH:MM values", i+1), Field: "periods"}
+		}
+		if p.RatePerKWh < 0 {
+			return nil, &CommandValidationError{Code: "invalid_tariff", Message: fmt.Sprintf("period %d: rate_per_kwh must not be negative", i+1), Field: "periods"}
+		}
+	}
+
+	periods, _ := json.Marshal(req.Periods)
+	_, err := database.DB.Exec(`
+		INSERT INTO farm_tariffs (farm_id, currency, base_rate_per_kwh, periods, updated_by, updated_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+		ON CONFLICT (farm_id) DO UPDATE SET
+			currency = EXCLUDED.currency, base_rate_per_kwh = EXCLUDED.base_rate_per_kwh,
+			periods = EXCLUDED.periods, updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at
+	`, farmID, currency, req.BaseRatePerKWh, periods, userID)
+	if err != nil {
+		return nil, err
+	}
+	return loadFarmTariff(farmID)
+}
+
+func loadFarmTariff(farmID uuid.UUID) (*schemas.FarmTariff, error) {
+	tariff := &schemas.FarmTariff{FarmID: farmID, Currency: defaultTariffCurrency, Periods: []schemas.TariffPeriod{}}
+	var periods []byte
+	err := database.DB.QueryRow(`
+		SELECT currency, base_rate_per_kwh, periods, updated_at FROM farm_tariffs WHERE farm_id = $1
+	`, farmID).Scan(&tariff.Currency, &tariff.BaseRatePerKWh, &periods, &tariff.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return tariff, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(periods) > 0 {
+		_ = json.Unmarshal(periods, &tariff.Periods)
+	}
+	return tariff, nil
+}
+
+// parseClockMinutes converts "HH:MM" to minutes after midnight
+func parseClockMinutes(v string) (int, bool) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// tariffRate returns the price per kWh at a local time of day
+func tariffRate(tariff *schemas.FarmTariff, local time.Time) float64 {
+	minute := local.Hour()*60 + local.Minute()
+	for _, p := range tariff.Periods {
+		start, okStart := parseClockMinutes(p.StartTime)
+		end, okEnd := parseClockMinutes(p.EndTime)
+		if !okStart || !okEnd {
+			continue
+		}
+		if (start < end && minute >= start && minute < end) ||
+			(start > end && (minute >= start || minute < end)) {
+			return p.RatePerKWh
+		}
+	}
+	return tariff.BaseRatePerKWh
+}
+
+// nextTariffBoundary returns the next local midnight or period edge after local
+func nextTariffBoundary(tariff *schemas.FarmTariff, local time.Time) time.Time {
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	next := midnight.AddDate(0, 0, 1)
+	for _, p := range tariff.Periods {
+		for _, edge := range []string{p.StartTime, p.EndTime} {
+			m, ok := parseClockMinutes(edge)
+			if !ok {
+				continue
+			}
+			at := midnight.Add(time.Duration(m) * time.Minute)
+			if at.After(local) && at.Before(next) {
+				next = at
+			}
+		}
+	}
+	return next
+}
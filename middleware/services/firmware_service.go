@@ -0,0 +1,673 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"middleware/config"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrFirmwareNotFound    = errors.New("firmware_not_found")
+	ErrFirmwareExists      = errors.New("firmware_exists")
+	ErrFirmwareChecksum    = errors.New("firmware_checksum_mismatch")
+	ErrCampaignNotFound    = errors.New("campaign_not_found")
+	ErrCampaignNotRunning  = errors.New("campaign_not_running")
+	ErrCampaignNotHalted   = errors.New("campaign_not_halted")
+	ErrCampaignBadPercent  = errors.New("campaign_invalid_percentage")
+	ErrCampaignNoFirmware  = errors.New("campaign_firmware_not_found")
+	ErrCampaignInvalidName = errors.New("campaign_name_required")
+)
+
+// otaCommandType is the gateway command that installs a firmware artifact
+const otaCommandType = "ota_update"
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// FirmwareService manages the firmware registry and OTA rollout campaigns (admin only)
+type FirmwareService struct{}
+
+func NewFirmwareService() *FirmwareService {
+	return &FirmwareService{}
+}
+
+const firmwareColumns = `id, version, target_model, file_name, file_path, size_bytes, checksum_sha256, signature, notes, uploaded_by, created_at`
+
+func scanFirmware(scanner interface{ Scan(...interface{}) error }) (*models.FirmwareArtifact, error) {
+	var f models.FirmwareArtifact
+	if err := scanner.Scan(&f.ID, &f.Version, &f.TargetModel, &f.FileName, &f.FilePath, &f.SizeBytes, &f.ChecksumSHA256,
+		&f.Signature, &f.Notes, &f.UploadedBy, &f.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// RegisterArtifact stores a firmware image on disk and records it. The SHA-256 checksum is computed
+// here; when expectedChecksum is given it must match. The signature is stored for gateways to verify.
+func (s *FirmwareService) RegisterArtifact(adminID uuid.UUID, version, targetModel, fileName string, body io.Reader, signature, expectedChecksum string, notes *string) (*models.FirmwareArtifact, error) {
+	version = strings.TrimSpace(version)
+	targetModel = strings.ToLower(strings.TrimSpace(targetModel))
+
+	var exists bool
+	if err := database.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM firmware_artifacts WHERE target_model = $1 AND version = $2)`,
+		targetModel, version).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrFirmwareExists
+	}
+
+	dir := config.AppConfig.FirmwareStorageDir
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	id := uuid.New()
+	safeName := unsafeFileChars.ReplaceAllString(filepath.Base(fileName), "_")
+	path := filepath.Join(dir, id.String()+"_"+safeName)
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if expectedChecksum != "" && !strings.EqualFold(expectedChecksum, checksum) {
+		_ = os.Remove(path)
+		return nil, ErrFirmwareChecksum
+	}
+
+	artifact, err := scanFirmware(database.DB.QueryRow(`
+		INSERT INTO firmware_artifacts (id, version, target_model, file_name, file_path, size_bytes, checksum_sha256, signature, notes, uploaded_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING `+firmwareColumns,
+		id, version, targetModel, safeName, path, size, checksum, signature, notes, adminID))
+	if err != nil {
+		_ = os.Remove(path)
+		// A concurrent upload of the same version won the race
+		if isUniqueViolation(err) {
+			return nil, ErrFirmwareExists
+		}
+		return nil, err
+	}
+	return artifact, nil
+}
+
+// ListArtifacts returns all registered firmware, newest first
+func (s *FirmwareService) ListArtifacts() ([]models.FirmwareArtifact, error) {
+	rows, err := database.DB.Query(`SELECT ` + firmwareColumns + ` FROM firmware_artifacts ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	artifacts := make([]models.FirmwareArtifact, 0)
+	for rows.Next() {
+		f, err := scanFirmware(rows)
+		if err != nil {
+			continue
+		}
+		artifacts = append(artifacts, *f)
+	}
+	return artifacts, nil
+}
+
+// GetArtifact returns a single firmware artifact
+func (s *FirmwareService) GetArtifact(firmwareID uuid.UUID) (*models.FirmwareArtifact, error) {
+	f, err := scanFirmware(database.DB.QueryRow(`SELECT `+firmwareColumns+` FROM firmware_artifacts WHERE id = $1`, firmwareID))
+	if err == sql.ErrNoRows {
+		return nil, ErrFirmwareNotFound
+	}
+	return f, err
+}
+
+// GetArtifactForGateway returns an artifact a gateway of farmID has been asked to install
+func (s *FirmwareService) GetArtifactForGateway(farmID, firmwareID uuid.UUID) (*models.FirmwareArtifact, error) {
+	var allowed bool
+	if err := database.DB.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM ota_campaign_devices cd
+			JOIN ota_campaigns c ON c.id = cd.campaign_id
+			WHERE c.firmware_id = $1 AND cd.farm_id = $2
+		)
+	`, firmwareID, farmID).Scan(&allowed); err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrFirmwareNotFound
+	}
+	return s.GetArtifact(firmwareID)
+}
+
+// ===== CAMPAIGNS =====
+
+// uuidArray binds a UUID list as a Postgres array; an empty list binds NULL (no filter)
+func uuidArray(ids []uuid.UUID) interface{} {
+	if len(ids) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, id.String())
+	}
+	return pq.Array(values)
+}
+
+const campaignColumns = `id, firmware_id, name, status, target_percentage, target_farm_ids, failure_threshold_pct, min_sample_size,
+	halt_reason, created_by, created_at, halted_at, completed_at, updated_at`
+
+func scanCampaign(scanner interface{ Scan(...interface{}) error }) (*models.OTACampaign, error) {
+	var c models.OTACampaign
+	var farmIDs []string
+	if err := scanner.Scan(&c.ID, &c.FirmwareID, &c.Name, &c.Status, &c.TargetPercentage, pq.Array(&farmIDs), &c.FailureThresholdPct,
+		&c.MinSampleSize, &c.HaltReason, &c.CreatedBy, &c.CreatedAt, &c.HaltedAt, &c.CompletedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	for _, id := range farmIDs {
+		if parsed, err := uuid.Parse(id); err == nil {
+			c.TargetFarmIDs = append(c.TargetFarmIDs, parsed)
+		}
+	}
+	return &c, nil
+}
+
+// CreateCampaign registers a rollout and immediately queues ota_update for the targeted devices
+func (s *FirmwareService) CreateCampaign(adminID uuid.UUID, req schemas.CreateOTACampaignRequest) (*schemas.OTACampaignDetail, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, ErrCampaignInvalidName
+	}
+	if req.TargetPercentage != nil && (*req.TargetPercentage < 1 || *req.TargetPercentage > 100) {
+		return nil, ErrCampaignBadPercent
+	}
+	if _, err := s.GetArtifact(req.FirmwareID); err != nil {
+		if err == ErrFirmwareNotFound {
+			return nil, ErrCampaignNoFirmware
+		}
+		return nil, err
+	}
+
+	threshold := config.AppConfig.OTAFailureThresholdPct
+	if req.FailureThresholdPct != nil && *req.FailureThresholdPct > 0 && *req.FailureThresholdPct <= 100 {
+		threshold = *req.FailureThresholdPct
+	}
+	minSample := 3
+	if req.MinSampleSize != nil && *req.MinSampleSize > 0 {
+		minSample = *req.MinSampleSize
+	}
+	farmIDs := uuidArray(req.FarmIDs)
+
+	campaign, err := scanCampaign(database.DB.QueryRow(`
+		INSERT INTO ota_campaigns (id, firmware_id, name, status, target_percentage, target_farm_ids, failure_threshold_pct, min_sample_size, created_by)
+		VALUES ($1, $2, $3, 'running', $4, $5, $6, $7, $8)
+		RETURNING `+campaignColumns,
+		uuid.New(), req.FirmwareID, strings.TrimSpace(req.Name), req.TargetPercentage, farmIDs, threshold, minSample, adminID))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.targetDevices(campaign); err != nil {
+		return nil, err
+	}
+	s.evaluateCampaign(campaign.ID)
+	return s.GetCampaign(campaign.ID)
+}
+
+// ListCampaigns returns all campaigns, newest first
+func (s *FirmwareService) ListCampaigns() ([]models.OTACampaign, error) {
+	rows, err := database.DB.Query(`SELECT ` + campaignColumns + ` FROM ota_campaigns ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := make([]models.OTACampaign, 0)
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			continue
+		}
+		campaigns = append(campaigns, *c)
+	}
+	return campaigns, nil
+}
+
+// GetCampaign returns a campaign with per-device progress and status counts
+func (s *FirmwareService) GetCampaign(campaignID uuid.UUID) (*schemas.OTACampaignDetail, error) {
+	campaign, err := scanCampaign(database.DB.QueryRow(`SELECT `+campaignColumns+` FROM ota_campaigns WHERE id = $1`, campaignID))
+	if err == sql.ErrNoRows {
+		return nil, ErrCampaignNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &schemas.OTACampaignDetail{
+		OTACampaign: *campaign,
+		Counts:      map[string]int{"pending": 0, "in_progress": 0, "succeeded": 0, "failed": 0, "cancelled": 0},
+		Devices:     make([]models.OTACampaignDevice, 0),
+	}
+	detail.Firmware, _ = s.GetArtifact(campaign.FirmwareID)
+
+	rows, err := database.DB.Query(`
+		SELECT cd.id, cd.campaign_id, cd.device_id, cd.farm_id, d.hardware_id, cd.command_id, cd.status, cd.from_version,
+			cd.progress_pct, cd.error, cd.created_at, cd.updated_at
+		FROM ota_campaign_devices cd
+		JOIN devices d ON d.id = cd.device_id
+		WHERE cd.campaign_id = $1
+		ORDER BY cd.created_at ASC
+	`, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d models.OTACampaignDevice
+		if err := rows.Scan(&d.ID, &d.CampaignID, &d.DeviceID, &d.FarmID, &d.HardwareID, &d.CommandID, &d.Status, &d.FromVersion,
+			&d.ProgressPct, &d.Error, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			continue
+		}
+		detail.Counts[d.Status]++
+		detail.Devices = append(detail.Devices, d)
+	}
+	return detail, nil
+}
+
+// ExpandCampaign raises the share of gateways a running campaign targets (the next stage)
+func (s *FirmwareService) ExpandCampaign(campaignID uuid.UUID, percentage int) (*schemas.OTACampaignDetail, error) {
+	if percentage < 1 || percentage > 100 {
+		return nil, ErrCampaignBadPercent
+	}
+	campaign, err := scanCampaign(database.DB.QueryRow(`
+		UPDATE ota_campaigns SET target_percentage = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'running' AND (target_percentage IS NULL OR target_percentage <= $2)
+		RETURNING `+campaignColumns, campaignID, percentage))
+	if err == sql.ErrNoRows {
+		var status string
+		if qerr := database.DB.QueryRow(`SELECT status FROM ota_campaigns WHERE id = $1`, campaignID).Scan(&status); qerr == sql.ErrNoRows {
+			return nil, ErrCampaignNotFound
+		}
+		if status != "running" {
+			return nil, ErrCampaignNotRunning
+		}
+		return nil, ErrCampaignBadPercent
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.targetDevices(campaign); err != nil {
+		return nil, err
+	}
+	s.evaluateCampaign(campaignID)
+	return s.GetCampaign(campaignID)
+}
+
+// HaltCampaign stops a running campaign by hand
+func (s *FirmwareService) HaltCampaign(campaignID uuid.UUID, reason string) (*schemas.OTACampaignDetail, error) {
+	if reason == "" {
+		reason = "halted by administrator"
+	}
+	halted, err := haltCampaign(campaignID, reason)
+	if err != nil {
+		return nil, err
+	}
+	if !halted {
+		if _, err := s.GetCampaign(campaignID); err != nil {
+			return nil, err
+		}
+		return nil, ErrCampaignNotRunning
+	}
+	return s.GetCampaign(campaignID)
+}
+
+// ResumeCampaign restarts a halted campaign and re-queues the devices that were cancelled
+func (s *FirmwareService) ResumeCampaign(campaignID uuid.UUID) (*schemas.OTACampaignDetail, error) {
+	campaign, err := scanCampaign(database.DB.QueryRow(`
+		UPDATE ota_campaigns SET status = 'running', halt_reason = NULL, halted_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'halted'
+		RETURNING `+campaignColumns, campaignID))
+	if err == sql.ErrNoRows {
+		if _, gerr := s.GetCampaign(campaignID); gerr != nil {
+			return nil, gerr
+		}
+		return nil, ErrCampaignNotHalted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	firmware, err := s.GetArtifact(campaign.FirmwareID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := database.DB.Query(`
+		SELECT d.id, d.farm_id, d.coop_id, d.type, d.model, d.hardware_id
+		FROM ota_campaign_devices cd
+		JOIN devices d ON d.id = cd.device_id
+		WHERE cd.campaign_id = $1 AND cd.status = 'cancelled' AND d.is_active = true
+	`, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*commandTarget, 0)
+	for rows.Next() {
+		var t commandTarget
+		if err := rows.Scan(&t.ID, &t.FarmID, &t.CoopID, &t.Type, &t.Model, &t.HardwareID); err == nil {
+			targets = append(targets, &t)
+		}
+	}
+	rows.Close()
+
+	for _, t := range targets {
+		cmd, err := queueOTACommand(t, firmware)
+		if err != nil {
+			log.Printf("OTA resume queue error (%s): %v", t.ID, err)
+			continue
+		}
+		_, _ = database.DB.Exec(`
+			UPDATE ota_campaign_devices SET status = 'pending', command_id = $3, progress_pct = NULL, error = NULL, updated_at = CURRENT_TIMESTAMP
+			WHERE campaign_id = $1 AND device_id = $2
+		`, campaignID, t.ID, cmd.ID)
+	}
+	return s.GetCampaign(campaignID)
+}
+
+// targetDevices adds the devices a campaign now covers and queues their ota_update commands.
+// Gateways are sampled deterministically per campaign, so expanding a percentage only adds gateways.
+func (s *FirmwareService) targetDevices(campaign *models.OTACampaign) error {
+	firmware, err := s.GetArtifact(campaign.FirmwareID)
+	if err != nil {
+		return err
+	}
+
+	farmFilter := uuidArray(campaign.TargetFarmIDs)
+
+	rows, err := database.DB.Query(`
+		SELECT d.id, d.farm_id, d.coop_id, d.type, d.model, d.hardware_id, d.firmware_version
+		FROM devices d
+		WHERE d.is_active = true AND LOWER(d.model) = $1 AND d.firmware_version <> $2
+			AND ($3::UUID[] IS NULL OR d.farm_id = ANY($3::UUID[]))
+			AND NOT EXISTS (SELECT 1 FROM ota_campaign_devices cd WHERE cd.campaign_id = $4 AND cd.device_id = d.id)
+	`, firmware.TargetModel, firmware.Version, farmFilter, campaign.ID)
+	if err != nil {
+		return err
+	}
+	type candidate struct {
+		target      commandTarget
+		fromVersion string
+	}
+	candidates := make([]candidate, 0)
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.target.ID, &c.target.FarmID, &c.target.CoopID, &c.target.Type, &c.target.Model, &c.target.HardwareID, &c.fromVersion); err == nil {
+			candidates = append(candidates, c)
+		}
+	}
+	rows.Close()
+
+	selected := selectGateways(campaign, firmware)
+	for _, c := range candidates {
+		if selected != nil && !selected[c.target.HardwareID] {
+			continue
+		}
+		target := c.target
+		cmd, err := queueOTACommand(&target, firmware)
+		if err != nil {
+			log.Printf("OTA queue error (%s): %v", target.ID, err)
+			continue
+		}
+		_, err = database.DB.Exec(`
+			INSERT INTO ota_campaign_devices (id, campaign_id, device_id, farm_id, command_id, status, from_version)
+			VALUES ($1, $2, $3, $4, $5, 'pending', $6)
+			ON CONFLICT (campaign_id, device_id) DO NOTHING
+		`, uuid.New(), campaign.ID, target.ID, target.FarmID, cmd.ID, c.fromVersion)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectGateways picks TargetPercentage of the eligible gateways; nil means all of them
+func selectGateways(campaign *models.OTACampaign, firmware *models.FirmwareArtifact) map[string]bool {
+	if campaign.TargetPercentage == nil || *campaign.TargetPercentage >= 100 {
+		return nil
+	}
+
+	farmFilter := uuidArray(campaign.TargetFarmIDs)
+	// Sample from every gateway carrying the model (including updated ones) so the share is stable
+	rows, err := database.DB.Query(`
+		SELECT DISTINCT hardware_id FROM devices
+		WHERE is_active = true AND LOWER(model) = $1 AND ($2::UUID[] IS NULL OR farm_id = ANY($2::UUID[]))
+	`, firmware.TargetModel, farmFilter)
+	if err != nil {
+		return map[string]bool{}
+	}
+	defer rows.Close()
+
+	type ranked struct {
+		hardwareID string
+		rank       string
+	}
+	gateways := make([]ranked, 0)
+	for rows.Next() {
+		var hw string
+		if rows.Scan(&hw) == nil {
+			sum := sha256.Sum256([]byte(campaign.ID.String() + hw))
+			gateways = append(gateways, ranked{hardwareID: hw, rank: hex.EncodeToString(sum[:])})
+		}
+	}
+	sort.Slice(gateways, func(i, j int) bool { return gateways[i].rank < gateways[j].rank })
+
+	n := (len(gateways)**campaign.TargetPercentage + 99) / 100
+	selected := make(map[string]bool, n)
+	for i := 0; i < n && i < len(gateways); i++ {
+		selected[gateways[i].hardwareID] = true
+	}
+	return selected
+}
+
+// queueOTACommand sends ota_update to a device on behalf of its farm owner. The command value
+// carries everything the gateway needs to download and verify the image.
+func queueOTACommand(target *commandTarget, firmware *models.FirmwareArtifact) (*models.DeviceCommand, error) {
+	var ownerID uuid.UUID
+	if err := database.DB.QueryRow(`SELECT owner_id FROM farms WHERE id = $1`, target.FarmID).Scan(&ownerID); err != nil {
+		return nil, err
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"firmware_id":     firmware.ID,
+		"version":         firmware.Version,
+		"download_path":   fmt.Sprintf("/v1/gateway/firmware/%s", firmware.ID),
+		"size_bytes":      firmware.SizeBytes,
+		"checksum_sha256": firmware.ChecksumSHA256,
+		"signature":       firmware.Signature,
+	})
+	value := string(payload)
+
+	cmd := newPendingCommand(ownerID, target, otaCommandType, &value, nil)
+	if err := insertCommand(database.DB, cmd); err != nil {
+		return nil, err
+	}
+	commandQueued(cmd, target.HardwareID)
+	return cmd, nil
+}
+
+// ApplyOTAProgress updates campaign devices from a gateway's progress reports
+func (s *DeviceService) ApplyOTAProgress(farmID uuid.UUID, hardwareID string, reports []schemas.OTAProgressReport) error {
+	touched := make(map[uuid.UUID]struct{})
+	for _, r := range reports {
+		key := strings.TrimSpace(r.DeviceID)
+		rows, err := database.DB.Query(`
+			SELECT cd.id, cd.campaign_id, cd.device_id, f.version
+			FROM ota_campaign_devices cd
+			JOIN ota_campaigns c ON c.id = cd.campaign_id
+			JOIN firmware_artifacts f ON f.id = c.firmware_id
+			JOIN devices d ON d.id = cd.device_id
+			WHERE d.hardware_id = $1 AND d.farm_id = $3 AND cd.status IN ('pending', 'in_progress')
+				AND ($2 = '' OR d.device_id = $2 OR LOWER(d.model) = LOWER($2))
+		`, hardwareID, key, farmID)
+		if err != nil {
+			return err
+		}
+		type entry struct {
+			id, campaignID, deviceID uuid.UUID
+			version                  string
+		}
+		entries := make([]entry, 0)
+		for rows.Next() {
+			var e entry
+			if rows.Scan(&e.id, &e.campaignID, &e.deviceID, &e.version) == nil {
+				entries = append(entries, e)
+			}
+		}
+		rows.Close()
+
+		for _, e := range entries {
+			status := strings.ToLower(strings.TrimSpace(r.Status))
+			if r.FirmwareVersion != nil {
+				_, _ = database.DB.Exec(`UPDATE devices SET firmware_version = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, e.deviceID, *r.FirmwareVersion)
+				if *r.FirmwareVersion == e.version && status != "failed" {
+					status = "succeeded"
+				}
+			}
+			switch status {
+			case "succeeded", "failed":
+			case "downloading", "installing", "in_progress":
+				status = "in_progress"
+			default:
+				continue
+			}
+			_, _ = database.DB.Exec(`
+				UPDATE ota_campaign_devices SET status = $2, progress_pct = COALESCE($3, progress_pct), error = $4, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1
+			`, e.id, status, r.ProgressPct, r.Error)
+			touched[e.campaignID] = struct{}{}
+		}
+	}
+	for id := range touched {
+		NewFirmwareService().evaluateCampaign(id)
+	}
+	return nil
+}
+
+// otaCommandFinished reflects the ota_update command status in the campaign. A successful command
+// only means the gateway accepted the job; success is confirmed by the reported firmware version.
+func otaCommandFinished(commandID uuid.UUID, status string, response string) {
+	var campaignID uuid.UUID
+	newStatus := "in_progress"
+	var errMsg interface{}
+	if status != "success" {
+		newStatus = "failed"
+		errMsg = "command " + status
+		if response != "" {
+			errMsg = response
+		}
+	}
+	err := database.DB.QueryRow(`
+		UPDATE ota_campaign_devices SET status = $2, error = COALESCE($3, error), updated_at = CURRENT_TIMESTAMP
+		WHERE command_id = $1 AND status IN ('pending', 'in_progress')
+		RETURNING campaign_id
+	`, commandID, newStatus, errMsg).Scan(&campaignID)
+	if err != nil {
+		return
+	}
+	NewFirmwareService().evaluateCampaign(campaignID)
+}
+
+// evaluateCampaign halts a running campaign whose failure rate reached its threshold
+// (after min_sample_size finished devices) and completes it once every device is done.
+func (s *FirmwareService) evaluateCampaign(campaignID uuid.UUID) {
+	var status string
+	var threshold, minSample, succeeded, failed, open int
+	err := database.DB.QueryRow(`
+		SELECT c.status, c.failure_threshold_pct, c.min_sample_size,
+			COUNT(*) FILTER (WHERE cd.status = 'succeeded'),
+			COUNT(*) FILTER (WHERE cd.status = 'failed'),
+			COUNT(*) FILTER (WHERE cd.status IN ('pending', 'in_progress'))
+		FROM ota_campaigns c
+		LEFT JOIN ota_campaign_devices cd ON cd.campaign_id = c.id
+		WHERE c.id = $1
+		GROUP BY c.id
+	`, campaignID).Scan(&status, &threshold, &minSample, &succeeded, &failed, &open)
+	if err != nil || status != "running" {
+		return
+	}
+
+	finished := succeeded + failed
+	if failed > 0 && finished >= minSample && failed*100 >= threshold*finished {
+		reason := fmt.Sprintf("failure rate %d%% (%d of %d) reached threshold %d%%", failed*100/finished, failed, finished, threshold)
+		if _, err := haltCampaign(campaignID, reason); err != nil {
+			log.Printf("OTA halt error (%s): %v", campaignID, err)
+		}
+		return
+	}
+	if open == 0 && finished > 0 {
+		_, _ = database.DB.Exec(`
+			UPDATE ota_campaigns SET status = 'completed', completed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND status = 'running'
+		`, campaignID)
+	}
+}
+
+// haltCampaign stops a running campaign and cancels ota_update commands not yet picked up
+func haltCampaign(campaignID uuid.UUID, reason string) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE ota_campaigns SET status = 'halted', halt_reason = $2, halted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'running'
+	`, campaignID, reason)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`
+		UPDATE device_commands SET status = 'cancelled', response = 'OTA campaign halted', executed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE status = 'pending' AND attempt_count = 0
+			AND id IN (SELECT command_id FROM ota_campaign_devices WHERE campaign_id = $1 AND status = 'pending')
+	`, campaignID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE ota_campaign_devices cd SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP
+		FROM device_commands dc
+		WHERE cd.command_id = dc.id AND cd.campaign_id = $1 AND cd.status = 'pending' AND dc.status = 'cancelled'
+	`, campaignID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	log.Printf("⚠️  OTA campaign %s halted: %s", campaignID, reason)
+	return true, nil
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"middleware/config"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Gateway diagnostics alert types, raised and auto-resolved from heartbeat diagnostics
+const (
+	alertGatewayDiskLow     = "gateway_disk_low"
+	alertGatewayOverheating = "gateway_overheating"
+)
+
+// RecordGatewayDiagnostics stores the diagnostics block of an authenticated gateway and raises or
+// resolves the disk, temperature and clock skew alerts for it. Gateways outside the farm are ignored.
+func (s *DeviceService) RecordGatewayDiagnostics(farmID uuid.UUID, hardwareID string, d schemas.GatewayDiagnostics) error {
+	if d.IsEmpty() {
+		return nil
+	}
+
+	var deviceID uuid.UUID
+	var coopID *uuid.UUID
+	err := database.DB.QueryRow(`
+		SELECT id, coop_id FROM devices
+		WHERE hardware_id = $1 AND farm_id = $2
+		ORDER BY is_main_controller DESC, created_at ASC
+		LIMIT 1
+	`, hardwareID, farmID).Scan(&deviceID, &coopID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := database.DB.Exec(`
+		INSERT INTO gateway_diagnostics (id, farm_id, hardware_id, uptime_seconds, cpu_temp_c, load_1m, disk_free_mb, disk_free_pct,
+			mem_free_mb, mem_free_pct, wifi_rssi, cellular_rssi, queue_depth, clock_offset_ms, recorded_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+	`, uuid.New(), farmID, hardwareID, d.UptimeSeconds, d.CPUTempC, d.Load1m, d.DiskFreeMB, d.DiskFreePct,
+		d.MemFreeMB, d.MemFreePct, d.WifiRSSI, d.CellularRSSI, d.QueueDepth, d.ClockOffsetMs, now); err != nil {
+		return err
+	}
+
+	if d.DiskFreePct != nil {
+		minPct := float64(config.AppConfig.GatewayDiskFreeMinPct)
+		severity := "warning"
+		if *d.DiskFreePct < minPct/2 {
+			severity = "critical"
+		}
+		msg := fmt.Sprintf("Gateway %s disk almost full (%.1f%% free)", hardwareID, *d.DiskFreePct)
+		if err := syncGatewayAlert(farmID, coopID, deviceID, alertGatewayDiskLow, severity, msg, minPct, *d.DiskFreePct, *d.DiskFreePct < minPct, now); err != nil {
+			return err
+		}
+	}
+	if d.CPUTempC != nil {
+		maxTemp := float64(config.AppConfig.GatewayCPUTempMaxC)
+		msg := fmt.Sprintf("Gateway %s is overheating (CPU %.1f C)", hardwareID, *d.CPUTempC)
+		if err := syncGatewayAlert(farmID, coopID, deviceID, alertGatewayOverheating, "critical", msg, maxTemp, *d.CPUTempC, *d.CPUTempC >= maxTemp, now); err != nil {
+			return err
+		}
+	}
+	if d.ClockOffsetMs != nil {
+		skew := time.Duration(*d.ClockOffsetMs) * time.Millisecond
+		if err := recordClockSkew(farmID, hardwareID, skew, clockSourceDiagnostics, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncGatewayAlert keeps one active alert per gateway and type: raised when breached, resolved once back to normal
+func syncGatewayAlert(farmID uuid.UUID, coopID *uuid.UUID, deviceID uuid.UUID, alertType, severity, message string, threshold, actual float64, breached bool, now time.Time) error {
+	if !breached {
+		_, err := database.DB.Exec(`
+			UPDATE alerts SET is_active = false, resolved_at = $3
+			WHERE device_id = $1 AND alert_type = $2 AND is_active = true
+		`, deviceID, alertType, now)
+		return err
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM alerts WHERE device_id = $1 AND alert_type = $2 AND is_active = true)
+	`, deviceID, alertType).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	alertID := uuid.New()
+	if _, err := database.DB.Exec(`
+		INSERT INTO alerts (id, farm_id, coop_id, device_id, alert_type, severity, message, threshold_value, actual_value, is_active, is_acknowledged, triggered_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, true, false, $10, $10)
+	`, alertID, farmID, coopID, deviceID, alertType, severity, message, threshold, actual, now); err != nil {
+		return err
+	}
+	events.PublishDeviceEvent(farmID, deviceID, "alert", map[string]interface{}{
+		"id":         alertID,
+		"alert_type": alertType,
+		"severity":   severity,
+		"message":    message,
+		"device_id":  deviceID,
+	})
+	return nil
+}
+
+// GetGatewayDiagnostics returns a gateway's diagnostics over the last hours, its latest
+// report and its active diagnostics alerts
+func (s *DeviceService) GetGatewayDiagnostics(userID, farmID uuid.UUID, hardwareID string, hours int) (*schemas.GatewayDiagnosticsHistory, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	var exists bool
+	if err := database.DB.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM devices WHERE hardware_id = $1 AND farm_id = $2)
+	`, hardwareID, farmID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrDeviceNotFound
+	}
+
+	history := &schemas.GatewayDiagnosticsHistory{
+		HardwareID:   hardwareID,
+		WindowHours:  hours,
+		Samples:      make([]models.GatewayDiagnosticsSample, 0),
+		ClockSkew:    gatewayClockSkew(farmID, hardwareID),
+		ActiveAlerts: make([]models.Alert, 0),
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT `+gatewayDiagnosticsColumns+`
+		FROM gateway_diagnostics
+		WHERE farm_id = $1 AND hardware_id = $2 AND recorded_at >= $3
+		ORDER BY recorded_at ASC
+	`, farmID, hardwareID, time.Now().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		sample, err := scanGatewayDiagnostics(rows)
+		if err != nil {
+			continue
+		}
+		history.Samples = append(history.Samples, *sample)
+	}
+	rows.Close()
+
+	if n := len(history.Samples); n > 0 {
+		history.Latest = &history.Samples[n-1]
+	} else if latest, err := scanGatewayDiagnostics(database.DB.QueryRow(`
+		SELECT `+gatewayDiagnosticsColumns+`
+		FROM gateway_diagnostics
+		WHERE farm_id = $1 AND hardware_id = $2
+		ORDER BY recorded_at DESC
+		LIMIT 1
+	`, farmID, hardwareID)); err == nil {
+		history.Latest = latest
+	}
+
+	alertRows, err := database.DB.Query(`
+		SELECT a.id, a.farm_id, a.coop_id, a.device_id, a.alert_type, a.severity, a.message, a.threshold_value, a.actual_value,
+			a.is_active, a.is_acknowledged, a.triggered_at, a.created_at
+		FROM alerts a
+		JOIN devices d ON d.id = a.device_id
+		WHERE a.farm_id = $1 AND d.hardware_id = $2 AND a.is_active = true AND a.alert_type IN ($3, $4, $5)
+		ORDER BY a.triggered_at DESC
+	`, farmID, hardwareID, alertGatewayDiskLow, alertGatewayOverheating, alertGatewayClockSkew)
+	if err != nil {
+		return nil, err
+	}
+	defer alertRows.Close()
+	for alertRows.Next() {
+		var a models.Alert
+		if err := alertRows.Scan(&a.ID, &a.FarmID, &a.CoopID, &a.DeviceID, &a.AlertType, &a.Severity, &a.Message, &a.ThresholdValue, &a.ActualValue,
+			&a.IsActive, &a.IsAcknowledged, &a.TriggeredAt, &a.CreatedAt); err != nil {
+			continue
+		}
+		history.ActiveAlerts = append(history.ActiveAlerts, a)
+	}
+	return history, nil
+}
+
+const gatewayDiagnosticsColumns = `id, farm_id, hardware_id, uptime_seconds, cpu_temp_c, load_1m, disk_free_mb, disk_free_pct,
+		mem_free_mb, mem_free_pct, wifi_rssi, cellular_rssi, queue_depth, clock_offset_ms, recorded_at`
+
+func scanGatewayDiagnostics(scanner interface{ Scan(...interface{}) error }) (*models.GatewayDiagnosticsSample, error) {
+	var g models.GatewayDiagnosticsSample
+	if err := scanner.Scan(&g.ID, &g.FarmID, &g.HardwareID, &g.UptimeSeconds, &g.CPUTempC, &g.Load1m, &g.DiskFreeMB, &g.DiskFreePct,
+		&g.MemFreeMB, &g.MemFreePct, &g.WifiRSSI, &g.CellularRSSI, &g.QueueDepth, &g.ClockOffsetMs, &g.RecordedAt); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
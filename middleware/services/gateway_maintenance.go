@@ -0,0 +1,232 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"middleware/config"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMaintenanceAction  = errors.New("invalid_maintenance_action")
+	ErrGatewayLogNotFound = errors.New("gateway_log_not_found")
+	ErrLogUploadInvalid   = errors.New("log_upload_invalid")
+)
+
+// gatewayMaintenanceCommands maps maintenance actions to their device_commands.command_type
+var gatewayMaintenanceCommands = map[string]string{
+	"reboot":        "gateway_reboot",
+	"restart_agent": "gateway_restart_agent",
+	"upload_logs":   "gateway_upload_logs",
+	"rediscover":    "gateway_rediscover",
+}
+
+// defaultLogUploadLines is used when upload_logs does not say how many lines to send
+const defaultLogUploadLines = 200
+
+// QueueGatewayMaintenance queues a maintenance command for a gateway on behalf of the farm
+// owner. Other farm members, including farmers, are refused.
+func (s *DeviceService) QueueGatewayMaintenance(userID, farmID uuid.UUID, hardwareID string, req schemas.GatewayMaintenanceRequest, ipAddress string) (*models.DeviceCommand, error) {
+	var ownerID uuid.UUID
+	if err := database.DB.QueryRow(`SELECT owner_id FROM farms WHERE id = $1`, farmID).Scan(&ownerID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrFarmAccessDenied
+		}
+		return nil, err
+	}
+	if ownerID != userID {
+		return nil, ErrFarmAccessDenied
+	}
+	return queueGatewayMaintenance(&farmID, hardwareID, req, ownerID, nil, ipAddress)
+}
+
+// AdminQueueGatewayMaintenance queues a maintenance command for any assigned gateway. The
+// command is issued in the farm owner's name; the admin is recorded in the audit entry.
+func (s *DeviceService) AdminQueueGatewayMaintenance(adminID uuid.UUID, hardwareID string, req schemas.GatewayMaintenanceRequest, ipAddress string) (*models.DeviceCommand, error) {
+	return queueGatewayMaintenance(nil, hardwareID, req, uuid.Nil, &adminID, ipAddress)
+}
+
+func queueGatewayMaintenance(farmID *uuid.UUID, hardwareID string, req schemas.GatewayMaintenanceRequest, issuerID uuid.UUID, adminID *uuid.UUID, ipAddress string) (*models.DeviceCommand, error) {
+	commandType, ok := gatewayMaintenanceCommands[req.Action]
+	if !ok {
+		return nil, ErrMaintenanceAction
+	}
+	target, err := gatewayCommandTarget(farmID, strings.TrimSpace(hardwareID))
+	if err != nil {
+		return nil, err
+	}
+	if issuerID == uuid.Nil {
+		if err := database.DB.QueryRow(`SELECT owner_id FROM farms WHERE id = $1`, target.FarmID).Scan(&issuerID); err != nil {
+			return nil, err
+		}
+	}
+
+	var value *string
+	if commandType == "gateway_upload_logs" {
+		lines := defaultLogUploadLines
+		if req.Lines != nil {
+			lines = *req.Lines
+		}
+		if lines < 1 || lines > config.AppConfig.GatewayLogMaxLines {
+			return nil, ErrMaintenanceAction
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"lines":       lines,
+			"upload_path": "/v1/gateway/logs",
+		})
+		v := string(payload)
+		value = &v
+	}
+
+	cmd := newPendingCommand(issuerID, target, commandType, value, nil)
+	if err := insertCommand(database.DB, cmd); err != nil {
+		return nil, err
+	}
+	commandQueued(cmd, target.HardwareID)
+
+	logEvent(target.FarmID, issuerID, "gateway_maintenance", &cmd.ID, nil, map[string]interface{}{
+		"hardware_id": target.HardwareID,
+		"action":      req.Action,
+		"admin_id":    adminID,
+	}, ipAddress)
+	return cmd, nil
+}
+
+// gatewayCommandTarget picks the device row that stands for the gateway itself, preferring
+// the main controller. farmID limits the lookup to one farm when set.
+func gatewayCommandTarget(farmID *uuid.UUID, hardwareID string) (*commandTarget, error) {
+	var t commandTarget
+	err := database.DB.QueryRow(`
+		SELECT id, farm_id, coop_id, type, model, hardware_id
+		FROM devices
+		WHERE hardware_id = $1 AND ($2::UUID IS NULL OR farm_id = $2)
+		ORDER BY is_main_controller DESC, is_active DESC, created_at ASC
+		LIMIT 1
+	`, hardwareID, farmID).Scan(&t.ID, &t.FarmID, &t.CoopID, &t.Type, &t.Model, &t.HardwareID)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ReceiveGatewayLogs stores the lines a gateway uploaded for one of its upload_logs commands.
+// Uploads beyond GATEWAY_LOG_MAX_LINES keep the newest lines and are marked truncated.
+func (s *DeviceService) ReceiveGatewayLogs(farmID uuid.UUID, tokenDeviceID *uuid.UUID, req schemas.GatewayLogUploadRequest) (*models.GatewayLogUpload, error) {
+	hardwareID, err := s.ResolveGatewayHardwareID(farmID, tokenDeviceID, req.HardwareID)
+	if err != nil {
+		return nil, err
+	}
+
+	var issuedBy uuid.UUID
+	var commandType string
+	err = database.DB.QueryRow(`
+		SELECT c.issued_by, c.command_type FROM device_commands c
+		JOIN devices d ON d.id = c.device_id
+		WHERE c.id = $1 AND c.farm_id = $2 AND d.hardware_id = $3
+	`, req.CommandID, farmID, hardwareID).Scan(&issuedBy, &commandType)
+	if err == sql.ErrNoRows || (err == nil && commandType != "gateway_upload_logs") {
+		return nil, ErrCommandNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Lines) == 0 {
+		return nil, ErrLogUploadInvalid
+	}
+
+	lines := req.Lines
+	truncated := false
+	if max := config.AppConfig.GatewayLogMaxLines; len(lines) > max {
+		lines = lines[len(lines)-max:]
+		truncated = true
+	}
+	content := strings.Join(lines, "\n")
+	now := time.Now()
+	upload := &models.GatewayLogUpload{
+		ID:          uuid.New(),
+		FarmID:      farmID,
+		HardwareID:  hardwareID,
+		CommandID:   &req.CommandID,
+		RequestedBy: &issuedBy,
+		LineCount:   len(lines),
+		SizeBytes:   len(content),
+		Truncated:   truncated,
+		UploadedAt:  now,
+		ExpiresAt:   now.AddDate(0, 0, config.AppConfig.GatewayLogRetentionDays),
+	}
+	_, err = database.DB.Exec(`
+		INSERT INTO gateway_log_uploads (id, farm_id, hardware_id, command_id, requested_by, line_count, size_bytes, truncated, content, uploaded_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, upload.ID, upload.FarmID, upload.HardwareID, upload.CommandID, upload.RequestedBy, upload.LineCount, upload.SizeBytes,
+		upload.Truncated, content, upload.UploadedAt, upload.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// ListGatewayLogs returns log uploads (without content), newest first, optionally for one gateway
+func (s *DeviceService) ListGatewayLogs(hardwareID string, limit int) ([]models.GatewayLogUpload, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	rows, err := database.DB.Query(`
+		SELECT id, farm_id, hardware_id, command_id, requested_by, line_count, size_bytes, truncated, uploaded_at, expires_at
+		FROM gateway_log_uploads
+		WHERE ($1 = '' OR hardware_id = $1) AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY uploaded_at DESC
+		LIMIT $2
+	`, strings.TrimSpace(hardwareID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := make([]models.GatewayLogUpload, 0)
+	for rows.Next() {
+		var u models.GatewayLogUpload
+		if err := rows.Scan(&u.ID, &u.FarmID, &u.HardwareID, &u.CommandID, &u.RequestedBy, &u.LineCount, &u.SizeBytes,
+			&u.Truncated, &u.UploadedAt, &u.ExpiresAt); err != nil {
+			continue
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// GetGatewayLog returns one log upload with its content
+func (s *DeviceService) GetGatewayLog(logID uuid.UUID) (*models.GatewayLogUpload, error) {
+	var u models.GatewayLogUpload
+	err := database.DB.QueryRow(`
+		SELECT id, farm_id, hardware_id, command_id, requested_by, line_count, size_bytes, truncated, content, uploaded_at, expires_at
+		FROM gateway_log_uploads
+		WHERE id = $1 AND expires_at > CURRENT_TIMESTAMP
+	`, logID).Scan(&u.ID, &u.FarmID, &u.HardwareID, &u.CommandID, &u.RequestedBy, &u.LineCount, &u.SizeBytes,
+		&u.Truncated, &u.Content, &u.UploadedAt, &u.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrGatewayLogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CleanupGatewayLogs deletes log uploads past their retention
+func (s *DeviceService) CleanupGatewayLogs() (int64, error) {
+	res, err := database.DB.Exec(`DELETE FROM gateway_log_uploads WHERE expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
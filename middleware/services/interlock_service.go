@@ -0,0 +1,376 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"middleware/database"
+	"middleware/models"
+	"middleware/schemas"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInterlockNotFound = errors.New("interlock_not_found")
+
+// Interlock rule types
+const (
+	InterlockMutualExclusion = "mutual_exclusion" // device and other device never run together
+	InterlockRequiresRunning = "requires_running" // device may only run while other device runs
+	InterlockMaxRuntime      = "max_runtime"      // device runs at most duration_seconds at a time
+	InterlockMinOffTime      = "min_off_time"     // device stays off at least duration_seconds between runs
+)
+
+var pairInterlocks = map[string]bool{InterlockMutualExclusion: true, InterlockRequiresRunning: true}
+var timedInterlocks = map[string]bool{InterlockMaxRuntime: true, InterlockMinOffTime: true}
+
+// InterlockViolationError is returned when a command would break a coop interlock
+type InterlockViolationError struct {
+	InterlockID uuid.UUID `json:"interlock_id"`
+	RuleType    string    `json:"rule_type"`
+	Reason      string    `json:"reason"`
+}
+
+func (e *InterlockViolationError) Error() string {
+	return "interlock_violation: " + e.Reason
+}
+
+// InterlockService manages per-coop actuator safety rules
+type InterlockService struct {
+	farmService *FarmService
+}
+
+func NewInterlockService() *InterlockService {
+	return &InterlockService{
+		farmService: NewFarmService(),
+	}
+}
+
+const interlockColumns = `id, farm_id, coop_id, rule_type, device_id, other_device_id, duration_seconds, description, is_active, created_by, created_at, updated_at`
+
+func scanInterlock(scanner interface{ Scan(...interface{}) error }) (*models.CoopInterlock, error) {
+	var il models.CoopInterlock
+	err := scanner.Scan(&il.ID, &il.FarmID, &il.CoopID, &il.RuleType, &il.DeviceID, &il.OtherDeviceID, &il.DurationSeconds,
+		&il.Description, &il.IsActive, &il.CreatedBy, &il.CreatedAt, &il.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &il, nil
+}
+
+// ListInterlocks returns the interlocks configured for a coop
+func (s *InterlockService) ListInterlocks(userID, farmID, coopID uuid.UUID) ([]models.CoopInterlock, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+
+	rows, err := database.DB.Query(`SELECT `+interlockColumns+` FROM coop_interlocks
+		WHERE farm_id = $1 AND coop_id = $2 ORDER BY created_at ASC`, farmID, coopID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	interlocks := make([]models.CoopInterlock, 0)
+	for rows.Next() {
+		il, err := scanInterlock(rows)
+		if err != nil {
+			continue
+		}
+		interlocks = append(interlocks, *il)
+	}
+	return interlocks, nil
+}
+
+// CreateInterlock adds a safety rule between devices of a coop
+func (s *InterlockService) CreateInterlock(userID, farmID, coopID uuid.UUID, req schemas.CreateInterlockRequest) (*models.CoopInterlock, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case pairInterlocks[req.RuleType]:
+		if req.OtherDeviceID == nil {
+			return nil, &CommandValidationError{Code: "invalid_interlock", Message: req.RuleType + " requires other_device_id", Field: "other_device_id"}
+		}
+		if *req.OtherDeviceID == req.DeviceID {
+			return nil, &CommandValidationError{Code: "invalid_interlock", Message: "other_device_id must differ from device_id", Field: "other_device_id"}
+		}
+		req.DurationSeconds = nil
+	case timedInterlocks[req.RuleType]:
+		if req.DurationSeconds == nil || *req.DurationSeconds <= 0 {
+			return nil, &CommandValidationError{Code: "invalid_interlock", Message: req.RuleType + " requires a positive duration_seconds", Field: "duration_seconds"}
+		}
+		req.OtherDeviceID = nil
+	default:
+		return nil, &CommandValidationError{
+			Code:    "invalid_interlock",
+			Message: "rule_type must be one of: mutual_exclusion, requires_running, max_runtime, min_off_time",
+			Field:   "rule_type",
+		}
+	}
+
+	for _, id := range []*uuid.UUID{&req.DeviceID, req.OtherDeviceID} {
+		if id == nil {
+			continue
+		}
+		var inCoop bool
+		if err := database.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM devices WHERE id = $1 AND farm_id = $2 AND coop_id = $3)`,
+			*id, farmID, coopID).Scan(&inCoop); err != nil {
+			return nil, err
+		}
+		if !inCoop {
+			return nil, ErrDeviceNotFound
+		}
+	}
+
+	now := time.Now()
+	return scanInterlock(database.DB.QueryRow(`
+		INSERT INTO coop_interlocks (id, farm_id, coop_id, rule_type, device_id, other_device_id, duration_seconds, description, is_active, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, true, $9, $10, $10)
+		RETURNING `+interlockColumns,
+		uuid.New(), farmID, coopID, req.RuleType, req.DeviceID, req.OtherDeviceID, req.DurationSeconds, req.Description, userID, now))
+}
+
+// UpdateInterlock changes the limit or description of an interlock, or enables/disables it
+func (s *InterlockService) UpdateInterlock(userID, farmID, coopID, interlockID uuid.UUID, req schemas.UpdateInterlockRequest) (*models.CoopInterlock, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return nil, err
+	}
+	if req.DurationSeconds != nil && *req.DurationSeconds <= 0 {
+		return nil, &CommandValidationError{Code: "invalid_interlock", Message: "duration_seconds must be positive", Field: "duration_seconds"}
+	}
+
+	il, err := scanInterlock(database.DB.QueryRow(`
+		UPDATE coop_interlocks SET
+			duration_seconds = CASE WHEN rule_type IN ('max_runtime', 'min_off_time') THEN COALESCE($4, duration_seconds) ELSE duration_seconds END,
+			description = COALESCE($5, description),
+			is_active = COALESCE($6, is_active),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND farm_id = $2 AND coop_id = $3
+		RETURNING `+interlockColumns,
+		interlockID, farmID, coopID, req.DurationSeconds, req.Description, req.IsActive))
+	if err == sql.ErrNoRows {
+		return nil, ErrInterlockNotFound
+	}
+	return il, err
+}
+
+// DeleteInterlock removes an interlock
+func (s *InterlockService) DeleteInterlock(userID, farmID, coopID, interlockID uuid.UUID) error {
+	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
+		return err
+	}
+	res, err := database.DB.Exec(`DELETE FROM coop_interlocks WHERE id = $1 AND farm_id = $2 AND coop_id = $3`, interlockID, farmID, coopID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInterlockNotFound
+	}
+	return nil
+}
+
+// ListViolations returns the most recent commands blocked by interlocks in a coop
+func (s *InterlockService) ListViolations(userID, farmID, coopID uuid.UUID, limit int) ([]models.InterlockViolation, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, farm_id, coop_id, interlock_id, device_id, command_type, source, reason, attempted_by, created_at
+		FROM interlock_violations
+		WHERE farm_id = $1 AND coop_id = $2
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, farmID, coopID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	violations := make([]models.InterlockViolation, 0)
+	for rows.Next() {
+		var v models.InterlockViolation
+		if err := rows.Scan(&v.ID, &v.FarmID, &v.CoopID, &v.InterlockID, &v.DeviceID, &v.CommandType, &v.Source, &v.Reason, &v.AttemptedBy, &v.CreatedAt); err != nil {
+			continue
+		}
+		violations = append(violations, v)
+	}
+	return violations, nil
+}
+
+// isActivatingCommand reports whether a command starts (or keeps) a device running
+func isActivatingCommand(commandType string, commandValue *string) bool {
+	switch commandType {
+	case "on", "open":
+		return true
+	case "set_value":
+		return commandValue == nil || *commandValue != "0"
+	}
+	return false
+}
+
+// checkInterlocks enforces the coop's interlocks for a command. It returns the action duration
+// to use: an untimed "on" is capped at the max_runtime limit.
+func checkInterlocks(target *commandTarget, commandType string, commandValue *string, actionDuration *int) (*int, error) {
+	if target.CoopID == nil {
+		return actionDuration, nil
+	}
+
+	rows, err := database.DB.Query(`SELECT `+interlockColumns+` FROM coop_interlocks
+		WHERE coop_id = $1 AND is_active = true AND (device_id = $2 OR other_device_id = $2)
+		ORDER BY created_at ASC`, *target.CoopID, target.ID)
+	if err != nil {
+		return nil, err
+	}
+	interlocks := make([]*models.CoopInterlock, 0)
+	for rows.Next() {
+		if il, err := scanInterlock(rows); err == nil {
+			interlocks = append(interlocks, il)
+		}
+	}
+	rows.Close()
+
+	activating := isActivatingCommand(commandType, commandValue)
+	for _, il := range interlocks {
+		violation := func(reason string) error {
+			return &InterlockViolationError{InterlockID: il.ID, RuleType: il.RuleType, Reason: reason}
+		}
+
+		switch il.RuleType {
+		case InterlockMutualExclusion:
+			if !activating {
+				continue
+			}
+			other := il.DeviceID
+			if other == target.ID {
+				other = *il.OtherDeviceID
+			}
+			if deviceIsRunning(other) {
+				return nil, violation(fmt.Sprintf("%s is running and cannot run together with %s", deviceName(other), deviceName(target.ID)))
+			}
+
+		case InterlockRequiresRunning:
+			if il.DeviceID == target.ID && activating && !deviceIsRunning(*il.OtherDeviceID) {
+				return nil, violation(fmt.Sprintf("%s may only run while %s is running", deviceName(target.ID), deviceName(*il.OtherDeviceID)))
+			}
+			if il.OtherDeviceID != nil && *il.OtherDeviceID == target.ID && !activating && deviceIsRunning(il.DeviceID) {
+				return nil, violation(fmt.Sprintf("%s cannot stop while %s is running", deviceName(target.ID), deviceName(il.DeviceID)))
+			}
+
+		case InterlockMaxRuntime:
+			if il.DeviceID != target.ID || !activating || il.DurationSeconds == nil {
+				continue
+			}
+			limit := *il.DurationSeconds
+			if actionDuration == nil {
+				actionDuration = &limit
+			} else if *actionDuration > limit {
+				return nil, violation(fmt.Sprintf("action_duration %ds exceeds the %ds continuous runtime limit", *actionDuration, limit))
+			}
+
+		case InterlockMinOffTime:
+			if il.DeviceID != target.ID || !activating || il.DurationSeconds == nil || deviceIsRunning(target.ID) {
+				continue
+			}
+			if offAt := lastStoppedAt(target.ID); offAt != nil {
+				elapsed := time.Since(*offAt)
+				limit := time.Duration(*il.DurationSeconds) * time.Second
+				if elapsed >= 0 && elapsed < limit {
+					return nil, violation(fmt.Sprintf("%s must stay off %ds between runs (%ds remaining)",
+						deviceName(target.ID), *il.DurationSeconds, int((limit-elapsed).Seconds())+1))
+				}
+			}
+		}
+	}
+	return actionDuration, nil
+}
+
+// deviceIsRunning uses the device's newest command while it is still queued or its timed run has
+// not ended; otherwise the device shadow, where whichever of desired/reported is newer wins
+func deviceIsRunning(deviceID uuid.UUID) bool {
+	var commandType, status string
+	var commandValue *string
+	var runEnd sql.NullTime
+	err := database.DB.QueryRow(`
+		SELECT command_type, command_value, status, COALESCE(executed_at, issued_at) + make_interval(secs => action_duration)
+		FROM device_commands
+		WHERE device_id = $1 AND status IN ('pending', 'success')
+			AND command_type IN ('on', 'off', 'open', 'close', 'set_value')
+		ORDER BY issued_at DESC
+		LIMIT 1
+	`, deviceID).Scan(&commandType, &commandValue, &status, &runEnd)
+	if err == nil {
+		if status == "pending" {
+			return isActivatingCommand(commandType, commandValue)
+		}
+		if runEnd.Valid && runEnd.Time.After(time.Now()) && isActivatingCommand(commandType, commandValue) {
+			return true
+		}
+	}
+
+	sh, err := loadShadow(deviceID)
+	if err != nil || sh == nil {
+		return false
+	}
+	state := sh.Desired.State
+	if sh.Reported.State != nil && (sh.Desired.UpdatedAt == nil ||
+		(sh.Reported.UpdatedAt != nil && sh.Reported.UpdatedAt.After(*sh.Desired.UpdatedAt))) {
+		state = sh.Reported.State
+	}
+	return state != nil && (*state == "on" || *state == "open")
+}
+
+// lastStoppedAt returns when the device last stopped: an "off" command or the end of a timed run
+func lastStoppedAt(deviceID uuid.UUID) *time.Time {
+	var t sql.NullTime
+	_ = database.DB.QueryRow(`
+		SELECT MAX(CASE WHEN command_type = 'off' THEN issued_at
+			ELSE COALESCE(executed_at, issued_at) + make_interval(secs => action_duration) END)
+		FROM device_commands
+		WHERE device_id = $1 AND status IN ('pending', 'success')
+			AND (command_type = 'off' OR (command_type = 'on' AND action_duration IS NOT NULL))
+	`, deviceID).Scan(&t)
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func deviceName(deviceID uuid.UUID) string {
+	var name string
+	if err := database.DB.QueryRow(`SELECT name FROM devices WHERE id = $1`, deviceID).Scan(&name); err != nil {
+		return "device " + deviceID.String()
+	}
+	return name
+}
+
+// recordInterlockViolation logs a blocked command and notifies farm clients
+func recordInterlockViolation(target *commandTarget, v *InterlockViolationError, userID uuid.UUID, commandType, source string) {
+	if target.CoopID == nil {
+		return
+	}
+	violation := models.InterlockViolation{
+		ID:          uuid.New(),
+		FarmID:      target.FarmID,
+		CoopID:      *target.CoopID,
+		InterlockID: &v.InterlockID,
+		DeviceID:    target.ID,
+		CommandType: commandType,
+		Source:      source,
+		Reason:      v.Reason,
+		AttemptedBy: userID,
+		CreatedAt:   time.Now(),
+	}
+	_, err := database.DB.Exec(`
+		INSERT INTO interlock_violations (id, farm_id, coop_id, interlock_id, device_id, command_type, source, reason, attempted_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, violation.ID, violation.FarmID, violation.CoopID, violation.InterlockID, violation.DeviceID, violation.CommandType,
+		violation.Source, violation.Reason, violation.AttemptedBy, violation.CreatedAt)
+	if err != nil {
+		return
+	}
+	events.PublishFarmEvent(target.FarmID, "interlock_blocked", violation)
+}
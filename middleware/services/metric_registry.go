@@ -0,0 +1,227 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"middleware/database"
+	"middleware/schemas"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrUnknownMetric = errors.New("unknown_metric")
+
+// metricDefinitions is the registry of telemetry metrics, in display order. A metric is stored as
+// device_readings.sensor_type on the coop's device of the owning model, which is created on the
+// first reading.
+var metricDefinitions = []schemas.MetricDefinition{
+	{Name: "temperature", Label: "Temperature", Unit: "C", ValidMin: floatPtr(-10), ValidMax: floatPtr(60), DeviceModel: "temp_humidity", DeviceName: "Temp/Humidity", MaxRatePerMin: floatPtr(2), SpikeDelta: floatPtr(8)},
+	{Name: "humidity", Label: "Humidity", Unit: "%", ValidMin: floatPtr(0), ValidMax: floatPtr(100), DeviceModel: "temp_humidity", DeviceName: "Temp/Humidity", MaxRatePerMin: floatPtr(10), SpikeDelta: floatPtr(25)},
+	{Name: "water_level", Label: "Water level", Unit: "raw", DeviceModel: "water_level", DeviceName: "Water Level"},
+	{Name: "ammonia", Label: "Ammonia", Unit: "ppm", ValidMin: floatPtr(0), ValidMax: floatPtr(500), DeviceModel: "ammonia_sensor", DeviceName: "Ammonia Sensor", AlertAbove: floatPtr(25), SpikeDelta: floatPtr(50)},
+	{Name: "co2", Label: "CO2", Unit: "ppm", ValidMin: floatPtr(0), ValidMax: floatPtr(10000), DeviceModel: "co2_sensor", DeviceName: "CO2 Sensor", AlertAbove: floatPtr(3000), SpikeDelta: floatPtr(2000)},
+	{Name: "light", Label: "Light", Unit: "lux", ValidMin: floatPtr(0), ValidMax: floatPtr(200000), DeviceModel: "light_sensor", DeviceName: "Light Sensor"},
+	{Name: "feed_bin_weight", Label: "Feed bin weight", Unit: "kg", ValidMin: floatPtr(0), ValidMax: floatPtr(20000), DeviceModel: "feed_bin_scale", DeviceName: "Feed Bin Scale"},
+	{Name: "egg_count", Label: "Egg count", Unit: "eggs", ValidMin: floatPtr(0), ValidMax: floatPtr(100000), DeviceModel: "egg_counter", DeviceName: "Egg Counter"},
+}
+
+var metricsByName = func() map[string]schemas.MetricDefinition {
+	m := make(map[string]schemas.MetricDefinition, len(metricDefinitions))
+	for _, d := range metricDefinitions {
+		m[d.Name] = d
+	}
+	return m
+}()
+
+// coopMetricThresholds are coop columns that override a metric's registered alert bounds
+var coopMetricThresholds = map[string]struct{ below, above string }{
+	"temperature": {below: "temp_min", above: "temp_max"},
+	"water_level": {below: "water_level_half_threshold"},
+}
+
+// ListMetrics returns the metric registry
+func ListMetrics() []schemas.MetricDefinition {
+	out := make([]schemas.MetricDefinition, len(metricDefinitions))
+	copy(out, metricDefinitions)
+	return out
+}
+
+// LookupMetric returns a registered metric by name
+func LookupMetric(name string) (schemas.MetricDefinition, bool) {
+	d, ok := metricsByName[strings.ToLower(strings.TrimSpace(name))]
+	return d, ok
+}
+
+// isSensorModel reports whether a device model owns a registered metric
+func isSensorModel(model string) bool {
+	for _, d := range metricDefinitions {
+		if d.DeviceModel == model {
+			return true
+		}
+	}
+	return false
+}
+
+// telemetryMetrics merges the legacy sensor fields into the metrics map and checks every name
+// against the registry.
+func telemetryMetrics(sensors schemas.TelemetrySensors, metrics map[string]float64) (map[string]float64, error) {
+	out := make(map[string]float64, len(metrics)+3)
+	for name, v := range metrics {
+		d, ok := LookupMetric(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownMetric, name)
+		}
+		out[d.Name] = v
+	}
+	if sensors.TemperatureC != nil {
+		out["temperature"] = *sensors.TemperatureC
+	}
+	if sensors.HumidityPct != nil {
+		out["humidity"] = *sensors.HumidityPct
+	}
+	if sensors.WaterLevel != nil {
+		out["water_level"] = *sensors.WaterLevel
+	}
+	return out, nil
+}
+
+// latestCoopMetrics returns the newest value of every metric reported in a coop and when the
+// newest of them arrived.
+func latestCoopMetrics(coopID uuid.UUID) (map[string]float64, *time.Time, error) {
+	rows, err := database.DB.Query(`
+		SELECT DISTINCT ON (dr.sensor_type) dr.sensor_type, dr.value, dr.timestamp
+		FROM device_readings dr
+		JOIN devices d ON dr.device_id = d.id
+		WHERE d.coop_id = $1 AND dr.quality = 'good'
+		ORDER BY dr.sensor_type, dr.timestamp DESC
+	`, coopID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]float64)
+	var latest *time.Time
+	for rows.Next() {
+		var name string
+		var value float64
+		var ts time.Time
+		if err := rows.Scan(&name, &value, &ts); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := metricsByName[name]; !ok {
+			continue
+		}
+		values[name] = value
+		if latest == nil || ts.After(*latest) {
+			t := ts
+			latest = &t
+		}
+	}
+	return values, latest, rows.Err()
+}
+
+// latestMetricValue returns the newest reading of one metric in a coop
+func latestMetricValue(coopID uuid.UUID, metric string) *float64 {
+	var v sql.NullFloat64
+	_ = database.DB.QueryRow(`
+		SELECT dr.value FROM device_readings dr
+		JOIN devices d ON dr.device_id = d.id
+		WHERE d.coop_id = $1 AND dr.sensor_type = $2 AND dr.quality = 'good'
+		ORDER BY dr.timestamp DESC LIMIT 1
+	`, coopID, metric).Scan(&v)
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
+
+// metricAlertBounds returns a metric's alert bounds for a coop, coop settings taking precedence
+func metricAlertBounds(coopID uuid.UUID, d schemas.MetricDefinition) (below, above *float64) {
+	below, above = d.AlertBelow, d.AlertAbove
+	cols, ok := coopMetricThresholds[d.Name]
+	if !ok {
+		return below, above
+	}
+	load := func(col string) *float64 {
+		if col == "" {
+			return nil
+		}
+		var v sql.NullFloat64
+		if database.DB.QueryRow(`SELECT `+col+` FROM coops WHERE id = $1`, coopID).Scan(&v) != nil || !v.Valid {
+			return nil
+		}
+		return &v.Float64
+	}
+	if v := load(cols.below); v != nil {
+		below = v
+	}
+	if v := load(cols.above); v != nil {
+		above = v
+	}
+	return below, above
+}
+
+// checkMetricAlert raises <metric>_low or <metric>_high when every reading of the metric in the
+// coop over the last minute is past the alert bound. An active alert of the same type is not
+// duplicated.
+func (s *TelemetryService) checkMetricAlert(farmID, coopID uuid.UUID, d schemas.MetricDefinition, latest float64, ts time.Time) error {
+	below, above := metricAlertBounds(coopID, d)
+
+	var alertType, agg, msg string
+	var threshold float64
+	switch {
+	case below != nil && latest < *below:
+		alertType, agg, threshold = d.Name+"_low", "MAX", *below
+		msg = fmt.Sprintf("%s below %g %s for 1 minute", d.Label, threshold, d.Unit)
+	case above != nil && latest > *above:
+		alertType, agg, threshold = d.Name+"_high", "MIN", *above
+		msg = fmt.Sprintf("%s above %g %s for 1 minute", d.Label, threshold, d.Unit)
+	default:
+		return nil
+	}
+
+	oneMinAgo := ts.Add(-1 * time.Minute)
+	var extreme sql.NullFloat64
+	err := database.DB.QueryRow(`
+		SELECT `+agg+`(dr.value) FROM device_readings dr
+		JOIN devices d ON dr.device_id = d.id
+		WHERE d.coop_id = $1 AND dr.sensor_type = $2 AND dr.timestamp >= $3 AND dr.quality = 'good'
+	`, coopID, d.Name, oneMinAgo).Scan(&extreme)
+	if err != nil || !extreme.Valid {
+		return nil
+	}
+	if (agg == "MAX" && extreme.Float64 >= threshold) || (agg == "MIN" && extreme.Float64 <= threshold) {
+		return nil
+	}
+
+	var exists bool
+	_ = database.DB.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM alerts
+			WHERE coop_id = $1 AND alert_type = $2 AND is_active = true
+		)
+	`, coopID, alertType).Scan(&exists)
+	if exists {
+		return nil
+	}
+
+	alertID := uuid.New()
+	if _, err := database.DB.Exec(`
+		INSERT INTO alerts (id, farm_id, coop_id, alert_type, severity, message, threshold_value, actual_value, is_active, is_acknowledged, triggered_at, created_at)
+		VALUES ($1,$2,$3,$4,'warning',$5,$6,$7,true,false,$8,$8)
+	`, alertID, farmID, coopID, alertType, msg, threshold, latest, ts); err != nil {
+		return err
+	}
+	events.PublishCoopEvent(farmID, coopID, "alert", map[string]interface{}{
+		"id":         alertID,
+		"alert_type": alertType,
+		"severity":   "warning",
+		"message":    msg,
+		"coop_id":    coopID,
+	})
+	return nil
+}
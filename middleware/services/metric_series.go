@@ -0,0 +1,350 @@
+package services
+
+import (
+	"errors"
+	"middleware/database"
+	"middleware/schemas"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrSeriesRange         = errors.New("invalid_series_range")
+	ErrSeriesBucket        = errors.New("invalid_series_bucket")
+	ErrSeriesBucketTooFine = errors.New("series_bucket_too_fine")
+	ErrSeriesAgg           = errors.New("invalid_series_agg")
+	ErrSeriesTooManyCoops  = errors.New("too_many_series_coops")
+)
+
+const (
+	maxSeriesBuckets = 1000
+	maxSeriesCoops   = 10
+)
+
+// seriesBuckets are the supported bucket sizes, finest first
+var seriesBuckets = []struct {
+	label   string
+	seconds int64
+}{
+	{"1m", 60}, {"5m", 300}, {"15m", 900}, {"30m", 1800},
+	{"1h", 3600}, {"3h", 10800}, {"6h", 21600}, {"12h", 43200},
+	{"1d", 86400}, {"7d", 604800},
+}
+
+var seriesAggs = map[string]bool{"avg": true, "min": true, "max": true, "sum": true, "count": true, "last": true}
+
+// seriesAcc accumulates one bucket, possibly from several tiers and devices
+type seriesAcc struct {
+	min, max, sum float64
+	count         int64
+	last          float64
+	lastAt        time.Time
+}
+
+func (a *seriesAcc) merge(min, max, sum float64, count int64, last float64, lastAt time.Time) {
+	if a.count == 0 || min < a.min {
+		a.min = min
+	}
+	if a.count == 0 || max > a.max {
+		a.max = max
+	}
+	a.sum += sum
+	a.count += count
+	if !lastAt.Before(a.lastAt) {
+		a.last, a.lastAt = last, lastAt
+	}
+}
+
+func (a *seriesAcc) value(agg string) float64 {
+	switch agg {
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "sum":
+		return a.sum
+	case "count":
+		return float64(a.count)
+	case "last":
+		return a.last
+	}
+	return a.sum / float64(a.count)
+}
+
+// GetMetricSeries returns a bucketed series of one metric for a coop and optionally other coops
+// of the farm to compare against. Buckets are aligned in the farm's time zone. Each part of the
+// range is read from the finest tier that still holds it (raw, hourly or daily rollups), so
+// buckets must be at least an hour (a day) once the range reaches past raw (hourly) retention.
+// Runs of buckets without readings are returned as gaps.
+func (s *TelemetryService) GetMetricSeries(userID, farmID, coopID uuid.UUID, metric string, q schemas.MetricSeriesQuery) (*schemas.MetricSeriesResponse, error) {
+	def, ok := LookupMetric(metric)
+	if !ok {
+		return nil, ErrUnknownMetric
+	}
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return nil, err
+	}
+	agg := strings.ToLower(strings.TrimSpace(q.Agg))
+	if agg == "" {
+		agg = "avg"
+	}
+	if !seriesAggs[agg] {
+		return nil, ErrSeriesAgg
+	}
+
+	loc := farmLocation(farmID)
+	now := time.Now().In(loc)
+	from, to, err := parseSeriesRange(q.From, q.To, now, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	rawFrom, hourlyFrom := tierBoundaries()
+	// Daily rollups cover the farm's local days; let the hourly tier take over at a farm midnight
+	if !hourlyFrom.IsZero() {
+		local := hourlyFrom.In(loc)
+		if midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc); midnight.Before(local) {
+			hourlyFrom = midnight.AddDate(0, 0, 1)
+		} else {
+			hourlyFrom = midnight
+		}
+	}
+	minSeconds := int64(0)
+	if !rawFrom.IsZero() && from.Before(rawFrom) {
+		minSeconds = 3600
+	}
+	if !hourlyFrom.IsZero() && from.Before(hourlyFrom) {
+		minSeconds = 86400
+	}
+	label, bucketSeconds, err := pickSeriesBucket(q.Bucket, to.Sub(from), minSeconds)
+	if err != nil {
+		return nil, err
+	}
+	bucket := time.Duration(bucketSeconds) * time.Second
+
+	// Align the first bucket to local midnight plus whole buckets
+	midnight := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	origin := midnight
+	if bucketSeconds < 86400 {
+		origin = midnight.Add(from.Sub(midnight) / bucket * bucket)
+	}
+	buckets := int((to.Sub(origin) + bucket - 1) / bucket)
+	if buckets > maxSeriesBuckets {
+		return nil, ErrSeriesRange
+	}
+
+	coopIDs := []uuid.UUID{coopID}
+	for _, id := range q.CoopIDs {
+		dup := false
+		for _, existing := range coopIDs {
+			dup = dup || existing == id
+		}
+		if !dup {
+			coopIDs = append(coopIDs, id)
+		}
+	}
+	if len(coopIDs) > maxSeriesCoops {
+		return nil, ErrSeriesTooManyCoops
+	}
+
+	resp := &schemas.MetricSeriesResponse{
+		Metric:        def,
+		From:          origin,
+		To:            to,
+		Timezone:      loc.String(),
+		Bucket:        label,
+		BucketSeconds: bucketSeconds,
+		Agg:           agg,
+		Tiers:         make([]string, 0, 3),
+		Series:        make([]schemas.CoopMetricSeries, 0, len(coopIDs)),
+	}
+
+	// Tier segments: daily rollups, hourly rollups, raw readings
+	type segment struct {
+		tier, table string
+		from, to    time.Time
+	}
+	segments := make([]segment, 0, 3)
+	cursor := origin
+	if !hourlyFrom.IsZero() && cursor.Before(hourlyFrom) {
+		end := minTime(hourlyFrom, to)
+		segments = append(segments, segment{"daily", "reading_rollups_daily", cursor, end})
+		cursor = end
+	}
+	if !rawFrom.IsZero() && cursor.Before(rawFrom) && cursor.Before(to) {
+		end := minTime(rawFrom, to)
+		segments = append(segments, segment{"hourly", "reading_rollups_hourly", cursor, end})
+		cursor = end
+	}
+	if cursor.Before(to) {
+		segments = append(segments, segment{"raw", "", cursor, to})
+	}
+	for _, seg := range segments {
+		resp.Tiers = append(resp.Tiers, seg.tier)
+	}
+
+	for _, id := range coopIDs {
+		var name string
+		if err := database.DB.QueryRow(`SELECT name FROM coops WHERE id = $1 AND farm_id = $2`, id, farmID).Scan(&name); err != nil {
+			return nil, ErrCoopNotFound
+		}
+
+		accs := make(map[int64]*seriesAcc)
+		for _, seg := range segments {
+			if err := loadSeriesSegment(accs, id, def.Name, seg.table, origin, seg.from, seg.to, bucketSeconds, q.IncludeSuspect); err != nil {
+				return nil, err
+			}
+		}
+
+		series := schemas.CoopMetricSeries{
+			CoopID:   id,
+			CoopName: name,
+			Points:   make([]schemas.MetricSeriesPoint, 0, len(accs)),
+			Gaps:     make([]schemas.MetricSeriesGap, 0),
+		}
+		var gap *schemas.MetricSeriesGap
+		for i := 0; i < buckets; i++ {
+			start := origin.Add(time.Duration(i) * bucket)
+			if !start.Before(now) {
+				break
+			}
+			if acc, ok := accs[int64(i)]; ok {
+				series.Points = append(series.Points, schemas.MetricSeriesPoint{Time: start, Value: acc.value(agg), Count: acc.count})
+				gap = nil
+				continue
+			}
+			end := minTime(start.Add(bucket), minTime(to, now))
+			if gap == nil {
+				series.Gaps = append(series.Gaps, schemas.MetricSeriesGap{From: start, To: end})
+				gap = &series.Gaps[len(series.Gaps)-1]
+			} else {
+				gap.To = end
+			}
+		}
+		resp.Series = append(resp.Series, series)
+	}
+	return resp, nil
+}
+
+// loadSeriesSegment merges one tier's readings between from and to into per-bucket accumulators.
+// Raw readings that are not good are only included on request.
+func loadSeriesSegment(accs map[int64]*seriesAcc, coopID uuid.UUID, metric, table string, origin, from, to time.Time, bucketSeconds int64, includeSuspect bool) error {
+	query := `
+		SELECT FLOOR(EXTRACT(EPOCH FROM (dr.timestamp - $3)) / $6)::BIGINT AS idx,
+			MIN(dr.value), MAX(dr.value), SUM(dr.value), COUNT(*),
+			(ARRAY_AGG(dr.value ORDER BY dr.timestamp DESC))[1], MAX(dr.timestamp)
+		FROM device_readings dr
+		JOIN devices d ON dr.device_id = d.id
+		WHERE d.coop_id = $1 AND dr.sensor_type = $2 AND dr.timestamp >= $4 AND dr.timestamp < $5
+			AND ($7 OR dr.quality = 'good')
+		GROUP BY idx`
+	if table != "" {
+		query = `
+			SELECT FLOOR(EXTRACT(EPOCH FROM (r.bucket - $3)) / $6)::BIGINT AS idx,
+				MIN(r.min_value), MAX(r.max_value), SUM(r.avg_value * r.sample_count), SUM(r.sample_count),
+				(ARRAY_AGG(r.last_value ORDER BY r.last_at DESC))[1], MAX(r.last_at)
+			FROM ` + table + ` r
+			JOIN devices d ON r.device_id = d.id
+			WHERE d.coop_id = $1 AND r.sensor_type = $2 AND r.bucket >= $4 AND r.bucket < $5
+			GROUP BY idx`
+	}
+	args := []interface{}{coopID, metric, origin.In(time.Local), from.In(time.Local), to.In(time.Local), bucketSeconds}
+	if table == "" {
+		args = append(args, includeSuspect)
+	}
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var idx, count int64
+		var min, max, sum, last float64
+		var lastAt time.Time
+		if err := rows.Scan(&idx, &min, &max, &sum, &count, &last, &lastAt); err != nil {
+			return err
+		}
+		acc, ok := accs[idx]
+		if !ok {
+			acc = &seriesAcc{}
+			accs[idx] = acc
+		}
+		acc.merge(min, max, sum, count, last, lastAt)
+	}
+	return rows.Err()
+}
+
+// parseSeriesRange reads from/to as RFC 3339 times or YYYY-MM-DD days in the farm's time zone
+// (to inclusive). The default is the last 24 hours.
+func parseSeriesRange(rawFrom, rawTo string, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	parse := func(raw string, endOfDay bool) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			return t.In(loc), nil
+		}
+		t, err := time.ParseInLocation("2006-01-02", raw, loc)
+		if err != nil {
+			return time.Time{}, ErrSeriesRange
+		}
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+
+	to := now
+	if rawTo != "" {
+		t, err := parse(rawTo, true)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if rawFrom != "" {
+		t, err := parse(rawFrom, false)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, ErrSeriesRange
+	}
+	return from, to, nil
+}
+
+// pickSeriesBucket validates the requested bucket, or picks the finest one that keeps the series
+// within maxSeriesBuckets and the tier's resolution
+func pickSeriesBucket(requested string, span time.Duration, minSeconds int64) (string, int64, error) {
+	requested = strings.ToLower(strings.TrimSpace(requested))
+	if requested != "" {
+		for _, b := range seriesBuckets {
+			if b.label != requested {
+				continue
+			}
+			if b.seconds < minSeconds {
+				return "", 0, ErrSeriesBucketTooFine
+			}
+			return b.label, b.seconds, nil
+		}
+		return "", 0, ErrSeriesBucket
+	}
+
+	for _, b := range seriesBuckets {
+		if b.seconds >= minSeconds && span/(time.Duration(b.seconds)*time.Second) < maxSeriesBuckets {
+			return b.label, b.seconds, nil
+		}
+	}
+	last := seriesBuckets[len(seriesBuckets)-1]
+	return last.label, last.seconds, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
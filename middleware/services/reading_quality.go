@@ -0,0 +1,173 @@
+package services
+
+import (
+	"math"
+	"middleware/database"
+	"middleware/schemas"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Reading quality flags. Only good readings feed alerts, rollups, timelines, series and coop
+// status; suspect and bad readings stay in device_readings for debugging.
+const (
+	readingQualityGood    = "good"
+	readingQualitySuspect = "suspect"
+	readingQualityBad     = "bad"
+)
+
+const (
+	// Good readings older than this are not used to judge a new reading
+	qualityWindow = 30 * time.Minute
+	// Good readings the spike check takes the median of
+	spikeSamples = 5
+	// Fewer recent readings than this are not enough to call a value a spike
+	spikeMinSamples = 3
+	// Consecutive readings that must agree before a sustained jump is accepted as the new level
+	levelShiftReadings = 3
+)
+
+type qualityPoint struct {
+	value float64
+	ts    time.Time
+}
+
+// qualityHistory is what a new reading of one device and metric is judged against
+type qualityHistory struct {
+	// good holds good readings, newest first, up to spikeSamples
+	good []qualityPoint
+	// latest holds the last good or suspect readings, newest first, up to levelShiftReadings-1
+	latest []qualityPoint
+}
+
+// assessReading classifies a (calibrated) reading: bad when outside the metric's valid range,
+// suspect when it changes faster than the metric's rate limit since the previous good reading or
+// deviates from the median of recent good readings by more than the spike delta. A suspect value
+// is accepted after all when the previous readings already agree with it, so a real sustained
+// jump (e.g. a ventilation failure) reaches alerts after levelShiftReadings readings.
+func assessReading(def schemas.MetricDefinition, value float64, ts time.Time, history qualityHistory) (string, string) {
+	if (def.ValidMin != nil && value < *def.ValidMin) || (def.ValidMax != nil && value > *def.ValidMax) {
+		return readingQualityBad, "out_of_range"
+	}
+	quality, reason := judgeAgainstGood(def, value, ts, history.good)
+	if quality == readingQualitySuspect && isLevelShift(def, qualityPoint{value, ts}, history.latest) {
+		return readingQualityGood, ""
+	}
+	return quality, reason
+}
+
+// judgeAgainstGood runs the rate and spike checks against good readings before ts, newest first
+func judgeAgainstGood(def schemas.MetricDefinition, value float64, ts time.Time, recent []qualityPoint) (string, string) {
+	window := make([]qualityPoint, 0, len(recent))
+	for _, p := range recent {
+		if p.ts.Before(ts) && ts.Sub(p.ts) <= qualityWindow {
+			window = append(window, p)
+		}
+	}
+	if len(window) == 0 {
+		return readingQualityGood, ""
+	}
+
+	if def.MaxRatePerMin != nil {
+		// Sub-minute deltas are judged per minute so sensor noise between fast samples is tolerated
+		minutes := math.Max(ts.Sub(window[0].ts).Minutes(), 1)
+		if math.Abs(value-window[0].value)/minutes > *def.MaxRatePerMin {
+			return readingQualitySuspect, "rate_of_change"
+		}
+	}
+
+	if def.SpikeDelta != nil && len(window) >= spikeMinSamples {
+		values := make([]float64, len(window))
+		for i, p := range window {
+			values[i] = p.value
+		}
+		sort.Float64s(values)
+		median := values[len(values)/2]
+		if len(values)%2 == 0 {
+			median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+		}
+		if math.Abs(value-median) > *def.SpikeDelta {
+			return readingQualitySuspect, "spike"
+		}
+	}
+	return readingQualityGood, ""
+}
+
+// isLevelShift reports whether the last levelShiftReadings-1 readings before p (good or suspect)
+// are all within the metric's spike delta and rate limit of it
+func isLevelShift(def schemas.MetricDefinition, p qualityPoint, latest []qualityPoint) bool {
+	agreeing := 0
+	for _, q := range latest {
+		if !q.ts.Before(p.ts) || p.ts.Sub(q.ts) > qualityWindow {
+			continue
+		}
+		delta := math.Abs(p.value - q.value)
+		if def.SpikeDelta != nil && delta > *def.SpikeDelta {
+			return false
+		}
+		if def.MaxRatePerMin != nil && delta/math.Max(p.ts.Sub(q.ts).Minutes(), 1) > *def.MaxRatePerMin {
+			return false
+		}
+		agreeing++
+		if agreeing == levelShiftReadings-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// recentQualityHistory loads the readings a new reading at ts is judged against
+func recentQualityHistory(deviceID uuid.UUID, sensorType string, ts time.Time) qualityHistory {
+	return qualityHistory{
+		good:   loadQualityPoints(deviceID, sensorType, ts, []string{readingQualityGood}, spikeSamples),
+		latest: loadQualityPoints(deviceID, sensorType, ts, []string{readingQualityGood, readingQualitySuspect}, levelShiftReadings-1),
+	}
+}
+
+// loadQualityPoints returns up to limit readings of the given qualities in the window before ts, newest first
+func loadQualityPoints(deviceID uuid.UUID, sensorType string, ts time.Time, qualities []string, limit int) []qualityPoint {
+	rows, err := database.DB.Query(`
+		SELECT value, timestamp FROM device_readings
+		WHERE device_id = $1 AND sensor_type = $2 AND quality = ANY($3::TEXT[]) AND timestamp < $4 AND timestamp >= $5
+		ORDER BY timestamp DESC
+		LIMIT $6
+	`, deviceID, sensorType, pq.Array(qualities), ts, ts.Add(-qualityWindow), limit)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	points := make([]qualityPoint, 0, limit)
+	for rows.Next() {
+		var p qualityPoint
+		if rows.Scan(&p.value, &p.ts) == nil {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// push records a stored reading in the history; bad readings are not part of it
+func (h qualityHistory) push(p qualityPoint, quality string) qualityHistory {
+	switch quality {
+	case readingQualityGood:
+		h.good = pushQualityPoint(h.good, p, spikeSamples)
+		h.latest = pushQualityPoint(h.latest, p, levelShiftReadings-1)
+	case readingQualitySuspect:
+		h.latest = pushQualityPoint(h.latest, p, levelShiftReadings-1)
+	}
+	return h
+}
+
+// pushQualityPoint adds a reading to a newest-first list kept to max entries
+func pushQualityPoint(recent []qualityPoint, p qualityPoint, max int) []qualityPoint {
+	recent = append(recent, p)
+	sort.Slice(recent, func(i, j int) bool { return recent[i].ts.After(recent[j].ts) })
+	if len(recent) > max {
+		recent = recent[:max]
+	}
+	return recent
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"middleware/database"
 	"middleware/models"
 	"middleware/schemas"
@@ -11,6 +12,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// ErrScheduleTargetConflict is returned when a schedule names both a device and a tag or group
+var ErrScheduleTargetConflict = errors.New("schedule_target_conflict")
+
 // ScheduleService handles all business logic related to automated schedules
 type ScheduleService struct {
 	farmService *FarmService
@@ -28,7 +32,7 @@ func (s *ScheduleService) ListSchedules(userID, farmID uuid.UUID, coopID *uuid.U
 		return nil, err
 	}
 
-	query := `SELECT id, farm_id, coop_id, device_id, name, schedule_type, cron_expression, on_duration, off_duration, condition_json, action, action_value, action_duration, action_sequence, priority, is_active, next_execution, last_execution, execution_count, created_by, created_at, updated_at FROM schedules WHERE farm_id = $1`
+	query := `SELECT id, farm_id, coop_id, device_id, target_tag, target_group_id, name, schedule_type, cron_expression, on_duration, off_duration, condition_json, action, action_value, action_duration, action_sequence, priority, is_active, next_execution, last_execution, execution_count, created_by, created_at, updated_at FROM schedules WHERE farm_id = $1`
 	args := []interface{}{farmID}
 
 	if coopID != nil {
@@ -47,7 +51,7 @@ func (s *ScheduleService) ListSchedules(userID, farmID uuid.UUID, coopID *uuid.U
 	var schedules []models.Schedule
 	for rows.Next() {
 		var sc models.Schedule
-		if err := rows.Scan(&sc.ID, &sc.FarmID, &sc.CoopID, &sc.DeviceID, &sc.Name, &sc.ScheduleType, &sc.CronExpression,
+		if err := rows.Scan(&sc.ID, &sc.FarmID, &sc.CoopID, &sc.DeviceID, &sc.TargetTag, &sc.TargetGroupID, &sc.Name, &sc.ScheduleType, &sc.CronExpression,
 			&sc.OnDuration, &sc.OffDuration, &sc.ConditionJSON, &sc.Action, &sc.ActionValue, &sc.ActionDuration, &sc.ActionSequence,
 			&sc.Priority, &sc.IsActive, &sc.NextExecution, &sc.LastExecution, &sc.ExecutionCount, &sc.CreatedBy, &sc.CreatedAt, &sc.UpdatedAt); err != nil {
 			continue
@@ -64,10 +68,33 @@ func (s *ScheduleService) CreateSchedule(userID, farmID uuid.UUID, req schemas.C
 		return nil, err
 	}
 
-	if ok, err := scheduleDeviceBelongsToFarm(req.DeviceID, farmID); err != nil {
-		return nil, err
-	} else if !ok {
-		return nil, sql.ErrNoRows
+	var targetTag *string
+	if req.DeviceID != nil && !req.DeviceSelector.IsEmpty() {
+		return nil, ErrScheduleTargetConflict
+	}
+	if req.DeviceID != nil {
+		if ok, err := scheduleDeviceBelongsToFarm(*req.DeviceID, farmID); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, sql.ErrNoRows
+		}
+		if err := ValidateDeviceCommand(farmID, *req.DeviceID, req.Action, req.ActionValue, req.ActionDuration); err != nil {
+			return nil, err
+		}
+	} else {
+		if req.DeviceSelector.IsEmpty() {
+			return nil, ErrDeviceNotFound
+		}
+		if req.Tag != nil && *req.Tag != "" {
+			tag, err := normalizeTag(*req.Tag)
+			if err != nil {
+				return nil, err
+			}
+			targetTag = &tag
+		}
+		if err := validateSelectorSchedule(farmID, req.CoopID, req.DeviceSelector, req.Action, req.ActionValue, req.ActionDuration); err != nil {
+			return nil, err
+		}
 	}
 
 	now := time.Now()
@@ -90,6 +117,8 @@ func (s *ScheduleService) CreateSchedule(userID, farmID uuid.UUID, req schemas.C
 		FarmID:         farmID,
 		CoopID:         req.CoopID,
 		DeviceID:       req.DeviceID,
+		TargetTag:      targetTag,
+		TargetGroupID:  req.GroupID,
 		Name:           req.Name,
 		ScheduleType:   req.ScheduleType,
 		CronExpression: req.CronExpression,
@@ -111,9 +140,9 @@ func (s *ScheduleService) CreateSchedule(userID, farmID uuid.UUID, req schemas.C
 	}
 
 	_, err := database.DB.Exec(`
-		INSERT INTO schedules (id, farm_id, coop_id, device_id, name, schedule_type, cron_expression, on_duration, off_duration, condition_json, action, action_value, action_duration, action_sequence, priority, is_active, created_by, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
-	`, schedule.ID, schedule.FarmID, schedule.CoopID, schedule.DeviceID, schedule.Name, schedule.ScheduleType,
+		INSERT INTO schedules (id, farm_id, coop_id, device_id, target_tag, target_group_id, name, schedule_type, cron_expression, on_duration, off_duration, condition_json, action, action_value, action_duration, action_sequence, priority, is_active, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+	`, schedule.ID, schedule.FarmID, schedule.CoopID, schedule.DeviceID, schedule.TargetTag, schedule.TargetGroupID, schedule.Name, schedule.ScheduleType,
 		schedule.CronExpression, schedule.OnDuration, schedule.OffDuration, schedule.ConditionJSON, schedule.Action,
 		schedule.ActionValue, schedule.ActionDuration, actionSequence, schedule.Priority, schedule.IsActive,
 		schedule.CreatedBy, schedule.CreatedAt, schedule.UpdatedAt)
@@ -130,12 +159,35 @@ func (s *ScheduleService) UpdateSchedule(userID, farmID, scheduleID uuid.UUID, r
 		return nil, err
 	}
 
+	// Validate the resulting action against the device before persisting
+	existing, err := s.GetSchedule(userID, farmID, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	action, actionValue, actionDuration := existing.Action, existing.ActionValue, existing.ActionDuration
+	if req.Action != nil {
+		action = *req.Action
+	}
+	if req.ActionValue != nil {
+		actionValue = req.ActionValue
+	}
+	if req.ActionDuration != nil {
+		actionDuration = req.ActionDuration
+	}
+	if existing.DeviceID != nil {
+		if err := ValidateDeviceCommand(farmID, *existing.DeviceID, action, actionValue, actionDuration); err != nil {
+			return nil, err
+		}
+	} else if err := validateSelectorSchedule(farmID, existing.CoopID, scheduleSelector(existing), action, actionValue, actionDuration); err != nil {
+		return nil, err
+	}
+
 	var actionSequence interface{} = nil
 	if len(req.ActionSequence) > 0 {
 		actionSequence = models.NullRawMessage(req.ActionSequence)
 	}
 
-	_, err := database.DB.Exec(`
+	_, err = database.DB.Exec(`
 		UPDATE schedules SET
 			name = COALESCE($1, name),
 			schedule_type = COALESCE($2, schedule_type),
@@ -188,13 +240,13 @@ func (s *ScheduleService) GetSchedule(userID, farmID, scheduleID uuid.UUID) (*mo
 
 	var sc models.Schedule
 	err := database.DB.QueryRow(`
-		SELECT id, farm_id, coop_id, device_id, name, schedule_type, cron_expression, on_duration, off_duration,
+		SELECT id, farm_id, coop_id, device_id, target_tag, target_group_id, name, schedule_type, cron_expression, on_duration, off_duration,
 		       condition_json, action, action_value, action_duration, action_sequence, priority, is_active,
 		       next_execution, last_execution, execution_count, created_by, created_at, updated_at
 		FROM schedules
 		WHERE id = $1 AND farm_id = $2
 	`, scheduleID, farmID).Scan(
-		&sc.ID, &sc.FarmID, &sc.CoopID, &sc.DeviceID, &sc.Name, &sc.ScheduleType, &sc.CronExpression,
+		&sc.ID, &sc.FarmID, &sc.CoopID, &sc.DeviceID, &sc.TargetTag, &sc.TargetGroupID, &sc.Name, &sc.ScheduleType, &sc.CronExpression,
 		&sc.OnDuration, &sc.OffDuration, &sc.ConditionJSON, &sc.Action, &sc.ActionValue, &sc.ActionDuration,
 		&sc.ActionSequence, &sc.Priority, &sc.IsActive, &sc.NextExecution, &sc.LastExecution,
 		&sc.ExecutionCount, &sc.CreatedBy, &sc.CreatedAt, &sc.UpdatedAt,
@@ -237,20 +289,61 @@ func (s *ScheduleService) GetExecutionHistory(userID, farmID, scheduleID uuid.UU
 	return items, nil
 }
 
-// ExecuteScheduleNow creates an immediate execution entry and device command
-func (s *ScheduleService) ExecuteScheduleNow(userID, farmID, scheduleID uuid.UUID) (*models.DeviceCommand, error) {
+// ExecuteScheduleNow creates an immediate execution entry and device command. Tag and group
+// schedules resolve their devices at run time and return one result per device instead.
+func (s *ScheduleService) ExecuteScheduleNow(userID, farmID, scheduleID uuid.UUID) (*models.DeviceCommand, []schemas.BatchResult, error) {
 	if err := s.farmService.CheckAccess(userID, farmID, "farmer"); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	sc, err := s.GetSchedule(userID, farmID, scheduleID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if sc.DeviceID != nil {
+		cmd, err := executeScheduleOnDevice(userID, farmID, sc, *sc.DeviceID)
+		return cmd, nil, err
+	}
+
+	sel := scheduleSelector(sc)
+	if sel.IsEmpty() {
+		// The target group was deleted
+		return nil, nil, ErrDeviceGroupNotFound
+	}
+	deviceIDs, err := resolveDeviceSelector(farmID, sc.CoopID, sel)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]schemas.BatchResult, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		cmd, err := executeScheduleOnDevice(userID, farmID, sc, deviceID)
+		if err != nil {
+			results = append(results, batchFailure(deviceID, err))
+			continue
+		}
+		results = append(results, schemas.BatchResult{CommandID: cmd.ID, DeviceID: deviceID, Status: cmd.Status})
 	}
+	return nil, results, nil
+}
 
+// executeScheduleOnDevice issues the schedule action to one device and records the execution
+func executeScheduleOnDevice(userID, farmID uuid.UUID, sc *models.Schedule, deviceID uuid.UUID) (*models.DeviceCommand, error) {
 	commandType := sc.Action
 	commandValue := sc.ActionValue
-	cmd, err := NewDeviceService().IssueCommand(userID, farmID, sc.DeviceID, commandType, commandValue, sc.ActionDuration)
+	cmd, err := NewDeviceService().IssueCommandWithOptions(userID, farmID, deviceID, commandType, commandValue, sc.ActionDuration, CommandOptions{Source: "schedule"})
+	var violation *InterlockViolationError
+	if err == ErrEmergencyStopActive || errors.As(err, &violation) {
+		reason := "emergency stop active"
+		if violation != nil {
+			reason = violation.Reason
+		}
+		_, _ = database.DB.Exec(`
+			INSERT INTO schedule_executions (id, schedule_id, device_id, scheduled_time, status, error_message, created_at)
+			VALUES ($1, $2, $3, $4, 'skipped', $5, $4)
+		`, uuid.New(), sc.ID, deviceID, time.Now(), reason)
+		return nil, err
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -263,11 +356,34 @@ func (s *ScheduleService) ExecuteScheduleNow(userID, farmID, scheduleID uuid.UUI
 	_, _ = database.DB.Exec(`
 		INSERT INTO schedule_executions (id, schedule_id, device_id, scheduled_time, actual_execution_time, status, device_response, created_at)
 		VALUES ($1, $2, $3, $4, $5, 'executed', $6, $7)
-	`, uuid.New(), scheduleID, sc.DeviceID, time.Now(), time.Now(), respJSON, time.Now())
+	`, uuid.New(), sc.ID, deviceID, time.Now(), time.Now(), respJSON, time.Now())
 
 	return cmd, nil
 }
 
+// scheduleSelector returns the tag/group target of a schedule without a fixed device
+func scheduleSelector(sc *models.Schedule) schemas.DeviceSelector {
+	return schemas.DeviceSelector{Tag: sc.TargetTag, GroupID: sc.TargetGroupID}
+}
+
+// validateSelectorSchedule checks a schedule action against every device the selector matches now;
+// devices tagged or grouped later are validated when the schedule runs.
+func validateSelectorSchedule(farmID uuid.UUID, coopID *uuid.UUID, sel schemas.DeviceSelector, action string, value *string, duration *int) error {
+	if sel.IsEmpty() {
+		return ErrDeviceGroupNotFound
+	}
+	deviceIDs, err := resolveDeviceSelector(farmID, coopID, sel)
+	if err != nil {
+		return err
+	}
+	for _, deviceID := range deviceIDs {
+		if err := ValidateDeviceCommand(farmID, deviceID, action, value, duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func scheduleDeviceBelongsToFarm(deviceID, farmID uuid.UUID) (bool, error) {
 	var exists bool
 	if err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM devices WHERE id = $1 AND farm_id = $2)", deviceID, farmID).Scan(&exists); err != nil {
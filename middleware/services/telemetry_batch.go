@@ -0,0 +1,327 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"middleware/database"
+	"middleware/schemas"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrTelemetryBatchSize = errors.New("invalid_batch_size")
+
+const (
+	// MaxTelemetryBatchItems bounds one batch upload; gateways split longer backlogs
+	MaxTelemetryBatchItems = 1000
+	// Backfilled snapshots older than this are stored but never raise alerts
+	telemetryAlertMaxAge = 5 * time.Minute
+	// Rows per multi-row INSERT (9 parameters each, well below the protocol limit)
+	readingInsertChunk = 500
+)
+
+type batchReading struct {
+	deviceID      uuid.UUID
+	sensorType    string
+	value         float64
+	raw           *float64
+	unit          string
+	quality       string
+	qualityReason string
+	ts            time.Time
+}
+
+type readingKey struct {
+	deviceID   uuid.UUID
+	sensorType string
+	ts         int64
+}
+
+type calibrationKey struct {
+	deviceID   uuid.UUID
+	sensorType string
+}
+
+// IngestTelemetryBatch stores an array of timestamped snapshots in one transaction. Items are
+// accepted or rejected individually; only snapshots newer than telemetryAlertMaxAge are
+// considered for alerting so a replayed backlog does not raise stale alerts. Timestamps are
+// shifted by the gateway's clock skew when that is known to be large, and items still out of
+// window are rejected.
+func (s *TelemetryService) IngestTelemetryBatch(userID, farmID, coopID uuid.UUID, req schemas.TelemetryBatchRequest) (*schemas.TelemetryBatchResponse, error) {
+	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
+		return nil, err
+	}
+	if _, err := s.coopService.GetCoop(userID, farmID, coopID); err != nil {
+		return nil, err
+	}
+	if len(req.Items) == 0 || len(req.Items) > MaxTelemetryBatchItems {
+		return nil, ErrTelemetryBatchSize
+	}
+
+	now := time.Now()
+	clock := gatewayClock(farmID, req.HardwareID, req.SentAt, clockSourceBatch, now)
+
+	resp := &schemas.TelemetryBatchResponse{
+		ClockSkewMs: clock.skewMs(),
+		Results:     make([]schemas.TelemetryBatchItemResult, len(req.Items)),
+	}
+	// Item timestamps in server time
+	stamped := make([]time.Time, len(req.Items))
+	itemMetrics := make([]map[string]float64, len(req.Items))
+	devices := make(map[string]*uuid.UUID)
+	var stamps []time.Time
+	for i, item := range req.Items {
+		res := &resp.Results[i]
+		res.Index = i
+		res.Timestamp = item.Timestamp
+		metrics, err := telemetryMetrics(item.Sensors, item.Metrics)
+		var reason string
+		if item.Timestamp != nil {
+			var ts time.Time
+			ts, res.TimestampCorrected, reason = clock.sanitize(*item.Timestamp)
+			stamped[i] = ts.In(time.Local)
+			if res.TimestampCorrected {
+				res.Timestamp = &ts
+			}
+		}
+		switch {
+		case item.Timestamp == nil:
+			res.Reason = "missing_timestamp"
+		case reason != "":
+			res.Reason = reason
+		case err != nil:
+			res.Reason = "unknown_metric"
+		case len(metrics) == 0:
+			res.Reason = "no_sensor_values"
+		default:
+			res.Accepted = true
+			itemMetrics[i] = metrics
+			stamps = append(stamps, stamped[i])
+			for name := range metrics {
+				d := metricsByName[name]
+				if _, ok := devices[d.DeviceModel]; !ok {
+					devices[d.DeviceModel], _ = s.ensureSensorDevice(farmID, coopID, req.HardwareID, d.DeviceModel, d.DeviceName)
+				}
+			}
+		}
+	}
+
+	deviceIDs := make([]uuid.UUID, 0, len(devices))
+	for _, id := range devices {
+		if id != nil {
+			deviceIDs = append(deviceIDs, *id)
+		}
+	}
+	existing, err := existingReadingKeys(deviceIDs, stamps)
+	if err != nil {
+		return nil, err
+	}
+
+	calibration := make(map[calibrationKey][2]float64)
+	calibrated := func(deviceID uuid.UUID, sensorType string, value float64) (float64, *float64) {
+		key := calibrationKey{deviceID, sensorType}
+		coeff, ok := calibration[key]
+		if !ok {
+			offset, gain := calibrationCoefficients(deviceID, sensorType)
+			coeff = [2]float64{offset, gain}
+			calibration[key] = coeff
+		}
+		return calibrate(coeff[0], coeff[1], value)
+	}
+
+	var readings []batchReading
+	latest := make(map[uuid.UUID]time.Time)
+	// Heartbeats: one per accepted snapshot and device, counted per hour
+	hours := make(map[uuid.UUID]map[time.Time]int)
+	// Newest snapshot per metric recent enough to alert on, and newest good value per metric
+	type freshValue struct {
+		value float64
+		ts    time.Time
+	}
+	fresh := make(map[string]freshValue)
+	live := make(map[string]schemas.TelemetryEventValue)
+	goodReadings := 0
+	// Quality is judged in timestamp order against the readings before each one
+	recent := make(map[calibrationKey]qualityHistory)
+	order := make([]int, 0, len(req.Items))
+	for i := range req.Items {
+		if resp.Results[i].Accepted {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return stamped[order[a]].Before(stamped[order[b]])
+	})
+	for _, i := range order {
+		res := &resp.Results[i]
+		ts := stamped[i]
+		touched := make(map[uuid.UUID]bool, 2)
+		hasDevice := false
+		for _, d := range metricDefinitions {
+			value, ok := itemMetrics[i][d.Name]
+			deviceID := devices[d.DeviceModel]
+			if !ok || deviceID == nil {
+				continue
+			}
+			hasDevice = true
+			key := readingKey{*deviceID, d.Name, readingStamp(ts)}
+			if existing[key] {
+				continue
+			}
+			existing[key] = true
+			stored, raw := calibrated(*deviceID, d.Name, value)
+			series := calibrationKey{*deviceID, d.Name}
+			history, ok := recent[series]
+			if !ok {
+				history = recentQualityHistory(*deviceID, d.Name, ts)
+			}
+			quality, reason := assessReading(d, stored, ts, history)
+			if quality != readingQualityGood {
+				res.Flagged++
+			}
+			recent[series] = history.push(qualityPoint{stored, ts}, quality)
+			readings = append(readings, batchReading{*deviceID, d.Name, stored, raw, d.Unit, quality, reason, ts})
+			res.Readings++
+			touched[*deviceID] = true
+			if ts.After(latest[*deviceID]) {
+				latest[*deviceID] = ts
+			}
+			if quality == readingQualityGood {
+				goodReadings++
+				if ts.After(live[d.Name].Timestamp) {
+					live[d.Name] = schemas.TelemetryEventValue{Value: stored, Unit: d.Unit, Timestamp: ts}
+				}
+			}
+			if quality == readingQualityGood && now.Sub(ts) <= telemetryAlertMaxAge && ts.After(fresh[d.Name].ts) {
+				fresh[d.Name] = freshValue{stored, ts}
+			}
+		}
+
+		if res.Readings == 0 {
+			res.Accepted = false
+			if !hasDevice {
+				res.Reason = "unknown_sensor_device"
+			} else {
+				res.Reason = "duplicate"
+			}
+			continue
+		}
+		resp.Readings += res.Readings
+		resp.Flagged += res.Flagged
+		for deviceID := range touched {
+			if hours[deviceID] == nil {
+				hours[deviceID] = make(map[time.Time]int)
+			}
+			hours[deviceID][ts.Truncate(time.Hour)]++
+		}
+	}
+	for i := range resp.Results {
+		if resp.Results[i].Accepted {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+	if len(readings) == 0 {
+		return resp, nil
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(readings); start += readingInsertChunk {
+		end := start + readingInsertChunk
+		if end > len(readings) {
+			end = len(readings)
+		}
+		chunk := readings[start:end]
+		values := make([]string, 0, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*9)
+		for j, r := range chunk {
+			n := j * 9
+			values = append(values, fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d,$%d,NULLIF($%d, ''),$%d)",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9))
+			args = append(args, uuid.New(), r.deviceID, r.sensorType, r.value, r.raw, r.unit, r.quality, r.qualityReason, r.ts)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO device_readings (id, device_id, sensor_type, value, raw_value, unit, quality, quality_reason, timestamp)
+			VALUES `+strings.Join(values, ","), args...); err != nil {
+			return nil, err
+		}
+	}
+
+	// last_heartbeat never moves backwards when older snapshots arrive
+	for deviceID, ts := range latest {
+		if _, err := tx.Exec(`
+			UPDATE devices SET is_online = true, last_heartbeat = GREATEST(COALESCE(last_heartbeat, $1), $1), updated_at = $2
+			WHERE id = $3
+		`, ts, now, deviceID); err != nil {
+			return nil, err
+		}
+	}
+	for deviceID, counts := range hours {
+		for hour, n := range counts {
+			if _, err := tx.Exec(`
+				INSERT INTO device_heartbeat_hours (device_id, hour, heartbeats) VALUES ($1, date_trunc('hour', $2::TIMESTAMP), $3)
+				ON CONFLICT (device_id, hour) DO UPDATE SET heartbeats = device_heartbeat_hours.heartbeats + EXCLUDED.heartbeats
+			`, deviceID, hour, n); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, d := range metricDefinitions {
+		if v, ok := fresh[d.Name]; ok {
+			resp.AlertsEvaluated = true
+			_ = s.checkMetricAlert(farmID, coopID, d, v.value, v.ts)
+		}
+	}
+	publishTelemetry(farmID, coopID, live, goodReadings)
+	return resp, nil
+}
+
+// existingReadingKeys loads readings already stored for the batch's devices and time range so
+// a replayed batch does not store the same snapshot twice.
+func existingReadingKeys(ids []uuid.UUID, stamps []time.Time) (map[readingKey]bool, error) {
+	existing := make(map[readingKey]bool)
+	if len(ids) == 0 || len(stamps) == 0 {
+		return existing, nil
+	}
+	sort.Slice(stamps, func(a, b int) bool { return stamps[a].Before(stamps[b]) })
+
+	rows, err := database.DB.Query(`
+		SELECT device_id, sensor_type, timestamp FROM device_readings
+		WHERE device_id = ANY($1::UUID[]) AND timestamp BETWEEN $2 AND $3
+	`, uuidArray(ids), stamps[0], stamps[len(stamps)-1])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key readingKey
+		var ts time.Time
+		if err := rows.Scan(&key.deviceID, &key.sensorType, &ts); err != nil {
+			return nil, err
+		}
+		key.ts = readingStamp(ts)
+		existing[key] = true
+	}
+	return existing, rows.Err()
+}
+
+// readingStamp keys a reading by its wall-clock time, which is what a TIMESTAMP column keeps.
+func readingStamp(t time.Time) int64 {
+	y, mo, d := t.Date()
+	h, mi, sec := t.Clock()
+	return time.Date(y, mo, d, h, mi, sec, t.Nanosecond(), time.UTC).UnixMicro()
+}
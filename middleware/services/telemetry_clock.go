@@ -0,0 +1,158 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"middleware/config"
+	"middleware/database"
+	"middleware/schemas"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrTelemetryTimestamp = errors.New("invalid_telemetry_timestamp")
+
+const alertGatewayClockSkew = "gateway_clock_skew"
+
+const (
+	// A stored skew older than this is not trusted to correct timestamps
+	clockSkewMaxAge = 24 * time.Hour
+	// Oldest reading accepted when raw readings are kept forever
+	telemetryMaxAgeUnbounded = 365 * 24 * time.Hour
+)
+
+// Timestamp outcomes of single ingest
+const (
+	timestampOK            = "ok"
+	timestampSkewCorrected = "skew_corrected"
+	timestampServerTime    = "server_time"
+)
+
+// Clock skew sources
+const (
+	clockSourceTelemetry   = "telemetry"
+	clockSourceBatch       = "telemetry_batch"
+	clockSourceDiagnostics = "diagnostics"
+)
+
+// telemetryClock decides which reading timestamps of one request are plausible. Readings may be
+// up to TELEMETRY_MAX_FUTURE_SECONDS ahead of server time and as old as raw retention.
+type telemetryClock struct {
+	now    time.Time
+	latest time.Time
+	oldest time.Time
+	// skew is the gateway clock minus server time; correct is set when it is large enough to
+	// shift timestamps by under the "correct" policy
+	skew    time.Duration
+	known   bool
+	correct bool
+}
+
+// gatewayClock measures the gateway's skew from the time it sent the request (sentAt), or falls
+// back to the last skew stored for it within clockSkewMaxAge. Every measurement is stored and
+// raises or resolves the gateway's clock skew alert.
+func gatewayClock(farmID uuid.UUID, hardwareID string, sentAt *time.Time, source string, now time.Time) telemetryClock {
+	c := telemetryClock{
+		now:    now,
+		latest: now.Add(time.Duration(config.AppConfig.TelemetryMaxFutureSeconds) * time.Second),
+		oldest: now.Add(-telemetryMaxAgeUnbounded),
+	}
+	if days := config.AppConfig.TelemetryRetentionDays; days > 0 {
+		c.oldest = now.AddDate(0, 0, -days)
+	}
+
+	if sentAt != nil {
+		c.skew, c.known = sentAt.Sub(now), true
+		if hardwareID != "" {
+			_ = recordClockSkew(farmID, hardwareID, c.skew, source, now)
+		}
+	} else if hardwareID != "" {
+		var skewMs int64
+		var measuredAt time.Time
+		if database.DB.QueryRow(`
+			SELECT skew_ms, measured_at FROM gateway_clock_skew WHERE hardware_id = $1 AND farm_id = $2
+		`, hardwareID, farmID).Scan(&skewMs, &measuredAt) == nil && now.Sub(measuredAt) <= clockSkewMaxAge {
+			c.skew, c.known = time.Duration(skewMs)*time.Millisecond, true
+		}
+	}
+
+	maxSkew := time.Duration(config.AppConfig.GatewayClockSkewMaxSeconds) * time.Second
+	c.correct = c.known && config.AppConfig.TelemetryTimestampPolicy != "reject" && absDuration(c.skew) >= maxSkew
+	return c
+}
+
+// skewMs returns the known skew in milliseconds, nil when unknown
+func (c telemetryClock) skewMs() *int64 {
+	if !c.known {
+		return nil
+	}
+	ms := c.skew.Milliseconds()
+	return &ms
+}
+
+// sanitize returns a reading timestamp in server time and whether it was shifted by the skew.
+// reason is future_timestamp or older_than_retention when it is out of window even then.
+func (c telemetryClock) sanitize(ts time.Time) (fixed time.Time, corrected bool, reason string) {
+	if c.correct {
+		ts, corrected = ts.Add(-c.skew), true
+	}
+	switch {
+	case ts.After(c.latest):
+		return ts, corrected, "future_timestamp"
+	case ts.Before(c.oldest):
+		return ts, corrected, "older_than_retention"
+	}
+	return ts, corrected, ""
+}
+
+// recordClockSkew stores a gateway's latest skew and syncs its clock skew alert
+func recordClockSkew(farmID uuid.UUID, hardwareID string, skew time.Duration, source string, now time.Time) error {
+	if _, err := database.DB.Exec(`
+		INSERT INTO gateway_clock_skew (hardware_id, farm_id, skew_ms, source, measured_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (hardware_id) DO UPDATE SET
+			farm_id = EXCLUDED.farm_id, skew_ms = EXCLUDED.skew_ms, source = EXCLUDED.source, measured_at = EXCLUDED.measured_at
+	`, hardwareID, farmID, skew.Milliseconds(), source, now); err != nil {
+		return err
+	}
+
+	var deviceID uuid.UUID
+	var coopID *uuid.UUID
+	err := database.DB.QueryRow(`
+		SELECT id, coop_id FROM devices
+		WHERE hardware_id = $1 AND farm_id = $2
+		ORDER BY is_main_controller DESC, created_at ASC
+		LIMIT 1
+	`, hardwareID, farmID).Scan(&deviceID, &coopID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	maxSeconds := float64(config.AppConfig.GatewayClockSkewMaxSeconds)
+	seconds := skew.Seconds()
+	msg := fmt.Sprintf("Gateway %s clock is off by %.0f s", hardwareID, seconds)
+	return syncGatewayAlert(farmID, coopID, deviceID, alertGatewayClockSkew, "warning", msg, maxSeconds, seconds, absDuration(skew).Seconds() >= maxSeconds, now)
+}
+
+// gatewayClockSkew returns a gateway's latest stored skew, nil when never measured
+func gatewayClockSkew(farmID uuid.UUID, hardwareID string) *schemas.GatewayClockSkew {
+	var skew schemas.GatewayClockSkew
+	if err := database.DB.QueryRow(`
+		SELECT skew_ms, source, measured_at FROM gateway_clock_skew WHERE hardware_id = $1 AND farm_id = $2
+	`, hardwareID, farmID).Scan(&skew.SkewMs, &skew.Source, &skew.MeasuredAt); err != nil {
+		return nil
+	}
+	return &skew
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
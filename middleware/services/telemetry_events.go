@@ -0,0 +1,81 @@
+package services
+
+import (
+	"middleware/config"
+	"middleware/schemas"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// coopTelemetryStream throttles the "telemetry" events of one coop. Readings arriving within
+// TELEMETRY_EVENT_INTERVAL_MS of the last event are merged into a pending event that is sent
+// when the interval is up, so clients always end up with the latest value of every metric.
+type coopTelemetryStream struct {
+	farmID    uuid.UUID
+	lastSent  time.Time
+	pending   *schemas.TelemetryEvent
+	scheduled bool
+}
+
+var (
+	telemetryStreamsMu sync.Mutex
+	telemetryStreams   = make(map[uuid.UUID]*coopTelemetryStream)
+)
+
+// publishTelemetry queues good readings of a coop for its next telemetry event
+func publishTelemetry(farmID, coopID uuid.UUID, values map[string]schemas.TelemetryEventValue, readings int) {
+	if len(values) == 0 {
+		return
+	}
+	interval := time.Duration(config.AppConfig.TelemetryEventIntervalMs) * time.Millisecond
+
+	telemetryStreamsMu.Lock()
+	stream, ok := telemetryStreams[coopID]
+	if !ok {
+		stream = &coopTelemetryStream{}
+		telemetryStreams[coopID] = stream
+	}
+	stream.farmID = farmID
+	if stream.pending == nil {
+		stream.pending = &schemas.TelemetryEvent{CoopID: coopID, Metrics: make(map[string]schemas.TelemetryEventValue, len(values))}
+	}
+	for name, v := range values {
+		// A backfilled value never replaces a newer one
+		if prev, ok := stream.pending.Metrics[name]; !ok || !v.Timestamp.Before(prev.Timestamp) {
+			stream.pending.Metrics[name] = v
+		}
+	}
+	stream.pending.Readings += readings
+
+	if stream.scheduled {
+		telemetryStreamsMu.Unlock()
+		return
+	}
+	wait := interval - time.Since(stream.lastSent)
+	if wait > 0 {
+		stream.scheduled = true
+		telemetryStreamsMu.Unlock()
+		time.AfterFunc(wait, func() { flushTelemetry(coopID) })
+		return
+	}
+	telemetryStreamsMu.Unlock()
+	flushTelemetry(coopID)
+}
+
+// flushTelemetry sends a coop's pending telemetry event
+func flushTelemetry(coopID uuid.UUID) {
+	telemetryStreamsMu.Lock()
+	stream := telemetryStreams[coopID]
+	event := stream.pending
+	stream.pending = nil
+	stream.scheduled = false
+	stream.lastSent = time.Now()
+	farmID := stream.farmID
+	telemetryStreamsMu.Unlock()
+
+	if event != nil {
+		events.PublishCoopEvent(farmID, coopID, "telemetry", event)
+	}
+}
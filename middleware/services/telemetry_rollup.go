@@ -0,0 +1,248 @@
+package services
+
+import (
+	"middleware/config"
+	"middleware/database"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reading tiers. Raw readings are kept TELEMETRY_RETENTION_DAYS, hourly rollups
+// TELEMETRY_HOURLY_RETENTION_DAYS and daily rollups forever.
+const (
+	readingTierRaw    = "raw"
+	readingTierHourly = "hourly"
+)
+
+// rollupWatermarkLag keeps the watermark behind the run start. created_at is the inserting
+// transaction's start time, so a batch that began before a run and committed after it is still
+// picked up by the next run.
+const rollupWatermarkLag = 10 * time.Minute
+
+var (
+	// rollupMu serializes rollup runs with each other and with raw pruning
+	rollupMu sync.Mutex
+	// rollupWatermark is the insert time from which raw readings are rolled up; zero after a
+	// restart, so the first run re-rolls everything still in the raw tier
+	rollupWatermark time.Time
+)
+
+// RollupReadings folds raw readings inserted since the last run (including backfilled ones) into
+// the hourly and daily rollups. Touched hours are recomputed from raw readings and touched days
+// from hourly rollups, so a run is idempotent. Days are the farm's local days.
+func (s *TelemetryService) RollupReadings() (int64, error) {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	return rollupReadingsLocked()
+}
+
+func rollupReadingsLocked() (int64, error) {
+	var runStart time.Time
+	if err := database.DB.QueryRow(`SELECT LOCALTIMESTAMP`).Scan(&runStart); err != nil {
+		return 0, err
+	}
+
+	// Hours partly pruned from the raw tier cannot be recomputed without losing samples
+	rawFrom, _ := tierBoundaries()
+
+	res, err := database.DB.Exec(`
+		WITH dirty AS (
+			SELECT DISTINCT device_id, sensor_type, date_trunc('hour', timestamp) AS bucket
+			FROM device_readings
+			WHERE created_at >= $1 AND created_at < $2 AND timestamp >= $3
+		)
+		INSERT INTO reading_rollups_hourly (device_id, sensor_type, bucket, min_value, max_value, avg_value, sample_count, last_value, last_at, rolled_at)
+		SELECT r.device_id, r.sensor_type, d.bucket, MIN(r.value), MAX(r.value), AVG(r.value), COUNT(*),
+			(ARRAY_AGG(r.value ORDER BY r.timestamp DESC))[1], MAX(r.timestamp), $2
+		FROM device_readings r
+		JOIN dirty d ON d.device_id = r.device_id AND d.sensor_type = r.sensor_type
+			AND r.timestamp >= d.bucket AND r.timestamp < d.bucket + INTERVAL '1 hour'
+		WHERE r.quality = 'good'
+		GROUP BY r.device_id, r.sensor_type, d.bucket
+		ON CONFLICT (device_id, sensor_type, bucket) DO UPDATE SET
+			min_value = EXCLUDED.min_value, max_value = EXCLUDED.max_value, avg_value = EXCLUDED.avg_value,
+			sample_count = EXCLUDED.sample_count, last_value = EXCLUDED.last_value, last_at = EXCLUDED.last_at,
+			rolled_at = EXCLUDED.rolled_at
+	`, rollupWatermark, runStart, rawFrom)
+	if err != nil {
+		return 0, err
+	}
+	hours, _ := res.RowsAffected()
+
+	if hours > 0 {
+		// Buckets are server-local timestamps; a day runs from the farm's local midnight to the
+		// next one, converted back to server-local time. Unknown time zones fall back to UTC.
+		// Daily rows inside a recomputed day that are not on its midnight (e.g. from before a
+		// time zone change) are replaced.
+		if _, err := database.DB.Exec(`
+			WITH zones AS (
+				SELECT f.id AS farm_id, COALESCE(tz.name, 'UTC') AS tz
+				FROM farms f LEFT JOIN pg_timezone_names tz ON tz.name = f.timezone
+			),
+			local_days AS (
+				SELECT DISTINCT h.device_id, h.sensor_type, COALESCE(z.tz, 'UTC') AS tz,
+					date_trunc('day', (h.bucket AT TIME ZONE current_setting('TimeZone')) AT TIME ZONE COALESCE(z.tz, 'UTC')) AS local_day
+				FROM reading_rollups_hourly h
+				JOIN devices dv ON dv.id = h.device_id
+				LEFT JOIN zones z ON z.farm_id = dv.farm_id
+				WHERE h.rolled_at = $1
+			),
+			dirty AS (
+				SELECT device_id, sensor_type,
+					(local_day AT TIME ZONE tz) AT TIME ZONE current_setting('TimeZone') AS day,
+					((local_day + INTERVAL '1 day') AT TIME ZONE tz) AT TIME ZONE current_setting('TimeZone') AS day_end
+				FROM local_days
+			),
+			replaced AS (
+				DELETE FROM reading_rollups_daily r USING dirty d
+				WHERE r.device_id = d.device_id AND r.sensor_type = d.sensor_type
+					AND r.bucket >= d.day AND r.bucket < d.day_end AND r.bucket <> d.day
+			)
+			INSERT INTO reading_rollups_daily (device_id, sensor_type, bucket, min_value, max_value, avg_value, sample_count, last_value, last_at, rolled_at)
+			SELECT h.device_id, h.sensor_type, d.day, MIN(h.min_value), MAX(h.max_value),
+				SUM(h.avg_value * h.sample_count) / SUM(h.sample_count), SUM(h.sample_count),
+				(ARRAY_AGG(h.last_value ORDER BY h.last_at DESC))[1], MAX(h.last_at), $1
+			FROM reading_rollups_hourly h
+			JOIN dirty d ON d.device_id = h.device_id AND d.sensor_type = h.sensor_type
+				AND h.bucket >= d.day AND h.bucket < d.day_end
+			GROUP BY h.device_id, h.sensor_type, d.day
+			ON CONFLICT (device_id, sensor_type, bucket) DO UPDATE SET
+				min_value = EXCLUDED.min_value, max_value = EXCLUDED.max_value, avg_value = EXCLUDED.avg_value,
+				sample_count = EXCLUDED.sample_count, last_value = EXCLUDED.last_value, last_at = EXCLUDED.last_at,
+				rolled_at = EXCLUDED.rolled_at
+		`, runStart); err != nil {
+			return hours, err
+		}
+	}
+
+	rollupWatermark = runStart.Add(-rollupWatermarkLag)
+	return hours, nil
+}
+
+// tierCutoff returns the oldest timestamp a tier still holds; false when the tier is kept forever
+func tierCutoff(tier string) (time.Time, bool) {
+	var days int
+	switch tier {
+	case readingTierRaw:
+		days = config.AppConfig.TelemetryRetentionDays
+	case readingTierHourly:
+		days = config.AppConfig.TelemetryHourlyRetentionDays
+	}
+	if days <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().AddDate(0, 0, -days), true
+}
+
+// tierBoundaries returns where the raw and hourly tiers start being complete: the first full
+// hour after the raw cutoff and the first full day after the hourly cutoff. Zero means the tier
+// reaches back indefinitely.
+func tierBoundaries() (rawFrom, hourlyFrom time.Time) {
+	if cutoff, ok := tierCutoff(readingTierRaw); ok {
+		rawFrom = cutoff.Truncate(time.Hour).Add(time.Hour)
+	}
+	if cutoff, ok := tierCutoff(readingTierHourly); ok {
+		y, m, d := cutoff.Date()
+		hourlyFrom = time.Date(y, m, d+1, 0, 0, 0, 0, cutoff.Location())
+	}
+	return rawFrom, hourlyFrom
+}
+
+// loadMetricPoints returns a coop's values of one metric since start. Each part of the range is
+// read from the finest tier that still covers it: daily rollups, then hourly rollups, then raw
+// readings. Rollup buckets contribute their min and max at the bucket start, which is enough for
+// high/low summaries; daily points carry no time of day.
+func loadMetricPoints(coopID uuid.UUID, metric string, start time.Time) ([]tempReading, error) {
+	rawFrom, hourlyFrom := tierBoundaries()
+	readings := make([]tempReading, 0)
+
+	if !rawFrom.IsZero() && start.Before(rawFrom) {
+		if !hourlyFrom.IsZero() && start.Before(hourlyFrom) {
+			points, err := loadRollupPoints("reading_rollups_daily", coopID, metric, start, hourlyFrom, true)
+			if err != nil {
+				return nil, err
+			}
+			readings = append(readings, points...)
+			start = hourlyFrom
+		}
+		if start.Before(rawFrom) {
+			points, err := loadRollupPoints("reading_rollups_hourly", coopID, metric, start, rawFrom, false)
+			if err != nil {
+				return nil, err
+			}
+			readings = append(readings, points...)
+			start = rawFrom
+		}
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT dr.value, dr.timestamp
+		FROM device_readings dr
+		JOIN devices d ON dr.device_id = d.id
+		WHERE d.coop_id = $1 AND dr.sensor_type = $2 AND dr.timestamp >= $3 AND dr.quality = 'good'
+		ORDER BY dr.timestamp ASC
+	`, coopID, metric, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r tempReading
+		if err := rows.Scan(&r.Temp, &r.Time); err == nil {
+			readings = append(readings, r)
+		}
+	}
+	return readings, rows.Err()
+}
+
+func loadRollupPoints(table string, coopID uuid.UUID, metric string, from, to time.Time, noTime bool) ([]tempReading, error) {
+	rows, err := database.DB.Query(`
+		SELECT r.min_value, r.max_value, r.bucket
+		FROM `+table+` r
+		JOIN devices d ON r.device_id = d.id
+		WHERE d.coop_id = $1 AND r.sensor_type = $2 AND r.bucket >= $3 AND r.bucket < $4
+		ORDER BY r.bucket ASC
+	`, coopID, metric, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]tempReading, 0)
+	for rows.Next() {
+		var min, max float64
+		var bucket time.Time
+		if err := rows.Scan(&min, &max, &bucket); err != nil {
+			continue
+		}
+		points = append(points,
+			tempReading{Temp: min, Time: bucket, NoTime: noTime},
+			tempReading{Temp: max, Time: bucket, NoTime: noTime})
+	}
+	return points, rows.Err()
+}
+
+// pruneReadingTiers rolls up outstanding raw readings, then drops raw readings older than
+// rawCutoff and hourly rollups past their retention. Daily rollups are never pruned.
+func pruneReadingTiers(rawCutoff time.Time) (int64, error) {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+
+	if _, err := rollupReadingsLocked(); err != nil {
+		return 0, err
+	}
+	res, err := database.DB.Exec(`DELETE FROM device_readings WHERE timestamp < $1`, rawCutoff)
+	if err != nil {
+		return 0, err
+	}
+	affected, _ := res.RowsAffected()
+	if cutoff, ok := tierCutoff(readingTierHourly); ok {
+		if _, err := database.DB.Exec(`DELETE FROM reading_rollups_hourly WHERE bucket < $1`, cutoff); err != nil {
+			return affected, err
+		}
+	}
+	return affected, nil
+}
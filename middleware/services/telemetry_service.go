@@ -3,6 +3,7 @@ package services
 import (
 	"database/sql"
 	"fmt"
+	"middleware/config"
 	"middleware/database"
 	"middleware/models"
 	"middleware/schemas"
@@ -28,6 +29,8 @@ func NewTelemetryService() *TelemetryService {
 type tempReading struct {
 	Temp float64
 	Time time.Time
+	// NoTime marks daily rollup points, whose time of day is unknown
+	NoTime bool
 }
 
 func (s *TelemetryService) CleanupOldReadings(retentionDays int) (int64, error) {
@@ -35,11 +38,17 @@ func (s *TelemetryService) CleanupOldReadings(retentionDays int) (int64, error)
 		return 0, nil
 	}
 	cutoff := time.Now().AddDate(0, 0, -retentionDays)
-	res, err := database.DB.Exec(`DELETE FROM device_readings WHERE timestamp < $1`, cutoff)
+	affected, err := pruneReadingTiers(cutoff)
 	if err != nil {
 		return 0, err
 	}
-	affected, _ := res.RowsAffected()
+	// Heartbeat hours only feed the health report, which never looks further back than raw readings
+	if _, err := database.DB.Exec(`DELETE FROM device_heartbeat_hours WHERE hour < $1`, cutoff); err != nil {
+		return affected, err
+	}
+	if _, err := database.DB.Exec(`DELETE FROM gateway_diagnostics WHERE recorded_at < $1`, cutoff); err != nil {
+		return affected, err
+	}
 	return affected, nil
 }
 
@@ -76,7 +85,7 @@ func (s *TelemetryService) ReportCoopDevices(userID, farmID, coopID uuid.UUID, r
 		}
 		deviceType := strings.ToLower(strings.TrimSpace(d.Type))
 		if deviceType == "" {
-			if model == "temp_humidity" || model == "water_level" {
+			if isSensorModel(model) {
 				deviceType = "sensor"
 			} else {
 				deviceType = "relay"
@@ -136,6 +145,11 @@ func (s *TelemetryService) ReportCoopDevices(userID, farmID, coopID uuid.UUID, r
 		if err != nil {
 			return nil, err
 		}
+		if d.Capabilities != nil {
+			if err := saveReportedCapabilities(dev.ID, d.Capabilities); err != nil {
+				return nil, err
+			}
+		}
 		devices = append(devices, dev)
 	}
 
@@ -158,91 +172,91 @@ func (s *TelemetryService) ReportCoopDevices(userID, farmID, coopID uuid.UUID, r
 	return devices, nil
 }
 
-func (s *TelemetryService) IngestTelemetry(userID, farmID, coopID uuid.UUID, req schemas.TelemetryRequest) error {
+// IngestTelemetry stores one snapshot of registered metrics. Each metric goes to the coop's
+// device of the owning model, created on first use. The snapshot's timestamp is shifted by the
+// gateway's clock skew when that is known to be large; a timestamp still out of window is
+// replaced by server time, or rejected under TELEMETRY_TIMESTAMP_POLICY=reject. Snapshots
+// older than telemetryAlertMaxAge are stored without alerting or publishing.
+func (s *TelemetryService) IngestTelemetry(userID, farmID, coopID uuid.UUID, req schemas.TelemetryRequest) (*schemas.TelemetryIngestResponse, error) {
 	if err := s.farmService.CheckAccess(userID, farmID, "worker"); err != nil {
-		return err
+		return nil, err
 	}
 	if _, err := s.coopService.GetCoop(userID, farmID, coopID); err != nil {
-		return err
+		return nil, err
 	}
-	ts := time.Now()
+	now := time.Now()
+	clock := gatewayClock(farmID, req.HardwareID, req.SentAt, clockSourceTelemetry, now)
+	ts := now
+	status := timestampOK
 	if req.Timestamp != nil {
-		ts = *req.Timestamp
-	}
-
-	if req.Sensors.TemperatureC == nil && req.Sensors.HumidityPct == nil && req.Sensors.WaterLevel == nil {
-		return nil
+		fixed, corrected, reason := clock.sanitize(*req.Timestamp)
+		switch {
+		case reason != "" && config.AppConfig.TelemetryTimestampPolicy == "reject":
+			return nil, fmt.Errorf("%w: %s", ErrTelemetryTimestamp, reason)
+		case reason != "":
+			status = timestampServerTime
+		case corrected:
+			ts, status = fixed, timestampSkewCorrected
+		default:
+			ts = fixed
+		}
 	}
+	resp := &schemas.TelemetryIngestResponse{Timestamp: ts, TimestampStatus: status, ClockSkewMs: clock.skewMs()}
 
-	tempDeviceID, _ := s.ensureSensorDevice(farmID, coopID, req.HardwareID, "temp_humidity", "Temp/Humidity")
-	waterDeviceID, _ := s.ensureSensorDevice(farmID, coopID, req.HardwareID, "water_level", "Water Level")
-
-	if req.Sensors.TemperatureC != nil && tempDeviceID != nil {
-		_ = insertReading(*tempDeviceID, "temperature", *req.Sensors.TemperatureC, "C", ts)
-	}
-	if req.Sensors.HumidityPct != nil && tempDeviceID != nil {
-		_ = insertReading(*tempDeviceID, "humidity", *req.Sensors.HumidityPct, "%", ts)
+	metrics, err := telemetryMetrics(req.Sensors, req.Metrics)
+	if err != nil {
+		return nil, err
 	}
-	if req.Sensors.WaterLevel != nil && waterDeviceID != nil {
-		_ = insertReading(*waterDeviceID, "water_level", *req.Sensors.WaterLevel, "raw", ts)
+	if len(metrics) == 0 {
+		return resp, nil
 	}
 
-	// Update heartbeats
-	if tempDeviceID != nil {
-		_, _ = database.DB.Exec("UPDATE devices SET is_online = true, last_heartbeat = $1, updated_at = $1 WHERE id = $2", ts, *tempDeviceID)
-	}
-	if waterDeviceID != nil {
-		_, _ = database.DB.Exec("UPDATE devices SET is_online = true, last_heartbeat = $1, updated_at = $1 WHERE id = $2", ts, *waterDeviceID)
+	devices := make(map[string]*uuid.UUID)
+	for _, d := range metricDefinitions {
+		value, ok := metrics[d.Name]
+		if !ok {
+			continue
+		}
+		deviceID, seen := devices[d.DeviceModel]
+		if !seen {
+			deviceID, _ = s.ensureSensorDevice(farmID, coopID, req.HardwareID, d.DeviceModel, d.DeviceName)
+			devices[d.DeviceModel] = deviceID
+		}
+		if deviceID == nil {
+			continue
+		}
+		stored, quality, err := insertReading(*deviceID, d.Name, value, d.Unit, ts)
+		if err != nil || quality != readingQualityGood {
+			// Suspect and bad readings never raise alerts
+			delete(metrics, d.Name)
+			continue
+		}
+		metrics[d.Name] = stored
 	}
 
-	if req.Sensors.WaterLevel != nil {
-		_ = s.checkWaterAlert(farmID, coopID, *req.Sensors.WaterLevel, ts)
+	// Update heartbeats
+	for _, deviceID := range devices {
+		if deviceID == nil {
+			continue
+		}
+		_, _ = database.DB.Exec("UPDATE devices SET is_online = true, last_heartbeat = $1, updated_at = $1 WHERE id = $2", ts, *deviceID)
+		recordHeartbeatHour(*deviceID, ts)
 	}
 
-	return nil
-}
-
-func (s *TelemetryService) checkWaterAlert(farmID, coopID uuid.UUID, latest float64, ts time.Time) error {
-	var threshold sql.NullFloat64
-	err := database.DB.QueryRow(`SELECT water_level_half_threshold FROM coops WHERE id = $1`, coopID).Scan(&threshold)
-	if err != nil || !threshold.Valid {
-		return nil
+	// Replayed (offline-queued) snapshots are stored but neither alert nor go out as live telemetry
+	if now.Sub(ts) > telemetryAlertMaxAge {
+		return resp, nil
 	}
-	if latest >= threshold.Float64 {
-		return nil
+	live := make(map[string]schemas.TelemetryEventValue, len(metrics))
+	for _, d := range metricDefinitions {
+		if value, ok := metrics[d.Name]; ok {
+			_ = s.checkMetricAlert(farmID, coopID, d, value, ts)
+			live[d.Name] = schemas.TelemetryEventValue{Value: value, Unit: d.Unit, Timestamp: ts}
+		}
 	}
+	publishTelemetry(farmID, coopID, live, len(live))
 
-	oneMinAgo := ts.Add(-1 * time.Minute)
-	var maxVal sql.NullFloat64
-	err = database.DB.QueryRow(`
-		SELECT MAX(dr.value) FROM device_readings dr
-		JOIN devices d ON dr.device_id = d.id
-		WHERE d.coop_id = $1 AND dr.sensor_type = 'water_level' AND dr.timestamp >= $2
-	`, coopID, oneMinAgo).Scan(&maxVal)
-	if err != nil || !maxVal.Valid {
-		return nil
-	}
-	if maxVal.Float64 >= threshold.Float64 {
-		return nil
-	}
-
-	var exists bool
-	_ = database.DB.QueryRow(`
-		SELECT EXISTS(
-			SELECT 1 FROM alerts 
-			WHERE coop_id = $1 AND alert_type = 'water_level_low' AND is_active = true
-		)
-	`, coopID).Scan(&exists)
-	if exists {
-		return nil
-	}
-
-	msg := "Water level below half for 1 minute"
-	_, err = database.DB.Exec(`
-		INSERT INTO alerts (id, farm_id, coop_id, alert_type, severity, message, threshold_value, actual_value, is_active, is_acknowledged, triggered_at, created_at)
-		VALUES ($1,$2,$3,'water_level_low','warning',$4,$5,$6,true,false,$7,$7)
-	`, uuid.New(), farmID, coopID, msg, threshold.Float64, latest, ts)
-	return err
+	return resp, nil
 }
 
 func (s *TelemetryService) ensureSensorDevice(farmID, coopID uuid.UUID, hardwareID, model, name string) (*uuid.UUID, error) {
@@ -281,12 +295,19 @@ func (s *TelemetryService) ensureSensorDevice(farmID, coopID uuid.UUID, hardware
 	return &id, nil
 }
 
-func insertReading(deviceID uuid.UUID, sensorType string, value float64, unit string, ts time.Time) error {
+// insertReading stores a reading with the device's calibration applied and its quality flag,
+// and returns the stored value and flag. The raw value is kept for audit.
+func insertReading(deviceID uuid.UUID, sensorType string, value float64, unit string, ts time.Time) (float64, string, error) {
+	value, raw := applyCalibration(deviceID, sensorType, value)
+	quality, reason := readingQualityGood, ""
+	if def, ok := LookupMetric(sensorType); ok {
+		quality, reason = assessReading(def, value, ts, recentQualityHistory(deviceID, sensorType, ts))
+	}
 	_, err := database.DB.Exec(`
-		INSERT INTO device_readings (id, device_id, sensor_type, value, unit, quality, timestamp)
-		VALUES ($1, $2, $3, $4, $5, 'good', $6)
-	`, uuid.New(), deviceID, sensorType, value, unit, ts)
-	return err
+		INSERT INTO device_readings (id, device_id, sensor_type, value, raw_value, unit, quality, quality_reason, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9)
+	`, uuid.New(), deviceID, sensorType, value, raw, unit, quality, reason, ts)
+	return value, quality, err
 }
 
 func (s *TelemetryService) GetTemperatureTimeline(userID, farmID, coopID uuid.UUID, days int) (schemas.TemperatureTimelineResponse, error) {
@@ -301,57 +322,11 @@ func (s *TelemetryService) GetTemperatureTimeline(userID, farmID, coopID uuid.UU
 		return schemas.TemperatureTimelineResponse{SensorFound: false}, err
 	}
 
-	loc, _ := time.LoadLocation("Asia/Phnom_Penh")
-	now := time.Now().In(loc)
-	todayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
-	start := todayStart.AddDate(0, 0, -(days-1))
-
-	// Latest readings
-	var currentTemp *float64
-	var currentHumidity *float64
-	var tempVal sql.NullFloat64
-	var humidVal sql.NullFloat64
-	_ = database.DB.QueryRow(`
-		SELECT dr.value FROM device_readings dr
-		JOIN devices d ON dr.device_id = d.id
-		WHERE d.coop_id = $1 AND dr.sensor_type = 'temperature'
-		ORDER BY dr.timestamp DESC LIMIT 1
-	`, coopID).Scan(&tempVal)
-	if tempVal.Valid {
-		v := tempVal.Float64
-		currentTemp = &v
-	}
-	_ = database.DB.QueryRow(`
-		SELECT dr.value FROM device_readings dr
-		JOIN devices d ON dr.device_id = d.id
-		WHERE d.coop_id = $1 AND dr.sensor_type = 'humidity'
-		ORDER BY dr.timestamp DESC LIMIT 1
-	`, coopID).Scan(&humidVal)
-	if humidVal.Valid {
-		v := humidVal.Float64
-		currentHumidity = &v
-	}
-
-	rows, err := database.DB.Query(`
-		SELECT dr.value, dr.timestamp
-		FROM device_readings dr
-		JOIN devices d ON dr.device_id = d.id
-		WHERE d.coop_id = $1 AND dr.sensor_type = 'temperature' AND dr.timestamp >= $2
-		ORDER BY dr.timestamp ASC
-	`, coopID, start)
+	today, history, found, err := metricTimeline(farmID, coopID, "temperature", days)
 	if err != nil {
 		return schemas.TemperatureTimelineResponse{SensorFound: false}, err
 	}
-	defer rows.Close()
-
-	readings := make([]tempReading, 0)
-	for rows.Next() {
-		var r tempReading
-		if err := rows.Scan(&r.Temp, &r.Time); err == nil {
-			readings = append(readings, r)
-		}
-	}
-	if len(readings) == 0 {
+	if !found {
 		return schemas.TemperatureTimelineResponse{
 			SensorFound: false,
 			CoopName:    coop.Name,
@@ -359,12 +334,83 @@ func (s *TelemetryService) GetTemperatureTimeline(userID, farmID, coopID uuid.UU
 		}, nil
 	}
 
+	// Latest readings
+	currentTemp := latestMetricValue(coopID, "temperature")
+	currentHumidity := latestMetricValue(coopID, "humidity")
+
+	todaySummary := toTempDay(today)
+	tempHistory := make([]schemas.DaySummary, 0, len(history))
+	for _, d := range history {
+		tempHistory = append(tempHistory, toTempDay(d))
+	}
+
+	bgHint := "neutral"
+	if currentTemp != nil {
+		bgHint = tempToBg(*currentTemp)
+	}
+
+	return schemas.TemperatureTimelineResponse{
+		SensorFound:     true,
+		CoopName:        coop.Name,
+		CurrentTemp:     currentTemp,
+		CurrentHumidity: currentHumidity,
+		BgHint:          bgHint,
+		Today:           &todaySummary,
+		History:         tempHistory,
+	}, nil
+}
+
+// GetMetricTimeline returns today's hourly averages and the daily high/low of any registered metric
+func (s *TelemetryService) GetMetricTimeline(userID, farmID, coopID uuid.UUID, metric string, days int) (schemas.MetricTimelineResponse, error) {
+	def, ok := LookupMetric(metric)
+	if !ok {
+		return schemas.MetricTimelineResponse{}, ErrUnknownMetric
+	}
+	if days < 1 {
+		days = 7
+	}
+	if err := s.farmService.CheckAccess(userID, farmID, "viewer"); err != nil {
+		return schemas.MetricTimelineResponse{}, err
+	}
+	coop, err := s.coopService.GetCoop(userID, farmID, coopID)
+	if err != nil {
+		return schemas.MetricTimelineResponse{}, err
+	}
+
+	resp := schemas.MetricTimelineResponse{Metric: def, CoopName: coop.Name, History: []schemas.MetricDaySummary{}}
+	today, history, found, err := metricTimeline(farmID, coopID, def.Name, days)
+	if err != nil || !found {
+		return resp, err
+	}
+	resp.SensorFound = true
+	resp.Current = latestMetricValue(coopID, def.Name)
+	resp.Today = &today
+	resp.History = history
+	return resp, nil
+}
+
+// metricTimeline buckets a coop's readings of one metric over the last days (days in the farm's
+// time zone): hourly averages for today and high/low for every day with readings.
+func metricTimeline(farmID, coopID uuid.UUID, metric string, days int) (schemas.MetricDaySummary, []schemas.MetricDaySummary, bool, error) {
+	loc := farmLocation(farmID)
+	now := time.Now().In(loc)
+	todayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	start := todayStart.AddDate(0, 0, -(days-1))
+
+	readings, err := loadMetricPoints(coopID, metric, start)
+	if err != nil {
+		return schemas.MetricDaySummary{}, nil, false, err
+	}
+	if len(readings) == 0 {
+		return schemas.MetricDaySummary{}, nil, false, nil
+	}
+
 	// Bucket by day
 	dayBuckets := map[string][]tempReading{}
 	for _, r := range readings {
 		t := r.Time.In(loc)
 		dayKey := t.Format("2006-01-02")
-		dayBuckets[dayKey] = append(dayBuckets[dayKey], tempReading{Temp: r.Temp, Time: t})
+		dayBuckets[dayKey] = append(dayBuckets[dayKey], tempReading{Temp: r.Temp, Time: t, NoTime: r.NoTime})
 	}
 
 	// Today hourly
@@ -382,22 +428,24 @@ func (s *TelemetryService) GetTemperatureTimeline(userID, farmID, coopID uuid.UU
 	}
 	sort.Ints(hours)
 
-	hourly := make([]schemas.HourlyPoint, 0, len(hours))
+	hourly := make([]schemas.MetricHourlyPoint, 0, len(hours))
 	for _, h := range hours {
 		vals := hourMap[h]
 		sum := 0.0
-		for _, v := range vals { sum += v }
+		for _, v := range vals {
+			sum += v
+		}
 		avg := sum / float64(len(vals))
-		hourly = append(hourly, schemas.HourlyPoint{
-			Hour: fmt.Sprintf("%02d:00", h),
-			Temp: round1(avg),
+		hourly = append(hourly, schemas.MetricHourlyPoint{
+			Hour:  fmt.Sprintf("%02d:00", h),
+			Value: round1(avg),
 		})
 	}
 
 	todaySummary := summarizeDay(dayBuckets[todayKey], hourly, "")
 
 	// History (previous days)
-	history := make([]schemas.DaySummary, 0)
+	history := make([]schemas.MetricDaySummary, 0)
 	for i := 1; i < days; i++ {
 		dt := todayStart.AddDate(0, 0, -i)
 		key := dt.Format("2006-01-02")
@@ -409,26 +457,12 @@ func (s *TelemetryService) GetTemperatureTimeline(userID, farmID, coopID uuid.UU
 			history = append(history, summarizeDay(items, nil, label))
 		}
 	}
-
-	bgHint := "neutral"
-	if currentTemp != nil {
-		bgHint = tempToBg(*currentTemp)
-	}
-
-	return schemas.TemperatureTimelineResponse{
-		SensorFound:     true,
-		CoopName:        coop.Name,
-		CurrentTemp:     currentTemp,
-		CurrentHumidity: currentHumidity,
-		BgHint:          bgHint,
-		Today:           &todaySummary,
-		History:         history,
-	}, nil
+	return todaySummary, history, true, nil
 }
 
-func summarizeDay(items []tempReading, hourly []schemas.HourlyPoint, label string) schemas.DaySummary {
+func summarizeDay(items []tempReading, hourly []schemas.MetricHourlyPoint, label string) schemas.MetricDaySummary {
 	if len(items) == 0 {
-		return schemas.DaySummary{Label: label, Hourly: hourly}
+		return schemas.MetricDaySummary{Label: label, Hourly: hourly}
 	}
 	min := items[0]
 	max := items[0]
@@ -436,9 +470,9 @@ func summarizeDay(items []tempReading, hourly []schemas.HourlyPoint, label strin
 		if r.Temp < min.Temp { min = r }
 		if r.Temp > max.Temp { max = r }
 	}
-	high := &schemas.TempPoint{Temp: round1(max.Temp), Time: max.Time.Format("15:04")}
-	low := &schemas.TempPoint{Temp: round1(min.Temp), Time: min.Time.Format("15:04")}
-	return schemas.DaySummary{
+	high := &schemas.MetricPoint{Value: round1(max.Temp), Time: pointTime(max)}
+	low := &schemas.MetricPoint{Value: round1(min.Temp), Time: pointTime(min)}
+	return schemas.MetricDaySummary{
 		Label:  label,
 		High:   high,
 		Low:    low,
@@ -446,6 +480,28 @@ func summarizeDay(items []tempReading, hourly []schemas.HourlyPoint, label strin
 	}
 }
 
+func pointTime(r tempReading) string {
+	if r.NoTime {
+		return ""
+	}
+	return r.Time.Format("15:04")
+}
+
+// toTempDay keeps the temperature timeline's original response shape
+func toTempDay(d schemas.MetricDaySummary) schemas.DaySummary {
+	out := schemas.DaySummary{Label: d.Label}
+	if d.High != nil {
+		out.High = &schemas.TempPoint{Temp: d.High.Value, Time: d.High.Time}
+	}
+	if d.Low != nil {
+		out.Low = &schemas.TempPoint{Temp: d.Low.Value, Time: d.Low.Time}
+	}
+	for _, h := range d.Hourly {
+		out.Hourly = append(out.Hourly, schemas.HourlyPoint{Hour: h.Hour, Temp: h.Value})
+	}
+	return out
+}
+
 func round1(v float64) float64 {
 	return float64(int(v*10+0.5)) / 10
 }
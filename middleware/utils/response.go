@@ -47,6 +47,18 @@ func ErrorResponse(c *fiber.Ctx, statusCode int, code string, message string) er
 	})
 }
 
+// ErrorResponseWithDetails sends a standard error response carrying structured details
+func ErrorResponseWithDetails(c *fiber.Ctx, statusCode int, code string, message string, details interface{}) error {
+	return c.Status(statusCode).JSON(fiber.Map{
+		"success": false,
+		"error": schemas.ErrorResponse{
+			Code:    code,
+			Message: message,
+			Details: details,
+		},
+	})
+}
+
 // BadRequest sends a 400 error
 func BadRequest(c *fiber.Ctx, code string, message string) error {
 	return ErrorResponse(c, fiber.StatusBadRequest, code, message)